@@ -3,116 +3,158 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
-	"github.com/jamiealquiza/ascender/outputs/console"
-	"github.com/jamiealquiza/ascender/outputs/sqs"
+	"github.com/jamiealquiza/ascender/outputs"
 	"github.com/jamiealquiza/ghostats"
 )
 
+// Message is a received message and its connection metadata.
+type Message struct {
+	Body string
+	// Name of the listener the message arrived on.
+	Listener string
+	// Remote IP of the client.
+	Source string
+	// Remote address (IP and port) of the client.
+	RemoteAddr string
+	// Authenticated client, nil if the listener has no token file.
+	Client *ClientToken
+	// When the message was read.
+	Received time.Time
+	// Route picked by the pipeline, if any.
+	Route string
+	// Output a replayed dead letter goes to, instead of
+	// its route's outputs.
+	Output string
+}
+
+// output returns m as handed to outputs.
+func (m *Message) output(route string) *outputs.Message {
+	o := &outputs.Message{Body: m.Body, Listener: m.Listener, Source: m.Source, Route: route, Received: m.Received}
+	if m.Client != nil {
+		o.Client = m.Client.Name
+	}
+	return o
+}
+
 var (
 	// Channel that listeners pass received messages to
 	// for consumption by messageHandler.
 	// Limits number of in-flight message and subsequently is
 	// a large dictator of Ascender memory usage.
-	messageIncomingQueue = make(chan string, options.queuecap)
-	// Queue that messageHandler loads message batches into.
-	// Output handlers read batches and send to destinations.
-	messageOutgoingQueue = make(chan []string, options.queuecap)
-	// Timeout to force the current messageHandler batch to the messageOutgoingQueue.
-	flushTimeout = time.Tick(5 * time.Second)
+	messageIncomingQueue chan *Message
+	// Passes reloaded routes to messageHandler.
+	routerUpdates = make(chan *router)
 
 	options struct {
-		addr     string
-		port     string
-		handlers int
-		queuecap int
-		console  bool
-	}
-
-	config struct {
-		batchSize    int
-		flushTimeout int
+		configFile    string
+		checkConfig   bool
+		addr          string
+		port          string
+		handlers      int
+		queuecap      int
+		flushInterval time.Duration
+		console       bool
+		awsAccessKey  string
+		awsSecretKey  string
+		awsQueue      string
+		awsRegion     string
+		replay        string
+		replayTo      string
+		replayToken   string
+		replayOutput  string
+		replayTLS     bool
+		reassemble    string
 	}
 
-	sig_chan = make(chan os.Signal)
+	sig_chan = make(chan os.Signal, 1)
 )
 
 func init() {
+	flag.StringVar(&options.configFile, "config", "", "Path to JSON config file")
+	flag.BoolVar(&options.checkConfig, "check-config", false, "Validate config and exit")
 	flag.StringVar(&options.addr, "listen-addr", "localhost", "bind address")
 	flag.StringVar(&options.port, "listen-port", "6030", "bind port")
 	flag.IntVar(&options.handlers, "handlers", 3, "Queue handlers")
 	flag.IntVar(&options.queuecap, "queue-cap", 1000, "In-flight message queue capacity")
+	flag.DurationVar(&options.flushInterval, "flush-interval", 5*time.Second, "Max time a partial batch waits before sending")
 	flag.BoolVar(&options.console, "console-out", false, "Dump output to console")
-	flag.Parse()
-	// Update vars that depend on flag inputs.
-	messageIncomingQueue = make(chan string, options.queuecap)
-	messageOutgoingQueue = make(chan []string, options.queuecap)
+	flag.StringVar(&options.awsAccessKey, "aws-access-key", os.Getenv("ASCENDER_ACCESS_KEY"), "AWS access key")
+	flag.StringVar(&options.awsSecretKey, "aws-secret-key", os.Getenv("ASCENDER_SECRET_KEY"), "AWS secret key")
+	flag.StringVar(&options.awsQueue, "aws-sqs-queue", os.Getenv("ASCENDER_SQS_QUEUE"), "SQS queue name")
+	flag.StringVar(&options.awsRegion, "aws-sqs-region", os.Getenv("ASCENDER_SQS_REGION"), "SQS queue region")
+	flag.StringVar(&options.replay, "replay", "", "Replay dead letters from this file (- for stdin) and exit")
+	flag.StringVar(&options.replayTo, "replay-to", "localhost:6030", "Listener address to replay dead letters to")
+	flag.StringVar(&options.replayToken, "replay-token", os.Getenv("ASCENDER_REPLAY_TOKEN"), "Token to authenticate replays with")
+	flag.StringVar(&options.replayOutput, "replay-output", "", "Only replay dead letters from this output")
+	flag.BoolVar(&options.replayTLS, "replay-tls", false, "Replay over TLS")
+	flag.StringVar(&options.reassemble, "reassemble", "", "Reassemble chunked messages from this file (- for stdin) to stdout and exit")
 }
 
-// Receives messages on messageIncomingQueue, batches into message groups
-// and flushes into the 'messageOutgoingQueue' channel when the batch
-// hits either the configured config.batchSize or flushTimeout treshold.
-func messageHandler() {
-	messages := []string{}
-	for {
-		select {
-		case <-flushTimeout:
-			// We hit the flush timeout, load the current batch if present.
-			if len(messages) > 0 {
-				messageOutgoingQueue <- messages
-				messages = []string{}
-			}
-			messages = []string{}
-		case msg := <-messageIncomingQueue:
-			// If this puts us at the batchSize threshold, enqueue
-			// into the messageOutgoingQueue.
-			if len(messages)+1 >= config.batchSize {
-				messages = append(messages, msg)
-				messageOutgoingQueue <- messages
-				messages = []string{}
-			} else {
-				// Otherwise, just append message to current batch.
-				messages = append(messages, msg)
-			}
+// Handles signal events.
+// SIGHUP reloads the config file, SIGINT kills service
+// (will eventually perform graceful shutdown). Reloads
+// run in the background so SIGINT is always handled.
+func runControl(s *service) {
+	signal.Notify(sig_chan, syscall.SIGINT, syscall.SIGHUP)
+	for sig := range sig_chan {
+		switch sig {
+		case syscall.SIGHUP:
+			go s.reload()
+		case syscall.SIGINT:
+			log.Printf("Ascender shutting down")
+			os.Exit(0)
 		}
 	}
 }
 
-// Handles signal events.
-// Currently just kills service, will eventually perform graceful shutdown.
-func runControl() {
-	signal.Notify(sig_chan, syscall.SIGINT)
-	<-sig_chan
-	log.Printf("Ascender shutting down")
-	os.Exit(0)
-}
-
 func main() {
-	// Start internals.
-	go listenTcp()
-	go messageHandler()
+	flag.Parse()
+	if options.replay != "" {
+		err := replayDeadLetters(options.replay, options.replayTo, options.replayToken, options.replayOutput, options.replayTLS)
+		if err != nil {
+			log.Fatalf("Replay error: %s\n", err)
+		}
+		os.Exit(0)
+	}
+	if options.reassemble != "" {
+		if err := reassemble(options.reassemble, os.Stdout); err != nil {
+			log.Fatalf("Reassemble error: %s\n", err)
+		}
+		os.Exit(0)
+	}
+
+	cfg, errs := loadConfig()
+	if errs != nil {
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "Config error: %s\n", err)
+		}
+		os.Exit(1)
+	}
+	if options.checkConfig {
+		fmt.Println("Config OK")
+		os.Exit(0)
+	}
+
+	messageIncomingQueue = make(chan *Message, cfg.QueueCap)
+	deadLetterQueue = make(chan *deadLetter, cfg.QueueCap)
 
 	// Start stat services.
 	sentCnt := NewStatser()
 	go statsTracker(sentCnt)
 	go ghostats.Start("localhost", "6040", nil)
 
-	// Start outputs
-	for i := 0; i < options.handlers; i++ {
-		if options.console {
-			config.batchSize = 1
-			go console.Handler(messageOutgoingQueue)
-		} else {
-			// AWS SQS max batch size is currently 10.
-			config.batchSize = 10
-			go sqs.Handler(messageOutgoingQueue, sentCnt)
-		}
+	// Start outputs, internals and listeners.
+	s := &service{stats: sentCnt}
+	if err := s.apply(cfg); err != nil {
+		log.Fatalf("Listener error: %s\n", err)
 	}
 
-	runControl()
+	runControl(s)
 }
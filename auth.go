@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// ClientToken is a shared token from a listener token file.
+// Clients presenting it are identified by Name and may only
+// use the listed Routes and Outputs (all if empty).
+// RateLimit, if set, replaces the listener's per-client limit.
+type ClientToken struct {
+	Name      string     `json:"name"`
+	Token     string     `json:"token"`
+	Routes    []string   `json:"routes"`
+	Outputs   []string   `json:"outputs"`
+	RateLimit *RateLimit `json:"rate-limit"`
+}
+
+type tokenFile struct {
+	Tokens []*ClientToken `json:"tokens"`
+}
+
+// loadTokens reads and checks a token file, interpolating
+// environment variables as in the config file.
+func loadTokens(path string) ([]*ClientToken, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	b, errs := interpolateEnv(b)
+	if errs != nil {
+		return nil, fmt.Errorf("token file %s: %s", path, errs[0])
+	}
+
+	f := &tokenFile{}
+	if err := decodeStrict(b, f); err != nil {
+		return nil, fmt.Errorf("token file %s: %s", path, err)
+	}
+	if len(f.Tokens) == 0 {
+		return nil, fmt.Errorf("token file %s: no tokens", path)
+	}
+
+	names, tokens := map[string]bool{}, map[string]bool{}
+	for i, t := range f.Tokens {
+		switch {
+		case t.Name == "":
+			return nil, fmt.Errorf("token file %s: token %d: name is required", path, i)
+		case names[t.Name]:
+			return nil, fmt.Errorf("token file %s: duplicate name %q", path, t.Name)
+		case t.Token == "":
+			return nil, fmt.Errorf("token file %s: %q: token is required", path, t.Name)
+		case tokens[t.Token]:
+			return nil, fmt.Errorf("token file %s: %q: duplicate token", path, t.Name)
+		case t.RateLimit != nil && (t.RateLimit.Messages < 0 || t.RateLimit.Bytes < 0):
+			return nil, fmt.Errorf("token file %s: %q: rate limits can't be negative", path, t.Name)
+		}
+		names[t.Name], tokens[t.Token] = true, true
+	}
+
+	return f.Tokens, nil
+}
+
+// authenticate returns the client for an "AUTH <token>" line.
+func authenticate(tokens []*ClientToken, line string) (*ClientToken, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 || fields[0] != "AUTH" {
+		return nil, errors.New("missing AUTH")
+	}
+
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(fields[1]), []byte(t.Token)) == 1 {
+			return t, nil
+		}
+	}
+
+	return nil, errors.New("invalid token")
+}
+
+// allowsRoute reports whether the client may use route name.
+func (t *ClientToken) allowsRoute(name string) bool {
+	return t == nil || allowed(t.Routes, name)
+}
+
+// allowsOutput reports whether the client may use output name.
+func (t *ClientToken) allowsOutput(name string) bool {
+	return t == nil || allowed(t.Outputs, name)
+}
+
+// allowed reports whether name is in list, or list is empty.
+func allowed(list []string, name string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, n := range list {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// authConn connects to a listener requiring tokens.
+func authConn(t *testing.T, tokens []*ClientToken) (net.Conn, *bufio.Scanner) {
+	return authConnTimeout(t, tokens, time.Second)
+}
+
+// authConnTimeout connects to a listener requiring tokens
+// within timeout.
+func authConnTimeout(t *testing.T, tokens []*ClientToken, timeout time.Duration) (net.Conn, *bufio.Scanner) {
+	withQueues(t, &Config{})
+	conn, err := net.Dial("tcp", listenTest(t, &ListenerConfig{Name: "auth", MaxMessageSize: 1024, tokens: tokens, authTimeout: timeout}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	return conn, bufio.NewScanner(conn)
+}
+
+func TestAuthHandshake(t *testing.T) {
+	conn, responses := authConn(t, []*ClientToken{{Name: "web", Token: "s3cret"}})
+	conn.Write([]byte("AUTH s3cret\n{\"a\":1}\n"))
+	expectResponses(t, responses, "200|0|authenticated", "200|7|received")
+
+	select {
+	case m := <-messageIncomingQueue:
+		if m.Client == nil || m.Client.Name != "web" {
+			t.Errorf("message from client %+v, want web", m.Client)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not queued")
+	}
+}
+
+func TestAuthRejected(t *testing.T) {
+	for _, first := range []string{"AUTH wrong", "AUTH", `{"a":1}`, "AUTH s3cret extra"} {
+		conn, responses := authConn(t, []*ClientToken{{Name: "web", Token: "s3cret"}})
+		conn.Write([]byte(first + "\n{\"a\":1}\n"))
+		expectResponses(t, responses, "401|0|unauthorized")
+		if responses.Scan() {
+			t.Errorf("%q: connection open after 401, read %q", first, responses.Text())
+		}
+		if n := len(messageIncomingQueue); n != 0 {
+			t.Errorf("%q: %d messages queued", first, n)
+		}
+	}
+}
+
+func TestAuthTimeout(t *testing.T) {
+	_, responses := authConnTimeout(t, []*ClientToken{{Name: "web", Token: "s3cret"}}, 50*time.Millisecond)
+	start := time.Now()
+	if responses.Scan() {
+		t.Fatalf("response %q without AUTH", responses.Text())
+	}
+	if err := responses.Err(); err != nil {
+		t.Fatalf("connection not closed: %s", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("closed after %s, want 50ms", d)
+	}
+}
+
+func TestAuthTimeoutConfig(t *testing.T) {
+	for _, timeout := range []string{"0s", "-1s", "soon"} {
+		c := &Config{Listeners: []*ListenerConfig{{Name: "main", Port: "6030", AuthTimeout: timeout}}}
+		c.setDefaults()
+		if errs := c.validate(); len(errs) == 0 || !strings.Contains(errs[0].Error(), "auth-timeout") {
+			t.Errorf("auth-timeout %q: %v", timeout, errs)
+		}
+	}
+	c := &Config{Listeners: []*ListenerConfig{{Name: "main", Port: "6030"}}}
+	c.setDefaults()
+	c.validate()
+	if c.Listeners[0].authTimeout != 10*time.Second {
+		t.Errorf("default auth-timeout %s, want 10s", c.Listeners[0].authTimeout)
+	}
+}
+
+func TestLoadTokens(t *testing.T) {
+	dir := t.TempDir()
+	os.Setenv("ASCENDER_TEST_TOKEN", "s3cret")
+	defer os.Unsetenv("ASCENDER_TEST_TOKEN")
+
+	tests := []struct {
+		file, err string
+	}{
+		{`{"tokens": [{"name": "web", "token": "${ASCENDER_TEST_TOKEN}", "routes": ["a"]}]}`, ""},
+		{`{"tokens": []}`, "no tokens"},
+		{`{"tokens": [{"token": "x"}]}`, "name is required"},
+		{`{"tokens": [{"name": "web"}]}`, "token is required"},
+		{`{"tokens": [{"name": "a", "token": "x"}, {"name": "a", "token": "y"}]}`, "duplicate name"},
+		{`{"tokens": [{"name": "a", "token": "x"}, {"name": "b", "token": "x"}]}`, "duplicate token"},
+		{`{"tokens": [{"name": "a", "token": "x", "rate-limit": {"messages-per-sec": -1}}]}`, "can't be negative"},
+		{`{"tokens": [{"name": "a", "token": "x", "unknown": 1}]}`, "unknown"},
+	}
+	for i, tt := range tests {
+		path := filepath.Join(dir, "tokens.json")
+		os.WriteFile(path, []byte(tt.file), 0644)
+		tokens, err := loadTokens(path)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%d: %s", i, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%d: error %v, want %q", i, err, tt.err)
+		}
+		if tt.err == "" && (len(tokens) != 1 || tokens[0].Token != "s3cret") {
+			t.Errorf("%d: tokens %+v", i, tokens)
+		}
+	}
+}
+
+func TestClientTokenAllows(t *testing.T) {
+	var anyone *ClientToken
+	c := &ClientToken{Routes: []string{"a"}}
+	switch {
+	case !anyone.allowsRoute("a") || !anyone.allowsOutput("x"):
+		t.Error("listener without tokens restricted")
+	case !c.allowsRoute("a") || c.allowsRoute("b"):
+		t.Error("routes not restricted")
+	case !c.allowsOutput("x"):
+		t.Error("outputs restricted without a list")
+	}
+}
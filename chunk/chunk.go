@@ -0,0 +1,258 @@
+// Package chunk splits messages too large for an output into
+// ordered chunks, and reassembles them for consumers.
+//
+// Chunks of a message share an ID and carry their index and
+// the total, either in an envelope:
+//
+//	{"chunk":{"id":"...","index":0,"total":3},"data":"..."}
+//
+// or as message attributes (see IDAttribute). Envelope data
+// is base64 encoded, flagged by "base64":true, if the message
+// isn't valid UTF-8.
+package chunk
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Attributes carrying a chunk's Header.
+const (
+	IDAttribute    = "Chunk-Id"
+	IndexAttribute = "Chunk-Index"
+	TotalAttribute = "Chunk-Total"
+)
+
+// Header identifies a chunk.
+type Header struct {
+	ID     string `json:"id"`
+	Index  int    `json:"index"`
+	Total  int    `json:"total"`
+	Base64 bool   `json:"base64,omitempty"`
+}
+
+type envelope struct {
+	Chunk *Header `json:"chunk"`
+	Data  string  `json:"data"`
+}
+
+// Split splits body into parts of at most max bytes,
+// never splitting a UTF-8 character.
+func Split(body string, max int) ([]string, error) {
+	if max < utf8.UTFMax {
+		return nil, fmt.Errorf("chunks of %d bytes are too small", max)
+	}
+	return split(body, max, func(r rune, size int) int { return size }), nil
+}
+
+// Envelopes splits body into chunk envelopes of at most
+// max bytes each.
+func Envelopes(body, id string, max int) ([]string, error) {
+	h := Header{ID: id, Base64: !utf8.ValidString(body)}
+	// The total (and so any index) has no more digits
+	// than the body's length.
+	h.Index, h.Total = len(body), len(body)
+	e, err := marshal(&envelope{Chunk: &h})
+	if err != nil {
+		return nil, err
+	}
+	budget := max - len(e)
+	if budget < 6 {
+		return nil, fmt.Errorf("chunks of %d bytes are too small", max)
+	}
+
+	var parts []string
+	if h.Base64 {
+		b := []byte(body)
+		n := budget / 4 * 3
+		for len(b) > 0 {
+			if n > len(b) {
+				n = len(b)
+			}
+			parts = append(parts, base64.StdEncoding.EncodeToString(b[:n]))
+			b = b[n:]
+		}
+	} else {
+		parts = split(body, budget, escapedLen)
+	}
+
+	h.Total = len(parts)
+	envelopes := make([]string, len(parts))
+	for i, p := range parts {
+		h.Index = i
+		e, err := marshal(&envelope{Chunk: &h, Data: p})
+		if err != nil {
+			return nil, err
+		}
+		if len(e) > max {
+			return nil, fmt.Errorf("chunk of %d bytes exceeds %d", len(e), max)
+		}
+		envelopes[i] = string(e)
+	}
+
+	return envelopes, nil
+}
+
+// split splits s into parts costing at most max, where
+// cost gives the cost of each rune.
+func split(s string, max int, cost func(r rune, size int) int) []string {
+	var parts []string
+	start, n := 0, 0
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		c := cost(r, size)
+		if n+c > max {
+			parts = append(parts, s[start:i])
+			start, n = i, 0
+		}
+		n += c
+		i += size
+	}
+	if start < len(s) || len(parts) == 0 {
+		parts = append(parts, s[start:])
+	}
+	return parts
+}
+
+// escapedLen is the most bytes a rune takes in a JSON string.
+func escapedLen(r rune, size int) int {
+	switch {
+	case r == '"' || r == '\\' || r == '\n' || r == '\r' || r == '\t':
+		return 2
+	case r < 0x20 || r == '\u2028' || r == '\u2029':
+		return 6
+	}
+	return size
+}
+
+func marshal(e *envelope) ([]byte, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(e); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n")), nil
+}
+
+// ParseAttributes returns the chunk header held by message
+// attributes, or false if the message isn't a chunk.
+func ParseAttributes(attrs map[string]string) (Header, bool, error) {
+	var h Header
+	var ok bool
+	if h.ID, ok = attrs[IDAttribute]; !ok {
+		return h, false, nil
+	}
+	var err error
+	if h.Index, err = strconv.Atoi(attrs[IndexAttribute]); err != nil {
+		return h, true, fmt.Errorf("invalid %s: %s", IndexAttribute, err)
+	}
+	if h.Total, err = strconv.Atoi(attrs[TotalAttribute]); err != nil {
+		return h, true, fmt.Errorf("invalid %s: %s", TotalAttribute, err)
+	}
+	return h, true, nil
+}
+
+// Assembler reassembles messages from their chunks, which
+// may arrive in any order. It isn't safe for concurrent use.
+type Assembler struct {
+	timeout time.Duration
+	pending map[string]*message
+}
+
+type message struct {
+	parts  []string
+	base64 []bool
+	got    []bool
+	have   int
+	first  time.Time
+}
+
+// NewAssembler returns an Assembler. Messages incomplete
+// after timeout are dropped by Expire; 0 keeps them.
+func NewAssembler(timeout time.Duration) *Assembler {
+	return &Assembler{timeout: timeout, pending: map[string]*message{}}
+}
+
+// Add adds a chunk, returning the message once all of its
+// chunks have been added. Repeated chunks are ignored.
+func (a *Assembler) Add(h Header, data string) (string, bool, error) {
+	switch {
+	case h.ID == "":
+		return "", false, errors.New("chunk has no id")
+	case h.Total < 1:
+		return "", false, fmt.Errorf("chunk %s: invalid total %d", h.ID, h.Total)
+	case h.Index < 0 || h.Index >= h.Total:
+		return "", false, fmt.Errorf("chunk %s: index %d out of range", h.ID, h.Index)
+	}
+
+	m, ok := a.pending[h.ID]
+	if !ok {
+		m = &message{parts: make([]string, h.Total), base64: make([]bool, h.Total), got: make([]bool, h.Total), first: time.Now()}
+		a.pending[h.ID] = m
+	}
+	if len(m.parts) != h.Total {
+		return "", false, fmt.Errorf("chunk %s: total %d, was %d", h.ID, h.Total, len(m.parts))
+	}
+	if !m.got[h.Index] {
+		m.parts[h.Index], m.base64[h.Index], m.got[h.Index] = data, h.Base64, true
+		m.have++
+	}
+	if m.have < h.Total {
+		return "", false, nil
+	}
+
+	delete(a.pending, h.ID)
+	var b strings.Builder
+	for i, p := range m.parts {
+		if !m.base64[i] {
+			b.WriteString(p)
+			continue
+		}
+		d, err := base64.StdEncoding.DecodeString(p)
+		if err != nil {
+			return "", false, fmt.Errorf("chunk %s: index %d: %s", h.ID, i, err)
+		}
+		b.Write(d)
+	}
+
+	return b.String(), true, nil
+}
+
+// AddEnvelope adds a chunk envelope as Add does. Bodies that
+// aren't chunk envelopes are returned, complete, as they are.
+func (a *Assembler) AddEnvelope(body string) (string, bool, error) {
+	var e envelope
+	if json.Unmarshal([]byte(body), &e) != nil || e.Chunk == nil {
+		return body, true, nil
+	}
+	return a.Add(*e.Chunk, e.Data)
+}
+
+// Expire drops messages incomplete after the timeout,
+// returning their IDs.
+func (a *Assembler) Expire(now time.Time) []string {
+	if a.timeout <= 0 {
+		return nil
+	}
+	var ids []string
+	for id, m := range a.pending {
+		if now.Sub(m.first) > a.timeout {
+			delete(a.pending, id)
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Pending returns the number of incomplete messages.
+func (a *Assembler) Pending() int {
+	return len(a.pending)
+}
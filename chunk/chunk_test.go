@@ -0,0 +1,154 @@
+package chunk
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplit(t *testing.T) {
+	body := strings.Repeat("héllo wörld ", 100)
+	parts, err := Split(body, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(parts, "") != body {
+		t.Fatal("parts don't join to the body")
+	}
+	for i, p := range parts {
+		if len(p) > 50 {
+			t.Errorf("part %d is %d bytes", i, len(p))
+		}
+		if !utf8.ValidString(p) {
+			t.Errorf("part %d splits a character", i)
+		}
+	}
+
+	if _, err := Split(body, 3); err == nil {
+		t.Error("parts smaller than a character accepted")
+	}
+	if parts, _ := Split("", 10); len(parts) != 1 || parts[0] != "" {
+		t.Errorf("empty body split into %q", parts)
+	}
+}
+
+// assemble adds envelopes to a new Assembler in a random
+// order, returning the message once complete.
+func assemble(t *testing.T, envelopes []string) string {
+	a := NewAssembler(0)
+	var got string
+	complete := 0
+	for _, i := range rand.Perm(len(envelopes)) {
+		m, ok, err := a.AddEnvelope(envelopes[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			got = m
+			complete++
+		}
+	}
+	if complete != 1 || a.Pending() != 0 {
+		t.Fatalf("%d messages completed, %d pending", complete, a.Pending())
+	}
+	return got
+}
+
+func TestEnvelopesRoundTrip(t *testing.T) {
+	for name, body := range map[string]string{
+		"text":    strings.Repeat(`{"msg": "line\n\t\"quoted\" <tag> & é 世界"} `, 200),
+		"control": strings.Repeat("\x01\x02  ", 300),
+		"binary":  string([]byte{0xff, 0xfe, 0, 1}) + strings.Repeat("x", 3000),
+	} {
+		envelopes, err := Envelopes(body, "id1", 200)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if len(envelopes) < 2 {
+			t.Fatalf("%s: %d envelopes", name, len(envelopes))
+		}
+		for i, e := range envelopes {
+			if len(e) > 200 {
+				t.Errorf("%s: envelope %d is %d bytes", name, i, len(e))
+			}
+		}
+		if got := assemble(t, envelopes); got != body {
+			t.Errorf("%s: reassembled message differs", name)
+		}
+	}
+}
+
+func TestAttributesRoundTrip(t *testing.T) {
+	body := strings.Repeat("abcdefghij", 50)
+	parts, _ := Split(body, 64)
+	a := NewAssembler(0)
+	var got string
+	for i := len(parts) - 1; i >= 0; i-- {
+		h, ok, err := ParseAttributes(map[string]string{
+			IDAttribute:    "id",
+			IndexAttribute: string(rune('0'+i/10)) + string(rune('0'+i%10)),
+			TotalAttribute: "08",
+		})
+		if !ok || err != nil {
+			t.Fatalf("attributes: %v %v", ok, err)
+		}
+		if m, ok, err := a.Add(h, parts[i]); err != nil {
+			t.Fatal(err)
+		} else if ok {
+			got = m
+		}
+	}
+	if len(parts) != 8 || got != body {
+		t.Fatalf("%d parts, reassembled %q", len(parts), got)
+	}
+
+	if _, ok, _ := ParseAttributes(map[string]string{"Other": "x"}); ok {
+		t.Error("message without chunk attributes taken as a chunk")
+	}
+	if _, _, err := ParseAttributes(map[string]string{IDAttribute: "id", IndexAttribute: "x"}); err == nil {
+		t.Error("invalid index accepted")
+	}
+}
+
+func TestAssembler(t *testing.T) {
+	a := NewAssembler(0)
+	if m, ok, err := a.AddEnvelope(`{"msg": "not a chunk"}`); !ok || err != nil || m != `{"msg": "not a chunk"}` {
+		t.Errorf("plain message: %q %v %v", m, ok, err)
+	}
+
+	// Repeated chunks are ignored.
+	a.Add(Header{ID: "x", Index: 0, Total: 2}, "a")
+	if _, ok, _ := a.Add(Header{ID: "x", Index: 0, Total: 2}, "a"); ok {
+		t.Error("repeated chunk completed the message")
+	}
+	if m, ok, _ := a.Add(Header{ID: "x", Index: 1, Total: 2}, ""); !ok || m != "a" {
+		t.Errorf("got %q, %v", m, ok)
+	}
+
+	for _, h := range []Header{
+		{Index: 0, Total: 1},
+		{ID: "y", Index: 2, Total: 2},
+		{ID: "y", Index: 0, Total: 0},
+	} {
+		if _, _, err := a.Add(h, "d"); err == nil {
+			t.Errorf("invalid header %+v accepted", h)
+		}
+	}
+	a.Add(Header{ID: "z", Index: 0, Total: 2}, "d")
+	if _, _, err := a.Add(Header{ID: "z", Index: 1, Total: 3}, "d"); err == nil {
+		t.Error("changed total accepted")
+	}
+}
+
+func TestAssemblerExpire(t *testing.T) {
+	a := NewAssembler(1)
+	a.Add(Header{ID: "x", Index: 0, Total: 2}, "a")
+	first := a.pending["x"].first
+	if ids := a.Expire(first.Add(2)); len(ids) != 1 || ids[0] != "x" || a.Pending() != 0 {
+		t.Fatalf("expired %v, %d pending", ids, a.Pending())
+	}
+	if ids := NewAssembler(0).Expire(first); ids != nil {
+		t.Fatal("assembler without timeout expired messages")
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jamiealquiza/ascender/chunk"
+	"github.com/jamiealquiza/ascender/outputs"
+)
+
+// ChunkConfig splits messages over MaxBytes (default the
+// output's limit) into ordered chunks rather than failing
+// them. Chunks share an ID and carry their index and the
+// total in an envelope (Flag "envelope", the default) or as
+// attributes ("attribute": sqs, sns). Package chunk and the
+// -reassemble flag put them back together.
+type ChunkConfig struct {
+	MaxBytes int    `json:"max-bytes"`
+	Flag     string `json:"flag"`
+}
+
+func (c *ChunkConfig) validate(t *outputType) error {
+	switch c.Flag {
+	case "":
+		c.Flag = "envelope"
+	case "envelope":
+	case "attribute":
+		if !t.attributes {
+			return errors.New("output doesn't support the attribute flag")
+		}
+	default:
+		return fmt.Errorf("invalid flag %q", c.Flag)
+	}
+
+	switch {
+	case c.MaxBytes < 0:
+		return errors.New("max-bytes can't be negative")
+	case c.MaxBytes == 0:
+		c.MaxBytes = t.maxSize
+		if c.MaxBytes == 0 {
+			return errors.New("max-bytes is required, the output has no limit")
+		}
+	case t.maxSize > 0 && c.MaxBytes > t.maxSize:
+		return fmt.Errorf("max-bytes exceeds the output's limit of %d", t.maxSize)
+	}
+
+	return nil
+}
+
+// split returns m as chunks of at most MaxBytes, or m
+// alone if it fits.
+func (c *ChunkConfig) split(m *outputs.Message) ([]*outputs.Message, error) {
+	if len(m.Body)+m.AttributeSize() <= c.MaxBytes {
+		return []*outputs.Message{m}, nil
+	}
+
+	id := messageID(time.Now())
+	max := c.MaxBytes - m.AttributeSize()
+	var parts []string
+	var err error
+	if c.Flag == "attribute" {
+		// Index and total have no more digits than
+		// the body's length.
+		digits := len(strconv.Itoa(len(m.Body)))
+		max -= len(chunk.IDAttribute) + len(id) + len(chunk.IndexAttribute) + len(chunk.TotalAttribute) + 2*digits + 3*len("String")
+		parts, err = chunk.Split(m.Body, max)
+	} else {
+		parts, err = chunk.Envelopes(m.Body, id, max)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	original := m
+	if m.Original != nil {
+		original = m.Original
+	}
+	chunks := make([]*outputs.Message, len(parts))
+	shared := &outputs.Chunks{}
+	for i, p := range parts {
+		cm := *m
+		cm.Body = p
+		cm.Original = original
+		cm.Chunks = shared
+		if c.Flag == "attribute" {
+			cm.Attributes = append(m.Attributes[:len(m.Attributes):len(m.Attributes)],
+				outputs.Attribute{Name: chunk.IDAttribute, Value: id},
+				outputs.Attribute{Name: chunk.IndexAttribute, Value: strconv.Itoa(i)},
+				outputs.Attribute{Name: chunk.TotalAttribute, Value: strconv.Itoa(len(parts))})
+		}
+		chunks[i] = &cm
+	}
+
+	return chunks, nil
+}
+
+// prepare encodes and chunks m for an output, returning
+// the messages to send or an error if m can't be sent.
+func prepare(c *OutputConfig, enc *encoder, m *outputs.Message) ([]*outputs.Message, error) {
+	em := m
+	if enc != nil {
+		em = enc.encode(m)
+	}
+	if c.Chunk != nil {
+		return c.Chunk.split(em)
+	}
+	if enc != nil {
+		if n := len(em.Body) + em.AttributeSize(); c.Encoding.MaxSize > 0 && n > c.Encoding.MaxSize {
+			return nil, fmt.Errorf("message of %d bytes encoded (%d before) exceeds max-size %d", n, len(m.Body), c.Encoding.MaxSize)
+		}
+	}
+	return []*outputs.Message{em}, nil
+}
+
+// prepareBatches prepares batches read from q for an output
+// worker, failing messages that can't be sent. A message's
+// chunks are kept together, in order.
+func prepareBatches(c *OutputConfig, enc *encoder, q <-chan []*outputs.Message, s *outputStats) <-chan []*outputs.Message {
+	prepared := make(chan []*outputs.Message)
+	go func() {
+		defer close(prepared)
+		for batch := range q {
+			out := make([]*outputs.Message, 0, len(batch))
+			failed := 0
+			var err error
+			for _, m := range batch {
+				ms, perr := prepare(c, enc, m)
+				if perr != nil {
+					err = perr
+					failed++
+					s.Failed(m, 0, err)
+					continue
+				}
+				out = append(out, ms...)
+			}
+			if err != nil {
+				log.Printf("Output %s: %d of %d messages not sent: %s\n", c.Name, failed, len(batch), err)
+			}
+			if len(out) > 0 {
+				prepared <- out
+			}
+		}
+	}()
+	return prepared
+}
+
+// reassemble reads chunk envelopes, one per line, from path
+// (- for stdin) and writes each complete message to w as a
+// line. Other lines are written as they are.
+func reassemble(path string, w io.Writer) error {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	a := chunk.NewAssembler(0)
+	out := bufio.NewWriter(w)
+	defer out.Flush()
+	lines := bufio.NewScanner(r)
+	lines.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; lines.Scan(); n++ {
+		m, ok, err := a.AddEnvelope(lines.Text())
+		if err != nil {
+			log.Printf("Reassemble: line %d: %s\n", n, err)
+			continue
+		}
+		if ok {
+			out.WriteString(m)
+			out.WriteByte('\n')
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return err
+	}
+	if n := a.Pending(); n > 0 {
+		log.Printf("Reassemble: %d messages incomplete\n", n)
+	}
+
+	return out.Flush()
+}
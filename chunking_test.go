@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jamiealquiza/ascender/outputs"
+)
+
+// Replaying every failed chunk's original would send the
+// message once per chunk.
+func TestFailedChunksDeadLetterOnce(t *testing.T) {
+	withQueues(t, &Config{})
+	c := &ChunkConfig{MaxBytes: 200, Flag: "envelope"}
+	m := &outputs.Message{Body: strings.Repeat("x", 1000), Route: "r"}
+	chunks, err := c.split(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) < 3 {
+		t.Fatalf("%d chunks", len(chunks))
+	}
+
+	s := &outputStats{config: &OutputConfig{Name: "o", DeadLetter: "dead"}}
+	for _, cm := range chunks {
+		s.Failed(cm, 3, errors.New("down"))
+	}
+	if n := len(deadLetterQueue); n != 1 {
+		t.Fatalf("%d dead letters, want 1", n)
+	}
+	if d := <-deadLetterQueue; !strings.Contains(d.message.Body, m.Body) {
+		t.Errorf("dead letter %q isn't the original", d.message.Body)
+	}
+
+	// Messages that weren't chunked are each failed.
+	s.Failed(&outputs.Message{Body: "a"}, 1, nil)
+	s.Failed(&outputs.Message{Body: "a"}, 1, nil)
+	if n := len(deadLetterQueue); n != 2 {
+		t.Fatalf("%d dead letters, want 2", n)
+	}
+}
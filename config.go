@@ -0,0 +1,705 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/jamiealquiza/ascender/outputs/sqs"
+)
+
+// Config describes the listeners, pipeline stages, routes
+// and outputs that make up an Ascender instance.
+type Config struct {
+	QueueCap      int                `json:"queue-cap"`
+	FlushInterval string             `json:"flush-interval"`
+	Listeners     []*ListenerConfig  `json:"listeners"`
+	Pipeline      []*ProcessorConfig `json:"pipeline"`
+	Priorities    []*PriorityRule    `json:"priorities"`
+	Shedding      Shedding           `json:"shedding"`
+	Routes        []*RouteConfig     `json:"routes"`
+	Outputs       []*OutputConfig    `json:"outputs"`
+}
+
+// ListenerConfig describes a TCP line protocol listener.
+// Connections are TLS if TLSCert and TLSKey are set.
+// Messages over MaxMessageSize bytes are rejected. With
+// Multiline, lines are joined into events per connection.
+// With Replay, dead letters sent by -replay are accepted;
+// with ReplayDirect, output dead letters skip the pipeline.
+// With TokenFile, clients must send an AUTH line within
+// AuthTimeout (default 10s).
+type ListenerConfig struct {
+	Name           string           `json:"name"`
+	Addr           string           `json:"addr"`
+	Port           string           `json:"port"`
+	TLSCert        string           `json:"tls-cert"`
+	TLSKey         string           `json:"tls-key"`
+	TokenFile      string           `json:"token-file"`
+	AuthTimeout    string           `json:"auth-timeout"`
+	RateLimits     RateLimits       `json:"rate-limits"`
+	MaxMessageSize int              `json:"max-message-size"`
+	Multiline      *MultilineConfig `json:"multiline"`
+	Replay         bool             `json:"replay"`
+	ReplayDirect   bool             `json:"replay-direct"`
+
+	// Loaded from TLSCert and TLSKey.
+	tlsConfig *tls.Config
+	// Loaded from TokenFile.
+	tokens      []*ClientToken
+	authTimeout time.Duration
+}
+
+func (l *ListenerConfig) address() string {
+	return l.Addr + ":" + l.Port
+}
+
+// ProcessorConfig describes a pipeline stage applied to
+// messages before they are routed. Options used depend on
+// the type; When limits the stage to matching messages.
+type ProcessorConfig struct {
+	Name string     `json:"name"`
+	Type string     `json:"type"`
+	When *Condition `json:"when"`
+	// Values to add (add-fields), old to new names
+	// (rename-fields) or names to delete (delete-fields).
+	Fields json.RawMessage `json:"fields"`
+	// Replace fields already set (add-fields, envelope).
+	Overwrite bool `json:"overwrite"`
+	// Field wrapping plain text (json, envelope) or compared
+	// instead of the whole message (dedup), and what to do
+	// with plain text instead (json).
+	Field     string `json:"field"`
+	OnInvalid string `json:"on-invalid"`
+	// New body (template).
+	Template string `json:"template"`
+	Escape   string `json:"escape"`
+	// Names of the time and host fields (stamp, envelope).
+	TimestampField string `json:"timestamp-field"`
+	HostnameField  string `json:"hostname-field"`
+	// Starlark file, limits per call and what to do with
+	// messages it fails on (script).
+	Script   string `json:"script"`
+	MaxSteps uint64 `json:"max-steps"`
+	Timeout  string `json:"timeout"`
+	OnError  string `json:"on-error"`
+	// How long and how many messages are remembered, and
+	// whether repeats are summarized (dedup).
+	Window  string `json:"window"`
+	MaxKeys int    `json:"max-keys"`
+	Summary bool   `json:"summary"`
+	// Rate, with Field counted separately by value (sample).
+	Sampling
+
+	// Built from the options.
+	processor processor
+}
+
+// RouteConfig sends messages received on any of Listeners
+// (all listeners if empty) to each of Outputs. Messages
+// take the first route that matches. Sample, if set,
+// samples the messages taking the route.
+//
+// With Schema set, messages are checked against the JSON
+// Schema in that file as they're received. Those violating
+// it are rejected, or sent to the Quarantine output.
+type RouteConfig struct {
+	Name       string    `json:"name"`
+	Listeners  []string  `json:"listeners"`
+	Outputs    []string  `json:"outputs"`
+	Sample     *Sampling `json:"sample"`
+	Schema     string    `json:"schema"`
+	Quarantine string    `json:"quarantine"`
+
+	// Built from Sample.
+	sampler *sampler
+	// Loaded from Schema.
+	schema *schema
+}
+
+// OutputConfig describes an output destination. Settings
+// are type specific and decoded by the output's package.
+//
+// A partial batch is sent MaxLinger (default: the config
+// FlushInterval) after its first message arrived. With
+// AdaptiveLinger, the linger time moves between MinLinger
+// and MaxLinger: halved after a flush that leaves the output
+// queue empty, doubled while messages are queued behind it.
+//
+// Messages the output gives up on are wrapped as a DeadLetter
+// and sent to the output named by DeadLetter, if set.
+// Pack, if set, packs messages together, Encoding encodes
+// messages (or packs) and Chunk splits those too large to
+// send, in that order.
+type OutputConfig struct {
+	Name           string          `json:"name"`
+	Type           string          `json:"type"`
+	Workers        int             `json:"workers"`
+	BatchSize      int             `json:"batch-size"`
+	MaxLinger      string          `json:"max-linger"`
+	MinLinger      string          `json:"min-linger"`
+	AdaptiveLinger bool            `json:"adaptive-linger"`
+	DeadLetter     string          `json:"dead-letter"`
+	Pack           *PackConfig     `json:"pack"`
+	Encoding       *EncodingConfig `json:"encoding"`
+	Chunk          *ChunkConfig    `json:"chunk"`
+	Settings       json.RawMessage `json:"settings"`
+
+	// Parsed MaxLinger and MinLinger.
+	maxLinger, minLinger time.Duration
+	// Decoded Settings.
+	settings outputSettings
+}
+
+type outputSettings interface {
+	Validate() error
+}
+
+// Matches ${VAR} environment variable references.
+var envVarRe = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// loadConfig builds the running config from the -config file
+// if provided, otherwise from flags. Explicitly set flags
+// override values from the file. Either way the config is
+// validated.
+func loadConfig() (*Config, []error) {
+	if options.configFile == "" {
+		c := configFromFlags()
+		if errs := c.validate(); errs != nil {
+			return nil, errs
+		}
+		return c, nil
+	}
+
+	b, err := ioutil.ReadFile(options.configFile)
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	c, errs := parseConfig(b)
+	if c == nil {
+		return nil, errs
+	}
+
+	c.applyFlags()
+	c.setDefaults()
+	if errs = append(errs, c.validate()...); errs != nil {
+		return nil, errs
+	}
+
+	return c, nil
+}
+
+// parseConfig interpolates environment variables into a JSON
+// config and decodes it, including per-output settings.
+// A nil config is returned if the JSON could not be decoded.
+func parseConfig(b []byte) (*Config, []error) {
+	b, errs := interpolateEnv(b)
+	if errs != nil {
+		return nil, errs
+	}
+
+	c := &Config{}
+	if err := decodeStrict(b, c); err != nil {
+		return nil, []error{fmt.Errorf("config: %s", err)}
+	}
+
+	for _, o := range c.Outputs {
+		if err := o.decodeSettings(); err != nil {
+			errs = append(errs, fmt.Errorf("output %q: %s", o.Name, err))
+		}
+	}
+
+	return c, errs
+}
+
+// interpolateEnv replaces ${VAR} references with the
+// JSON escaped value of the environment variable VAR.
+func interpolateEnv(b []byte) ([]byte, []error) {
+	var errs []error
+	b = envVarRe.ReplaceAllFunc(b, func(ref []byte) []byte {
+		name := string(envVarRe.FindSubmatch(ref)[1])
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			errs = append(errs, fmt.Errorf("environment variable %s is not set", name))
+			return ref
+		}
+		esc, _ := json.Marshal(v)
+		return esc[1 : len(esc)-1]
+	})
+	return b, errs
+}
+
+// decodeStrict decodes JSON into v, rejecting unknown fields.
+func decodeStrict(b []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// decodeSettings decodes type specific output settings.
+func (o *OutputConfig) decodeSettings() error {
+	t, ok := outputTypes[o.Type]
+	if !ok {
+		// Reported by validate.
+		return nil
+	}
+
+	if t.settings == nil {
+		if len(o.Settings) > 0 {
+			return fmt.Errorf("output type %q takes no settings", o.Type)
+		}
+		return nil
+	}
+
+	o.settings = t.settings()
+	if len(o.Settings) == 0 {
+		return nil
+	}
+	if err := decodeStrict(o.Settings, o.settings); err != nil {
+		return fmt.Errorf("settings: %s", err)
+	}
+
+	return nil
+}
+
+// configFromFlags builds a single listener, single output
+// config from command line flags.
+func configFromFlags() *Config {
+	o := &OutputConfig{Name: "default", Workers: options.handlers}
+	if options.console {
+		o.Type = "console"
+	} else {
+		o.Type = "sqs"
+		o.settings = &sqs.Config{
+			AccessKey: options.awsAccessKey,
+			SecretKey: options.awsSecretKey,
+			Queue:     options.awsQueue,
+			Region:    options.awsRegion,
+		}
+	}
+
+	c := &Config{
+		QueueCap:      options.queuecap,
+		FlushInterval: options.flushInterval.String(),
+		Listeners: []*ListenerConfig{
+			{Name: "default", Addr: options.addr, Port: options.port},
+		},
+		Routes: []*RouteConfig{
+			{Name: "default", Outputs: []string{"default"}},
+		},
+		Outputs: []*OutputConfig{o},
+	}
+	c.setDefaults()
+
+	return c
+}
+
+// applyFlags overrides config values with any flags
+// explicitly set on the command line.
+func (c *Config) applyFlags() {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen-addr", "listen-port":
+			if len(c.Listeners) == 0 {
+				c.Listeners = []*ListenerConfig{{Name: "default"}}
+			}
+			if f.Name == "listen-addr" {
+				c.Listeners[0].Addr = options.addr
+			} else {
+				c.Listeners[0].Port = options.port
+			}
+		case "queue-cap":
+			c.QueueCap = options.queuecap
+		case "flush-interval":
+			c.FlushInterval = options.flushInterval.String()
+		case "handlers":
+			for _, o := range c.Outputs {
+				o.Workers = options.handlers
+			}
+		case "console-out":
+			if !options.console {
+				return
+			}
+			for _, o := range c.Outputs {
+				o.Type, o.settings = "console", nil
+			}
+		}
+
+		for _, o := range c.Outputs {
+			s, ok := o.settings.(*sqs.Config)
+			if !ok {
+				continue
+			}
+			switch f.Name {
+			case "aws-access-key":
+				s.AccessKey = options.awsAccessKey
+			case "aws-secret-key":
+				s.SecretKey = options.awsSecretKey
+			case "aws-sqs-queue":
+				s.Queue = options.awsQueue
+			case "aws-sqs-region":
+				s.Region = options.awsRegion
+			}
+		}
+	})
+}
+
+// setDefaults fills in unset optional values.
+func (c *Config) setDefaults() {
+	if c.QueueCap == 0 {
+		c.QueueCap = 1000
+	}
+	if c.FlushInterval == "" {
+		c.FlushInterval = "5s"
+	}
+
+	for _, l := range c.Listeners {
+		if l.Addr == "" {
+			l.Addr = "localhost"
+		}
+		if l.AuthTimeout == "" {
+			l.AuthTimeout = "10s"
+		}
+		if l.MaxMessageSize == 0 {
+			// SQS, the reference queue, takes 256KB.
+			l.MaxMessageSize = 256 * 1024
+		}
+	}
+
+	for i, p := range c.Pipeline {
+		if p.Name == "" {
+			p.Name = fmt.Sprintf("%d-%s", i, p.Type)
+		}
+	}
+
+	// Without priorities, normal messages may fill the queue.
+	// Defaults give way to a threshold that was set.
+	sh := &c.Shedding
+	if sh.Normal == 0 {
+		sh.Normal = 100
+		if len(c.Priorities) > 0 {
+			sh.Normal = 90
+		}
+		if sh.Low > sh.Normal && sh.Low <= 100 {
+			sh.Normal = sh.Low
+		}
+	}
+	if sh.Low == 0 {
+		sh.Low = 50
+		if sh.Normal < sh.Low && sh.Normal > 0 {
+			sh.Low = sh.Normal
+		}
+	}
+
+	for _, o := range c.Outputs {
+		if o.Workers == 0 {
+			o.Workers = 3
+		}
+		if t, ok := outputTypes[o.Type]; ok && o.BatchSize == 0 {
+			o.BatchSize = t.defaultBatch
+		}
+		if o.MaxLinger == "" {
+			o.MaxLinger = c.FlushInterval
+		}
+		if o.MinLinger == "" {
+			o.MinLinger = "10ms"
+		}
+		// Parsed here so every config has them, even
+		// one never validated; errors are reported by
+		// validate.
+		o.parseLinger()
+	}
+}
+
+// loadTLS loads the listener certificate, if configured.
+func (l *ListenerConfig) loadTLS() error {
+	switch {
+	case l.TLSCert == "" && l.TLSKey == "":
+		return nil
+	case l.TLSCert == "" || l.TLSKey == "":
+		return errors.New("tls-cert and tls-key must be set together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(l.TLSCert, l.TLSKey)
+	if err != nil {
+		return err
+	}
+	l.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	return nil
+}
+
+// output returns the named output config, nil if none.
+func (c *Config) output(name string) *OutputConfig {
+	for _, o := range c.Outputs {
+		if o.Name == name {
+			return o
+		}
+	}
+	return nil
+}
+
+// parseLinger parses the output linger durations.
+func (o *OutputConfig) parseLinger() error {
+	var err error
+	if o.maxLinger, err = time.ParseDuration(o.MaxLinger); err != nil || o.maxLinger <= 0 {
+		return fmt.Errorf("invalid max-linger %q", o.MaxLinger)
+	}
+	if o.minLinger, err = time.ParseDuration(o.MinLinger); err != nil || o.minLinger <= 0 {
+		return fmt.Errorf("invalid min-linger %q", o.MinLinger)
+	}
+	if o.AdaptiveLinger && o.minLinger > o.maxLinger {
+		return errors.New("min-linger exceeds max-linger")
+	}
+	return nil
+}
+
+// validate returns all problems found in the config.
+func (c *Config) validate() []error {
+	var errs []error
+	fail := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+
+	if c.QueueCap < 1 {
+		fail("queue-cap must be at least 1")
+	}
+	if d, err := time.ParseDuration(c.FlushInterval); err != nil || d <= 0 {
+		fail("invalid flush-interval %q", c.FlushInterval)
+	}
+
+	// Listeners.
+	if len(c.Listeners) == 0 {
+		fail("at least one listener is required")
+	}
+	listeners := map[string]bool{}
+	addresses := map[string]bool{}
+	for i, l := range c.Listeners {
+		switch {
+		case l.Name == "":
+			fail("listener %d: name is required", i)
+		case listeners[l.Name]:
+			fail("listener %q: duplicate name", l.Name)
+		}
+		listeners[l.Name] = true
+		if p, err := strconv.Atoi(l.Port); err != nil || p < 1 || p > 65535 {
+			fail("listener %q: invalid port %q", l.Name, l.Port)
+		}
+		if addresses[l.address()] {
+			fail("listener %q: duplicate address %s", l.Name, l.address())
+		}
+		addresses[l.address()] = true
+		if err := l.loadTLS(); err != nil {
+			fail("listener %q: %s", l.Name, err)
+		}
+		if r := l.RateLimits; r.Connection.Messages < 0 || r.Connection.Bytes < 0 ||
+			r.IP.Messages < 0 || r.IP.Bytes < 0 ||
+			r.Client.Messages < 0 || r.Client.Bytes < 0 {
+			fail("listener %q: rate limits can't be negative", l.Name)
+		}
+		if l.MaxMessageSize < 1 {
+			fail("listener %q: max-message-size must be at least 1", l.Name)
+		} else if l.Multiline != nil {
+			if err := l.Multiline.validate(l.MaxMessageSize); err != nil {
+				fail("listener %q: multiline: %s", l.Name, err)
+			}
+		}
+		if l.Replay && l.Multiline != nil {
+			fail("listener %q: replay can't be combined with multiline", l.Name)
+		}
+		if l.ReplayDirect && !l.Replay {
+			fail("listener %q: replay-direct needs replay", l.Name)
+		}
+		if l.TokenFile != "" {
+			var err error
+			if l.tokens, err = loadTokens(l.TokenFile); err != nil {
+				fail("listener %q: %s", l.Name, err)
+			}
+		}
+		var err error
+		if l.authTimeout, err = time.ParseDuration(l.AuthTimeout); err != nil || l.authTimeout <= 0 {
+			fail("listener %q: invalid auth-timeout %q", l.Name, l.AuthTimeout)
+		}
+	}
+
+	// Pipeline.
+	stages := map[string]bool{}
+	for i, p := range c.Pipeline {
+		if stages[p.Name] {
+			fail("pipeline stage %q: duplicate name", p.Name)
+		}
+		stages[p.Name] = true
+		newProcessor, ok := processorTypes[p.Type]
+		if !ok {
+			fail("pipeline stage %d: unknown type %q", i, p.Type)
+			continue
+		}
+		if p.When != nil {
+			if err := p.When.compile(); err != nil {
+				fail("pipeline stage %q: when: %s", p.Name, err)
+			}
+		}
+		var err error
+		if p.processor, err = newProcessor(p); err != nil {
+			fail("pipeline stage %q: %s", p.Name, err)
+		}
+	}
+
+	// Priorities.
+	for i, p := range c.Priorities {
+		if _, ok := priorityClasses[p.Class]; !ok {
+			fail("priority %d: invalid class %q", i, p.Class)
+		}
+		if p.When == nil {
+			fail("priority %d: when is required", i)
+		} else if err := p.When.compile(); err != nil {
+			fail("priority %d: when: %s", i, err)
+		}
+	}
+	if s := c.Shedding; s.Low <= 0 || s.Low > s.Normal || s.Normal > 100 {
+		fail("shedding: need 0 < low <= normal <= 100")
+	}
+
+	// Outputs.
+	if len(c.Outputs) == 0 {
+		fail("at least one output is required")
+	}
+	outputs := map[string]bool{}
+	for i, o := range c.Outputs {
+		switch {
+		case o.Name == "":
+			fail("output %d: name is required", i)
+		case outputs[o.Name]:
+			fail("output %q: duplicate name", o.Name)
+		}
+		outputs[o.Name] = true
+
+		t, ok := outputTypes[o.Type]
+		if !ok {
+			fail("output %q: unknown output type %q", o.Name, o.Type)
+			continue
+		}
+		if o.Workers < 1 {
+			fail("output %q: workers must be at least 1", o.Name)
+		}
+		switch {
+		case o.BatchSize < 1:
+			fail("output %q: batch-size must be at least 1", o.Name)
+		case t.maxBatch > 0 && o.BatchSize > t.maxBatch:
+			fail("output %q: batch-size exceeds %s maximum of %d", o.Name, o.Type, t.maxBatch)
+		}
+		if err := o.parseLinger(); err != nil {
+			fail("output %q: %s", o.Name, err)
+		}
+		if o.settings != nil {
+			if err := o.settings.Validate(); err != nil {
+				fail("output %q: %s", o.Name, err)
+			}
+		}
+		if o.Pack != nil {
+			if err := o.Pack.validate(t); err != nil {
+				fail("output %q: pack: %s", o.Name, err)
+			}
+		}
+		if o.Encoding != nil {
+			if err := o.Encoding.validate(t); err != nil {
+				fail("output %q: encoding: %s", o.Name, err)
+			}
+		}
+		if o.Chunk != nil {
+			if err := o.Chunk.validate(t); err != nil {
+				fail("output %q: chunk: %s", o.Name, err)
+			}
+		}
+	}
+
+	// Dead-letter outputs. These can't have their own,
+	// so dead letters never loop.
+	for _, o := range c.Outputs {
+		if o.DeadLetter == "" {
+			continue
+		}
+		switch d := c.output(o.DeadLetter); {
+		case d == nil:
+			fail("output %q: unknown dead-letter output %q", o.Name, o.DeadLetter)
+		case d == o:
+			fail("output %q: can't be its own dead-letter output", o.Name)
+		case d.DeadLetter != "":
+			fail("output %q: dead-letter output %q has a dead-letter output", o.Name, d.Name)
+		}
+	}
+
+	// Routes.
+	if len(c.Routes) == 0 {
+		fail("at least one route is required")
+	}
+	routes := map[string]bool{}
+	for i, r := range c.Routes {
+		switch {
+		case r.Name == "":
+			fail("route %d: name is required", i)
+		case routes[r.Name]:
+			fail("route %q: duplicate name", r.Name)
+		}
+		routes[r.Name] = true
+		for _, l := range r.Listeners {
+			if !listeners[l] {
+				fail("route %q: unknown listener %q", r.Name, l)
+			}
+		}
+		if len(r.Outputs) == 0 {
+			fail("route %q: at least one output is required", r.Name)
+		}
+		for _, o := range r.Outputs {
+			if !outputs[o] {
+				fail("route %q: unknown output %q", r.Name, o)
+			}
+		}
+		if r.Sample != nil {
+			var err error
+			if r.sampler, err = newSampler(r.Sample, ""); err != nil {
+				fail("route %q: sample: %s", r.Name, err)
+			}
+		}
+		if r.Schema != "" {
+			var err error
+			if r.schema, err = loadSchema(r.Schema); err != nil {
+				fail("route %q: schema: %s", r.Name, err)
+			}
+		}
+		switch {
+		case r.Quarantine == "":
+		case r.Schema == "":
+			fail("route %q: quarantine requires a schema", r.Name)
+		case !outputs[r.Quarantine]:
+			fail("route %q: unknown quarantine output %q", r.Name, r.Quarantine)
+		}
+	}
+
+	// Client token restrictions.
+	for _, l := range c.Listeners {
+		for _, t := range l.tokens {
+			for _, r := range t.Routes {
+				if !routes[r] {
+					fail("listener %q: token %q: unknown route %q", l.Name, t.Name, r)
+				}
+			}
+			for _, o := range t.Outputs {
+				if !outputs[o] {
+					fail("listener %q: token %q: unknown output %q", l.Name, t.Name, o)
+				}
+			}
+		}
+	}
+
+	return errs
+}
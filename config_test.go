@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withFlags sets flag options for the duration of a test.
+func withFlags(t *testing.T, set func()) {
+	saved := options
+	t.Cleanup(func() { options = saved })
+	options.configFile = ""
+	options.addr, options.port = "localhost", "6030"
+	options.handlers, options.queuecap = 3, 1000
+	options.flushInterval = 5 * time.Second
+	set()
+}
+
+func TestLoadConfigFromFlagsValidates(t *testing.T) {
+	withFlags(t, func() {
+		options.awsAccessKey, options.awsSecretKey = "a", "b"
+		options.awsQueue, options.awsRegion = "q", "mars-1"
+	})
+	if _, errs := loadConfig(); len(errs) != 1 || errs[0].Error() != `output "default": invalid region: mars-1` {
+		t.Fatalf("errs = %v", errs)
+	}
+
+	options.awsRegion = ""
+	options.awsAccessKey = ""
+	if _, errs := loadConfig(); len(errs) == 0 {
+		t.Fatal("missing access key accepted")
+	}
+}
+
+func TestLoadConfigFromFlagsDefaults(t *testing.T) {
+	withFlags(t, func() {
+		options.awsAccessKey, options.awsSecretKey = "a", "b"
+		options.awsQueue, options.awsRegion = "q", "us-west-2"
+		options.flushInterval = 2 * time.Second
+	})
+	c, errs := loadConfig()
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	if o := c.Outputs[0]; o.maxLinger != 2*time.Second {
+		t.Errorf("max linger %s, want 2s", o.maxLinger)
+	}
+}
+
+func TestParseConfigRejectsUnknownKeys(t *testing.T) {
+	for _, b := range []string{
+		`{"queue-cap": 10, "queue-size": 10}`,
+		`{"listeners": [{"name": "main", "port": "6030", "tls": true}]}`,
+		`{"outputs": [{"name": "o", "type": "sqs", "settings": {"queue": "q", "region": "us-east-1", "que": "x"}}]}`,
+	} {
+		_, errs := parseConfig([]byte(b))
+		if len(errs) == 0 {
+			t.Errorf("%s accepted", b)
+			continue
+		}
+		if !strings.Contains(errs[0].Error(), "unknown field") {
+			t.Errorf("%s: %v", b, errs)
+		}
+	}
+
+	var v struct{ A int }
+	if err := decodeStrict([]byte(`{"A": 1}`), &v); err != nil || v.A != 1 {
+		t.Errorf("decodeStrict: %v, %+v", err, v)
+	}
+	if err := decodeStrict([]byte(`{"A": 1, "B": 2}`), &v); err == nil {
+		t.Error("decodeStrict accepted an unknown field")
+	}
+}
+
+func TestInterpolateEnv(t *testing.T) {
+	t.Setenv("ASCENDER_TEST_KEY", `se"cret\`)
+	os.Unsetenv("ASCENDER_TEST_UNSET")
+
+	b, errs := interpolateEnv([]byte(`{"key": "${ASCENDER_TEST_KEY}", "cost": "$5", "ref": "$ASCENDER_TEST_KEY"}`))
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	var v map[string]string
+	if err := json.Unmarshal(b, &v); err != nil {
+		t.Fatalf("%s: %s", b, err)
+	}
+	if v["key"] != `se"cret\` || v["cost"] != "$5" || v["ref"] != "$ASCENDER_TEST_KEY" {
+		t.Errorf("interpolated %v", v)
+	}
+
+	_, errs = interpolateEnv([]byte(`{"a": "${ASCENDER_TEST_UNSET}", "b": "${ASCENDER_TEST_KEY}"}`))
+	if len(errs) != 1 || errs[0].Error() != "environment variable ASCENDER_TEST_UNSET is not set" {
+		t.Errorf("errs = %v", errs)
+	}
+	if c, errs := parseConfig([]byte(`{"queue-cap": ${ASCENDER_TEST_UNSET}}`)); c != nil || len(errs) != 1 {
+		t.Errorf("unset variable: %v, %v", c, errs)
+	}
+}
+
+// writeConfig writes a config file, returning its path.
+func writeConfig(t *testing.T, config string) string {
+	path := filepath.Join(t.TempDir(), "ascender.json")
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const testConfig = `{
+	"queue-cap": 10,
+	"listeners": [{"name": "main", "port": "6030"}],
+	"routes": [{"name": "all", "outputs": ["out"]}],
+	"outputs": [{"name": "out", "type": "console"}]
+}`
+
+func TestApplyFlagsOverridesFile(t *testing.T) {
+	path := writeConfig(t, testConfig)
+	withFlags(t, func() { options.configFile = path })
+	// A flag set of its own, so flags set here don't
+	// count as set for other tests.
+	saved := flag.CommandLine
+	t.Cleanup(func() { flag.CommandLine = saved })
+	flag.CommandLine = flag.NewFlagSet("ascender", flag.ContinueOnError)
+	flag.IntVar(&options.queuecap, "queue-cap", 1000, "")
+	flag.StringVar(&options.port, "listen-port", "6030", "")
+	flag.IntVar(&options.handlers, "handlers", 3, "")
+
+	c, errs := loadConfig()
+	if errs != nil {
+		t.Fatal(errs)
+	}
+	if c.QueueCap != 10 || c.Listeners[0].Port != "6030" {
+		t.Errorf("unset flags overrode the file: queue-cap %d, port %s", c.QueueCap, c.Listeners[0].Port)
+	}
+
+	if err := flag.CommandLine.Parse([]string{"-queue-cap", "20", "-listen-port", "7000"}); err != nil {
+		t.Fatal(err)
+	}
+	if c, errs = loadConfig(); errs != nil {
+		t.Fatal(errs)
+	}
+	if c.QueueCap != 20 || c.Listeners[0].Port != "7000" || c.Listeners[0].Name != "main" {
+		t.Errorf("queue-cap %d, listener %+v", c.QueueCap, c.Listeners[0])
+	}
+	if c.Outputs[0].Workers != 3 {
+		t.Errorf("workers %d, want the default 3", c.Outputs[0].Workers)
+	}
+}
+
+func TestSheddingDefaults(t *testing.T) {
+	for _, tc := range []struct {
+		set, want  Shedding
+		priorities bool
+	}{
+		{Shedding{}, Shedding{Low: 50, Normal: 100}, false},
+		{Shedding{}, Shedding{Low: 50, Normal: 90}, true},
+		{Shedding{Normal: 40}, Shedding{Low: 40, Normal: 40}, true},
+		{Shedding{Normal: 80}, Shedding{Low: 50, Normal: 80}, true},
+		{Shedding{Low: 95}, Shedding{Low: 95, Normal: 95}, true},
+		{Shedding{Low: 20}, Shedding{Low: 20, Normal: 90}, true},
+	} {
+		c := &Config{Shedding: tc.set}
+		if tc.priorities {
+			c.Priorities = []*PriorityRule{{}}
+		}
+		c.setDefaults()
+		if c.Shedding != tc.want {
+			t.Errorf("%+v: got %+v, want %+v", tc.set, c.Shedding, tc.want)
+		}
+	}
+
+	// Limits that were both set still have to agree.
+	c := &Config{Shedding: Shedding{Low: 60, Normal: 40}}
+	c.setDefaults()
+	for _, err := range c.validate() {
+		if strings.HasPrefix(err.Error(), "shedding") {
+			return
+		}
+	}
+	t.Error("low above normal accepted")
+}
+
+// With ASCENDER_TEST_MAIN set, TestCheckConfigExitStatus
+// runs main with its arguments.
+func TestCheckConfigExitStatus(t *testing.T) {
+	if args := os.Getenv("ASCENDER_TEST_MAIN"); args != "" {
+		os.Args = append([]string{"ascender"}, strings.Fields(args)...)
+		main()
+		return
+	}
+
+	run := func(config string) (int, string) {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestCheckConfigExitStatus$")
+		cmd.Env = append(os.Environ(), "ASCENDER_TEST_MAIN=-check-config -config "+writeConfig(t, config))
+		out, err := cmd.CombinedOutput()
+		var exit *exec.ExitError
+		if errors.As(err, &exit) {
+			return exit.ExitCode(), string(out)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return 0, string(out)
+	}
+
+	if code, out := run(testConfig); code != 0 || !strings.Contains(out, "Config OK") {
+		t.Errorf("valid config: exit %d: %s", code, out)
+	}
+	if code, out := run(`{"routes": [{"name": "r", "outputs": ["missing"]}]}`); code != 1 || !strings.Contains(out, "Config error:") {
+		t.Errorf("invalid config: exit %d: %s", code, out)
+	}
+	if code, out := run(`{"queue-cap": 10,`); code != 1 {
+		t.Errorf("malformed config: exit %d: %s", code, out)
+	}
+}
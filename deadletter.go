@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jamiealquiza/ascender/outputs"
+)
+
+// DeadLetter wraps a message an output gave up on, as
+// sent to the output's dead-letter output, or one a route
+// quarantined (with no output) for violating its schema.
+type DeadLetter struct {
+	// The message as received.
+	Message  string `json:"message"`
+	Reason   string `json:"reason"`
+	Output   string `json:"output"`
+	Attempts int    `json:"attempts"`
+	Listener string `json:"listener"`
+	Source   string `json:"source"`
+	Client   string `json:"client,omitempty"`
+	Route    string `json:"route"`
+	// When the message was received and given up on.
+	Received time.Time `json:"received"`
+	Failed   time.Time `json:"failed"`
+}
+
+// deadLetter is a wrapped message for the named output.
+type deadLetter struct {
+	output  string
+	message *outputs.Message
+}
+
+// Dead letters for messageHandler to hand to their outputs.
+var deadLetterQueue chan *deadLetter
+
+// outputStats counts messages sent by an output, and
+// passes those it gives up on to its dead-letter output.
+type outputStats struct {
+	*Statser
+	config *OutputConfig
+}
+
+// Failed takes a message the output gave up on after attempts
+// tries (0 if it was never sent), failing with reason. A
+// chunked message is failed with its first failed chunk,
+// and a pack's messages are each failed.
+func (s *outputStats) Failed(m *outputs.Message, attempts int, reason error) {
+	if s.config.DeadLetter == "" || !m.Chunks.FirstFailure() {
+		return
+	}
+	if reason == nil {
+		reason = errors.New("not sent")
+	}
+	if m.Original != nil {
+		m = m.Original
+	}
+	failed := []*outputs.Message{m}
+	if m.Packed != nil {
+		failed = m.Packed
+	}
+
+	for _, m := range failed {
+		// Don't block the output's workers, as the
+		// message handler may be waiting on them.
+		select {
+		case deadLetterQueue <- &deadLetter{output: s.config.DeadLetter, message: newDeadLetter(m, s.config.Name, attempts, reason)}:
+		default:
+			log.Printf("Dead-letter queue full, dropping message from output %s\n", s.config.Name)
+		}
+	}
+}
+
+// quarantine sends m, which violates the schema of route r,
+// to the route's quarantine output as a dead letter.
+func quarantine(m *Message, r *RouteConfig, reason error) {
+	dm := newDeadLetter(m.output(r.Name), "", 0, reason)
+	select {
+	case deadLetterQueue <- &deadLetter{output: r.Quarantine, message: dm}:
+	default:
+		log.Printf("Dead-letter queue full, dropping message quarantined by route %s\n", r.Name)
+	}
+}
+
+// newDeadLetter wraps m as a DeadLetter.
+func newDeadLetter(m *outputs.Message, output string, attempts int, reason error) *outputs.Message {
+	d := &DeadLetter{
+		Message:  m.Body,
+		Reason:   reason.Error(),
+		Output:   output,
+		Attempts: attempts,
+		Listener: m.Listener,
+		Source:   m.Source,
+		Client:   m.Client,
+		Route:    m.Route,
+		Received: m.Received.UTC(),
+		Failed:   time.Now().UTC(),
+	}
+	b, _ := json.Marshal(d)
+	return &outputs.Message{Body: string(b), Listener: m.Listener, Source: m.Source, Client: m.Client, Route: m.Route, Received: m.Received}
+}
+
+// replayDeadLetters sends dead letters read from path (NDJSON,
+// gzipped if named .gz, or - for stdin) to a listener at addr
+// accepting replays, waiting out rate limits and full queues.
+// Letters may be filtered by output name.
+func replayDeadLetters(path, addr, token, output string, useTLS bool) error {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+		if strings.HasSuffix(path, ".gz") {
+			gz, err := gzip.NewReader(f)
+			if err != nil {
+				return err
+			}
+			r = gz
+		}
+	}
+
+	var conn net.Conn
+	var err error
+	if useTLS {
+		conn, err = tls.Dial("tcp", addr, &tls.Config{})
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	responses := bufio.NewScanner(conn)
+	request := func(line string) (string, error) {
+		if _, err := conn.Write([]byte(line + "\n")); err != nil {
+			return "", err
+		}
+		if !responses.Scan() {
+			if err := responses.Err(); err != nil {
+				return "", err
+			}
+			return "", io.EOF
+		}
+		return responses.Text(), nil
+	}
+
+	if token != "" {
+		resp, err := request("AUTH " + token)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(resp, "200|") {
+			return fmt.Errorf("authentication failed: %s", resp)
+		}
+	}
+
+	letters := bufio.NewScanner(r)
+	letters.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var sent, skipped int
+	for n := 1; letters.Scan(); n++ {
+		var d DeadLetter
+		if err := json.Unmarshal(letters.Bytes(), &d); err != nil || (d.Output == "" && d.Route == "") {
+			log.Printf("Replay: line %d is not a dead letter, skipping\n", n)
+			skipped++
+			continue
+		}
+		if output != "" && d.Output != output {
+			continue
+		}
+
+		for wait := 100 * time.Millisecond; ; wait *= 2 {
+			resp, err := request(replayPrefix + letters.Text())
+			if err != nil {
+				return fmt.Errorf("line %d: %s (%d replayed)", n, err, sent)
+			}
+			code := strings.SplitN(resp, "|", 2)[0]
+			if code == "429" || code == "503" {
+				if wait > 10*time.Second {
+					wait = 10 * time.Second
+				}
+				time.Sleep(wait)
+				continue
+			}
+			if code == "200" {
+				sent++
+			} else {
+				log.Printf("Replay: line %d rejected: %s\n", n, resp)
+				skipped++
+			}
+			break
+		}
+	}
+	if err := letters.Err(); err != nil {
+		return err
+	}
+
+	log.Printf("Replay: %d messages replayed, %d skipped\n", sent, skipped)
+	return nil
+}
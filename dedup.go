@@ -0,0 +1,150 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jamiealquiza/ascender/outputs"
+)
+
+// dedup drops messages repeating one seen within the
+// window, comparing the whole message or a field. At most
+// maxKeys messages are remembered; the oldest is forgotten
+// to make room. With summary set, a message counting the
+// repeats is released when a repeated message is forgotten.
+type dedup struct {
+	field   string
+	window  time.Duration
+	maxKeys int
+	summary bool
+
+	seen map[[sha256.Size]byte]*list.Element
+	// Entries by first seen, oldest first.
+	order *list.List
+	// Summaries waiting for the next flush.
+	pending []*event
+}
+
+// dedupEntry is a remembered message.
+type dedupEntry struct {
+	key     [sha256.Size]byte
+	first   time.Time
+	repeats int
+	// The message (or field value) repeated and its
+	// metadata, kept for summaries.
+	sample *Message
+}
+
+// Longest message quoted in summaries.
+const dedupSampleSize = 256
+
+func newDedup(p *ProcessorConfig) (processor, error) {
+	d := &dedup{
+		field:   p.Field,
+		window:  time.Minute,
+		maxKeys: 10000,
+		summary: p.Summary,
+		seen:    map[[sha256.Size]byte]*list.Element{},
+		order:   list.New(),
+	}
+	if p.Window != "" {
+		w, err := time.ParseDuration(p.Window)
+		if err != nil || w <= 0 {
+			return nil, fmt.Errorf("invalid window %q", p.Window)
+		}
+		d.window = w
+	}
+	switch {
+	case p.MaxKeys < 0:
+		return nil, errors.New("max-keys can't be negative")
+	case p.MaxKeys > 0:
+		d.maxKeys = p.MaxKeys
+	}
+	return d, nil
+}
+
+func (d *dedup) process(e *event) (bool, error) {
+	value := e.body()
+	if d.field != "" {
+		obj := e.object()
+		if obj == nil {
+			return true, errNotObject
+		}
+		v, ok := obj.values[d.field]
+		if !ok {
+			return true, nil
+		}
+		value = outputs.FieldString(v)
+	}
+
+	now := time.Now()
+	d.expire(now)
+
+	key := sha256.Sum256([]byte(value))
+	if el, ok := d.seen[key]; ok {
+		el.Value.(*dedupEntry).repeats++
+		return false, nil
+	}
+
+	if d.order.Len() >= d.maxKeys {
+		d.forget(d.order.Front())
+	}
+	entry := &dedupEntry{key: key, first: now}
+	if d.summary {
+		sample := *e.Message
+		if len(value) > dedupSampleSize {
+			value = value[:dedupSampleSize] + "..."
+		}
+		sample.Body = value
+		entry.sample = &sample
+	}
+	d.seen[key] = d.order.PushBack(entry)
+
+	return true, nil
+}
+
+// expire forgets messages first seen a window before now.
+func (d *dedup) expire(now time.Time) {
+	for el := d.order.Front(); el != nil; el = d.order.Front() {
+		if now.Sub(el.Value.(*dedupEntry).first) < d.window {
+			return
+		}
+		d.forget(el)
+	}
+}
+
+// forget removes an entry, queueing its summary if
+// it was repeated.
+func (d *dedup) forget(el *list.Element) {
+	entry := d.order.Remove(el).(*dedupEntry)
+	delete(d.seen, entry.key)
+	if !d.summary || entry.repeats == 0 {
+		return
+	}
+
+	m := *entry.sample
+	m.Received = time.Now()
+	m.Body = fmt.Sprintf(`{"message":%s,"repeats":%d,"first":"%s"}`,
+		outputs.JSONString(fmt.Sprintf("%d repeats of %s", entry.repeats, entry.sample.Body)),
+		entry.repeats,
+		entry.first.UTC().Format(time.RFC3339))
+	d.pending = append(d.pending, &event{Message: &m})
+}
+
+// flush releases summaries of expired messages, or of all
+// messages if now is zero.
+func (d *dedup) flush(now time.Time) []*event {
+	if now.IsZero() {
+		for d.order.Len() > 0 {
+			d.forget(d.order.Front())
+		}
+	} else {
+		d.expire(now)
+	}
+	events := d.pending
+	d.pending = nil
+	return events
+}
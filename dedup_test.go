@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedup(t *testing.T) {
+	p := newTestPipeline(t, `[{"type": "dedup"}]`)
+	expectBodies(t, p.bodies("a"), "a")
+	expectBodies(t, p.bodies("a"))
+	expectBodies(t, p.bodies("b"), "b")
+	// Nothing is held back without summaries.
+	expectBodies(t, messageBodies(p.flush(time.Time{})))
+}
+
+func TestDedupField(t *testing.T) {
+	p := newTestPipeline(t, `[{"type": "dedup", "field": "id"}]`)
+	expectBodies(t, p.bodies(`{"id":1,"n":1}`), `{"id":1,"n":1}`)
+	expectBodies(t, p.bodies(`{"id":1,"n":2}`))
+	// Messages without the field pass.
+	expectBodies(t, p.bodies(`{"n":3}`), `{"n":3}`)
+	expectBodies(t, p.bodies(`{"n":3}`), `{"n":3}`)
+	expectBodies(t, p.bodies(`text`), `text`)
+}
+
+func TestDedupWindow(t *testing.T) {
+	p := newTestPipeline(t, `[{"type": "dedup", "window": "50ms"}]`)
+	expectBodies(t, p.bodies("a"), "a")
+	time.Sleep(60 * time.Millisecond)
+	expectBodies(t, p.bodies("a"), "a")
+}
+
+func TestDedupMaxKeys(t *testing.T) {
+	p := newTestPipeline(t, `[{"type": "dedup", "max-keys": 2}]`)
+	for _, b := range []string{"a", "b", "c"} {
+		expectBodies(t, p.bodies(b), b)
+	}
+	// a was forgotten to make room for c.
+	expectBodies(t, p.bodies("a"), "a")
+	expectBodies(t, p.bodies("c"))
+}
+
+func TestDedupSummary(t *testing.T) {
+	p := newTestPipeline(t, `[
+		{"type": "dedup", "summary": true, "window": "1h"},
+		{"type": "add-fields", "fields": {"after": true}}
+	]`)
+	for i := 0; i < 3; i++ {
+		p.bodies(`{"a":1}`)
+	}
+	p.bodies(`{"b":1}`)
+	if got := p.flush(time.Now()); len(got) != 0 {
+		t.Fatalf("%d summaries released within the window", len(got))
+	}
+
+	// Only repeated messages are summarized, and summaries
+	// continue through later stages.
+	got := p.flush(time.Time{})
+	if len(got) != 1 {
+		t.Fatalf("%d summaries, want 1", len(got))
+	}
+	var s struct {
+		Message string
+		Repeats int
+		First   string
+		After   bool
+	}
+	if err := json.Unmarshal([]byte(got[0].Body), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Message != `2 repeats of {"a":1}` || s.Repeats != 2 || s.First == "" || !s.After || got[0].Listener != "main" {
+		t.Errorf("summary %s", got[0].Body)
+	}
+}
+
+func TestDedupSummarySample(t *testing.T) {
+	p := newTestPipeline(t, `[{"type": "dedup", "summary": true}]`)
+	long := strings.Repeat("x", dedupSampleSize+10)
+	p.bodies(long)
+	p.bodies(long)
+	got := p.flush(time.Time{})
+	if len(got) != 1 || !strings.Contains(got[0].Body, strings.Repeat("x", dedupSampleSize)+`..."`) || strings.Contains(got[0].Body, long) {
+		t.Errorf("summary %v", messageBodies(got))
+	}
+}
+
+func TestDedupConfigErrors(t *testing.T) {
+	for _, p := range []*ProcessorConfig{{Window: "0s"}, {Window: "soon"}, {MaxKeys: -1}} {
+		if _, err := newDedup(p); err == nil {
+			t.Errorf("%+v accepted", *p)
+		}
+	}
+}
+
+// messageBodies returns the bodies of messages.
+func messageBodies(messages []*Message) []string {
+	var bodies []string
+	for _, m := range messages {
+		bodies = append(bodies, m.Body)
+	}
+	return bodies
+}
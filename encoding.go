@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/jamiealquiza/ascender/outputs"
+	"github.com/klauspost/compress/zstd"
+)
+
+// EncodingConfig compresses (gzip or zstd) and/or base64
+// encodes messages before an output sends them. Flag says
+// how consumers learn the encoding: "envelope" (default)
+// wraps the body as {"encoding": "gzip+base64", "data":
+// "..."}, "attribute" sets a message attribute (sqs, sns)
+// and "none" leaves it to them. Encoded messages over
+// MaxSize (default the output's limit) are failed and
+// dead-lettered, never truncated, unless the output
+// chunks them.
+type EncodingConfig struct {
+	Compression string `json:"compression"`
+	Base64      bool   `json:"base64"`
+	Flag        string `json:"flag"`
+	MaxSize     int    `json:"max-size"`
+
+	// Name of the encoding, e.g. "gzip+base64".
+	name string
+}
+
+func (c *EncodingConfig) validate(t *outputType) error {
+	switch c.Compression {
+	case "":
+		if !c.Base64 {
+			return errors.New("compression or base64 is required")
+		}
+	case "gzip", "zstd":
+	default:
+		return fmt.Errorf("invalid compression %q", c.Compression)
+	}
+
+	switch c.Flag {
+	case "":
+		c.Flag = "envelope"
+		fallthrough
+	case "envelope":
+		if !c.Base64 {
+			return errors.New("envelope flag requires base64")
+		}
+	case "attribute":
+		if !t.attributes {
+			return errors.New("output doesn't support the attribute flag")
+		}
+	case "none":
+	default:
+		return fmt.Errorf("invalid flag %q", c.Flag)
+	}
+	if t.text && c.Compression != "" && !c.Base64 {
+		return errors.New("output only takes text, base64 is required")
+	}
+
+	switch {
+	case c.MaxSize < 0:
+		return errors.New("max-size can't be negative")
+	case c.MaxSize == 0:
+		c.MaxSize = t.maxSize
+	}
+
+	c.name = c.Compression
+	if c.Base64 {
+		if c.name != "" {
+			c.name += "+"
+		}
+		c.name += "base64"
+	}
+
+	return nil
+}
+
+// encoder encodes messages for an output's workers.
+type encoder struct {
+	config *EncodingConfig
+	// Safe for concurrent EncodeAll calls.
+	zstd  *zstd.Encoder
+	gzips sync.Pool
+}
+
+func newEncoder(c *EncodingConfig) *encoder {
+	e := &encoder{config: c}
+	if c.Compression == "zstd" {
+		e.zstd, _ = zstd.NewWriter(nil)
+	}
+	return e
+}
+
+// encode returns m encoded.
+func (e *encoder) encode(m *outputs.Message) *outputs.Message {
+	c := e.config
+	body := []byte(m.Body)
+	switch c.Compression {
+	case "gzip":
+		var b bytes.Buffer
+		w, _ := e.gzips.Get().(*gzip.Writer)
+		if w == nil {
+			w = gzip.NewWriter(&b)
+		} else {
+			w.Reset(&b)
+		}
+		w.Write(body)
+		w.Close()
+		e.gzips.Put(w)
+		body = b.Bytes()
+	case "zstd":
+		body = e.zstd.EncodeAll(body, nil)
+	}
+	if c.Base64 {
+		body = []byte(base64.StdEncoding.EncodeToString(body))
+	}
+
+	em := *m
+	em.Original = m
+	switch c.Flag {
+	case "envelope":
+		em.Body = fmt.Sprintf(`{"encoding":"%s","data":"%s"}`, c.name, body)
+	case "attribute":
+		em.Body = string(body)
+		em.Attributes = append(m.Attributes[:len(m.Attributes):len(m.Attributes)], outputs.Attribute{Name: outputs.EncodingAttribute, Value: c.name})
+	default:
+		em.Body = string(body)
+	}
+
+	return &em
+}
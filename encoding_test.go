@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/jamiealquiza/ascender/outputs"
+	"github.com/klauspost/compress/zstd"
+)
+
+// decode reverses c's encoding of body, failing the test
+// if it can't be.
+func decode(t *testing.T, c *EncodingConfig, body []byte) string {
+	if c.Base64 {
+		b, err := base64.StdEncoding.DecodeString(string(body))
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		body = b
+	}
+	switch c.Compression {
+	case "gzip":
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if body, err = io.ReadAll(r); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+	case "zstd":
+		d, _ := zstd.NewReader(nil)
+		defer d.Close()
+		var err error
+		if body, err = d.DecodeAll(body, nil); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+	}
+	return string(body)
+}
+
+func TestEncodingRoundTrip(t *testing.T) {
+	body := `{"msg": "a message, a message, a message", "n": 1}` + "\n\x00\xff"
+	attrs := []outputs.Attribute{{Name: "a", Value: "1"}}
+	for _, compression := range []string{"", "gzip", "zstd"} {
+		for _, b64 := range []bool{false, true} {
+			for _, flag := range []string{"envelope", "attribute", "none"} {
+				c := &EncodingConfig{Compression: compression, Base64: b64, Flag: flag}
+				if err := c.validate(&outputType{attributes: true}); err != nil {
+					// Nothing to encode, or an envelope without base64.
+					if compression != "" && (b64 || flag != "envelope") {
+						t.Errorf("%+v: %s", c, err)
+					}
+					continue
+				}
+				m := &outputs.Message{Body: body, Attributes: attrs[:1:1]}
+				em := newEncoder(c).encode(m)
+				if em.Original != m || m.Body != body || len(m.Attributes) != 1 {
+					t.Fatalf("%s/%s: original changed or not kept", c.name, flag)
+				}
+
+				data := []byte(em.Body)
+				var got []outputs.Attribute
+				switch flag {
+				case "envelope":
+					var env struct{ Encoding, Data string }
+					if err := json.Unmarshal(data, &env); err != nil {
+						t.Fatalf("%s/%s: %s: %q", c.name, flag, err, em.Body)
+					}
+					if env.Encoding != c.name {
+						t.Errorf("%s/%s: envelope encoding %q", c.name, flag, env.Encoding)
+					}
+					data = []byte(env.Data)
+				case "attribute":
+					got = em.Attributes[1:]
+					if len(got) != 1 || got[0].Name != outputs.EncodingAttribute || got[0].Value != c.name {
+						t.Errorf("%s/%s: attributes %+v", c.name, flag, em.Attributes)
+					}
+				case "none":
+					if len(em.Attributes) != 1 {
+						t.Errorf("%s/%s: attributes %+v", c.name, flag, em.Attributes)
+					}
+				}
+				if d := decode(t, c, data); d != body {
+					t.Errorf("%s/%s: round trip gave %q", c.name, flag, d)
+				}
+			}
+		}
+	}
+}
+
+func TestEncodingConfigErrors(t *testing.T) {
+	for _, tc := range []struct {
+		c    EncodingConfig
+		t    outputType
+		want string
+	}{
+		{EncodingConfig{}, outputType{}, "compression or base64 is required"},
+		{EncodingConfig{Compression: "lz4", Base64: true}, outputType{}, `invalid compression "lz4"`},
+		{EncodingConfig{Compression: "gzip"}, outputType{}, "envelope flag requires base64"},
+		{EncodingConfig{Base64: true, Flag: "attribute"}, outputType{}, "output doesn't support the attribute flag"},
+		{EncodingConfig{Compression: "zstd", Flag: "none"}, outputType{text: true}, "output only takes text, base64 is required"},
+		{EncodingConfig{Base64: true, Flag: "header"}, outputType{}, `invalid flag "header"`},
+	} {
+		if err := tc.c.validate(&tc.t); err == nil || err.Error() != tc.want {
+			t.Errorf("%+v: %v, want %s", tc.c, err, tc.want)
+		}
+	}
+
+	c := &EncodingConfig{Compression: "gzip", Base64: true}
+	if err := c.validate(&outputType{maxSize: 1024}); err != nil || c.Flag != "envelope" || c.MaxSize != 1024 || c.name != "gzip+base64" {
+		t.Errorf("defaults: %v, %+v", err, c)
+	}
+}
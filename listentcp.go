@@ -3,64 +3,278 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"strings"
+	"sync"
+	"time"
 )
 
-// We match SQS max message size since it's
-// the reference message queue (for now).
-var maxMsgSize = 256 * 1024
+// listener is a bound TCP listener. Its config may be
+// swapped on reload without closing the socket; new
+// connections use the current config.
+type listener struct {
+	server net.Listener
+	mu     sync.Mutex
+	config *ListenerConfig
+}
 
-// Listens for messages, reqHandler goroutine dispatched for each.
-func listenTcp() {
-	log.Printf("Ascender TCP listener started: %s:%s\n",
-		options.addr,
-		options.port)
-	server, err := net.Listen("tcp", options.addr+":"+options.port)
+// newListener binds the address for c.
+func newListener(c *ListenerConfig) (*listener, error) {
+	server, err := net.Listen("tcp", c.address())
 	if err != nil {
-		log.Fatalf("Listener error: %s\n", err)
+		return nil, err
 	}
-	defer server.Close()
+	return &listener{server: server, config: c}, nil
+}
+
+func (l *listener) setConfig(c *ListenerConfig) {
+	l.mu.Lock()
+	l.config = c
+	l.mu.Unlock()
+}
+
+func (l *listener) getConfig() *ListenerConfig {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.config
+}
+
+// Listens for messages, reqHandler goroutine dispatched for each.
+// Returns once the listener is closed; connections already
+// accepted are left open.
+func (l *listener) listenTcp() {
+	log.Printf("Ascender TCP listener %s started: %s\n",
+		l.getConfig().Name,
+		l.server.Addr())
 	// Connection handler loop.
 	for {
-		conn, err := server.Accept()
+		conn, err := l.server.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				log.Printf("Listener %s stopped\n", l.server.Addr())
+				return
+			}
 			log.Printf("Listener down: %s\n", err)
 			continue
 		}
-		go reqHandler(conn)
+		c := l.getConfig()
+		if c.tlsConfig != nil {
+			conn = tls.Server(conn, c.tlsConfig)
+		}
+		go reqHandler(conn, c)
 	}
 }
 
 // Receives messages from 'listener' & sends over 'messageIncomingQueue'.
-func reqHandler(conn net.Conn) {
+// Listeners with a token file require an AUTH line first.
+// Messages over the listener's rate limits are rejected, as
+// are those violating the schema of their route.
+func reqHandler(conn net.Conn, l *ListenerConfig) {
 	defer conn.Close()
 	messages := bufio.NewScanner(conn)
+	// Room for the longest message and its line ending, so
+	// longer lines can be told apart and rejected.
+	messages.Buffer(make([]byte, 0, 64*1024), l.MaxMessageSize+2)
 
+	ip := remoteIP(conn)
+	source := ip
+	var client *ClientToken
+	if l.tokens != nil {
+		conn.SetReadDeadline(time.Now().Add(l.authTimeout))
+		if !messages.Scan() {
+			return
+		}
+		var err error
+		if client, err = authenticate(l.tokens, messages.Text()); err != nil {
+			conn.Write(response(401, 0, "unauthorized"))
+			log.Printf("Listener %s: unauthorized client %s: %s\n", l.Name, source, err)
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+		conn.Write(response(200, 0, "authenticated"))
+		source = client.Name + "@" + source
+	}
+
+	connLimit := newLimiter(l.RateLimits.Connection)
+	ipLimit := ipLimiters.get(l.Name+"|"+ip, l.RateLimits.IP)
+	defer ipLimiters.release(ipLimit)
+	var clientLimit *limiter
+	if client != nil {
+		r := l.RateLimits.Client
+		if client.RateLimit != nil {
+			r = *client.RateLimit
+		}
+		clientLimit = clientLimiters.get(l.Name+"|"+client.Name, r)
+		defer clientLimiters.release(clientLimit)
+	}
+
+	// receive checks a line against the rate and size limits,
+	// passing its response to respond if it's rejected. It
+	// returns whether the line was accepted and whether to
+	// keep the connection open.
+	receive := func(m string, respond func(code, bytes int, info string)) (bool, bool) {
+		// Reject messages over the connection, source or client limits.
+		if !connLimit.allow(len(m)) || !ipLimit.allow(len(m)) || !clientLimit.allow(len(m)) {
+			respond(429, len(m), "rate limited")
+			sourceStats.count(source, len(m), true)
+			return false, true
+		}
+
+		// Reject messages over the size limit and close the
+		// connection; they're never truncated.
+		if len(m) > l.MaxMessageSize {
+			respond(400, len(m), "exceeds message size limit")
+			sourceStats.count(source, len(m), false)
+			return false, false
+		}
+		return true, true
+	}
+
+	// queue queues a message, passing its response to respond.
+	queue := func(m string, respond func(code, bytes int, info string)) {
+		msg := &Message{Body: m, Listener: l.Name, Source: ip, RemoteAddr: conn.RemoteAddr().String(), Client: client, Received: time.Now()}
+
+		// Drop message and respond if the 'batchBuffer' is too
+		// full for its priority.
+		if !currentShedder().accept(msg, len(messageIncomingQueue)) {
+			respond(503, 0, "message queue full")
+			return
+		}
+
+		// Reject (or quarantine) messages violating the
+		// schema of their route.
+		sourceStats.count(source, len(m), false)
+		if r, err := currentValidator().check(msg); err != nil {
+			if r.Quarantine != "" {
+				quarantine(msg, r, fmt.Errorf("schema violation: %s", err))
+			}
+			respond(422, len(m), "schema violation: "+err.Error())
+			return
+		}
+
+		// Queue message and send response back to client.
+		switch {
+		case m == "\n":
+			respond(204, len(m), "received empty message")
+		default:
+			respond(200, len(m), "received")
+			messageIncomingQueue <- msg
+		}
+	}
+
+	if l.Multiline != nil {
+		readMultiline(conn, l, messages, receive, queue)
+		return
+	}
+
+	respond := func(code, bytes int, info string) {
+		conn.Write(response(code, bytes, info))
+	}
 	for messages.Scan() {
 		m := messages.Text()
+		ok, open := receive(m, respond)
+		switch {
+		case !open:
+			return
+		case !ok:
+		case l.Replay && strings.HasPrefix(m, replayPrefix):
+			sourceStats.count(source, len(m), false)
+			code, info := currentReplayer().replay(m, client, l.ReplayDirect)
+			respond(code, len(m), info)
+		default:
+			queue(m, respond)
+		}
+	}
+	if errors.Is(messages.Err(), bufio.ErrTooLong) {
+		conn.Write(response(400, 0, "exceeds message size limit"))
+	}
+
+}
 
-		// Drop message and respond if the 'batchBuffer' is at capacity.
-		if len(messageIncomingQueue) >= options.queuecap {
-			conn.Write(response(503, 0, "message queue full"))
-			log.Printf("Queue capacity %d reached, dropping message\n", options.queuecap)
-		} else {
-			// Queue message and send response back to client.
-			switch {
-			case len(m) > maxMsgSize:
-				conn.Write(response(400, len(m), "exceeds message size limit"))
-				messageIncomingQueue <- m[:maxMsgSize]
-				conn.Close()
-			case m == "\n":
-				conn.Write(response(204, len(m), "received empty message"))
-			default:
-				conn.Write(response(200, len(m), "received"))
-				messageIncomingQueue <- m
+// readMultiline reads lines for a listener with multiline
+// events. Lines are answered in order once their event is
+// queued, each with the event's response; lines rejected
+// alone are answered with their own.
+func readMultiline(conn net.Conn, l *ListenerConfig, messages *bufio.Scanner, receive func(string, func(int, int, string)) (bool, bool), queue func(string, func(int, int, string))) {
+	// Lines are read separately so partial
+	// events can be flushed while waiting.
+	lines := make(chan string)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(lines)
+		for messages.Scan() {
+			select {
+			case lines <- messages.Text():
+			case <-done:
+				return
 			}
 		}
+	}()
+
+	// Responses held for the lines of the pending event,
+	// and any rejected among them. Code 0 takes the
+	// event's response.
+	type held struct {
+		code, bytes int
+		info        string
+	}
+	var pending []held
+	hold := func(code, bytes int, info string) {
+		if len(pending) == 0 {
+			conn.Write(response(code, bytes, info))
+			return
+		}
+		pending = append(pending, held{code, bytes, info})
+	}
+
+	agg := &aggregator{config: l.Multiline}
+	queueEvent := func(event string, ok bool) {
+		if !ok {
+			return
+		}
+		queue(event, func(code, _ int, info string) {
+			for _, h := range pending {
+				if h.code == 0 {
+					h.code, h.info = code, info
+				}
+				conn.Write(response(h.code, h.bytes, h.info))
+			}
+			pending = pending[:0]
+		})
 	}
 
+	var timeout <-chan time.Time
+	for {
+		select {
+		case m, ok := <-lines:
+			if !ok {
+				queueEvent(agg.flush())
+				if errors.Is(messages.Err(), bufio.ErrTooLong) {
+					conn.Write(response(400, 0, "exceeds message size limit"))
+				}
+				return
+			}
+			accepted, open := receive(m, hold)
+			if !open {
+				queueEvent(agg.flush())
+				return
+			}
+			if !accepted {
+				continue
+			}
+			queueEvent(agg.add(m))
+			pending = append(pending, held{bytes: len(m)})
+			timeout = time.After(l.Multiline.timeout)
+		case <-timeout:
+			queueEvent(agg.flush())
+			timeout = nil
+		}
+	}
 }
 
 // Generate response codes.
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// MultilineConfig joins the lines of an event, such as a
+// stack trace, into one message. Lines matching Start begin
+// an event and others continue it; or lines matching
+// Continuation, or indented with Indent, continue an event
+// and others begin one. An event is queued once its next
+// one begins, after Timeout (default 1s) without a line, or
+// before it would exceed MaxLines (default 500) or MaxBytes
+// (default the listener's MaxMessageSize).
+type MultilineConfig struct {
+	Start        string `json:"start"`
+	Continuation string `json:"continuation"`
+	Indent       bool   `json:"indent"`
+	Timeout      string `json:"timeout"`
+	MaxLines     int    `json:"max-lines"`
+	MaxBytes     int    `json:"max-bytes"`
+
+	start, continuation *regexp.Regexp
+	timeout             time.Duration
+}
+
+func (c *MultilineConfig) validate(maxMessageSize int) error {
+	var err error
+	switch {
+	case c.Start != "" && (c.Continuation != "" || c.Indent):
+		return errors.New("start can't be combined with continuation or indent")
+	case c.Start != "":
+		if c.start, err = regexp.Compile(c.Start); err != nil {
+			return fmt.Errorf("invalid start: %s", err)
+		}
+	case c.Continuation != "":
+		if c.continuation, err = regexp.Compile(c.Continuation); err != nil {
+			return fmt.Errorf("invalid continuation: %s", err)
+		}
+	case !c.Indent:
+		return errors.New("start, continuation or indent is required")
+	}
+
+	if c.Timeout == "" {
+		c.Timeout = "1s"
+	}
+	if c.timeout, err = time.ParseDuration(c.Timeout); err != nil || c.timeout <= 0 {
+		return fmt.Errorf("invalid timeout %q", c.Timeout)
+	}
+	switch {
+	case c.MaxLines < 0:
+		return errors.New("max-lines can't be negative")
+	case c.MaxLines == 0:
+		c.MaxLines = 500
+	}
+	switch {
+	case c.MaxBytes < 0:
+		return errors.New("max-bytes can't be negative")
+	case c.MaxBytes == 0:
+		c.MaxBytes = maxMessageSize
+	case c.MaxBytes > maxMessageSize:
+		return fmt.Errorf("max-bytes exceeds max-message-size of %d", maxMessageSize)
+	}
+
+	return nil
+}
+
+// continues reports whether line continues the event before it.
+func (c *MultilineConfig) continues(line string) bool {
+	if c.start != nil {
+		return !c.start.MatchString(line)
+	}
+	if c.Indent && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+		return true
+	}
+	return c.continuation != nil && c.continuation.MatchString(line)
+}
+
+// aggregator assembles the events of a connection.
+type aggregator struct {
+	config *MultilineConfig
+	event  strings.Builder
+	lines  int
+}
+
+// add adds a line, returning the event it completes, if any.
+func (a *aggregator) add(line string) (string, bool) {
+	c := a.config
+	if a.lines > 0 && c.continues(line) && a.lines < c.MaxLines && a.event.Len()+1+len(line) <= c.MaxBytes {
+		a.event.WriteByte('\n')
+		a.event.WriteString(line)
+		a.lines++
+		return "", false
+	}
+
+	event, ok := a.flush()
+	a.event.WriteString(line)
+	a.lines = 1
+	return event, ok
+}
+
+// flush returns the pending event, if any.
+func (a *aggregator) flush() (string, bool) {
+	if a.lines == 0 {
+		return "", false
+	}
+	event := a.event.String()
+	a.event.Reset()
+	a.lines = 0
+	return event, true
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// multilineConn connects to a multiline listener
+// joining indented lines, on route r.
+func multilineConn(t *testing.T, r *RouteConfig) (net.Conn, *bufio.Scanner) {
+	c := &Config{Routes: []*RouteConfig{r}}
+	withQueues(t, c)
+	l := &ListenerConfig{Name: "ml", MaxMessageSize: 1024, Multiline: &MultilineConfig{Indent: true, Timeout: "50ms"}}
+	if err := l.Multiline.validate(l.MaxMessageSize); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", listenTest(t, l))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	return conn, bufio.NewScanner(conn)
+}
+
+// expectResponses reads responses starting with want.
+func expectResponses(t *testing.T, responses *bufio.Scanner, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		if !responses.Scan() {
+			t.Fatalf("no response, want %q: %v", w, responses.Err())
+		}
+		if got := responses.Text(); !strings.HasPrefix(got, w) {
+			t.Fatalf("response %q, want %q", got, w)
+		}
+	}
+}
+
+// Lines are answered once their event is queued.
+func TestMultilineResponses(t *testing.T) {
+	conn, responses := multilineConn(t, &RouteConfig{Name: "r"})
+	conn.Write([]byte("first\n\tat a\n\tat b\nsecond\n"))
+	expectResponses(t, responses, "200|5|received", "200|5|received", "200|5|received")
+	if m := <-messageIncomingQueue; m.Body != "first\n\tat a\n\tat b" {
+		t.Fatalf("event %q", m.Body)
+	}
+
+	// The last event is queued on the timeout.
+	expectResponses(t, responses, "200|6|received")
+	if m := <-messageIncomingQueue; m.Body != "second" {
+		t.Fatalf("event %q", m.Body)
+	}
+}
+
+func TestMultilineSchemaViolation(t *testing.T) {
+	sc, err := compileSchema(t, `{"type": "object"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, responses := multilineConn(t, &RouteConfig{Name: "r", Listeners: []string{"ml"}, schema: sc})
+	conn.Write([]byte("{\n  \"a\": 1}\nnot json\n  still not\n"))
+	expectResponses(t, responses,
+		"200|1|received", "200|9|received",
+		"422|8|schema violation: invalid JSON", "422|11|schema violation: invalid JSON")
+	if n := len(messageIncomingQueue); n != 1 {
+		t.Fatalf("%d events queued, want 1", n)
+	}
+}
+
+func TestMultilineShed(t *testing.T) {
+	conn, responses := multilineConn(t, &RouteConfig{Name: "r"})
+	for len(messageIncomingQueue) < cap(messageIncomingQueue) {
+		messageIncomingQueue <- &Message{}
+	}
+	conn.Write([]byte("a\n b\n"))
+	expectResponses(t, responses, "503|1|message queue full", "503|2|message queue full")
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/jamiealquiza/ascender/outputs"
+	"github.com/jamiealquiza/ascender/outputs/amqp"
+	"github.com/jamiealquiza/ascender/outputs/console"
+	"github.com/jamiealquiza/ascender/outputs/elasticsearch"
+	"github.com/jamiealquiza/ascender/outputs/file"
+	"github.com/jamiealquiza/ascender/outputs/kafka"
+	"github.com/jamiealquiza/ascender/outputs/kinesis"
+	"github.com/jamiealquiza/ascender/outputs/mqtt"
+	"github.com/jamiealquiza/ascender/outputs/nats"
+	"github.com/jamiealquiza/ascender/outputs/redis"
+	"github.com/jamiealquiza/ascender/outputs/sns"
+	"github.com/jamiealquiza/ascender/outputs/sqs"
+	"github.com/jamiealquiza/ascender/outputs/webhook"
+)
+
+// outputType describes how to configure and start an output.
+type outputType struct {
+	// Batch size used if unset, and the most
+	// messages the destination accepts per batch (0 is unlimited).
+	defaultBatch, maxBatch int
+	// Largest message accepted in bytes (0 is unlimited).
+	maxSize int
+	// Whether the destination only takes text, and
+	// whether the output sets message attributes.
+	text, attributes bool
+	// Returns a new settings value to decode into,
+	// nil if the output takes no settings.
+	settings func() outputSettings
+	// Runs a worker that sends batches read from q.
+	start func(o *OutputConfig, q <-chan []*outputs.Message, s *outputStats)
+}
+
+var outputTypes = map[string]*outputType{
+	"amqp": {
+		defaultBatch: 100,
+		maxBatch:     1000,
+		settings:     func() outputSettings { return &amqp.Config{} },
+		start: func(o *OutputConfig, q <-chan []*outputs.Message, s *outputStats) {
+			amqp.Handler(o.settings.(*amqp.Config), q, s)
+		},
+	},
+	"console": {
+		defaultBatch: 1,
+		start: func(o *OutputConfig, q <-chan []*outputs.Message, s *outputStats) {
+			console.Handler(q)
+		},
+	},
+	"elasticsearch": {
+		defaultBatch: 500,
+		settings:     func() outputSettings { return &elasticsearch.Config{} },
+		start: func(o *OutputConfig, q <-chan []*outputs.Message, s *outputStats) {
+			elasticsearch.Handler(o.settings.(*elasticsearch.Config), q, s)
+		},
+	},
+	"file": {
+		defaultBatch: 100,
+		settings:     func() outputSettings { return &file.Config{} },
+		start: func(o *OutputConfig, q <-chan []*outputs.Message, s *outputStats) {
+			file.Handler(o.settings.(*file.Config), q, s)
+		},
+	},
+	"kafka": {
+		defaultBatch: 100,
+		settings:     func() outputSettings { return &kafka.Config{} },
+		start: func(o *OutputConfig, q <-chan []*outputs.Message, s *outputStats) {
+			kafka.Handler(o.settings.(*kafka.Config), q, s)
+		},
+	},
+	"kinesis": {
+		defaultBatch: 500,
+		maxBatch:     500,
+		maxSize:      1024 * 1024,
+		settings:     func() outputSettings { return &kinesis.Config{} },
+		start: func(o *OutputConfig, q <-chan []*outputs.Message, s *outputStats) {
+			kinesis.Handler(o.settings.(*kinesis.Config), q, s)
+		},
+	},
+	"mqtt": {
+		defaultBatch: 100,
+		settings:     func() outputSettings { return &mqtt.Config{} },
+		start: func(o *OutputConfig, q <-chan []*outputs.Message, s *outputStats) {
+			mqtt.Handler(o.settings.(*mqtt.Config), q, s)
+		},
+	},
+	"nats": {
+		defaultBatch: 100,
+		maxBatch:     1000,
+		settings:     func() outputSettings { return &nats.Config{} },
+		start: func(o *OutputConfig, q <-chan []*outputs.Message, s *outputStats) {
+			nats.Handler(o.settings.(*nats.Config), q, s)
+		},
+	},
+	"redis": {
+		defaultBatch: 100,
+		settings:     func() outputSettings { return &redis.Config{} },
+		start: func(o *OutputConfig, q <-chan []*outputs.Message, s *outputStats) {
+			redis.Handler(o.settings.(*redis.Config), q, s)
+		},
+	},
+	"sns": {
+		defaultBatch: 10,
+		maxBatch:     10,
+		maxSize:      256 * 1024,
+		text:         true,
+		attributes:   true,
+		settings:     func() outputSettings { return &sns.Config{} },
+		start: func(o *OutputConfig, q <-chan []*outputs.Message, s *outputStats) {
+			sns.Handler(o.settings.(*sns.Config), q, s)
+		},
+	},
+	"sqs": {
+		// AWS SQS max batch size is currently 10.
+		defaultBatch: 10,
+		maxBatch:     10,
+		maxSize:      256 * 1024,
+		text:         true,
+		attributes:   true,
+		settings:     func() outputSettings { return &sqs.Config{} },
+		start: func(o *OutputConfig, q <-chan []*outputs.Message, s *outputStats) {
+			sqs.Handler(o.settings.(*sqs.Config), q, s)
+		},
+	},
+	"webhook": {
+		defaultBatch: 100,
+		settings:     func() outputSettings { return &webhook.Config{} },
+		start: func(o *OutputConfig, q <-chan []*outputs.Message, s *outputStats) {
+			webhook.Handler(o.settings.(*webhook.Config), q, s)
+		},
+	},
+}
+
+// output is a running output: a batcher and its workers.
+type output struct {
+	config *OutputConfig
+	// Messages routed to this output.
+	incoming chan *outputs.Message
+	// Batches read by the output workers.
+	outgoing chan []*outputs.Message
+}
+
+// startOutput starts the batcher and workers for an output.
+func startOutput(c *OutputConfig, cfg *Config, s *Statser) *output {
+	o := &output{
+		config:   c,
+		incoming: make(chan *outputs.Message, cfg.QueueCap),
+		outgoing: make(chan []*outputs.Message, cfg.QueueCap),
+	}
+
+	go o.batcher()
+	stats := &outputStats{Statser: s, config: c}
+	var enc *encoder
+	if c.Encoding != nil {
+		enc = newEncoder(c.Encoding)
+	}
+	for i := 0; i < c.Workers; i++ {
+		var q <-chan []*outputs.Message = o.outgoing
+		if enc != nil || c.Chunk != nil {
+			q = prepareBatches(c, enc, q, stats)
+		}
+		go outputTypes[c.Type].start(c, q, stats)
+	}
+
+	return o
+}
+
+// stop closes the output to new messages. Queued messages
+// are still sent, after which the workers exit.
+func (o *output) stop() {
+	close(o.incoming)
+}
+
+// Receives messages on incoming, batches into message groups
+// and flushes into the outgoing channel when the batch hits
+// either the configured batch size or has lingered since its
+// first message arrived. With packing, messages are packed
+// first and a partial pack is sent when the batch lingers out.
+func (o *output) batcher() {
+	linger := o.config.maxLinger
+	if o.config.AdaptiveLinger {
+		linger = o.config.minLinger
+	}
+	// Nil while there's no partial batch.
+	var flushTimeout <-chan time.Time
+	timer := time.NewTimer(linger)
+	timer.Stop()
+	var pk *packer
+	if o.config.Pack != nil {
+		pk = &packer{config: o.config.Pack}
+	}
+
+	messages := []*outputs.Message{}
+	// flush sends the batch, with the partial pack if closePack.
+	flush := func(closePack bool) {
+		if !timer.Stop() && flushTimeout != nil {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		flushTimeout = nil
+		if closePack && pk.pending() {
+			messages = append(messages, pk.close())
+		}
+		o.outgoing <- messages
+		messages = []*outputs.Message{}
+		if o.config.AdaptiveLinger {
+			linger = o.adaptLinger(linger)
+		}
+	}
+
+	for {
+		select {
+		case <-flushTimeout:
+			// We hit the flush timeout, load the current batch.
+			flush(true)
+		case msg, ok := <-o.incoming:
+			if !ok {
+				// Output stopped, flush the last batch and
+				// let the workers drain the outgoing queue.
+				if len(messages) > 0 || pk.pending() {
+					flush(true)
+				}
+				close(o.outgoing)
+				return
+			}
+			if pk != nil {
+				// Batch the pack once full.
+				msg = pk.add(msg)
+			}
+			if msg != nil {
+				messages = append(messages, msg)
+			}
+			// If this puts us at the batch size threshold, enqueue
+			// into the outgoing queue.
+			if len(messages) >= o.config.BatchSize {
+				flush(false)
+			}
+			if flushTimeout == nil && (len(messages) > 0 || pk.pending()) {
+				timer.Reset(linger)
+				flushTimeout = timer.C
+			}
+		}
+	}
+}
+
+// adaptLinger shortens the linger time while the output keeps up
+// and lengthens it while messages queue behind the batcher.
+func (o *output) adaptLinger(linger time.Duration) time.Duration {
+	if len(o.incoming) == 0 {
+		linger /= 2
+	} else {
+		linger *= 2
+	}
+
+	switch {
+	case linger < o.config.minLinger:
+		return o.config.minLinger
+	case linger > o.config.maxLinger:
+		return o.config.maxLinger
+	}
+	return linger
+}
+
+// router maps messages to the outputs of their route.
+type router struct {
+	pipeline *pipeline
+	routes   []*route
+	// Outputs by name, for dead letters.
+	outputs map[string]*output
+}
+
+type route struct {
+	config    *RouteConfig
+	listeners map[string]bool
+	outputs   []*output
+}
+
+func newRouter(c *Config, outputs map[string]*output) *router {
+	r := &router{pipeline: newPipeline(c), outputs: outputs}
+	for _, rc := range c.Routes {
+		rt := &route{config: rc, listeners: map[string]bool{}}
+		for _, l := range rc.Listeners {
+			rt.listeners[l] = true
+		}
+		for _, name := range rc.Outputs {
+			rt.outputs = append(rt.outputs, outputs[name])
+		}
+		r.routes = append(r.routes, rt)
+	}
+
+	return r
+}
+
+// match returns the first route for m that its client
+// is allowed to use, or nil if none match. Routes picked
+// by the pipeline are taken whatever their listeners.
+func (r *router) match(m *Message) *route {
+	for _, rt := range r.routes {
+		if m.Route != "" {
+			if rt.config.Name == m.Route && m.Client.allowsRoute(rt.config.Name) {
+				return rt
+			}
+			continue
+		}
+		if len(rt.listeners) > 0 && !rt.listeners[m.Listener] {
+			continue
+		}
+		if m.Client.allowsRoute(rt.config.Name) {
+			return rt
+		}
+	}
+
+	return nil
+}
+
+// Receives messages on messageIncomingQueue, runs them through
+// the pipeline and hands each to the outputs of its route,
+// and dead letters on
+// deadLetterQueue to their outputs. Messages the pipeline
+// held back are flushed every second. Routers sent over
+// routerUpdates replace r, even while an output's queue is
+// full; once the send completes, no further messages are
+// handed to outputs only in the old r.
+func messageHandler(r *router) {
+	h := &handler{r: r}
+	flush := time.NewTicker(time.Second)
+	for {
+		select {
+		case nr := <-routerUpdates:
+			h.update(nr)
+		case now := <-flush.C:
+			for _, m := range h.r.pipeline.flush(now) {
+				h.route(m)
+			}
+		case d := <-deadLetterQueue:
+			o := h.r.outputs[d.output]
+			if o == nil {
+				log.Printf("Dead-letter output %s not running, dropping message\n", d.output)
+				continue
+			}
+			h.deliver(o, d.message)
+		case m := <-messageIncomingQueue:
+			for _, m := range h.r.pipeline.run(m) {
+				h.route(m)
+			}
+		}
+		h.routeHeld()
+	}
+}
+
+// handler is the state of messageHandler.
+type handler struct {
+	r *router
+	// Messages a replaced pipeline held back, routed
+	// once those in hand are delivered.
+	held []*Message
+}
+
+// update replaces the router with nr.
+func (h *handler) update(nr *router) {
+	h.held = append(h.held, h.r.pipeline.flush(time.Time{})...)
+	h.r = nr
+}
+
+func (h *handler) routeHeld() {
+	for len(h.held) > 0 {
+		m := h.held[0]
+		h.held = h.held[1:]
+		h.route(m)
+	}
+}
+
+// route hands m to the outputs of its route, or to
+// the output a replayed dead letter names.
+func (h *handler) route(m *Message) {
+	if m.Output != "" {
+		o := h.r.outputs[m.Output]
+		if o == nil {
+			log.Printf("Output %s removed, dropping replayed message\n", m.Output)
+			return
+		}
+		h.deliver(o, m.output(m.Route))
+		return
+	}
+	rt := h.r.match(m)
+	if rt == nil {
+		log.Printf("No route for message from listener %s, dropping\n", m.Listener)
+		return
+	}
+	if s := rt.config.sampler; s != nil {
+		e := &event{Message: m}
+		if keep, _ := s.process(e); !keep {
+			return
+		}
+		e.body()
+	}
+	out := m.output(rt.config.Name)
+	for _, o := range rt.outputs {
+		if m.Client.allowsOutput(o.config.Name) {
+			h.deliver(o, out)
+		}
+	}
+}
+
+// deliver hands m to output o, taking router updates while
+// o's queue is full so a stuck output can't hold up reloads.
+// Outputs a reload replaces are stopped once the update is
+// taken, so m goes to the output now running under o's name,
+// and is dropped if there's none.
+func (h *handler) deliver(o *output, m *outputs.Message) {
+	for {
+		if cur := h.r.outputs[o.config.Name]; cur != o {
+			if cur == nil {
+				log.Printf("Output %s removed, dropping message\n", o.config.Name)
+				return
+			}
+			o = cur
+		}
+		select {
+		case o.incoming <- m:
+			return
+		case nr := <-routerUpdates:
+			h.update(nr)
+		}
+	}
+}
@@ -0,0 +1,452 @@
+package amqp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxFrame is the largest frame size negotiated.
+const maxFrame = 128 * 1024
+
+// confirm is a publisher confirm (basic.ack or basic.nack).
+type confirm struct {
+	channel  uint16
+	tag      uint64
+	multiple bool
+	ack      bool
+}
+
+// conn is an AMQP connection. Writes are buffered;
+// a reader goroutine delivers confirms, channel closes
+// and method replies, and heartbeats are sent if
+// negotiated.
+type conn struct {
+	nc         net.Conn
+	w          *bufio.Writer
+	mu         sync.Mutex
+	frameMax   int
+	channelMax uint16
+	heartbeat  time.Duration
+	timeout    time.Duration
+	// Last channel id opened.
+	lastChannel uint16
+
+	rpc      chan frame
+	confirms chan confirm
+	// Ids of channels closed by the server.
+	closed   chan uint16
+	done     chan struct{}
+	errMu    sync.Mutex
+	err      error
+	chanErrs map[uint16]error
+}
+
+// dial connects, authenticates and opens the vhost on a server.
+func dial(c *Config, s *server) (*conn, error) {
+	nc, err := net.DialTimeout("tcp", s.addr, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	nc.SetDeadline(time.Now().Add(c.timeout))
+	if s.tls {
+		tc := tls.Client(nc, &tls.Config{ServerName: s.host})
+		if err := tc.Handshake(); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		nc = tc
+	}
+
+	cn := &conn{
+		nc:       nc,
+		w:        bufio.NewWriter(nc),
+		timeout:  c.timeout,
+		rpc:      make(chan frame, 1),
+		confirms: make(chan confirm, 1024),
+		closed:   make(chan uint16, 16),
+		done:     make(chan struct{}),
+		chanErrs: map[uint16]error{},
+	}
+	r := bufio.NewReader(nc)
+	if err := cn.handshake(c, s, r); err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	nc.SetDeadline(time.Time{})
+	go cn.read(r)
+	if cn.heartbeat > 0 {
+		go cn.heartbeats()
+	}
+
+	return cn, nil
+}
+
+// handshake runs the connection start, tune and open exchange.
+func (cn *conn) handshake(c *Config, s *server, r *bufio.Reader) error {
+	if _, err := cn.nc.Write(protocolHeader); err != nil {
+		return err
+	}
+
+	d, err := expect(r, connectionStart)
+	if err != nil {
+		return err
+	}
+	d.octet() // Version major.
+	d.octet() // Version minor.
+	d.skipTable()
+	mechanisms := strings.Fields(d.longstr())
+	if d.err != nil {
+		return fmt.Errorf("connection start: %s", d.err)
+	}
+	plain := false
+	for _, m := range mechanisms {
+		plain = plain || m == "PLAIN"
+	}
+	if !plain {
+		return fmt.Errorf("server doesn't support PLAIN authentication (offers %v)", mechanisms)
+	}
+
+	e := method(classConnection, connectionStartOk)
+	e.table(map[string]interface{}{
+		"product":         "ascender",
+		"connection_name": c.Name,
+		"capabilities": map[string]interface{}{
+			"publisher_confirms": true,
+			"connection.blocked": true,
+		},
+	})
+	e.shortstr("PLAIN")
+	e.longstr("\x00" + s.user + "\x00" + s.password)
+	e.shortstr("en_US")
+	if err := cn.send(frameMethod, 0, e.b); err != nil {
+		return err
+	}
+
+	if d, err = expect(r, connectionTune); err != nil {
+		return err
+	}
+	channelMax, frameMax, heartbeat := d.short(), d.long(), d.short()
+	if d.err != nil {
+		return fmt.Errorf("connection tune: %s", d.err)
+	}
+
+	// Take the lower of each limit, 0 meaning no limit.
+	cn.channelMax = channelMax
+	if cn.channelMax == 0 {
+		cn.channelMax = 2047
+	}
+	cn.frameMax = maxFrame
+	if frameMax != 0 && frameMax < maxFrame {
+		cn.frameMax = int(frameMax)
+	}
+	hb := uint16(c.heartbeat / time.Second)
+	if heartbeat != 0 && heartbeat < hb {
+		hb = heartbeat
+	}
+	cn.heartbeat = time.Duration(hb) * time.Second
+
+	e = method(classConnection, connectionTuneOk)
+	e.short(cn.channelMax)
+	e.long(uint32(cn.frameMax))
+	e.short(hb)
+	cn.writeFrame(frameMethod, 0, e.b)
+	e = method(classConnection, connectionOpen)
+	e.shortstr(s.vhost)
+	e.shortstr("") // Reserved.
+	e.octet(0)     // Reserved.
+	if err := cn.send(frameMethod, 0, e.b); err != nil {
+		return err
+	}
+
+	_, err = expect(r, connectionOpenOk)
+	return err
+}
+
+// expect reads the next connection method during
+// the handshake, failing if it isn't method id.
+func expect(r *bufio.Reader, id uint16) (*decoder, error) {
+	f, err := readFrame(r)
+	if err != nil {
+		if err == io.EOF {
+			// Servers close the socket on some failures,
+			// authentication among them.
+			err = errors.New("connection closed by server during handshake")
+		}
+		return nil, err
+	}
+	if f.typ != frameMethod {
+		return nil, fmt.Errorf("unexpected frame type %d during handshake", f.typ)
+	}
+	class, mid, d := f.method()
+	if class == classConnection && mid == connectionClose {
+		return nil, closeError("connection", d)
+	}
+	if class != classConnection || mid != id {
+		return nil, fmt.Errorf("unexpected method %d.%d during handshake", class, mid)
+	}
+	return d, nil
+}
+
+// readFrame reads a frame:
+// type (1), channel (2), size (4), payload, frame end (1).
+func readFrame(r *bufio.Reader) (frame, error) {
+	var h [7]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return frame{}, err
+	}
+	size := binary.BigEndian.Uint32(h[3:])
+	if size > maxFrame {
+		return frame{}, fmt.Errorf("frame of %d bytes exceeds frame max", size)
+	}
+
+	buf := make([]byte, size+1)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return frame{}, err
+	}
+	if buf[size] != frameEnd {
+		return frame{}, errors.New("malformed frame")
+	}
+
+	return frame{typ: h[0], channel: binary.BigEndian.Uint16(h[1:]), payload: buf[:size]}, nil
+}
+
+// writeFrame buffers a frame. Callers hold mu once
+// the connection is shared.
+func (cn *conn) writeFrame(typ uint8, channel uint16, payload []byte) {
+	var h [7]byte
+	h[0] = typ
+	binary.BigEndian.PutUint16(h[1:], channel)
+	binary.BigEndian.PutUint32(h[3:], uint32(len(payload)))
+	cn.w.Write(h[:])
+	cn.w.Write(payload)
+	cn.w.WriteByte(frameEnd)
+}
+
+// send writes a frame and flushes.
+func (cn *conn) send(typ uint8, channel uint16, payload []byte) error {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	cn.writeFrame(typ, channel, payload)
+	return cn.w.Flush()
+}
+
+func (cn *conn) fail(err error) {
+	cn.errMu.Lock()
+	if cn.err == nil {
+		cn.err = err
+		close(cn.done)
+	}
+	cn.errMu.Unlock()
+	cn.nc.Close()
+}
+
+// failed returns the error that broke the connection, if any.
+func (cn *conn) failed() error {
+	cn.errMu.Lock()
+	defer cn.errMu.Unlock()
+	return cn.err
+}
+
+// channelErr returns the error a channel was closed with, if any.
+func (cn *conn) channelErr(channel uint16) error {
+	cn.errMu.Lock()
+	defer cn.errMu.Unlock()
+	return cn.chanErrs[channel]
+}
+
+// close closes the connection, telling the server first.
+func (cn *conn) close() {
+	if cn.failed() == nil {
+		e := method(classConnection, connectionClose)
+		e.short(200)
+		e.shortstr("shutdown")
+		e.short(0)
+		e.short(0)
+		cn.send(frameMethod, 0, e.b)
+	}
+	cn.fail(errors.New("connection closed"))
+}
+
+// read handles server frames until the connection fails.
+func (cn *conn) read(r *bufio.Reader) {
+	for {
+		if cn.heartbeat > 0 {
+			cn.nc.SetReadDeadline(time.Now().Add(2 * cn.heartbeat))
+		}
+		f, err := readFrame(r)
+		if err != nil {
+			cn.fail(err)
+			return
+		}
+		if f.typ != frameMethod {
+			// Heartbeats, and content of returned messages.
+			continue
+		}
+
+		class, id, d := f.method()
+		switch {
+		case class == classConnection && id == connectionClose:
+			err := closeError("connection", d)
+			cn.send(frameMethod, 0, method(classConnection, connectionCloseOk).b)
+			cn.fail(err)
+			return
+		case class == classConnection && id == connectionBlocked:
+			log.Printf("AMQP server blocked publishing: %s\n", d.shortstr())
+		case class == classConnection && id == connectionUnblocked:
+			log.Println("AMQP server unblocked publishing")
+		case class == classChannel && id == channelClose:
+			err := closeError(fmt.Sprintf("channel %d", f.channel), d)
+			cn.send(frameMethod, f.channel, method(classChannel, channelCloseOk).b)
+			cn.errMu.Lock()
+			cn.chanErrs[f.channel] = err
+			cn.errMu.Unlock()
+			select {
+			case cn.closed <- f.channel:
+			default:
+			}
+		case class == classBasic && (id == basicAck || id == basicNack):
+			c := confirm{channel: f.channel, tag: d.longlong(), multiple: d.octet()&1 != 0, ack: id == basicAck}
+			select {
+			case cn.confirms <- c:
+			default:
+				// Nobody waiting for this many confirms.
+			}
+		default:
+			select {
+			case cn.rpc <- f:
+			default:
+			}
+		}
+	}
+}
+
+// heartbeats sends heartbeat frames at half the
+// negotiated interval until the connection fails.
+func (cn *conn) heartbeats() {
+	t := time.NewTicker(cn.heartbeat / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-cn.done:
+			return
+		case <-t.C:
+			if err := cn.send(frameHeartbeat, 0, nil); err != nil {
+				cn.fail(err)
+				return
+			}
+		}
+	}
+}
+
+// call sends a method on a channel and waits for its reply.
+func (cn *conn) call(channel uint16, payload []byte, class, id uint16) error {
+	if err := cn.send(frameMethod, channel, payload); err != nil {
+		cn.fail(err)
+		return err
+	}
+
+	timeout := time.After(cn.timeout)
+	for {
+		select {
+		case f := <-cn.rpc:
+			if f.channel != channel {
+				continue
+			}
+			if c, i, _ := f.method(); c != class || i != id {
+				return fmt.Errorf("unexpected method %d.%d", c, i)
+			}
+			return nil
+		case ch := <-cn.closed:
+			if ch == channel {
+				return cn.channelErr(ch)
+			}
+		case <-cn.done:
+			return cn.failed()
+		case <-timeout:
+			err := errors.New("timed out waiting for server")
+			cn.fail(err)
+			return err
+		}
+	}
+}
+
+// openChannel opens a new channel in confirm mode.
+func (cn *conn) openChannel() (uint16, error) {
+	cn.lastChannel++
+	if cn.lastChannel > cn.channelMax || cn.lastChannel == 0 {
+		cn.lastChannel = 1
+	}
+	ch := cn.lastChannel
+
+	e := method(classChannel, channelOpen)
+	e.shortstr("") // Reserved.
+	if err := cn.call(ch, e.b, classChannel, channelOpenOk); err != nil {
+		return 0, fmt.Errorf("channel open: %s", err)
+	}
+	e = method(classConfirm, confirmSelect)
+	e.octet(0) // No wait.
+	if err := cn.call(ch, e.b, classConfirm, confirmSelectOk); err != nil {
+		return 0, fmt.Errorf("confirm select: %s", err)
+	}
+
+	return ch, nil
+}
+
+// publish buffers a basic.publish with its content
+// header and body frames. Call flush to send.
+func (cn *conn) publish(channel uint16, exchange, key, contentType string, mode uint8, body []byte) {
+	m := method(classBasic, basicPublish)
+	m.short(0) // Reserved.
+	m.shortstr(exchange)
+	m.shortstr(key)
+	m.octet(0) // Not mandatory or immediate.
+
+	h := &encoder{}
+	h.short(classBasic)
+	h.short(0) // Weight.
+	h.longlong(uint64(len(body)))
+	flags := uint16(propDeliveryMode)
+	if contentType != "" {
+		flags |= propContentType
+	}
+	h.short(flags)
+	if contentType != "" {
+		h.shortstr(contentType)
+	}
+	h.octet(mode)
+
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	cn.writeFrame(frameMethod, channel, m.b)
+	cn.writeFrame(frameHeader, channel, h.b)
+	// Frames carry 8 bytes of overhead.
+	for chunk := cn.frameMax - 8; len(body) > 0; {
+		n := len(body)
+		if n > chunk {
+			n = chunk
+		}
+		cn.writeFrame(frameBody, channel, body[:n])
+		body = body[n:]
+	}
+}
+
+// flush sends buffered frames.
+func (cn *conn) flush() error {
+	cn.mu.Lock()
+	err := cn.w.Flush()
+	cn.mu.Unlock()
+	if err != nil {
+		cn.fail(err)
+	}
+	return err
+}
@@ -0,0 +1,429 @@
+package amqp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jamiealquiza/ascender/outputs"
+	"github.com/jamiealquiza/ascender/outputs/outputstest"
+)
+
+// publish is a message received by a fake broker.
+type publish struct {
+	channel       uint16
+	exchange, key string
+	contentType   string
+	mode          uint8
+	body          string
+	// Body frames it came in.
+	frames int
+}
+
+// What a fake broker does with a publish.
+const (
+	ackPublish = iota
+	nackPublish
+	ignorePublish
+	closeChannel
+	dropConnection
+)
+
+// broker is a fake AMQP 0-9-1 broker. handle says what to do
+// with each publish; acks are sent with the multiple flag if
+// multiple is set. With refuse, the socket is closed after
+// authentication, as RabbitMQ does for bad credentials.
+type broker struct {
+	addr     string
+	frameMax uint32
+	multiple bool
+	refuse   bool
+	handle   func(p publish) int
+
+	mu       sync.Mutex
+	pubs     []publish
+	logins   []string
+	channels int
+	conns    int
+}
+
+func newBroker(t *testing.T, b *broker) *broker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	b.addr = l.Addr().String()
+	if b.handle == nil {
+		b.handle = func(publish) int { return ackPublish }
+	}
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			b.mu.Lock()
+			b.conns++
+			b.mu.Unlock()
+			go b.serve(nc)
+		}
+	}()
+	return b
+}
+
+// send writes a frame.
+func send(nc net.Conn, typ uint8, channel uint16, payload []byte) {
+	h := make([]byte, 7, 8+len(payload))
+	h[0] = typ
+	binary.BigEndian.PutUint16(h[1:], channel)
+	binary.BigEndian.PutUint32(h[3:], uint32(len(payload)))
+	nc.Write(append(append(h, payload...), frameEnd))
+}
+
+func (b *broker) serve(nc net.Conn) {
+	defer nc.Close()
+	r := bufio.NewReader(nc)
+	header := make([]byte, 8)
+	if _, err := r.Read(header); err != nil || string(header) != string(protocolHeader) {
+		return
+	}
+
+	// Handshake.
+	e := method(classConnection, connectionStart)
+	e.octet(0)
+	e.octet(9)
+	e.table(nil)
+	e.longstr("AMQPLAIN PLAIN")
+	e.longstr("en_US")
+	send(nc, frameMethod, 0, e.b)
+	f, err := readFrame(r)
+	if err != nil {
+		return
+	}
+	_, _, d := f.method()
+	d.skipTable()
+	d.shortstr()
+	login := strings.Replace(strings.TrimPrefix(d.longstr(), "\x00"), "\x00", ":", 1)
+	if b.refuse {
+		return
+	}
+	e = method(classConnection, connectionTune)
+	e.short(0)
+	e.long(b.frameMax)
+	e.short(0)
+	send(nc, frameMethod, 0, e.b)
+	if _, err := readFrame(r); err != nil {
+		return
+	}
+	if f, err = readFrame(r); err != nil {
+		return
+	}
+	_, _, d = f.method()
+	b.mu.Lock()
+	b.logins = append(b.logins, login+"@"+d.shortstr())
+	b.mu.Unlock()
+	e = method(classConnection, connectionOpenOk)
+	e.shortstr("")
+	send(nc, frameMethod, 0, e.b)
+
+	// Delivery tags by channel.
+	tags := map[uint16]uint64{}
+	for {
+		f, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		if f.typ != frameMethod {
+			continue
+		}
+		class, id, d := f.method()
+		switch {
+		case class == classConnection && id == connectionClose:
+			send(nc, frameMethod, 0, method(classConnection, connectionCloseOk).b)
+			return
+		case class == classChannel && id == channelOpen:
+			b.mu.Lock()
+			b.channels++
+			b.mu.Unlock()
+			e := method(classChannel, channelOpenOk)
+			e.longstr("")
+			send(nc, frameMethod, f.channel, e.b)
+		case class == classConfirm && id == confirmSelect:
+			tags[f.channel] = 0
+			send(nc, frameMethod, f.channel, method(classConfirm, confirmSelectOk).b)
+		case class == classBasic && id == basicPublish:
+			p := publish{channel: f.channel}
+			d.short()
+			p.exchange, p.key = d.shortstr(), d.shortstr()
+
+			hf, err := readFrame(r)
+			if err != nil {
+				return
+			}
+			h := &decoder{b: hf.payload}
+			h.short()
+			h.short()
+			size := h.longlong()
+			if flags := h.short(); flags&propContentType != 0 {
+				p.contentType = h.shortstr()
+			}
+			p.mode = h.octet()
+			for uint64(len(p.body)) < size {
+				bf, err := readFrame(r)
+				if err != nil {
+					return
+				}
+				p.body += string(bf.payload)
+				p.frames++
+			}
+
+			action := b.handle(p)
+			if action == dropConnection {
+				return
+			}
+			b.mu.Lock()
+			b.pubs = append(b.pubs, p)
+			b.mu.Unlock()
+			tags[f.channel]++
+			switch action {
+			case ackPublish, nackPublish:
+				id := uint16(basicAck)
+				if action == nackPublish {
+					id = basicNack
+				}
+				e := method(classBasic, id)
+				e.longlong(tags[f.channel])
+				if b.multiple {
+					e.octet(1)
+				} else {
+					e.octet(0)
+				}
+				send(nc, frameMethod, f.channel, e.b)
+			case closeChannel:
+				e := method(classChannel, channelClose)
+				e.short(404)
+				e.shortstr("NOT_FOUND - no exchange '" + p.exchange + "'")
+				e.short(classBasic)
+				e.short(basicPublish)
+				send(nc, frameMethod, f.channel, e.b)
+			}
+		}
+	}
+}
+
+// published returns the messages published, and the numbers
+// of connections and channels opened.
+func (b *broker) published() ([]publish, int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]publish{}, b.pubs...), b.conns, b.channels
+}
+
+func bodies(pubs []publish) string {
+	var s []string
+	for _, p := range pubs {
+		s = append(s, p.body)
+	}
+	return strings.Join(s, ",")
+}
+
+func newPublisher(t *testing.T, c *Config) (*publisher, *outputstest.Stats) {
+	c.RetryBackoff, c.MaxBackoff = "1ms", "1ms"
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s := &outputstest.Stats{}
+	p := &publisher{config: c, stats: s}
+	t.Cleanup(func() {
+		if p.conn != nil {
+			p.conn.close()
+		}
+	})
+	return p, s
+}
+
+func routed(route string, bodies ...string) []*outputs.Message {
+	ms := outputstest.Messages(bodies...)
+	for _, m := range ms {
+		m.Route = route
+	}
+	return ms
+}
+
+func TestPublishConfirmed(t *testing.T) {
+	// Only every other publish is acked, with the multiple
+	// flag confirming the one before it too.
+	var mu sync.Mutex
+	n := 0
+	b := newBroker(t, &broker{frameMax: 64, multiple: true, handle: func(publish) int {
+		mu.Lock()
+		defer mu.Unlock()
+		if n++; n%2 == 1 {
+			return ignorePublish
+		}
+		return ackPublish
+	}})
+	p, s := newPublisher(t, &Config{
+		URLs:        []string{"amqp://u:p@" + b.addr + "/prod"},
+		Exchange:    "logs",
+		RoutingKey:  "logs.{:route}",
+		ContentType: "application/json",
+	})
+
+	long := strings.Repeat("x", 200)
+	batch := append(routed("a.b", "1", long), routed("c", "3", "4")...)
+	if sent, err := p.send(batch); sent != 4 || err != nil {
+		t.Fatalf("sent %d: %v", sent, err)
+	}
+	pubs, _, _ := b.published()
+	if bodies(pubs) != "1,"+long+",3,4" {
+		t.Fatalf("published %s", bodies(pubs))
+	}
+	// Routing key words from messages can't add words.
+	if pubs[0].exchange != "logs" || pubs[0].key != "logs.a_b" || pubs[3].key != "logs.c" ||
+		pubs[0].contentType != "application/json" || pubs[0].mode != 2 {
+		t.Errorf("publish %+v", pubs[0])
+	}
+	// Bodies are split to fit the frame max.
+	if pubs[1].frames != 4 {
+		t.Errorf("%d body frames, want 4", pubs[1].frames)
+	}
+	if len(b.logins) != 1 || b.logins[0] != "u:p@prod" {
+		t.Errorf("logins %q", b.logins)
+	}
+	if len(s.Dropped()) != 0 {
+		t.Errorf("failed %v", outputs.Bodies(s.Dropped()))
+	}
+}
+
+// Nacked messages, and those published when the server
+// closes the channel, are retried; a new channel is opened
+// on the same connection.
+func TestNacksAndChannelClose(t *testing.T) {
+	var mu sync.Mutex
+	first := map[string]bool{}
+	b := newBroker(t, &broker{handle: func(p publish) int {
+		mu.Lock()
+		defer mu.Unlock()
+		if first[p.body] {
+			return ackPublish
+		}
+		first[p.body] = true
+		switch p.body {
+		case "nacked":
+			return nackPublish
+		case "closed":
+			return closeChannel
+		}
+		return ackPublish
+	}})
+	p, s := newPublisher(t, &Config{URLs: []string{"amqp://" + b.addr}})
+
+	if sent, err := p.send(outputstest.Messages("ok", "nacked")); sent != 2 || err != nil {
+		t.Fatalf("nack: sent %d: %v", sent, err)
+	}
+	if sent, err := p.send(outputstest.Messages("closed")); sent != 1 || err != nil {
+		t.Fatalf("channel close: sent %d: %v", sent, err)
+	}
+	pubs, conns, channels := b.published()
+	if bodies(pubs) != "ok,nacked,nacked,closed,closed" || conns != 1 || channels != 2 {
+		t.Errorf("published %s over %d connections, %d channels", bodies(pubs), conns, channels)
+	}
+	if pubs[4].channel == pubs[3].channel {
+		t.Error("retried on the closed channel")
+	}
+	if len(s.Dropped()) != 0 {
+		t.Errorf("failed %v", outputs.Bodies(s.Dropped()))
+	}
+}
+
+// Unconfirmed messages are published again over a new
+// connection, trying the next server.
+func TestReconnect(t *testing.T) {
+	var mu sync.Mutex
+	dropped := false
+	b := newBroker(t, &broker{handle: func(p publish) int {
+		mu.Lock()
+		defer mu.Unlock()
+		if p.body == "2" && !dropped {
+			dropped = true
+			return dropConnection
+		}
+		return ackPublish
+	}})
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down.Close()
+	p, s := newPublisher(t, &Config{URLs: []string{"amqp://" + b.addr, "amqp://" + down.Addr().String()}})
+
+	if sent, err := p.send(outputstest.Messages("1", "2", "3")); sent < 1 || err != nil {
+		t.Fatalf("sent %d: %v", sent, err)
+	}
+	pubs, conns, _ := b.published()
+	if conns != 2 {
+		t.Errorf("%d connections, want 2", conns)
+	}
+	got := map[string]int{}
+	for _, pub := range pubs {
+		got[pub.body]++
+	}
+	// 1 may be confirmed before the connection drops.
+	if got["2"] != 1 || got["3"] != 1 || got["1"] < 1 {
+		t.Errorf("published %s", bodies(pubs))
+	}
+	if len(s.Dropped()) != 0 {
+		t.Errorf("failed %v", outputs.Bodies(s.Dropped()))
+	}
+}
+
+// Messages not confirmed in time are retried, and
+// failed once retries run out.
+func TestConfirmTimeout(t *testing.T) {
+	b := newBroker(t, &broker{handle: func(publish) int { return ignorePublish }})
+	retries := 1
+	p, s := newPublisher(t, &Config{URLs: []string{"amqp://" + b.addr}, Timeout: "50ms", Retries: &retries})
+	if sent, err := p.send(outputstest.Messages("1", "2")); sent != 0 || err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("sent %d: %v", sent, err)
+	}
+	if n := len(s.Dropped()); n != 2 {
+		t.Errorf("%d failed, want 2", n)
+	}
+	if pubs, _, _ := b.published(); len(pubs) != 4 {
+		t.Errorf("%d published, want 4", len(pubs))
+	}
+}
+
+func TestAuthFailure(t *testing.T) {
+	b := newBroker(t, &broker{refuse: true})
+	retries := 1
+	p, s := newPublisher(t, &Config{URLs: []string{"amqp://bad:creds@" + b.addr}, Retries: &retries})
+	if sent, err := p.send(outputstest.Messages("1")); sent != 0 || err == nil || !strings.Contains(err.Error(), "during handshake") {
+		t.Fatalf("sent %d: %v", sent, err)
+	}
+	if n := len(s.Dropped()); n != 1 {
+		t.Errorf("%d failed, want 1", n)
+	}
+	if _, conns, _ := b.published(); conns != 2 {
+		t.Errorf("%d connections, want 2", conns)
+	}
+}
+
+// Messages whose routing key is too long are failed
+// at once, without holding up the rest.
+func TestRoutingKeyTooLong(t *testing.T) {
+	b := newBroker(t, &broker{})
+	p, s := newPublisher(t, &Config{URLs: []string{"amqp://" + b.addr}, RoutingKey: "{:route}"})
+	batch := append(routed(strings.Repeat("k", 256), "long"), routed("k", "ok")...)
+	if sent, err := p.send(batch); sent != 1 || err == nil {
+		t.Fatalf("sent %d: %v", sent, err)
+	}
+	if d := s.Dropped(); len(d) != 1 || d[0].Body != "long" {
+		t.Errorf("failed %v", outputs.Bodies(d))
+	}
+}
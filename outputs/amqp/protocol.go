@@ -0,0 +1,210 @@
+package amqp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Frame types.
+const (
+	frameMethod    = 1
+	frameHeader    = 2
+	frameBody      = 3
+	frameHeartbeat = 8
+	frameEnd       = 0xce
+)
+
+// Class and method ids used.
+const (
+	classConnection = 10
+	classChannel    = 20
+	classBasic      = 60
+	classConfirm    = 85
+
+	connectionStart     = 10
+	connectionStartOk   = 11
+	connectionTune      = 30
+	connectionTuneOk    = 31
+	connectionOpen      = 40
+	connectionOpenOk    = 41
+	connectionClose     = 50
+	connectionCloseOk   = 51
+	connectionBlocked   = 60
+	connectionUnblocked = 61
+
+	channelOpen    = 10
+	channelOpenOk  = 11
+	channelClose   = 40
+	channelCloseOk = 41
+
+	basicPublish = 40
+	basicAck     = 80
+	basicNack    = 120
+
+	confirmSelect   = 10
+	confirmSelectOk = 11
+)
+
+// Basic content properties set by the publisher.
+const (
+	propContentType  = 0x8000
+	propDeliveryMode = 0x1000
+)
+
+var protocolHeader = []byte("AMQP\x00\x00\x09\x01")
+
+// encoder appends AMQP primitives to a buffer.
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) octet(v uint8) {
+	e.b = append(e.b, v)
+}
+
+func (e *encoder) short(v uint16) {
+	e.b = binary.BigEndian.AppendUint16(e.b, v)
+}
+
+func (e *encoder) long(v uint32) {
+	e.b = binary.BigEndian.AppendUint32(e.b, v)
+}
+
+func (e *encoder) longlong(v uint64) {
+	e.b = binary.BigEndian.AppendUint64(e.b, v)
+}
+
+func (e *encoder) shortstr(s string) {
+	e.octet(uint8(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *encoder) longstr(s string) {
+	e.long(uint32(len(s)))
+	e.b = append(e.b, s...)
+}
+
+// table encodes a field table of string, bool
+// and nested table values.
+func (e *encoder) table(t map[string]interface{}) {
+	f := &encoder{}
+	for k, v := range t {
+		f.shortstr(k)
+		switch v := v.(type) {
+		case string:
+			f.octet('S')
+			f.longstr(v)
+		case bool:
+			f.octet('t')
+			if v {
+				f.octet(1)
+			} else {
+				f.octet(0)
+			}
+		case map[string]interface{}:
+			f.octet('F')
+			f.table(v)
+		}
+	}
+	e.long(uint32(len(f.b)))
+	e.b = append(e.b, f.b...)
+}
+
+// method starts a method frame payload.
+func method(class, id uint16) *encoder {
+	e := &encoder{}
+	e.short(class)
+	e.short(id)
+	return e
+}
+
+var errShortFrame = errors.New("short frame")
+
+// decoder reads AMQP primitives. The first error
+// is kept and later reads return zero values.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.b) < n {
+		d.err = errShortFrame
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) octet() uint8 {
+	if b := d.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) short() uint16 {
+	if b := d.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) long() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) longlong() uint64 {
+	if b := d.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *decoder) shortstr() string {
+	return string(d.next(int(d.octet())))
+}
+
+func (d *decoder) longstr() string {
+	return string(d.next(int(d.long())))
+}
+
+// skipTable skips a field table, whose contents aren't needed.
+func (d *decoder) skipTable() {
+	d.next(int(d.long()))
+}
+
+// frame is a received frame.
+type frame struct {
+	typ     uint8
+	channel uint16
+	payload []byte
+}
+
+// method returns the class and method id of a method
+// frame and a decoder for its arguments.
+func (f frame) method() (uint16, uint16, *decoder) {
+	d := &decoder{b: f.payload}
+	return d.short(), d.short(), d
+}
+
+// closeError reads the arguments of a connection
+// or channel close method.
+func closeError(what string, d *decoder) error {
+	code := d.short()
+	text := d.shortstr()
+	class := d.short()
+	id := d.short()
+	if class != 0 {
+		return fmt.Errorf("%s closed by server: %d %s (method %d.%d)", what, code, text, class, id)
+	}
+	return fmt.Errorf("%s closed by server: %d %s", what, code, text)
+}
@@ -2,12 +2,14 @@ package console
 
 import (
 	"fmt"
+
+	"github.com/jamiealquiza/ascender/outputs"
 )
 
-func Handler(messageOutgoingQueue <-chan []string) {
+func Handler(messageOutgoingQueue <-chan []*outputs.Message) {
 	for m := range messageOutgoingQueue {
 		for _, l := range m {
-			fmt.Println(l)
+			fmt.Println(l.Body)
 		}
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,296 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jamiealquiza/ascender/outputs"
+)
+
+// item is a message's action and source lines.
+type item struct {
+	lines []byte
+
+	msg      *outputs.Message
+	attempts int
+	// Set if Elasticsearch rejected the item.
+	err error
+}
+
+// bulker sends batches as bulk requests.
+type bulker struct {
+	config *Config
+	client *http.Client
+	stats  outputs.Statser
+	// Index of the URL to use next.
+	next int
+}
+
+// indexName makes s a valid index name: lowercase,
+// without characters Elasticsearch doesn't allow.
+func indexName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`\/*?"<>| ,#:`, r) {
+			return '_'
+		}
+		return r
+	}, strings.ToLower(s))
+	// Names can't start with these either.
+	if s != "" && strings.ContainsRune("-_+", rune(s[0])) {
+		s = "x" + s
+	}
+	return s
+}
+
+// item returns the bulk lines for m. JSON objects are indexed as
+// they are; other messages are wrapped as {"message": "..."} with
+// the time received.
+func (b *bulker) item(m *outputs.Message) *item {
+	c := b.config
+	action := map[string]string{"_index": indexName(c.index.Execute(m, nil))}
+	if c.IDField != "" {
+		if id := m.Field(c.IDField); id != "" {
+			action["_id"] = id
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(map[string]interface{}{c.OpType: action})
+
+	body := bytes.TrimSpace([]byte(m.Body))
+	if len(body) > 0 && body[0] == '{' && json.Valid(body) {
+		// Each document must be on one line.
+		if json.Compact(&buf, body) != nil {
+			buf.Write(body)
+		}
+		buf.WriteByte('\n')
+	} else {
+		enc.Encode(map[string]string{
+			c.TimestampField: m.Time("").UTC().Format(time.RFC3339Nano),
+			"message":        m.Body,
+		})
+	}
+
+	return &item{lines: buf.Bytes(), msg: m}
+}
+
+// rejectError describes items Elasticsearch won't accept.
+type rejectError struct {
+	n      int
+	reason string
+}
+
+func (e *rejectError) Error() string {
+	return fmt.Sprintf("%d rejected, first: %s", e.n, e.reason)
+}
+
+// send indexes a batch and returns the number of messages sent.
+// Failed requests, responses that can't be read and items
+// failing with 429 or 5xx statuses are retried with backoff;
+// items rejected otherwise are dropped.
+// Messages not sent are passed to the Statser.
+func (b *bulker) send(batch []*outputs.Message) (int, error) {
+	items := make([]*item, len(batch))
+	for i, m := range batch {
+		items[i] = b.item(m)
+	}
+
+	sent := 0
+	var err error
+	var rejected *rejectError
+	retry := items
+	backoff := b.config.retryBackoff
+	for attempt := 0; len(retry) > 0; attempt++ {
+		var n int
+		var rej *rejectError
+		n, retry, rej, err = b.attempt(retry)
+		sent += n
+		if rej != nil {
+			if rejected == nil {
+				rejected = rej
+			} else {
+				rejected.n += rej.n
+			}
+		}
+		if err == nil || len(retry) == 0 || attempt >= b.config.retries {
+			break
+		}
+		log.Printf("Elasticsearch bulk request failed, retrying %d messages in %s: %s\n", len(retry), backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > b.config.maxBackoff {
+			backoff = b.config.maxBackoff
+		}
+	}
+	for _, it := range retry {
+		b.stats.Failed(it.msg, it.attempts, err)
+	}
+	for _, it := range items {
+		if it.err != nil {
+			b.stats.Failed(it.msg, it.attempts, it.err)
+		}
+	}
+
+	switch {
+	case rejected != nil && err != nil:
+		err = fmt.Errorf("%s; %s", err, rejected)
+	case rejected != nil:
+		err = rejected
+	}
+	return sent, err
+}
+
+// bulkResponse holds the parts of a bulk response used.
+type bulkResponse struct {
+	Errors bool
+	Items  []map[string]struct {
+		Status int
+		Error  *struct {
+			Type   string
+			Reason string
+		}
+	}
+}
+
+// attempt sends items in one bulk request, returning the number
+// sent, the items to retry, those rejected, and why items need
+// retrying, if any do.
+func (b *bulker) attempt(items []*item) (int, []*item, *rejectError, error) {
+	c := b.config
+	var body bytes.Buffer
+	for _, it := range items {
+		it.attempts++
+		body.Write(it.lines)
+	}
+
+	status, resp, err := b.post(body.Bytes())
+	switch {
+	case err != nil:
+		// Try the next node.
+		b.next++
+		return 0, items, nil, err
+	case status == http.StatusTooManyRequests || status >= 500:
+		b.next++
+		return 0, items, nil, fmt.Errorf("%d: %s", status, snippet(resp))
+	case status < 200 || status >= 300:
+		// Bad requests, including 413 (too large), fail again.
+		rejected := &rejectError{n: len(items), reason: fmt.Sprintf("%d: %s", status, snippet(resp))}
+		for _, it := range items {
+			it.err = errors.New(rejected.reason)
+		}
+		return 0, nil, rejected, nil
+	}
+
+	// Responses that don't say which items were indexed
+	// are retried, as requests that time out are.
+	var r bulkResponse
+	if err := json.Unmarshal(resp, &r); err != nil {
+		b.next++
+		return 0, items, nil, fmt.Errorf("invalid response: %s", err)
+	}
+	if !r.Errors {
+		return len(items), nil, nil, nil
+	}
+	if len(r.Items) != len(items) {
+		b.next++
+		return 0, items, nil, fmt.Errorf("response has %d items, expected %d", len(r.Items), len(items))
+	}
+
+	sent := 0
+	var retry []*item
+	var rejected *rejectError
+	var retryReason string
+	for i, res := range r.Items {
+		if len(res) == 0 {
+			retry = append(retry, items[i])
+			if retryReason == "" {
+				retryReason = "no result"
+			}
+		}
+		for _, s := range res {
+			reason := fmt.Sprintf("status %d", s.Status)
+			if s.Error != nil {
+				reason = fmt.Sprintf("%s: %s", s.Error.Type, s.Error.Reason)
+			}
+			switch {
+			case s.Status >= 200 && s.Status < 300,
+				s.Status == http.StatusConflict && c.OpType == "create":
+				sent++
+			case s.Status == http.StatusTooManyRequests || s.Status >= 500:
+				retry = append(retry, items[i])
+				if retryReason == "" {
+					retryReason = reason
+				}
+			default:
+				if rejected == nil {
+					rejected = &rejectError{reason: reason}
+				}
+				rejected.n++
+				items[i].err = errors.New(reason)
+			}
+		}
+	}
+	if len(retry) > 0 {
+		err = fmt.Errorf("%d items failed, first: %s", len(retry), retryReason)
+	}
+
+	return sent, retry, rejected, err
+}
+
+// post sends a bulk request body, returning
+// the response status and body.
+func (b *bulker) post(body []byte) (int, []byte, error) {
+	c := b.config
+	if c.Gzip {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(body)
+		gz.Close()
+		body = buf.Bytes()
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.bulkURLs[b.next%len(c.bulkURLs)], bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("User-Agent", "ascender")
+	if c.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	switch {
+	case c.APIKey != "":
+		req.Header.Set("Authorization", "ApiKey "+c.APIKey)
+	case c.Username != "" || c.Password != "":
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	rb, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return resp.StatusCode, rb, nil
+}
+
+// snippet returns the start of a response body for errors.
+func snippet(b []byte) string {
+	if len(b) > 512 {
+		b = b[:512]
+	}
+	return strings.TrimSpace(string(b))
+}
@@ -0,0 +1,144 @@
+// Package elasticsearch indexes messages with the
+// Elasticsearch (or OpenSearch) _bulk API.
+package elasticsearch
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jamiealquiza/ascender/outputs"
+)
+
+// Config holds Elasticsearch output settings.
+type Config struct {
+	// Base URLs of cluster nodes, e.g. "https://es1:9200".
+	// Requests move to the next URL when one fails.
+	URLs []string `json:"urls"`
+	// Index name template, e.g. "logs-{:route}-{+yyyy.MM.dd}"
+	// (see outputs.Template). Names are lowercased and
+	// characters not allowed in index names become "_".
+	Index string `json:"index"`
+	// Value for placeholders missing from a message.
+	IndexMissing string `json:"index-missing"`
+	// Field holding the time used for dates in Index, and added
+	// to plain text messages. Default "@timestamp".
+	TimestampField string `json:"timestamp-field"`
+	// Field holding the document ID. If unset or missing,
+	// Elasticsearch assigns one.
+	IDField string `json:"id-field"`
+	// "index" (default) or "create". With "create", documents
+	// that already exist count as sent.
+	OpType string `json:"op-type"`
+	// Ingest pipeline to run documents through.
+	Pipeline     string `json:"pipeline"`
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	APIKey       string `json:"api-key"`
+	Gzip         bool   `json:"gzip"`
+	Retries      *int   `json:"retries"`
+	RetryBackoff string `json:"retry-backoff"`
+	MaxBackoff   string `json:"max-backoff"`
+	Timeout      string `json:"timeout"`
+
+	index        *outputs.Template
+	bulkURLs     []string
+	retries      int
+	retryBackoff time.Duration
+	maxBackoff   time.Duration
+	timeout      time.Duration
+}
+
+// Validate checks settings and fills in defaults.
+func (c *Config) Validate() error {
+	if len(c.URLs) == 0 {
+		return errors.New("urls is required")
+	}
+	c.bulkURLs = nil
+	for _, s := range c.URLs {
+		u, err := url.Parse(s)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("url %q must be an absolute http or https URL", s)
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/_bulk"
+		q := u.Query()
+		// Only what's needed to find failed items.
+		q.Set("filter_path", "errors,items.*.status,items.*.error.type,items.*.error.reason")
+		if c.Pipeline != "" {
+			q.Set("pipeline", c.Pipeline)
+		}
+		u.RawQuery = q.Encode()
+		c.bulkURLs = append(c.bulkURLs, u.String())
+	}
+
+	if c.Index == "" {
+		return errors.New("index is required")
+	}
+	if c.TimestampField == "" {
+		c.TimestampField = "@timestamp"
+	}
+	var err error
+	if c.index, err = outputs.ParseTemplate(c.Index); err != nil {
+		return err
+	}
+	c.index.TimeField = c.TimestampField
+	c.index.Missing = "unknown"
+	if c.IndexMissing != "" {
+		c.index.Missing = c.IndexMissing
+	}
+
+	switch c.OpType {
+	case "":
+		c.OpType = "index"
+	case "index", "create":
+	default:
+		return fmt.Errorf("invalid op-type %q", c.OpType)
+	}
+	if c.APIKey != "" && (c.Username != "" || c.Password != "") {
+		return errors.New("use one of api-key or username/password")
+	}
+
+	c.retries = 3
+	if c.Retries != nil {
+		if *c.Retries < 0 {
+			return errors.New("retries can't be negative")
+		}
+		c.retries = *c.Retries
+	}
+	if c.retryBackoff, err = outputs.Duration(c.RetryBackoff, "500ms"); err != nil {
+		return fmt.Errorf("invalid retry-backoff %q", c.RetryBackoff)
+	}
+	if c.maxBackoff, err = outputs.Duration(c.MaxBackoff, "30s"); err != nil {
+		return fmt.Errorf("invalid max-backoff %q", c.MaxBackoff)
+	}
+	if c.timeout, err = outputs.Duration(c.Timeout, "30s"); err != nil {
+		return fmt.Errorf("invalid timeout %q", c.Timeout)
+	}
+
+	return nil
+}
+
+// Worker that reads message batches from the messageOutgoingQueue
+// and indexes them, one bulk request per batch.
+func Handler(c *Config, messageOutgoingQueue <-chan []*outputs.Message, s outputs.Statser) {
+	b := &bulker{
+		config: c,
+		client: &http.Client{Timeout: c.timeout},
+		stats:  s,
+		// Spread workers over the nodes.
+		next: rand.Intn(len(c.bulkURLs)),
+	}
+
+	for m := range messageOutgoingQueue {
+		sent, err := b.send(m)
+		if err != nil {
+			log.Printf("Elasticsearch batch error: %d of %d messages not sent: %s\n", len(m)-sent, len(m), err)
+		}
+		s.IncrSent(int64(sent))
+	}
+}
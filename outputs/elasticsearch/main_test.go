@@ -0,0 +1,130 @@
+package elasticsearch
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jamiealquiza/ascender/outputs/outputstest"
+)
+
+// cluster answers bulk requests with responses in turn, then
+// with success for every item, recording the documents sent.
+func cluster(t *testing.T, responses ...func(w http.ResponseWriter, docs []string)) (*httptest.Server, *[][]string) {
+	var mu sync.Mutex
+	var requests [][]string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var docs []string
+		lines := bufio.NewScanner(r.Body)
+		for i := 0; lines.Scan(); i++ {
+			if i%2 == 1 {
+				docs = append(docs, lines.Text())
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, docs)
+		if len(responses) > 0 {
+			respond := responses[0]
+			responses = responses[1:]
+			respond(w, docs)
+			return
+		}
+		w.Write([]byte(`{"errors": false, "items": []}`))
+	}))
+	t.Cleanup(s.Close)
+	return s, &requests
+}
+
+func body(b string) func(http.ResponseWriter, []string) {
+	return func(w http.ResponseWriter, _ []string) { w.Write([]byte(b)) }
+}
+
+func newBulker(t *testing.T, url string) (*bulker, *outputstest.Stats) {
+	retries := 2
+	c := &Config{URLs: []string{url}, Index: "logs", Retries: &retries, RetryBackoff: "1ms"}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s := &outputstest.Stats{}
+	return &bulker{config: c, client: &http.Client{Timeout: time.Second}, stats: s}, s
+}
+
+func TestBulk(t *testing.T) {
+	srv, requests := cluster(t)
+	b, s := newBulker(t, srv.URL)
+	if n, err := b.send(outputstest.Messages(`{"a": 1}`, "text")); n != 2 || err != nil {
+		t.Fatalf("sent %d: %v", n, err)
+	}
+	docs := (*requests)[0]
+	if len(docs) != 2 || docs[0] != `{"a":1}` || !strings.Contains(docs[1], `"message":"text"`) || len(s.Dropped()) != 0 {
+		t.Errorf("docs %q", docs)
+	}
+}
+
+// Only items failing with 429 or 5xx are retried.
+func TestBulkItemRetries(t *testing.T) {
+	srv, requests := cluster(t,
+		body(`{"errors": true, "items": [
+			{"index": {"status": 201}},
+			{"index": {"status": 429, "error": {"type": "es_rejected_execution_exception"}}},
+			{"index": {"status": 400, "error": {"type": "mapper_parsing_exception", "reason": "bad"}}}]}`))
+	b, s := newBulker(t, srv.URL)
+	n, err := b.send(outputstest.Messages(`{"n": 1}`, `{"n": 2}`, `{"n": 3}`))
+	if n != 2 || err == nil || !strings.Contains(err.Error(), "mapper_parsing_exception") {
+		t.Fatalf("sent %d: %v", n, err)
+	}
+	if len(*requests) != 2 || len((*requests)[1]) != 1 || (*requests)[1][0] != `{"n":2}` {
+		t.Errorf("requests %q", *requests)
+	}
+	if len(s.Dropped()) != 1 || s.Dropped()[0].Body != `{"n": 3}` {
+		t.Errorf("failed %v", s.Dropped())
+	}
+}
+
+// Responses that don't say which items were indexed are retried,
+// and the messages failed if they never do.
+func TestBulkUnreadableResponse(t *testing.T) {
+	for name, bad := range map[string]func(http.ResponseWriter, []string){
+		"invalid":  body(`<html>proxy error</html>`),
+		"mismatch": body(`{"errors": true, "items": [{"index": {"status": 201}}]}`),
+		"empty":    body(`{"errors": true, "items": [{}, {"index": {"status": 201}}]}`),
+	} {
+		srv, requests := cluster(t, bad)
+		b, s := newBulker(t, srv.URL)
+		if n, err := b.send(outputstest.Messages("a", "b")); n+len(s.Dropped()) != 2 || err != nil {
+			t.Errorf("%s: sent %d, %d failed: %v", name, n, len(s.Dropped()), err)
+		}
+		if len(*requests) != 2 {
+			t.Errorf("%s: %d requests", name, len(*requests))
+		}
+
+		srv, _ = cluster(t, bad, bad, bad)
+		b, s = newBulker(t, srv.URL)
+		if n, err := b.send(outputstest.Messages("a", "b")); n+len(s.Dropped()) != 2 || err == nil {
+			t.Errorf("%s: sent %d, %d failed after retries: %v", name, n, len(s.Dropped()), err)
+		}
+	}
+}
+
+// Requests failing with 429 or 5xx are retried; others fail.
+func TestBulkRequestStatus(t *testing.T) {
+	status := func(code int) func(http.ResponseWriter, []string) {
+		return func(w http.ResponseWriter, _ []string) { w.WriteHeader(code) }
+	}
+	srv, requests := cluster(t, status(503), status(429))
+	b, s := newBulker(t, srv.URL)
+	if n, err := b.send(outputstest.Messages("a")); n != 1 || err != nil || len(*requests) != 3 {
+		t.Fatalf("sent %d in %d requests: %v", n, len(*requests), err)
+	}
+
+	srv, requests = cluster(t, status(413))
+	b, s = newBulker(t, srv.URL)
+	if n, err := b.send(outputstest.Messages("a", "b")); n != 0 || err == nil || len(*requests) != 1 || len(s.Dropped()) != 2 {
+		t.Fatalf("sent %d in %d requests, %d failed: %v", n, len(*requests), len(s.Dropped()), err)
+	}
+}
@@ -0,0 +1,126 @@
+// Package file writes messages to local files as NDJSON, with
+// rotation, compression of closed segments and retention.
+package file
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jamiealquiza/ascender/outputs"
+)
+
+// Config holds file output settings.
+type Config struct {
+	// Path template, e.g. "/var/log/ascender/{:route}/{+yyyy-MM-dd}.ndjson"
+	// (see outputs.Template). Substituted values have "/" replaced by "_".
+	Path string `json:"path"`
+	// Value for placeholders missing from a message.
+	PathMissing string `json:"path-missing"`
+	// Field holding the time used for dates in Path.
+	TimestampField string `json:"timestamp-field"`
+	// Rotate files reaching this size. 0 doesn't.
+	MaxSizeMB int `json:"max-size-mb"`
+	// Rotate files at multiples of this interval, e.g. "1h".
+	RotateEvery string `json:"rotate-every"`
+	// Rotate files not written to for this long, default "5m".
+	IdleTimeout string `json:"idle-timeout"`
+	// Compress rotated segments.
+	Gzip bool `json:"gzip"`
+	// When to fsync: "rotate" (default, when a file is closed),
+	// "batch" (after each batch), "interval" (every FsyncInterval)
+	// or "never".
+	Fsync         string `json:"fsync"`
+	FsyncInterval string `json:"fsync-interval"`
+	// Keep at most this many rotated segments, and none
+	// older than MaxAge. 0 and "" keep everything.
+	MaxFiles int    `json:"max-files"`
+	MaxAge   string `json:"max-age"`
+
+	path          *outputs.Template
+	glob          string
+	maxSize       int64
+	rotateEvery   time.Duration
+	idleTimeout   time.Duration
+	fsyncInterval time.Duration
+	maxAge        time.Duration
+}
+
+// Validate checks settings and fills in defaults.
+func (c *Config) Validate() error {
+	if c.Path == "" {
+		return errors.New("path is required")
+	}
+	var err error
+	if c.path, err = outputs.ParseTemplate(filepath.Clean(c.Path)); err != nil {
+		return err
+	}
+	c.path.TimeField = c.TimestampField
+	c.path.Missing = "unknown"
+	if c.PathMissing != "" {
+		c.path.Missing = c.PathMissing
+	}
+	c.glob = c.path.Glob()
+
+	if c.MaxSizeMB < 0 {
+		return errors.New("max-size-mb can't be negative")
+	}
+	c.maxSize = int64(c.MaxSizeMB) << 20
+	if c.RotateEvery != "" {
+		if c.rotateEvery, err = outputs.Duration(c.RotateEvery, ""); err != nil {
+			return fmt.Errorf("invalid rotate-every %q", c.RotateEvery)
+		}
+	}
+	if c.idleTimeout, err = outputs.Duration(c.IdleTimeout, "5m"); err != nil {
+		return fmt.Errorf("invalid idle-timeout %q", c.IdleTimeout)
+	}
+
+	switch c.Fsync {
+	case "":
+		c.Fsync = "rotate"
+	case "rotate", "batch", "interval", "never":
+	default:
+		return fmt.Errorf("invalid fsync %q", c.Fsync)
+	}
+	if c.fsyncInterval, err = outputs.Duration(c.FsyncInterval, "1s"); err != nil {
+		return fmt.Errorf("invalid fsync-interval %q", c.FsyncInterval)
+	}
+
+	if c.MaxFiles < 0 {
+		return errors.New("max-files can't be negative")
+	}
+	if c.MaxAge != "" {
+		if c.maxAge, err = outputs.Duration(c.MaxAge, ""); err != nil {
+			return fmt.Errorf("invalid max-age %q", c.MaxAge)
+		}
+	}
+
+	return nil
+}
+
+// pathEscape keeps substituted values within one path element.
+func pathEscape(s string) string {
+	s = strings.NewReplacer("/", "_", "\\", "_", "\x00", "_").Replace(s)
+	if s == "." || s == ".." {
+		return "_"
+	}
+	return s
+}
+
+// Worker that reads message batches from the messageOutgoingQueue
+// and appends them to files shared by the output's workers.
+func Handler(c *Config, messageOutgoingQueue <-chan []*outputs.Message, s outputs.Statser) {
+	w := acquireWriter(c)
+	defer releaseWriter(c)
+
+	for m := range messageOutgoingQueue {
+		sent, err := w.write(m, s)
+		if err != nil {
+			log.Printf("File batch error: %d of %d messages not sent: %s\n", len(m)-sent, len(m), err)
+		}
+		s.IncrSent(int64(sent))
+	}
+}
@@ -0,0 +1,196 @@
+package file
+
+import (
+	"bufio"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jamiealquiza/ascender/outputs"
+	"github.com/jamiealquiza/ascender/outputs/outputstest"
+)
+
+// run runs workers Handlers for c over batches,
+// returning once they exit.
+func run(t *testing.T, c *Config, workers int, s outputs.Statser, batches ...[]*outputs.Message) {
+	q := make(chan []*outputs.Message, len(batches))
+	for _, b := range batches {
+		q <- b
+	}
+	close(q)
+	done := make(chan struct{})
+	for i := 0; i < workers; i++ {
+		go func() {
+			Handler(c, q, s)
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < workers; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("handler didn't exit")
+		}
+	}
+}
+
+// lines returns the lines of a file, gunzipped if named .gz.
+func lines(t *testing.T, path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := bufio.NewScanner(f)
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		r = bufio.NewScanner(gz)
+	}
+	var ls []string
+	for r.Scan() {
+		ls = append(ls, r.Text())
+	}
+	return ls
+}
+
+func routed(route string, bodies ...string) []*outputs.Message {
+	ms := outputstest.Messages(bodies...)
+	for _, m := range ms {
+		m.Route = route
+	}
+	return ms
+}
+
+func TestWriteToTemplatedPaths(t *testing.T) {
+	dir := t.TempDir()
+	c := &Config{Path: dir + "/{:route}/out.ndjson", Fsync: "batch"}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s := &outputstest.Stats{}
+	batch := append(routed("a", `{"n": 1}`, "plain"), routed("../b", "up")...)
+	batch = append(batch, routed("", "none")...)
+	run(t, c, 2, s, batch, routed("a", `{"n": 2}`))
+
+	if n := s.FetchSent(); n != 5 {
+		t.Errorf("%d sent, want 5", n)
+	}
+	if got := strings.Join(lines(t, filepath.Join(dir, "a", "out.ndjson")), "|"); got != `{"n":1}|{"message":"plain"}|{"n":2}` {
+		t.Errorf("a: %s", got)
+	}
+	// Substituted values stay within one path element.
+	if got := lines(t, filepath.Join(dir, ".._b", "out.ndjson")); len(got) != 1 {
+		t.Errorf(".._b: %q", got)
+	}
+	if got := lines(t, filepath.Join(dir, "unknown", "out.ndjson")); len(got) != 1 || got[0] != `{"message":"none"}` {
+		t.Errorf("unknown: %q", got)
+	}
+}
+
+// Files are rotated at max size, rotated segments gzipped
+// and all but the newest max-files removed.
+func TestRotateBySize(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.ndjson")
+	c := &Config{Path: path, Gzip: true, MaxFiles: 2}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	// Two messages a file.
+	c.maxSize = 60
+	s := &outputstest.Stats{}
+	var batches [][]*outputs.Message
+	for i := 0; i < 10; i++ {
+		batches = append(batches, routed("r", `{"msg":"message number `+string(rune('0'+i))+`"}`))
+	}
+	run(t, c, 1, s, batches...)
+
+	if n := s.FetchSent(); n != 10 {
+		t.Errorf("%d sent, want 10", n)
+	}
+	if got := lines(t, path); len(got) != 2 || !strings.Contains(got[1], "number 9") {
+		t.Errorf("current file %q", got)
+	}
+	segs, _ := filepath.Glob(path + ".*")
+	sort.Strings(segs)
+	if len(segs) != 2 {
+		t.Fatalf("segments %q, want the newest 2", segs)
+	}
+	for _, seg := range segs {
+		if !strings.HasSuffix(seg, ".gz") {
+			t.Errorf("segment %s not compressed", seg)
+		}
+	}
+	if got := lines(t, segs[1]); len(got) != 2 || !strings.Contains(got[0], "number 6") {
+		t.Errorf("newest segment %q", got)
+	}
+}
+
+func TestRotateWhenIdle(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.ndjson")
+	c := &Config{Path: path, IdleTimeout: "10ms"}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	q := make(chan []*outputs.Message, 1)
+	done := make(chan struct{})
+	go func() {
+		Handler(c, q, &outputstest.Stats{})
+		close(done)
+	}()
+	defer func() {
+		close(q)
+		<-done
+	}()
+	q <- routed("r", "m")
+
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		segs, _ := filepath.Glob(path + ".*")
+		if len(segs) == 1 {
+			if got := lines(t, segs[0]); len(got) != 1 {
+				t.Errorf("segment %q", got)
+			}
+			return
+		}
+	}
+	t.Fatal("idle file not rotated")
+}
+
+// Messages that can't be written are failed without holding
+// up the rest, and the path is retried for later batches.
+func TestWriteFailure(t *testing.T) {
+	dir := t.TempDir()
+	c := &Config{Path: dir + "/{:route}/out.ndjson"}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	// A file where the directory should be.
+	blocked := filepath.Join(dir, "blocked")
+	os.WriteFile(blocked, nil, 0644)
+
+	s := &outputstest.Stats{}
+	run(t, c, 1, s, append(routed("blocked", "lost"), routed("ok", "kept")...))
+	if n := s.FetchSent(); n != 1 {
+		t.Errorf("%d sent, want 1", n)
+	}
+	if d := s.Dropped(); len(d) != 1 || d[0].Body != "lost" || s.Reasons()[0] == nil {
+		t.Fatalf("failed %v", outputs.Bodies(d))
+	}
+	if got := lines(t, filepath.Join(dir, "ok", "out.ndjson")); len(got) != 1 {
+		t.Errorf("ok: %q", got)
+	}
+
+	os.Remove(blocked)
+	run(t, c, 1, s, routed("blocked", "retried"))
+	if got := lines(t, filepath.Join(blocked, "out.ndjson")); len(got) != 1 || got[0] != `{"message":"retried"}` {
+		t.Errorf("blocked: %q", got)
+	}
+}
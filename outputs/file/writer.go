@@ -0,0 +1,342 @@
+package file
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jamiealquiza/ascender/outputs"
+)
+
+// Rotated segments are named <path>.<stamp>[.gz].
+const stampFormat = "20060102T150405.000000000Z"
+
+var segmentName = regexp.MustCompile(`\.\d{8}T\d{6}\.\d{9}Z(\.gz)?$`)
+
+// file is an open file being appended to.
+type file struct {
+	path string
+	f    *os.File
+	w    *bufio.Writer
+	size int64
+	// When the file was opened and last written.
+	opened, written time.Time
+	// Whether written since the last fsync.
+	dirty bool
+}
+
+// writer appends messages to files for an output. It's shared by
+// the output's workers and closed when the last one exits.
+type writer struct {
+	config  *Config
+	mu      sync.Mutex
+	files   map[string]*file
+	workers int
+	// Rotated segments to compress and prune.
+	segments chan string
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+var writers = struct {
+	sync.Mutex
+	m map[*Config]*writer
+}{m: map[*Config]*writer{}}
+
+func acquireWriter(c *Config) *writer {
+	writers.Lock()
+	defer writers.Unlock()
+	w, ok := writers.m[c]
+	if !ok {
+		w = &writer{
+			config:   c,
+			files:    map[string]*file{},
+			segments: make(chan string, 1024),
+			stop:     make(chan struct{}),
+		}
+		w.wg.Add(2)
+		go w.maintain()
+		go w.archive()
+		writers.m[c] = w
+	}
+	w.workers++
+	return w
+}
+
+func releaseWriter(c *Config) {
+	writers.Lock()
+	w := writers.m[c]
+	if w == nil {
+		writers.Unlock()
+		return
+	}
+	if w.workers--; w.workers > 0 {
+		writers.Unlock()
+		return
+	}
+	delete(writers.m, c)
+	writers.Unlock()
+
+	close(w.stop)
+	w.mu.Lock()
+	for _, f := range w.files {
+		if err := w.close(f); err != nil {
+			log.Printf("File output error closing %s: %s\n", f.path, err)
+		}
+	}
+	w.files = nil
+	w.mu.Unlock()
+	close(w.segments)
+	w.wg.Wait()
+}
+
+// write appends a batch and returns the number of messages
+// written (and synced, if the fsync policy asks). Messages
+// not written are passed to s.
+func (w *writer) write(batch []*outputs.Message, s outputs.Statser) (int, error) {
+	c := w.config
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	sent := 0
+	var err error
+	// Messages written to each file but not yet flushed.
+	pending := map[*file][]*outputs.Message{}
+	failed := func(msgs []*outputs.Message, ferr error) {
+		err = ferr
+		for _, m := range msgs {
+			s.Failed(m, 1, ferr)
+		}
+	}
+	for _, m := range batch {
+		l := m.Line()
+		f, ferr := w.file(c.path.Execute(m, pathEscape))
+		if ferr != nil {
+			failed([]*outputs.Message{m}, ferr)
+			continue
+		}
+		if c.maxSize > 0 && f.size > 0 && f.size+int64(len(l)) > c.maxSize {
+			if rerr := w.rotate(f); rerr != nil {
+				failed(pending[f], rerr)
+			} else {
+				sent += len(pending[f])
+			}
+			delete(pending, f)
+			if f, ferr = w.file(f.path); ferr != nil {
+				failed([]*outputs.Message{m}, ferr)
+				continue
+			}
+		}
+		f.w.Write(l)
+		f.size += int64(len(l))
+		f.written = time.Now()
+		f.dirty = true
+		pending[f] = append(pending[f], m)
+	}
+
+	for f, msgs := range pending {
+		ferr := f.w.Flush()
+		if ferr == nil && c.Fsync == "batch" {
+			ferr = f.f.Sync()
+			f.dirty = false
+		}
+		if ferr != nil {
+			failed(msgs, ferr)
+			// Drop the file so it's reopened.
+			f.f.Close()
+			delete(w.files, f.path)
+			continue
+		}
+		sent += len(msgs)
+	}
+
+	return sent, err
+}
+
+// file returns the open file for path, opening it if needed.
+func (w *writer) file(path string) (*file, error) {
+	if f, ok := w.files[path]; ok {
+		return f, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+	now := time.Now()
+	f := &file{path: path, f: fh, w: bufio.NewWriter(fh), size: fi.Size(), opened: now, written: now}
+	w.files[path] = f
+	return f, nil
+}
+
+// close flushes and closes f, syncing unless the policy is "never".
+func (w *writer) close(f *file) error {
+	err := f.w.Flush()
+	if err == nil && w.config.Fsync != "never" {
+		err = f.f.Sync()
+	}
+	if cerr := f.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// rotate closes f and renames it to a segment to be archived.
+func (w *writer) rotate(f *file) error {
+	delete(w.files, f.path)
+	err := w.close(f)
+	if f.size == 0 {
+		os.Remove(f.path)
+		return err
+	}
+	seg := f.path + "." + time.Now().UTC().Format(stampFormat)
+	if rerr := os.Rename(f.path, seg); rerr != nil {
+		log.Printf("File output error rotating %s: %s\n", f.path, rerr)
+		return err
+	}
+	w.segments <- seg
+	return err
+}
+
+// maintain rotates files by time or when idle, and syncs
+// them with the "interval" policy, until the writer stops.
+func (w *writer) maintain() {
+	defer w.wg.Done()
+	c := w.config
+	tick := time.Second
+	if c.Fsync == "interval" && c.fsyncInterval < tick {
+		tick = c.fsyncInterval
+	}
+	t := time.NewTicker(tick)
+	defer t.Stop()
+	lastSync := time.Now()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-t.C:
+		}
+
+		now := time.Now()
+		doSync := c.Fsync == "interval" && now.Sub(lastSync) >= c.fsyncInterval
+		if doSync {
+			lastSync = now
+		}
+		w.mu.Lock()
+		for _, f := range w.files {
+			var err error
+			switch {
+			case c.rotateEvery > 0 && !now.Truncate(c.rotateEvery).Equal(f.opened.Truncate(c.rotateEvery)),
+				now.Sub(f.written) >= c.idleTimeout:
+				err = w.rotate(f)
+			case doSync && f.dirty:
+				err = f.f.Sync()
+				f.dirty = false
+			}
+			if err != nil {
+				log.Printf("File output error on %s: %s\n", f.path, err)
+			}
+		}
+		w.mu.Unlock()
+	}
+}
+
+// archive compresses rotated segments if configured, and
+// removes those beyond the retention limits.
+func (w *writer) archive() {
+	defer w.wg.Done()
+	w.prune()
+	for seg := range w.segments {
+		if w.config.Gzip {
+			// Segments may be pruned before they're compressed.
+			if err := compress(seg); err != nil && !os.IsNotExist(err) {
+				log.Printf("File output error compressing %s: %s\n", seg, err)
+			}
+		}
+		w.prune()
+	}
+}
+
+// compress replaces path with path.gz.
+func compress(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := path + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(path)
+}
+
+// prune removes the oldest segments beyond max-files,
+// and those older than max-age.
+func (w *writer) prune() {
+	c := w.config
+	if c.MaxFiles == 0 && c.maxAge == 0 {
+		return
+	}
+	matches, err := filepath.Glob(c.glob + ".*")
+	if err != nil {
+		return
+	}
+	type segment struct {
+		path    string
+		modTime time.Time
+	}
+	var segs []segment
+	for _, p := range matches {
+		if !segmentName.MatchString(p) {
+			continue
+		}
+		if fi, err := os.Stat(p); err == nil {
+			segs = append(segs, segment{p, fi.ModTime()})
+		}
+	}
+	// Newest first.
+	sort.Slice(segs, func(i, j int) bool { return segs[i].modTime.After(segs[j].modTime) })
+
+	for i, s := range segs {
+		if (c.MaxFiles > 0 && i >= c.MaxFiles) || (c.maxAge > 0 && time.Since(s.modTime) > c.maxAge) {
+			if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+				log.Printf("File output error removing %s: %s\n", s.path, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// brokerConn is a connection to a single broker.
+// Requests are sent one at a time.
+type brokerConn struct {
+	addr          string
+	conn          net.Conn
+	clientID      string
+	timeout       time.Duration
+	correlationID int32
+}
+
+func dialBroker(addr, clientID string, timeout time.Duration) (*brokerConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &brokerConn{addr: addr, conn: conn, clientID: clientID, timeout: timeout}, nil
+}
+
+func (b *brokerConn) close() {
+	b.conn.Close()
+}
+
+// request sends a request and returns the response body,
+// or nil if no response is expected (acks 0 produce).
+func (b *brokerConn) request(apiKey, version int16, body []byte, response bool) ([]byte, error) {
+	b.correlationID++
+
+	e := &encoder{}
+	e.int32(0) // Size, set below.
+	e.int16(apiKey)
+	e.int16(version)
+	e.int32(b.correlationID)
+	e.string(b.clientID)
+	e.b = append(e.b, body...)
+	binary.BigEndian.PutUint32(e.b, uint32(len(e.b)-4))
+
+	b.conn.SetDeadline(time.Now().Add(b.timeout))
+	if _, err := b.conn.Write(e.b); err != nil {
+		return nil, err
+	}
+	if !response {
+		return nil, nil
+	}
+
+	var size [4]byte
+	if _, err := io.ReadFull(b.conn, size[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(b.conn, resp); err != nil {
+		return nil, err
+	}
+
+	d := &decoder{b: resp}
+	if id := d.int32(); id != b.correlationID {
+		return nil, fmt.Errorf("broker %s: correlation id %d, expected %d", b.addr, id, b.correlationID)
+	}
+
+	return d.b, d.err
+}
+
+// client tracks brokers and partition leaders for a topic.
+type client struct {
+	config *Config
+	// Broker addresses by node id, from metadata.
+	nodes map[int32]string
+	// Open connections by address.
+	conns map[string]*brokerConn
+	// Leader node id for each partition.
+	leaders    map[int32]int32
+	partitions []int32
+}
+
+func newClient(c *Config) *client {
+	return &client{
+		config:  c,
+		nodes:   map[int32]string{},
+		conns:   map[string]*brokerConn{},
+		leaders: map[int32]int32{},
+	}
+}
+
+// broker returns a connection to addr, dialing if needed.
+func (c *client) broker(addr string) (*brokerConn, error) {
+	if b, ok := c.conns[addr]; ok {
+		return b, nil
+	}
+	b, err := dialBroker(addr, c.config.ClientID, c.config.timeout)
+	if err != nil {
+		return nil, err
+	}
+	c.conns[addr] = b
+	return b, nil
+}
+
+// request sends a request to addr. The connection is
+// dropped on error and redialed on the next request.
+func (c *client) request(addr string, apiKey, version int16, body []byte, response bool) ([]byte, error) {
+	b, err := c.broker(addr)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.request(apiKey, version, body, response)
+	if err != nil {
+		b.close()
+		delete(c.conns, addr)
+	}
+	return resp, err
+}
+
+// anyBroker sends a request to the first
+// bootstrap or known broker that answers.
+func (c *client) anyBroker(apiKey, version int16, body []byte) ([]byte, error) {
+	addrs := append([]string{}, c.config.Brokers...)
+	for _, addr := range c.nodes {
+		addrs = append(addrs, addr)
+	}
+
+	err := errors.New("no brokers")
+	for _, addr := range addrs {
+		var resp []byte
+		if resp, err = c.request(addr, apiKey, version, body, true); err == nil {
+			return resp, nil
+		}
+	}
+	return nil, err
+}
+
+// refreshMetadata loads brokers and partition leaders for the topic.
+func (c *client) refreshMetadata() error {
+	e := &encoder{}
+	e.int32(1)
+	e.string(c.config.Topic)
+	e.int8(1) // Allow auto topic creation.
+	resp, err := c.anyBroker(apiMetadata, metadataVersion, e.b)
+	if err != nil {
+		return fmt.Errorf("metadata: %s", err)
+	}
+
+	d := &decoder{b: resp}
+	d.int32() // Throttle time.
+	nodes := map[int32]string{}
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.string() // Rack.
+		nodes[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.string() // Cluster id.
+	d.int32()  // Controller id.
+
+	leaders := map[int32]int32{}
+	var partitions []int32
+	var topicErr Error
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		code := Error(d.int16())
+		name := d.string()
+		d.int8() // Is internal.
+		for j, np := 0, d.arrayLen(); j < np; j++ {
+			d.int16() // Partition error code.
+			p := d.int32()
+			leader := d.int32()
+			for k, nr := 0, d.arrayLen(); k < nr; k++ {
+				d.int32() // Replicas.
+			}
+			for k, ni := 0, d.arrayLen(); k < ni; k++ {
+				d.int32() // In-sync replicas.
+			}
+			if name == c.config.Topic {
+				leaders[p] = leader
+				partitions = append(partitions, p)
+			}
+		}
+		if name == c.config.Topic {
+			topicErr = code
+		}
+	}
+	if d.err != nil {
+		return fmt.Errorf("metadata: %s", d.err)
+	}
+	if topicErr != errNone {
+		return fmt.Errorf("metadata for topic %s: %s", c.config.Topic, topicErr)
+	}
+	if len(partitions) == 0 {
+		return fmt.Errorf("metadata for topic %s: no partitions", c.config.Topic)
+	}
+
+	// Sorted so keys map to partition ids as in other clients.
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
+	c.nodes, c.leaders, c.partitions = nodes, leaders, partitions
+	return nil
+}
+
+// initProducerID requests an idempotent producer id and epoch.
+func (c *client) initProducerID() (int64, int16, error) {
+	e := &encoder{}
+	e.nullString() // Transactional id.
+	e.int32(60000) // Transaction timeout.
+	resp, err := c.anyBroker(apiInitProducerID, initProducerIDVersion, e.b)
+	if err != nil {
+		return 0, 0, fmt.Errorf("init producer id: %s", err)
+	}
+
+	d := &decoder{b: resp}
+	d.int32() // Throttle time.
+	code := Error(d.int16())
+	id := d.int64()
+	epoch := d.int16()
+	if d.err != nil {
+		return 0, 0, fmt.Errorf("init producer id: %s", d.err)
+	}
+	if code != errNone {
+		return 0, 0, code
+	}
+
+	return id, epoch, nil
+}
+
+// produce sends a record batch to the leader for partition.
+func (c *client) produce(partition int32, batch []byte) error {
+	leader, ok := c.leaders[partition]
+	if !ok {
+		return errUnknownTopicOrPartition
+	}
+	addr, ok := c.nodes[leader]
+	if !ok {
+		return errLeaderNotAvailable
+	}
+
+	e := &encoder{}
+	e.nullString() // Transactional id.
+	e.int16(c.config.acks)
+	e.int32(int32(c.config.timeout / time.Millisecond))
+	e.int32(1)
+	e.string(c.config.Topic)
+	e.int32(1)
+	e.int32(partition)
+	e.bytes(batch)
+
+	resp, err := c.request(addr, apiProduce, produceVersion, e.b, c.config.acks != 0)
+	if err != nil {
+		return err
+	}
+	if resp == nil {
+		return nil
+	}
+
+	d := &decoder{b: resp}
+	code := errNone
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		d.string() // Topic.
+		for j, np := 0, d.arrayLen(); j < np; j++ {
+			p := d.int32()
+			pc := Error(d.int16())
+			d.int64() // Base offset.
+			d.int64() // Log append time.
+			if p == partition {
+				code = pc
+			}
+		}
+	}
+	if d.err != nil {
+		return fmt.Errorf("produce: %s", d.err)
+	}
+	if code != errNone {
+		return code
+	}
+
+	return nil
+}
+
+func (c *client) close() {
+	for addr, b := range c.conns {
+		b.close()
+		delete(c.conns, addr)
+	}
+}
@@ -0,0 +1,312 @@
+// Package kafka produces message batches to a Kafka topic,
+// speaking the Kafka wire protocol directly.
+package kafka
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jamiealquiza/ascender/outputs"
+)
+
+// Config holds Kafka output settings.
+type Config struct {
+	// Bootstrap brokers, host:port.
+	Brokers []string `json:"brokers"`
+	Topic   string   `json:"topic"`
+	// "all" (default), "leader" or "none".
+	Acks string `json:"acks"`
+	// "round-robin" (default) sends each batch to the next
+	// partition. "hash" picks partitions by the murmur2 hash
+	// of the message key, as the Java client does.
+	Partitioner string `json:"partitioner"`
+	// Message key: a top level field of JSON messages (KeyField)
+	// or metadata (KeyMeta: listener, source, client or route).
+	KeyField string `json:"key-field"`
+	KeyMeta  string `json:"key-meta"`
+	// "none" (default) or "gzip".
+	Compression string `json:"compression"`
+	// Use an idempotent producer so retries can't duplicate
+	// messages. Requires acks "all".
+	Idempotent   bool   `json:"idempotent"`
+	Retries      *int   `json:"retries"`
+	RetryBackoff string `json:"retry-backoff"`
+	MaxBackoff   string `json:"max-backoff"`
+	Timeout      string `json:"timeout"`
+	ClientID     string `json:"client-id"`
+
+	acks         int16
+	codec        int16
+	retries      int
+	retryBackoff time.Duration
+	maxBackoff   time.Duration
+	timeout      time.Duration
+}
+
+// Validate checks settings and fills in defaults.
+func (c *Config) Validate() error {
+	if len(c.Brokers) == 0 {
+		return errors.New("brokers is required")
+	}
+	if c.Topic == "" {
+		return errors.New("topic is required")
+	}
+
+	switch c.Acks {
+	case "", "all":
+		c.acks = -1
+	case "leader":
+		c.acks = 1
+	case "none":
+		c.acks = 0
+	default:
+		return fmt.Errorf("invalid acks %q", c.Acks)
+	}
+	if c.Idempotent && c.acks != -1 {
+		return errors.New("idempotent requires acks all")
+	}
+
+	switch c.Partitioner {
+	case "", "round-robin":
+	case "hash":
+		if (c.KeyField == "") == (c.KeyMeta == "") {
+			return errors.New("hash partitioner requires one of key-field or key-meta")
+		}
+	default:
+		return fmt.Errorf("invalid partitioner %q", c.Partitioner)
+	}
+	if c.KeyMeta != "" && !outputs.ValidMeta(c.KeyMeta) {
+		return fmt.Errorf("invalid key-meta %q", c.KeyMeta)
+	}
+
+	switch c.Compression {
+	case "", "none":
+		c.codec = codecNone
+	case "gzip":
+		c.codec = codecGzip
+	default:
+		return fmt.Errorf("unsupported compression %q", c.Compression)
+	}
+
+	c.retries = 5
+	if c.Retries != nil {
+		if *c.Retries < 0 {
+			return errors.New("retries can't be negative")
+		}
+		c.retries = *c.Retries
+	}
+
+	var err error
+	if c.retryBackoff, err = outputs.Duration(c.RetryBackoff, "100ms"); err != nil {
+		return fmt.Errorf("invalid retry-backoff %q", c.RetryBackoff)
+	}
+	if c.maxBackoff, err = outputs.Duration(c.MaxBackoff, "5s"); err != nil {
+		return fmt.Errorf("invalid max-backoff %q", c.MaxBackoff)
+	}
+	if c.timeout, err = outputs.Duration(c.Timeout, "10s"); err != nil {
+		return fmt.Errorf("invalid timeout %q", c.Timeout)
+	}
+	if c.ClientID == "" {
+		c.ClientID = "ascender"
+	}
+
+	return nil
+}
+
+// Worker that reads message batches from the messageOutgoingQueue
+// and produces them to Kafka. Each worker has its own broker
+// connections and, if idempotent, its own producer id.
+func Handler(c *Config, messageOutgoingQueue <-chan []*outputs.Message, s outputs.Statser) {
+	p := &producer{config: c, stats: s, client: newClient(c), producerID: -1}
+	defer p.client.close()
+
+	for m := range messageOutgoingQueue {
+		sent, err := p.send(m)
+		if err != nil {
+			log.Printf("Kafka batch error: %s\n", err)
+		}
+		s.IncrSent(int64(sent))
+	}
+}
+
+// producer sends batches, retrying failed partitions.
+type producer struct {
+	config *Config
+	stats  outputs.Statser
+	client *client
+	// Next round-robin partition index.
+	next int
+	// Idempotent producer state.
+	producerID    int64
+	producerEpoch int16
+	sequences     map[int32]int32
+}
+
+// send produces a batch, grouping messages by partition, and
+// returns the number of messages sent. Messages not sent are
+// passed to the Statser.
+func (p *producer) send(batch []*outputs.Message) (int, error) {
+	backoff := p.config.retryBackoff
+	for attempt := 0; len(p.client.partitions) == 0; attempt++ {
+		err := p.client.refreshMetadata()
+		if err == nil {
+			break
+		}
+		if attempt >= p.config.retries {
+			for _, m := range batch {
+				p.stats.Failed(m, 0, err)
+			}
+			return 0, err
+		}
+		log.Printf("Kafka %s, retrying in %s\n", err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > p.config.maxBackoff {
+			backoff = p.config.maxBackoff
+		}
+	}
+
+	groups := map[int32][]record{}
+	msgs := map[int32][]*outputs.Message{}
+	var order []int32
+	for _, m := range batch {
+		key := p.key(m)
+		var partition int32
+		if p.config.Partitioner == "hash" && key != nil {
+			partition = p.client.partitions[partitionForKey(key, len(p.client.partitions))]
+		} else {
+			partition = p.client.partitions[p.next%len(p.client.partitions)]
+		}
+		if _, ok := groups[partition]; !ok {
+			order = append(order, partition)
+		}
+		groups[partition] = append(groups[partition], record{key: key, value: []byte(m.Body)})
+		msgs[partition] = append(msgs[partition], m)
+	}
+	p.next++
+
+	var failed int
+	var lastErr error
+	for _, partition := range order {
+		attempts, err := p.produce(partition, groups[partition])
+		if err != nil {
+			failed += len(groups[partition])
+			lastErr = err
+			for _, m := range msgs[partition] {
+				p.stats.Failed(m, attempts, err)
+			}
+		}
+	}
+	if lastErr != nil {
+		return len(batch) - failed, fmt.Errorf("%d of %d messages not sent: %s", failed, len(batch), lastErr)
+	}
+
+	return len(batch), nil
+}
+
+// key returns the configured key for m, nil if none.
+func (p *producer) key(m *outputs.Message) []byte {
+	switch {
+	case p.config.KeyMeta != "":
+		if v := m.Meta(p.config.KeyMeta); v != "" {
+			return []byte(v)
+		}
+	case p.config.KeyField != "":
+		if v := m.Field(p.config.KeyField); v != "" {
+			return []byte(v)
+		}
+	}
+	return nil
+}
+
+// produce sends records to a partition, retrying retriable
+// errors, and returns the number of attempts made. Idempotent
+// retries resend the same sequence numbers so the broker drops
+// any duplicates.
+func (p *producer) produce(partition int32, records []record) (int, error) {
+	rb := &recordBatch{
+		records:       records,
+		timestamp:     time.Now(),
+		codec:         p.config.codec,
+		producerID:    -1,
+		producerEpoch: -1,
+		baseSequence:  -1,
+	}
+
+	backoff := p.config.retryBackoff
+	for attempt := 0; ; attempt++ {
+		err := p.attempt(partition, rb)
+		if err == nil {
+			return attempt + 1, nil
+		}
+
+		if attempt >= p.config.retries || !retriable(err) {
+			// The broker may have written the batch; a new
+			// producer id keeps later sequences unambiguous.
+			p.producerID = -1
+			return attempt + 1, err
+		}
+
+		log.Printf("Kafka produce to %s/%d failed, retrying in %s: %s\n",
+			p.config.Topic, partition, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > p.config.maxBackoff {
+			backoff = p.config.maxBackoff
+		}
+		if err := p.client.refreshMetadata(); err != nil {
+			log.Printf("Kafka %s\n", err)
+		}
+	}
+}
+
+// attempt makes a single produce request for rb.
+func (p *producer) attempt(partition int32, rb *recordBatch) error {
+	if p.config.Idempotent {
+		if p.producerID < 0 {
+			id, epoch, err := p.client.initProducerID()
+			if err != nil {
+				return err
+			}
+			p.producerID, p.producerEpoch = id, epoch
+			p.sequences = map[int32]int32{}
+		}
+		rb.producerID, rb.producerEpoch = p.producerID, p.producerEpoch
+		rb.baseSequence = p.sequences[partition]
+	}
+
+	batch, err := rb.encode()
+	if err != nil {
+		return err
+	}
+
+	err = p.client.produce(partition, batch)
+	switch err {
+	case nil, errDuplicateSequence:
+		if p.config.Idempotent {
+			p.sequences[partition] += int32(len(rb.records))
+		}
+		return nil
+	case errOutOfOrderSequence, errUnknownProducerID, errInvalidProducerEpoch:
+		// Producer state was lost by the broker; start over
+		// with a new producer id on the next attempt.
+		p.producerID = -1
+		return retryError{err}
+	}
+
+	return err
+}
+
+// retryError marks errors that should be retried.
+type retryError struct {
+	error
+}
+
+// retriable reports whether err may succeed if retried:
+// retriable Kafka errors and connection errors.
+func retriable(err error) bool {
+	if e, ok := err.(Error); ok {
+		return e.retriable()
+	}
+	return true
+}
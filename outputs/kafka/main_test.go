@@ -0,0 +1,407 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jamiealquiza/ascender/outputs/outputstest"
+)
+
+// Values from the Java client's tests.
+func TestMurmur2(t *testing.T) {
+	for key, want := range map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	} {
+		if got := murmur2([]byte(key)); got != want {
+			t.Errorf("murmur2(%q) = %d, want %d", key, got, want)
+		}
+	}
+	if p := partitionForKey([]byte("21"), 3); p != int(int32(-973932308)&0x7fffffff)%3 {
+		t.Errorf("partition %d", p)
+	}
+}
+
+func TestCastagnoli(t *testing.T) {
+	if c := crc32.Checksum([]byte("123456789"), castagnoli); c != 0xe3069283 {
+		t.Fatalf("crc %x", c)
+	}
+}
+
+// decodedBatch is a record batch as a broker reads it.
+type decodedBatch struct {
+	codec              int16
+	producerID         int64
+	producerEpoch      int16
+	baseSequence       int32
+	firstTime, maxTime int64
+	keys, values       []string
+	lastOffsetDelta    int32
+}
+
+// decodeBatch decodes a v2 record batch, checking its
+// length and CRC.
+func decodeBatch(t *testing.T, b []byte) *decodedBatch {
+	t.Helper()
+	d := &decoder{b: b}
+	if d.int64() != 0 {
+		t.Fatal("base offset not 0")
+	}
+	if n := d.int32(); int(n) != len(d.b) {
+		t.Fatalf("batch length %d, %d bytes follow", n, len(d.b))
+	}
+	d.int32() // Partition leader epoch.
+	if magic := d.int8(); magic != 2 {
+		t.Fatalf("magic %d", magic)
+	}
+	if crc := uint32(d.int32()); crc != crc32.Checksum(d.b, castagnoli) {
+		t.Fatal("crc mismatch")
+	}
+
+	rb := &decodedBatch{}
+	rb.codec = d.int16()
+	rb.lastOffsetDelta = d.int32()
+	rb.firstTime, rb.maxTime = d.int64(), d.int64()
+	rb.producerID, rb.producerEpoch, rb.baseSequence = d.int64(), d.int16(), d.int32()
+	count := int(d.int32())
+	records := d.b
+	if rb.codec == codecGzip {
+		r, err := gzip.NewReader(bytes.NewReader(records))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if records, err = io.ReadAll(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	varint := func() int64 {
+		v, n := binary.Varint(records)
+		if n <= 0 {
+			t.Fatal("bad varint")
+		}
+		records = records[n:]
+		return v
+	}
+	varbytes := func() []byte {
+		n := varint()
+		if n < 0 {
+			return nil
+		}
+		v := records[:n]
+		records = records[n:]
+		return v
+	}
+	for i := 0; i < count; i++ {
+		length := varint()
+		end := len(records) - int(length)
+		records = records[1:] // Attributes.
+		varint()              // Timestamp delta.
+		if delta := varint(); delta != int64(i) {
+			t.Fatalf("record %d offset delta %d", i, delta)
+		}
+		rb.keys = append(rb.keys, string(varbytes()))
+		rb.values = append(rb.values, string(varbytes()))
+		if headers := varint(); headers != 0 {
+			t.Fatalf("%d headers", headers)
+		}
+		if len(records) != end {
+			t.Fatalf("record %d length %d wrong", i, length)
+		}
+	}
+	if len(records) != 0 || d.err != nil {
+		t.Fatalf("%d bytes after records: %v", len(records), d.err)
+	}
+	return rb
+}
+
+func TestRecordBatch(t *testing.T) {
+	ts := time.Unix(1500000000, 123e6)
+	for _, codec := range []int16{codecNone, codecGzip} {
+		rb := &recordBatch{
+			records:       []record{{key: []byte("k"), value: []byte("one")}, {value: []byte("two")}},
+			timestamp:     ts,
+			codec:         codec,
+			producerID:    7,
+			producerEpoch: 1,
+			baseSequence:  42,
+		}
+		b, err := rb.encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := decodeBatch(t, b)
+		switch {
+		case got.codec != codec, got.lastOffsetDelta != 1,
+			got.firstTime != 1500000000123, got.maxTime != 1500000000123,
+			got.producerID != 7, got.producerEpoch != 1, got.baseSequence != 42:
+			t.Errorf("codec %d: batch %+v", codec, got)
+		}
+		if len(got.values) != 2 || got.keys[0] != "k" || got.keys[1] != "" || got.values[0] != "one" || got.values[1] != "two" {
+			t.Errorf("codec %d: records %q %q", codec, got.keys, got.values)
+		}
+	}
+}
+
+// broker is a fake Kafka broker serving one topic.
+type broker struct {
+	t          *testing.T
+	addr       string
+	partitions int32
+	mu         sync.Mutex
+	// Errors for produce requests in turn, then none.
+	produceErrors []Error
+	// Record batches produced by partition.
+	produced map[int32][][]byte
+	versions map[int16]int16
+}
+
+func newBroker(t *testing.T, partitions int32) *broker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	b := &broker{t: t, addr: l.Addr().String(), partitions: partitions, produced: map[int32][][]byte{}, versions: map[int16]int16{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *broker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		d := &decoder{b: req}
+		key, version, id := d.int16(), d.int16(), d.int32()
+		d.string() // Client id.
+
+		b.mu.Lock()
+		b.versions[key] = version
+		e := &encoder{}
+		e.int32(0) // Size.
+		e.int32(id)
+		respond := true
+		switch key {
+		case apiMetadata:
+			b.metadata(d, e)
+		case apiInitProducerID:
+			e.int32(0)
+			e.int16(0)
+			e.int64(1000)
+			e.int16(3)
+		case apiProduce:
+			respond = b.produce(d, e)
+		}
+		b.mu.Unlock()
+
+		if respond {
+			binary.BigEndian.PutUint32(e.b, uint32(len(e.b)-4))
+			conn.Write(e.b)
+		}
+	}
+}
+
+func (b *broker) metadata(d *decoder, e *encoder) {
+	var topics []string
+	for i, n := 0, d.arrayLen(); i < n; i++ {
+		topics = append(topics, d.string())
+	}
+	if d.int8() != 1 || d.err != nil {
+		b.t.Errorf("metadata request: auto create not set: %v", d.err)
+	}
+
+	host, port, _ := net.SplitHostPort(b.addr)
+	p, _ := strconv.Atoi(port)
+	e.int32(0) // Throttle time.
+	e.int32(1)
+	e.int32(1) // Node id.
+	e.string(host)
+	e.int32(int32(p))
+	e.nullString() // Rack.
+	e.string("cluster")
+	e.int32(1) // Controller.
+	e.int32(int32(len(topics)))
+	for _, topic := range topics {
+		e.int16(0)
+		e.string(topic)
+		e.int8(0)
+		e.int32(b.partitions)
+		// Listed in reverse, to be sorted by the client.
+		for p := b.partitions - 1; p >= 0; p-- {
+			e.int16(0)
+			e.int32(p)
+			e.int32(1) // Leader.
+			e.int32(1)
+			e.int32(1) // Replicas.
+			e.int32(1)
+			e.int32(1) // Isr.
+		}
+	}
+}
+
+func (b *broker) produce(d *decoder, e *encoder) bool {
+	d.string() // Transactional id.
+	acks := d.int16()
+	d.int32() // Timeout.
+	d.arrayLen()
+	topic := d.string()
+	d.arrayLen()
+	partition := d.int32()
+	batch := d.next(int(d.int32()))
+	if d.err != nil {
+		b.t.Errorf("produce request: %s", d.err)
+	}
+
+	code := errNone
+	if len(b.produceErrors) > 0 {
+		code, b.produceErrors = b.produceErrors[0], b.produceErrors[1:]
+	} else {
+		b.produced[partition] = append(b.produced[partition], batch)
+	}
+
+	e.int32(1)
+	e.string(topic)
+	e.int32(1)
+	e.int32(partition)
+	e.int16(int16(code))
+	e.int64(0)  // Base offset.
+	e.int64(-1) // Log append time.
+	e.int32(0)  // Throttle time.
+	return acks != 0
+}
+
+// batches decodes the batches produced to partition.
+func (b *broker) batches(partition int32) []*decodedBatch {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var rbs []*decodedBatch
+	for _, batch := range b.produced[partition] {
+		rbs = append(rbs, decodeBatch(b.t, batch))
+	}
+	return rbs
+}
+
+// version returns the version of the last request for key.
+func (b *broker) version(key int16) int16 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.versions[key]
+}
+
+func testConfig(t *testing.T, b *broker, c *Config) *Config {
+	c.Brokers, c.Topic = []string{b.addr}, "events"
+	if c.RetryBackoff == "" {
+		c.RetryBackoff = "1ms"
+	}
+	c.Timeout = "2s"
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestProduce(t *testing.T) {
+	b := newBroker(t, 2)
+	s := &outputstest.Stats{}
+	p := &producer{config: testConfig(t, b, &Config{}), stats: s, client: newClient(testConfig(t, b, &Config{})), producerID: -1}
+	defer p.client.close()
+
+	if n, err := p.send(outputstest.Messages("a", "b")); n != 2 || err != nil {
+		t.Fatalf("sent %d: %v", n, err)
+	}
+	if n, err := p.send(outputstest.Messages("c")); n != 1 || err != nil {
+		t.Fatalf("sent %d: %v", n, err)
+	}
+	if m, p := b.version(apiMetadata), b.version(apiProduce); m != 4 || p != 3 {
+		t.Errorf("metadata v%d, produce v%d", m, p)
+	}
+	if p.client.partitions[0] != 0 || p.client.partitions[1] != 1 {
+		t.Errorf("partitions %v", p.client.partitions)
+	}
+
+	// Round robin by batch.
+	p0, p1 := b.batches(0), b.batches(1)
+	if len(p0) != 1 || len(p1) != 1 {
+		t.Fatalf("produced %d and %d batches", len(p0), len(p1))
+	}
+	if v := p0[0].values; len(v) != 2 || v[0] != "a" || v[1] != "b" {
+		t.Errorf("partition 0 got %q", v)
+	}
+	if v := p1[0]; v.values[0] != "c" || v.producerID != -1 || v.baseSequence != -1 {
+		t.Errorf("partition 1 got %+v", v)
+	}
+}
+
+func TestProduceHash(t *testing.T) {
+	b := newBroker(t, 2)
+	c := testConfig(t, b, &Config{Partitioner: "hash", KeyField: "user", Compression: "gzip"})
+	p := &producer{config: c, stats: &outputstest.Stats{}, client: newClient(c), producerID: -1}
+	defer p.client.close()
+
+	if _, err := p.send(outputstest.Messages(`{"user": "21"}`, `{"user": "abc"}`, `{"user": "21"}`)); err != nil {
+		t.Fatal(err)
+	}
+	// Keys on different partitions.
+	for _, key := range []string{"21", "abc"} {
+		rb := b.batches(int32(partitionForKey([]byte(key), 2)))
+		if len(rb) != 1 || rb[0].codec != codecGzip || rb[0].keys[0] != key || len(rb[0].keys) != map[string]int{"21": 2, "abc": 1}[key] {
+			t.Errorf("key %s: %+v", key, rb)
+		}
+	}
+}
+
+// Retriable errors are retried, idempotently with the same
+// sequence; others fail the messages.
+func TestProduceRetries(t *testing.T) {
+	b := newBroker(t, 1)
+	b.produceErrors = []Error{errNotLeaderForPartition, errRequestTimedOut}
+	c := testConfig(t, b, &Config{Idempotent: true})
+	s := &outputstest.Stats{}
+	p := &producer{config: c, stats: s, client: newClient(c), producerID: -1}
+	defer p.client.close()
+
+	if n, err := p.send(outputstest.Messages("a", "b")); n != 2 || err != nil {
+		t.Fatalf("sent %d: %v", n, err)
+	}
+	if n, err := p.send(outputstest.Messages("c")); n != 1 || err != nil {
+		t.Fatalf("sent %d: %v", n, err)
+	}
+	rbs := b.batches(0)
+	if len(rbs) != 2 || rbs[0].producerID != 1000 || rbs[0].producerEpoch != 3 || rbs[0].baseSequence != 0 || rbs[1].baseSequence != 2 {
+		t.Fatalf("produced %+v", rbs)
+	}
+
+	b.mu.Lock()
+	b.produceErrors = []Error{29} // TOPIC_AUTHORIZATION_FAILED
+	b.mu.Unlock()
+	if n, err := p.send(outputstest.Messages("d")); n != 0 || err == nil || len(s.Dropped()) != 1 {
+		t.Fatalf("sent %d, %d failed: %v", n, len(s.Dropped()), err)
+	}
+}
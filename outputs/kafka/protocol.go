@@ -0,0 +1,207 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Kafka API keys and the versions used, the oldest
+// Kafka 4 accepts.
+const (
+	apiProduce        int16 = 0
+	apiMetadata       int16 = 3
+	apiInitProducerID int16 = 22
+
+	produceVersion        int16 = 3
+	metadataVersion       int16 = 4
+	initProducerIDVersion int16 = 0
+)
+
+// encoder appends Kafka protocol primitives to a buffer.
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) int8(v int8) {
+	e.b = append(e.b, byte(v))
+}
+
+func (e *encoder) int16(v int16) {
+	e.b = binary.BigEndian.AppendUint16(e.b, uint16(v))
+}
+
+func (e *encoder) int32(v int32) {
+	e.b = binary.BigEndian.AppendUint32(e.b, uint32(v))
+}
+
+func (e *encoder) int64(v int64) {
+	e.b = binary.BigEndian.AppendUint64(e.b, uint64(v))
+}
+
+func (e *encoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+// nullString encodes a null nullable string.
+func (e *encoder) nullString() {
+	e.int16(-1)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.b = append(e.b, b...)
+}
+
+// varint encodes a zigzag varint, as used in record batches.
+func (e *encoder) varint(v int64) {
+	e.b = binary.AppendVarint(e.b, v)
+}
+
+// varbytes encodes varint length prefixed bytes, -1 if nil.
+func (e *encoder) varbytes(b []byte) {
+	if b == nil {
+		e.varint(-1)
+		return
+	}
+	e.varint(int64(len(b)))
+	e.b = append(e.b, b...)
+}
+
+var errShortResponse = errors.New("short response")
+
+// decoder reads Kafka protocol primitives. The first
+// error is kept and later reads return zero values.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.b) < n {
+		d.err = errShortResponse
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) int8() int8 {
+	if b := d.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *decoder) int16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// string reads a string or nullable string (null as "").
+func (d *decoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+// arrayLen reads an array length, treating null as empty.
+func (d *decoder) arrayLen() int {
+	n := d.int32()
+	if n < 0 {
+		return 0
+	}
+	if int(n) > len(d.b) && d.err == nil {
+		d.err = errShortResponse
+		return 0
+	}
+	return int(n)
+}
+
+// Error is a Kafka protocol error code.
+type Error int16
+
+// Error codes handled by the producer.
+const (
+	errNone                      Error = 0
+	errUnknownTopicOrPartition   Error = 3
+	errLeaderNotAvailable        Error = 5
+	errNotLeaderForPartition     Error = 6
+	errRequestTimedOut           Error = 7
+	errNetworkException          Error = 13
+	errCoordinatorLoadInProgress Error = 14
+	errCoordinatorNotAvailable   Error = 15
+	errNotCoordinator            Error = 16
+	errNotEnoughReplicas         Error = 19
+	errNotEnoughReplicasAfter    Error = 20
+	errOutOfOrderSequence        Error = 45
+	errDuplicateSequence         Error = 46
+	errInvalidProducerEpoch      Error = 47
+	errUnknownProducerID         Error = 59
+)
+
+var errorNames = map[Error]string{
+	errUnknownTopicOrPartition:   "UNKNOWN_TOPIC_OR_PARTITION",
+	errLeaderNotAvailable:        "LEADER_NOT_AVAILABLE",
+	errNotLeaderForPartition:     "NOT_LEADER_OR_FOLLOWER",
+	errRequestTimedOut:           "REQUEST_TIMED_OUT",
+	errNetworkException:          "NETWORK_EXCEPTION",
+	errCoordinatorLoadInProgress: "COORDINATOR_LOAD_IN_PROGRESS",
+	errCoordinatorNotAvailable:   "COORDINATOR_NOT_AVAILABLE",
+	errNotCoordinator:            "NOT_COORDINATOR",
+	errNotEnoughReplicas:         "NOT_ENOUGH_REPLICAS",
+	errNotEnoughReplicasAfter:    "NOT_ENOUGH_REPLICAS_AFTER_APPEND",
+	errOutOfOrderSequence:        "OUT_OF_ORDER_SEQUENCE_NUMBER",
+	errDuplicateSequence:         "DUPLICATE_SEQUENCE_NUMBER",
+	errInvalidProducerEpoch:      "INVALID_PRODUCER_EPOCH",
+	errUnknownProducerID:         "UNKNOWN_PRODUCER_ID",
+	10:                           "MESSAGE_TOO_LARGE",
+	17:                           "INVALID_TOPIC_EXCEPTION",
+	18:                           "RECORD_LIST_TOO_LARGE",
+	29:                           "TOPIC_AUTHORIZATION_FAILED",
+	31:                           "CLUSTER_AUTHORIZATION_FAILED",
+	87:                           "INVALID_RECORD",
+}
+
+func (e Error) Error() string {
+	if name, ok := errorNames[e]; ok {
+		return fmt.Sprintf("kafka error %d (%s)", int16(e), name)
+	}
+	return fmt.Sprintf("kafka error %d", int16(e))
+}
+
+// retriable reports whether a request failing
+// with e may succeed if retried.
+func (e Error) retriable() bool {
+	switch e {
+	case errUnknownTopicOrPartition, errLeaderNotAvailable, errNotLeaderForPartition,
+		errRequestTimedOut, errNetworkException, errCoordinatorLoadInProgress,
+		errCoordinatorNotAvailable, errNotCoordinator, errNotEnoughReplicas,
+		errNotEnoughReplicasAfter:
+		return true
+	}
+	return false
+}
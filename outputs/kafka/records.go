@@ -0,0 +1,133 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"time"
+)
+
+// Record batch attribute compression codecs.
+const (
+	codecNone int16 = 0
+	codecGzip int16 = 1
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// record is a key and value to produce.
+type record struct {
+	key, value []byte
+}
+
+// recordBatch holds the fields of a v2 (magic 2)
+// record batch that vary between produce requests.
+type recordBatch struct {
+	records   []record
+	timestamp time.Time
+	codec     int16
+	// Idempotent producer fields, -1 if not idempotent.
+	producerID    int64
+	producerEpoch int16
+	baseSequence  int32
+}
+
+// encode returns the record batch in the Kafka v2 format.
+func (rb *recordBatch) encode() ([]byte, error) {
+	ts := rb.timestamp.UnixNano() / int64(time.Millisecond)
+
+	// Records, compressed together if configured.
+	r := &encoder{}
+	for i, rec := range rb.records {
+		body := &encoder{}
+		body.int8(0)             // Attributes.
+		body.varint(0)           // Timestamp delta.
+		body.varint(int64(i))    // Offset delta.
+		body.varbytes(rec.key)   // Key.
+		body.varbytes(rec.value) // Value.
+		body.varint(0)           // Header count.
+		r.varint(int64(len(body.b)))
+		r.b = append(r.b, body.b...)
+	}
+	records := r.b
+	if rb.codec == codecGzip {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(records); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		records = buf.Bytes()
+	}
+
+	// Fields covered by the CRC.
+	c := &encoder{}
+	c.int16(rb.codec)                   // Attributes.
+	c.int32(int32(len(rb.records) - 1)) // Last offset delta.
+	c.int64(ts)                         // First timestamp.
+	c.int64(ts)                         // Max timestamp.
+	c.int64(rb.producerID)              // Producer ID.
+	c.int16(rb.producerEpoch)           // Producer epoch.
+	c.int32(rb.baseSequence)            // Base sequence.
+	c.int32(int32(len(rb.records)))     // Record count.
+	c.b = append(c.b, records...)
+
+	e := &encoder{}
+	e.int64(0)                   // Base offset.
+	e.int32(int32(9 + len(c.b))) // Batch length: epoch, magic, crc and the rest.
+	e.int32(-1)                  // Partition leader epoch.
+	e.int8(2)                    // Magic.
+	e.b = binary.BigEndian.AppendUint32(e.b, crc32.Checksum(c.b, castagnoli))
+	e.b = append(e.b, c.b...)
+
+	return e.b, nil
+}
+
+// murmur2 is the hash used by the Java client's default
+// partitioner, so keyed messages land on the same
+// partitions as they would from other producers.
+func murmur2(data []byte) int32 {
+	const (
+		seed uint32 = 0x9747b28c
+		m    uint32 = 0x5bd1e995
+		r           = 24
+	)
+	length := len(data)
+	h := seed ^ uint32(length)
+
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+
+	tail := data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+
+	return int32(h)
+}
+
+// partitionForKey maps a key to one of n partitions.
+func partitionForKey(key []byte, n int) int {
+	return int(murmur2(key)&0x7fffffff) % n
+}
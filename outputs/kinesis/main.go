@@ -0,0 +1,343 @@
+// Package kinesis puts messages to an AWS Kinesis data
+// stream with PutRecords.
+package kinesis
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/AdRoll/goamz/aws"
+	"github.com/jamiealquiza/ascender/outputs"
+)
+
+// PutRecords limits. Record sizes include the partition key.
+const (
+	maxRecords      = 500
+	maxRecordBytes  = 1024 * 1024
+	maxRequestBytes = 5 * 1024 * 1024
+	maxKeyLength    = 256
+)
+
+// Config holds Kinesis output settings.
+type Config struct {
+	Stream string `json:"stream"`
+	// Default us-east-1.
+	Region string `json:"region"`
+	// If unset, credentials come from the environment, the
+	// instance role or the shared credentials file.
+	AccessKey string `json:"access-key"`
+	SecretKey string `json:"secret-key"`
+	// URL used instead of the region's endpoint.
+	Endpoint string `json:"endpoint"`
+	// Partition key template, e.g. "{:source}" (see
+	// outputs.Template). Messages get a random key if
+	// unset or the key is empty.
+	PartitionKey string `json:"partition-key"`
+	Retries      *int   `json:"retries"`
+	RetryBackoff string `json:"retry-backoff"`
+	MaxBackoff   string `json:"max-backoff"`
+	Timeout      string `json:"timeout"`
+
+	region       aws.Region
+	endpoint     string
+	partitionKey *outputs.Template
+	retries      int
+	retryBackoff time.Duration
+	maxBackoff   time.Duration
+	timeout      time.Duration
+}
+
+// Validate checks settings and fills in defaults.
+func (c *Config) Validate() error {
+	if c.Stream == "" {
+		return errors.New("stream is required")
+	}
+	if c.Region == "" {
+		c.Region = "us-east-1"
+	}
+	if (c.AccessKey == "") != (c.SecretKey == "") {
+		return errors.New("access-key and secret-key must be set together")
+	}
+
+	var ok bool
+	if c.region, ok = aws.Regions[c.Region]; ok && c.region.KinesisEndpoint != "" {
+		c.endpoint = c.region.KinesisEndpoint
+	} else {
+		c.region = aws.Region{Name: c.Region}
+		c.endpoint = fmt.Sprintf("https://kinesis.%s.amazonaws.com", c.Region)
+	}
+	if c.Endpoint != "" {
+		u, err := url.Parse(c.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("endpoint must be an absolute http or https URL")
+		}
+		c.endpoint = c.Endpoint
+	}
+
+	var err error
+	if c.PartitionKey != "" {
+		if c.partitionKey, err = outputs.ParseTemplate(c.PartitionKey); err != nil {
+			return err
+		}
+	}
+
+	c.retries = 3
+	if c.Retries != nil {
+		if *c.Retries < 0 {
+			return errors.New("retries can't be negative")
+		}
+		c.retries = *c.Retries
+	}
+	if c.retryBackoff, err = outputs.Duration(c.RetryBackoff, "100ms"); err != nil {
+		return fmt.Errorf("invalid retry-backoff %q", c.RetryBackoff)
+	}
+	if c.maxBackoff, err = outputs.Duration(c.MaxBackoff, "5s"); err != nil {
+		return fmt.Errorf("invalid max-backoff %q", c.MaxBackoff)
+	}
+	if c.timeout, err = outputs.Duration(c.Timeout, "10s"); err != nil {
+		return fmt.Errorf("invalid timeout %q", c.Timeout)
+	}
+
+	return nil
+}
+
+// Worker that reads message batches from the messageOutgoingQueue
+// and puts them, split into requests within the PutRecords limits.
+func Handler(c *Config, messageOutgoingQueue <-chan []*outputs.Message, s outputs.Statser) {
+	auth, err := aws.GetAuth(c.AccessKey, c.SecretKey, "", time.Time{})
+	for err != nil {
+		log.Printf("Kinesis credentials error: %s, retrying in 5s\n", err)
+		time.Sleep(5 * time.Second)
+		auth, err = aws.GetAuth(c.AccessKey, c.SecretKey, "", time.Time{})
+	}
+	p := &putter{config: c, auth: auth, client: &http.Client{Timeout: c.timeout}, stats: s}
+
+	for m := range messageOutgoingQueue {
+		sent, err := p.send(m)
+		if err != nil {
+			log.Printf("Kinesis batch error: %d of %d messages not sent: %s\n", len(m)-sent, len(m), err)
+		}
+		s.IncrSent(int64(sent))
+	}
+}
+
+// putter sends batches with PutRecords requests.
+type putter struct {
+	config *Config
+	auth   aws.Auth
+	client *http.Client
+	stats  outputs.Statser
+}
+
+// record is a PutRecords entry. Data is base64 encoded
+// when marshaled.
+type record struct {
+	Data         []byte
+	PartitionKey string
+
+	msg      *outputs.Message
+	attempts int
+}
+
+// partitionKey returns the key for m, truncated to the
+// longest allowed, or a random one if empty.
+func (p *putter) partitionKey(m *outputs.Message) string {
+	var key string
+	if p.config.partitionKey != nil {
+		key = p.config.partitionKey.Execute(m, nil)
+	}
+	if key == "" {
+		b := make([]byte, 16)
+		rand.Read(b)
+		return hex.EncodeToString(b)
+	}
+	if r := []rune(key); len(r) > maxKeyLength {
+		key = string(r[:maxKeyLength])
+	}
+	return key
+}
+
+// send puts a batch and returns the number of messages sent.
+// Messages not sent are passed to the Statser.
+func (p *putter) send(batch []*outputs.Message) (int, error) {
+	sent := 0
+	var err error
+	var req []*record
+	size := 0
+	flush := func() {
+		n, ferr := p.put(req)
+		sent += n
+		if ferr != nil {
+			err = ferr
+		}
+		req, size = nil, 0
+	}
+	for _, m := range batch {
+		r := &record{Data: []byte(m.Body), PartitionKey: p.partitionKey(m), msg: m}
+		n := len(r.Data) + len(r.PartitionKey)
+		if n > maxRecordBytes {
+			err = fmt.Errorf("record of %d bytes exceeds %d", n, maxRecordBytes)
+			p.stats.Failed(m, 0, err)
+			continue
+		}
+		if len(req) == maxRecords || size+n > maxRequestBytes {
+			flush()
+		}
+		req = append(req, r)
+		size += n
+	}
+	if len(req) > 0 {
+		flush()
+	}
+
+	return sent, err
+}
+
+// put sends records, retrying failed requests and records
+// with backoff. It returns the number sent.
+func (p *putter) put(records []*record) (int, error) {
+	sent := 0
+	var err error
+	backoff := p.config.retryBackoff
+	for attempt := 0; len(records) > 0; attempt++ {
+		var n int
+		var retry bool
+		n, records, retry, err = p.attempt(records)
+		sent += n
+		if err == nil || !retry || attempt >= p.config.retries {
+			break
+		}
+		log.Printf("Kinesis put failed, retrying %d messages in %s: %s\n", len(records), backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > p.config.maxBackoff {
+			backoff = p.config.maxBackoff
+		}
+	}
+	for _, r := range records {
+		p.stats.Failed(r.msg, r.attempts, err)
+	}
+
+	return sent, err
+}
+
+// putRecordsResponse holds the parts of a response used.
+// Records are in request order; failed ones have an ErrorCode.
+type putRecordsResponse struct {
+	FailedRecordCount int
+	Records           []struct {
+		ErrorCode    string
+		ErrorMessage string
+	}
+}
+
+// errorResponse is a Kinesis error.
+type errorResponse struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+// Errors worth retrying a request for.
+var retriable = map[string]bool{
+	"ProvisionedThroughputExceededException": true,
+	"LimitExceededException":                 true,
+	"ThrottlingException":                    true,
+	"KMSThrottlingException":                 true,
+	"InternalFailure":                        true,
+	"ServiceUnavailable":                     true,
+}
+
+// attempt sends one PutRecords request. It returns the number of
+// records sent, those that failed, and whether to retry them.
+func (p *putter) attempt(records []*record) (int, []*record, bool, error) {
+	for _, r := range records {
+		r.attempts++
+	}
+	body, err := json.Marshal(struct {
+		Records    []*record
+		StreamName string
+	}{records, p.config.Stream})
+	if err != nil {
+		return 0, records, false, err
+	}
+
+	status, resp, err := p.post(body)
+	if err != nil {
+		return 0, records, true, err
+	}
+	if status != http.StatusOK {
+		var e errorResponse
+		json.Unmarshal(resp, &e)
+		// Types may be prefixed with a namespace.
+		typ := e.Type
+		if i := strings.LastIndexByte(typ, '#'); i >= 0 {
+			typ = typ[i+1:]
+		}
+		retry := status >= 500 || retriable[typ]
+		return 0, records, retry, fmt.Errorf("%d %s: %s", status, typ, e.Message)
+	}
+
+	// Responses that don't say which records were put are
+	// retried, as requests that time out are.
+	var r putRecordsResponse
+	if err := json.Unmarshal(resp, &r); err != nil {
+		return 0, records, true, fmt.Errorf("invalid response: %s", err)
+	}
+	if len(r.Records) != len(records) {
+		return 0, records, true, fmt.Errorf("response has %d records, expected %d", len(r.Records), len(records))
+	}
+	if r.FailedRecordCount == 0 {
+		return len(records), nil, false, nil
+	}
+
+	// Failed records are throttled or hit internal errors,
+	// so all are retried.
+	var failed []*record
+	for i, res := range r.Records {
+		if res.ErrorCode == "" {
+			continue
+		}
+		if err == nil {
+			err = fmt.Errorf("%d records failed, first: %s: %s", r.FailedRecordCount, res.ErrorCode, res.ErrorMessage)
+		}
+		failed = append(failed, records[i])
+	}
+
+	return len(records) - len(failed), failed, true, err
+}
+
+// post sends a signed request, returning the response status and body.
+func (p *putter) post(body []byte) (int, []byte, error) {
+	c := p.config
+	req, err := http.NewRequest(http.MethodPost, c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "Kinesis_20131202.PutRecords")
+	if token := p.auth.Token(); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	aws.NewV4Signer(p.auth, "kinesis", c.region).Sign(req)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return resp.StatusCode, b, nil
+}
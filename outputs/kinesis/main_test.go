@@ -0,0 +1,122 @@
+package kinesis
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/goamz/aws"
+	"github.com/jamiealquiza/ascender/outputs/outputstest"
+)
+
+// putRequest holds the parts of a request checked.
+type putRequest struct {
+	StreamName string
+	Records    []struct {
+		Data         []byte
+		PartitionKey string
+	}
+}
+
+// stream answers requests with bodies in turn, then success
+// for every record, recording the data put by each request.
+func stream(t *testing.T, bodies ...string) (*putter, *outputstest.Stats, *[][]string) {
+	var mu sync.Mutex
+	var requests [][]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		var req putRequest
+		if err := json.Unmarshal(b, &req); err != nil || req.StreamName != "events" || r.Header.Get("X-Amz-Target") != "Kinesis_20131202.PutRecords" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		var data []string
+		for _, rec := range req.Records {
+			data = append(data, string(rec.Data))
+		}
+		requests = append(requests, data)
+		if len(bodies) > 0 {
+			w.Write([]byte(bodies[0]))
+			bodies = bodies[1:]
+			return
+		}
+		w.Write([]byte(`{"FailedRecordCount":0,"Records":[` + strings.Repeat(`{"SequenceNumber":"1"},`, len(data)-1) + `{"SequenceNumber":"1"}]}`))
+	}))
+	t.Cleanup(srv.Close)
+
+	retries := 2
+	c := &Config{Stream: "events", Endpoint: srv.URL, PartitionKey: "{:source}", Retries: &retries, RetryBackoff: "1ms"}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s := &outputstest.Stats{}
+	p := &putter{config: c, auth: aws.Auth{AccessKey: "a", SecretKey: "s"}, client: &http.Client{Timeout: time.Second}, stats: s}
+	return p, s, &requests
+}
+
+func TestPut(t *testing.T) {
+	p, s, requests := stream(t)
+	if n, err := p.send(outputstest.Messages("a", "b")); n != 2 || err != nil || len(*requests) != 1 || len(s.Dropped()) != 0 {
+		t.Fatalf("sent %d in %d requests: %v", n, len(*requests), err)
+	}
+	if got := strings.Join((*requests)[0], ","); got != "a,b" {
+		t.Errorf("put %s", got)
+	}
+}
+
+// Only records that failed are put again.
+func TestPutPartialFailure(t *testing.T) {
+	p, s, requests := stream(t, `{"FailedRecordCount":1,"Records":[
+		{"SequenceNumber":"1"},
+		{"ErrorCode":"ProvisionedThroughputExceededException","ErrorMessage":"slow down"},
+		{"SequenceNumber":"2"}]}`)
+	if n, err := p.send(outputstest.Messages("a", "b", "c")); n != 3 || err != nil || len(s.Dropped()) != 0 {
+		t.Fatalf("sent %d: %v", n, err)
+	}
+	if len(*requests) != 2 || strings.Join((*requests)[1], ",") != "b" {
+		t.Errorf("requests %v, want the failed record retried", *requests)
+	}
+
+	failed := `{"FailedRecordCount":1,"Records":[{"SequenceNumber":"1"},{"ErrorCode":"InternalFailure"}]}`
+	p, s, _ = stream(t, failed, `{"FailedRecordCount":1,"Records":[{"ErrorCode":"InternalFailure"}]}`, `{"FailedRecordCount":1,"Records":[{"ErrorCode":"InternalFailure"}]}`)
+	n, err := p.send(outputstest.Messages("a", "b"))
+	if dropped := s.Dropped(); n != 1 || err == nil || len(dropped) != 1 || dropped[0].Body != "b" {
+		t.Errorf("sent %d, failed %v: %v", n, dropped, err)
+	}
+}
+
+// Responses that don't account for every record have the
+// request retried, and its records failed if it never is.
+func TestPutUnreadableResponse(t *testing.T) {
+	for name, bad := range map[string]string{
+		"invalid": `<html>gateway error`,
+		"short":   `{"FailedRecordCount":0,"Records":[{"SequenceNumber":"1"}]}`,
+		"empty":   `{}`,
+	} {
+		p, s, requests := stream(t, bad)
+		if n, err := p.send(outputstest.Messages("a", "b")); n != 2 || err != nil || len(*requests) != 2 || len(s.Dropped()) != 0 {
+			t.Errorf("%s: sent %d in %d requests: %v", name, n, len(*requests), err)
+		}
+
+		p, s, _ = stream(t, bad, bad, bad)
+		if n, err := p.send(outputstest.Messages("a", "b")); n != 0 || err == nil || len(s.Dropped()) != 2 {
+			t.Errorf("%s: sent %d, %d failed: %v", name, n, len(s.Dropped()), err)
+		}
+	}
+}
+
+// Requests failing with client errors aren't retried.
+func TestPutRejected(t *testing.T) {
+	p, s, _ := stream(t)
+	p.config.Stream = "other"
+	if n, err := p.send(outputstest.Messages("a")); n != 0 || err == nil || len(s.Dropped()) != 1 {
+		t.Errorf("sent %d, %d failed: %v", n, len(s.Dropped()), err)
+	}
+}
@@ -0,0 +1,195 @@
+// Package outputs holds types shared by Ascender outputs.
+package outputs
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Message is a message handed to an output, along with
+// metadata about the connection it arrived on and the
+// route it took. Messages may be shared between outputs
+// and must not be modified.
+type Message struct {
+	Body string
+	// Name of the listener the message arrived on.
+	Listener string
+	// Remote IP of the client.
+	Source string
+	// Authenticated client name, if any.
+	Client string
+	// Name of the route that matched the message.
+	Route string
+	// When the message was read.
+	Received time.Time
+	// String attributes for outputs supporting them, such
+	// as how Body is encoded.
+	Attributes []Attribute
+	// The message before encoding or chunking, if it was.
+	Original *Message
+	// The messages packed into the message, if it's a pack.
+	Packed []*Message
+	// Shared by the chunks of a message, which is only
+	// failed once however many of them fail.
+	Chunks *Chunks
+}
+
+// Chunks tracks the chunks of a message.
+type Chunks struct {
+	failed int32
+}
+
+// FirstFailure reports whether no other chunk of the message
+// has failed. It's true for messages that weren't chunked.
+func (c *Chunks) FirstFailure() bool {
+	return c == nil || atomic.CompareAndSwapInt32(&c.failed, 0, 1)
+}
+
+// Attribute is a message attribute.
+type Attribute struct {
+	Name, Value string
+}
+
+// EncodingAttribute names the attribute saying how a
+// message is encoded, e.g. "gzip+base64".
+const EncodingAttribute = "Content-Encoding"
+
+// Attributes flagging a pack, with its format
+// ("ndjson" or "array") and message count.
+const (
+	PackFormatAttribute = "Pack-Format"
+	PackCountAttribute  = "Pack-Count"
+)
+
+// AttributeSize returns the bytes m's attributes
+// count toward a message size limit.
+func (m *Message) AttributeSize() int {
+	n := 0
+	for _, a := range m.Attributes {
+		n += len(a.Name) + len("String") + len(a.Value)
+	}
+	return n
+}
+
+// Meta returns metadata by name:
+// "listener", "source", "client" or "route".
+func (m *Message) Meta(name string) string {
+	switch name {
+	case "listener":
+		return m.Listener
+	case "source":
+		return m.Source
+	case "client":
+		return m.Client
+	case "route":
+		return m.Route
+	}
+	return ""
+}
+
+// MetaNames are the names accepted by Meta.
+var MetaNames = []string{"listener", "source", "client", "route"}
+
+// ValidMeta reports whether name is accepted by Meta.
+func ValidMeta(name string) bool {
+	for _, n := range MetaNames {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Field returns a top level field of a JSON message as a string
+// (the JSON text for non-string values), or "" if not present.
+func (m *Message) Field(name string) string {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal([]byte(m.Body), &fields) != nil {
+		return ""
+	}
+	return FieldString(fields[name])
+}
+
+// FieldString returns a JSON string field's value, or
+// the JSON text of other types. Null is empty.
+func FieldString(v json.RawMessage) string {
+	if v == nil || string(v) == "null" {
+		return ""
+	}
+	var s string
+	if json.Unmarshal(v, &s) == nil {
+		return s
+	}
+	return string(v)
+}
+
+// Time returns the time of a message: the top level field
+// name of a JSON message if it holds an RFC 3339 time or a
+// Unix time in seconds or milliseconds, else when it was
+// received, or now.
+func (m *Message) Time(field string) time.Time {
+	if field != "" {
+		if v := m.Field(field); v != "" {
+			if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+				return t
+			}
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				// Later than 2286 in seconds, so milliseconds.
+				if f > 1e10 {
+					f /= 1000
+				}
+				sec := int64(f)
+				return time.Unix(sec, int64((f-float64(sec))*1e9))
+			}
+		}
+	}
+	if !m.Received.IsZero() {
+		return m.Received
+	}
+	return time.Now()
+}
+
+// Line returns m as an NDJSON line. JSON is compacted;
+// other messages are wrapped as {"message": "..."}.
+func (m *Message) Line() []byte {
+	var b bytes.Buffer
+	if json.Compact(&b, []byte(m.Body)) != nil {
+		b.Reset()
+		enc := json.NewEncoder(&b)
+		enc.SetEscapeHTML(false)
+		enc.Encode(map[string]string{"message": m.Body})
+		return b.Bytes()
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+// JSONString returns s as a JSON string, without
+// escaping HTML.
+func JSONString(s string) json.RawMessage {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return bytes.TrimSpace(b.Bytes())
+}
+
+// JSONEscape escapes s for use inside a JSON string,
+// as a Template escape func.
+func JSONEscape(s string) string {
+	b := JSONString(s)
+	return string(b[1 : len(b)-1])
+}
+
+// Bodies returns the bodies of messages.
+func Bodies(messages []*Message) []string {
+	bodies := make([]string, len(messages))
+	for i, m := range messages {
+		bodies[i] = m.Body
+	}
+	return bodies
+}
@@ -0,0 +1,344 @@
+package mqtt
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxIncoming is the largest packet accepted from the server.
+// Only acks are expected, as nothing is subscribed.
+const maxIncoming = 64 * 1024
+
+// ack is a PUBACK, PUBREC or PUBCOMP.
+type ack struct {
+	typ byte
+	id  uint16
+	// Failure reported by the server (MQTT 5 only).
+	err error
+}
+
+// conn is an MQTT client connection. Writes are buffered;
+// a reader goroutine delivers acks and ping responses,
+// and pings are sent to keep the connection alive.
+type conn struct {
+	nc        net.Conn
+	w         *bufio.Writer
+	mu        sync.Mutex
+	v5        bool
+	timeout   time.Duration
+	keepAlive time.Duration
+	// Whether the server resumed an existing session.
+	sessionPresent bool
+	// Limits set by the server (MQTT 5), 0 if unlimited.
+	receiveMax      int
+	maxPacket       int
+	maxQoS          byte
+	retainAvailable bool
+
+	acks chan ack
+	// Pings sent and answered. pongSignal is
+	// closed and replaced on each answer.
+	pingMu     sync.Mutex
+	pings      uint64
+	pongs      uint64
+	pongSignal chan struct{}
+
+	done  chan struct{}
+	errMu sync.Mutex
+	err   error
+}
+
+// dial connects to a server and sends CONNECT.
+func dial(c *Config, s *server, clientID string) (*conn, error) {
+	nc, err := net.DialTimeout("tcp", s.addr, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	nc.SetDeadline(time.Now().Add(c.timeout))
+	if s.tls {
+		tc := tls.Client(nc, &tls.Config{ServerName: s.host})
+		if err := tc.Handshake(); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		nc = tc
+	}
+
+	cn := &conn{
+		nc:              nc,
+		w:               bufio.NewWriter(nc),
+		v5:              c.version == 5,
+		timeout:         c.timeout,
+		keepAlive:       c.keepAlive,
+		maxQoS:          2,
+		retainAvailable: true,
+		acks:            make(chan ack, 1024),
+		pongSignal:      make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+	r := bufio.NewReader(nc)
+	if err := cn.connect(c, clientID, r); err != nil {
+		nc.Close()
+		return nil, err
+	}
+
+	nc.SetDeadline(time.Time{})
+	go cn.read(r)
+	if cn.keepAlive > 0 {
+		go cn.keepAlives()
+	}
+
+	return cn, nil
+}
+
+// connect sends CONNECT and reads the CONNACK.
+func (cn *conn) connect(c *Config, clientID string, r *bufio.Reader) error {
+	e := &encoder{}
+	e.string("MQTT")
+	e.byte(c.version)
+	var flags byte
+	if c.CleanSession {
+		flags |= 0x02
+	}
+	if c.Username != "" {
+		flags |= 0x80
+	}
+	if c.Password != "" {
+		flags |= 0x40
+	}
+	e.byte(flags)
+	e.uint16(uint16(c.keepAlive / time.Second))
+	if cn.v5 {
+		p := &encoder{}
+		if !c.CleanSession {
+			p.byte(propSessionExpiry)
+			p.uint32(uint32(c.sessionExpiry / time.Second))
+		}
+		p.byte(propReceiveMaximum)
+		p.uint16(uint16(c.MaxInflight))
+		e.varint(len(p.b))
+		e.b = append(e.b, p.b...)
+	}
+	e.string(clientID)
+	if c.Username != "" {
+		e.string(c.Username)
+	}
+	if c.Password != "" {
+		e.string(c.Password)
+	}
+	if _, err := cn.nc.Write(packet(packetConnect, 0, e.b)); err != nil {
+		return err
+	}
+
+	p, err := readPacket(r, maxIncoming)
+	if err != nil {
+		return err
+	}
+	if p.typ != packetConnack {
+		return fmt.Errorf("unexpected packet type %d, expected CONNACK", p.typ)
+	}
+	d := &decoder{b: p.body}
+	cn.sessionPresent = d.byte()&0x01 != 0
+	code := d.byte()
+
+	if !cn.v5 {
+		if d.err != nil {
+			return fmt.Errorf("connack: %s", d.err)
+		}
+		if code != 0 {
+			if s, ok := connectReturnCodes[code]; ok {
+				return fmt.Errorf("connection refused: %s", s)
+			}
+			return fmt.Errorf("connection refused: return code %d", code)
+		}
+		return nil
+	}
+
+	nums, strs := d.properties()
+	if d.err != nil {
+		return fmt.Errorf("connack: %s", d.err)
+	}
+	if code >= 0x80 {
+		return fmt.Errorf("connection refused: %s", reasonError(code, strs[propReasonString]))
+	}
+	if v, ok := nums[propReceiveMaximum]; ok {
+		cn.receiveMax = int(v)
+	}
+	if v, ok := nums[propMaximumPacketSize]; ok {
+		cn.maxPacket = int(v)
+	}
+	if v, ok := nums[propMaximumQoS]; ok {
+		cn.maxQoS = byte(v)
+	}
+	if v, ok := nums[propRetainAvailable]; ok {
+		cn.retainAvailable = v == 1
+	}
+	if v, ok := nums[propServerKeepAlive]; ok {
+		cn.keepAlive = time.Duration(v) * time.Second
+	}
+
+	return nil
+}
+
+func (cn *conn) fail(err error) {
+	cn.errMu.Lock()
+	if cn.err == nil {
+		cn.err = err
+		close(cn.done)
+	}
+	cn.errMu.Unlock()
+	cn.nc.Close()
+}
+
+// failed returns the error that broke the connection, if any.
+func (cn *conn) failed() error {
+	cn.errMu.Lock()
+	defer cn.errMu.Unlock()
+	return cn.err
+}
+
+// close disconnects cleanly, keeping any persistent session.
+func (cn *conn) close() {
+	if cn.failed() == nil {
+		cn.mu.Lock()
+		cn.w.Write(packet(packetDisconnect, 0, nil))
+		cn.w.Flush()
+		cn.mu.Unlock()
+	}
+	cn.fail(errors.New("connection closed"))
+}
+
+// read handles server packets until the connection fails.
+func (cn *conn) read(r *bufio.Reader) {
+	for {
+		p, err := readPacket(r, maxIncoming)
+		if err != nil {
+			cn.fail(err)
+			return
+		}
+
+		switch p.typ {
+		case packetPuback, packetPubrec, packetPubcomp:
+			d := &decoder{b: p.body}
+			a := ack{typ: p.typ, id: d.uint16()}
+			// MQTT 5 acks may carry a reason code
+			// and properties after the packet id.
+			if cn.v5 && len(d.b) > 0 {
+				code := d.byte()
+				var reason string
+				if len(d.b) > 0 {
+					_, strs := d.properties()
+					reason = strs[propReasonString]
+				}
+				if code >= 0x80 {
+					a.err = reasonError(code, reason)
+				}
+			}
+			if d.err != nil {
+				cn.fail(fmt.Errorf("ack: %s", d.err))
+				return
+			}
+			select {
+			case cn.acks <- a:
+			default:
+				// Nobody waiting for this many acks.
+			}
+		case packetPingresp:
+			cn.pingMu.Lock()
+			cn.pongs++
+			close(cn.pongSignal)
+			cn.pongSignal = make(chan struct{})
+			cn.pingMu.Unlock()
+		case packetDisconnect:
+			err := errors.New("disconnected by server")
+			if d := (&decoder{b: p.body}); len(d.b) > 0 {
+				code := d.byte()
+				var reason string
+				if len(d.b) > 0 {
+					_, strs := d.properties()
+					reason = strs[propReasonString]
+				}
+				err = fmt.Errorf("disconnected by server: %s", reasonError(code, reason))
+			}
+			cn.fail(err)
+			return
+		}
+		// Publishes aren't expected, as nothing is subscribed.
+	}
+}
+
+// keepAlives pings at half the keep alive
+// interval until the connection fails.
+func (cn *conn) keepAlives() {
+	t := time.NewTicker(cn.keepAlive / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-cn.done:
+			return
+		case <-t.C:
+			if err := cn.ping(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// write buffers a packet. Call flush to send.
+func (cn *conn) write(b []byte) {
+	cn.mu.Lock()
+	cn.w.Write(b)
+	cn.mu.Unlock()
+}
+
+// flush sends buffered packets.
+func (cn *conn) flush() error {
+	cn.mu.Lock()
+	err := cn.w.Flush()
+	cn.mu.Unlock()
+	if err != nil {
+		cn.fail(err)
+	}
+	return err
+}
+
+// ping sends buffered packets and a PINGREQ, and waits for
+// the answer, confirming the server read everything before it.
+func (cn *conn) ping() error {
+	cn.mu.Lock()
+	cn.pingMu.Lock()
+	cn.pings++
+	n := cn.pings
+	cn.pingMu.Unlock()
+	cn.w.Write(packet(packetPingreq, 0, nil))
+	err := cn.w.Flush()
+	cn.mu.Unlock()
+	if err != nil {
+		cn.fail(err)
+		return err
+	}
+
+	timeout := time.After(cn.timeout)
+	for {
+		cn.pingMu.Lock()
+		pongs, signal := cn.pongs, cn.pongSignal
+		cn.pingMu.Unlock()
+		if pongs >= n {
+			return nil
+		}
+		select {
+		case <-signal:
+		case <-cn.done:
+			return cn.failed()
+		case <-timeout:
+			err := errors.New("timed out waiting for server")
+			cn.fail(err)
+			return err
+		}
+	}
+}
@@ -0,0 +1,511 @@
+// Package mqtt publishes messages to an MQTT broker,
+// speaking MQTT 3.1.1 or 5.
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jamiealquiza/ascender/outputs"
+)
+
+// Config holds MQTT output settings.
+type Config struct {
+	// Servers as host:port, or URLs with a tcp:// or mqtt://
+	// scheme (port 1883) or ssl://, tls:// or mqtts:// (8883).
+	// Tried in order on reconnect.
+	Servers []string `json:"servers"`
+	// "3.1.1" (default) or "5".
+	Version string `json:"version"`
+	// Client id prefix; each worker adds "-<n>". Defaults
+	// to ascender-<hostname>.
+	ClientID string `json:"client-id"`
+	// Topic template, e.g. "logs/{@type}". Placeholders are
+	// filled from message fields (see outputs.Template).
+	Topic string `json:"topic"`
+	// Value for placeholders missing from a message.
+	TopicMissing string `json:"topic-missing"`
+	// 0, 1 (default) or 2.
+	QoS    *int `json:"qos"`
+	Retain bool `json:"retain"`
+	// Start a new session on each connect rather than
+	// resuming the last one.
+	CleanSession bool `json:"clean-session"`
+	// How long the broker keeps a session after the
+	// connection closes (MQTT 5; 3.1.1 brokers keep it).
+	SessionExpiry string `json:"session-expiry"`
+	// Most QoS 1 and 2 messages awaiting acknowledgement.
+	MaxInflight  int    `json:"max-inflight"`
+	KeepAlive    string `json:"keep-alive"`
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	TLS          bool   `json:"tls"`
+	Retries      *int   `json:"retries"`
+	RetryBackoff string `json:"retry-backoff"`
+	MaxBackoff   string `json:"max-backoff"`
+	Timeout      string `json:"timeout"`
+
+	servers       []*server
+	version       byte
+	topic         *outputs.Template
+	qos           byte
+	sessionExpiry time.Duration
+	keepAlive     time.Duration
+	retries       int
+	retryBackoff  time.Duration
+	maxBackoff    time.Duration
+	timeout       time.Duration
+}
+
+// server is a parsed server address.
+type server struct {
+	addr, host string
+	tls        bool
+}
+
+// Validate checks settings and fills in defaults.
+func (c *Config) Validate() error {
+	if len(c.Servers) == 0 {
+		return errors.New("servers is required")
+	}
+	c.servers = nil
+	for _, s := range c.Servers {
+		sv, err := parseServer(s, c.TLS)
+		if err != nil {
+			return err
+		}
+		c.servers = append(c.servers, sv)
+	}
+
+	switch c.Version {
+	case "", "3.1.1":
+		c.version = 4
+	case "5":
+		c.version = 5
+	default:
+		return fmt.Errorf("unsupported version %q", c.Version)
+	}
+
+	if c.ClientID == "" {
+		host, _ := os.Hostname()
+		c.ClientID = "ascender-" + host
+	}
+
+	if c.Topic == "" {
+		return errors.New("topic is required")
+	}
+	if strings.ContainsAny(c.Topic, "+#") {
+		return errors.New("topic can't contain wildcards")
+	}
+	var err error
+	if c.topic, err = outputs.ParseTemplate(c.Topic); err != nil {
+		return err
+	}
+	c.topic.Missing = "unknown"
+	if c.TopicMissing != "" {
+		c.topic.Missing = c.TopicMissing
+	}
+
+	c.qos = 1
+	if c.QoS != nil {
+		if *c.QoS < 0 || *c.QoS > 2 {
+			return fmt.Errorf("invalid qos %d", *c.QoS)
+		}
+		c.qos = byte(*c.QoS)
+	}
+
+	if c.MaxInflight == 0 {
+		c.MaxInflight = 100
+	}
+	if c.MaxInflight < 0 || c.MaxInflight > 65535 {
+		return fmt.Errorf("invalid max-inflight %d", c.MaxInflight)
+	}
+
+	if c.sessionExpiry, err = outputs.Duration(c.SessionExpiry, "1h"); err != nil {
+		return fmt.Errorf("invalid session-expiry %q", c.SessionExpiry)
+	}
+	if c.keepAlive, err = outputs.Duration(c.KeepAlive, "30s"); err != nil || c.keepAlive < time.Second {
+		return fmt.Errorf("invalid keep-alive %q", c.KeepAlive)
+	}
+
+	c.retries = 3
+	if c.Retries != nil {
+		if *c.Retries < 0 {
+			return errors.New("retries can't be negative")
+		}
+		c.retries = *c.Retries
+	}
+	if c.retryBackoff, err = outputs.Duration(c.RetryBackoff, "100ms"); err != nil {
+		return fmt.Errorf("invalid retry-backoff %q", c.RetryBackoff)
+	}
+	if c.maxBackoff, err = outputs.Duration(c.MaxBackoff, "5s"); err != nil {
+		return fmt.Errorf("invalid max-backoff %q", c.MaxBackoff)
+	}
+	if c.timeout, err = outputs.Duration(c.Timeout, "5s"); err != nil {
+		return fmt.Errorf("invalid timeout %q", c.Timeout)
+	}
+
+	return nil
+}
+
+// parseServer parses a server address, adding the default port.
+func parseServer(s string, useTLS bool) (*server, error) {
+	addr := s
+	if i := strings.Index(s, "://"); i >= 0 {
+		switch s[:i] {
+		case "tcp", "mqtt":
+		case "ssl", "tls", "mqtts":
+			useTLS = true
+		default:
+			return nil, fmt.Errorf("unsupported scheme in server %q", s)
+		}
+		addr = s[i+3:]
+	}
+
+	port := "1883"
+	if useTLS {
+		port = "8883"
+	}
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	} else {
+		port = p
+	}
+	if host == "" {
+		return nil, fmt.Errorf("missing host in server %q", s)
+	}
+
+	return &server{addr: net.JoinHostPort(host, port), host: host, tls: useTLS}, nil
+}
+
+// escapeLevel keeps a value to a single topic level.
+func escapeLevel(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '+', '#', 0:
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// clientIDs holds the client ids of running workers, so
+// workers sharing a prefix connect with distinct ids that
+// stay the same across reconnects.
+var clientIDs = struct {
+	sync.Mutex
+	used map[string]bool
+}{used: map[string]bool{}}
+
+// claimClientID returns the lowest free id for prefix.
+func claimClientID(prefix string) string {
+	clientIDs.Lock()
+	defer clientIDs.Unlock()
+	for n := 0; ; n++ {
+		id := fmt.Sprintf("%s-%d", prefix, n)
+		if !clientIDs.used[id] {
+			clientIDs.used[id] = true
+			return id
+		}
+	}
+}
+
+func releaseClientID(id string) {
+	clientIDs.Lock()
+	delete(clientIDs.used, id)
+	clientIDs.Unlock()
+}
+
+// Worker that reads message batches from the messageOutgoingQueue
+// and publishes them to an MQTT broker.
+func Handler(c *Config, messageOutgoingQueue <-chan []*outputs.Message, s outputs.Statser) {
+	p := &publisher{config: c, stats: s, clientID: claimClientID(c.ClientID), inflight: map[uint16]*message{}}
+	defer releaseClientID(p.clientID)
+	defer func() {
+		if p.conn != nil {
+			p.conn.close()
+		}
+	}()
+
+	for m := range messageOutgoingQueue {
+		sent, err := p.send(m)
+		if err != nil {
+			log.Printf("MQTT batch error: %d of %d messages not sent: %s\n", len(m)-sent, len(m), err)
+		}
+		s.IncrSent(int64(sent))
+	}
+}
+
+// message is a message being published.
+type message struct {
+	topic   string
+	payload []byte
+	qos     byte
+	// Packet id while awaiting acknowledgement, else 0.
+	id uint16
+	// PUBREC received: PUBREL is sent (again
+	// after a reconnect) until PUBCOMP.
+	released bool
+	done     bool
+
+	msg      *outputs.Message
+	attempts int
+	// Set if the server rejected the message.
+	err error
+}
+
+// publisher sends batches over a connection,
+// reconnecting as needed.
+type publisher struct {
+	config   *Config
+	stats    outputs.Statser
+	clientID string
+	conn     *conn
+	// Next server to try.
+	server int
+	// Messages awaiting acknowledgement, by packet id.
+	inflight map[uint16]*message
+	lastID   uint16
+}
+
+// connect returns a working connection, trying each server once.
+func (p *publisher) connect() (*conn, error) {
+	if p.conn != nil && p.conn.failed() == nil {
+		return p.conn, nil
+	}
+
+	var err error
+	for range p.config.servers {
+		s := p.config.servers[p.server%len(p.config.servers)]
+		p.server++
+		if p.conn, err = dial(p.config, s, p.clientID); err == nil {
+			log.Printf("Connected to MQTT server: %s as %s (session present: %t)\n", s.addr, p.clientID, p.conn.sessionPresent)
+			return p.conn, nil
+		}
+		log.Printf("MQTT connection error: %s: %s\n", s.addr, err)
+	}
+	return nil, err
+}
+
+// packetID returns a free packet id.
+func (p *publisher) packetID() uint16 {
+	for {
+		p.lastID++
+		if _, used := p.inflight[p.lastID]; p.lastID != 0 && !used {
+			return p.lastID
+		}
+	}
+}
+
+// send publishes a batch and returns the number of messages
+// sent: acknowledged for QoS 1 and 2, or followed by an
+// answered ping for QoS 0. Messages not sent are passed
+// to the Statser.
+func (p *publisher) send(batch []*outputs.Message) (int, error) {
+	msgs := make([]*message, 0, len(batch))
+	var topicErr error
+	for _, m := range batch {
+		topic := p.config.topic.Execute(m, escapeLevel)
+		if len(topic) > 65535 {
+			topicErr = fmt.Errorf("topic of %d bytes exceeds 65535", len(topic))
+			p.stats.Failed(m, 0, topicErr)
+			continue
+		}
+		msgs = append(msgs, &message{topic: topic, payload: []byte(m.Body), msg: m})
+	}
+
+	sent := 0
+	var err error
+	retry := msgs
+	backoff := p.config.retryBackoff
+	for attempt := 0; len(retry) > 0; attempt++ {
+		var n int
+		n, retry, err = p.attempt(retry)
+		sent += n
+		if err == nil || len(retry) == 0 || attempt >= p.config.retries {
+			break
+		}
+		log.Printf("MQTT publish failed, retrying %d messages in %s: %s\n", len(retry), backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > p.config.maxBackoff {
+			backoff = p.config.maxBackoff
+		}
+	}
+
+	// Give up on messages still awaiting acknowledgement.
+	for _, m := range retry {
+		if m.id != 0 {
+			delete(p.inflight, m.id)
+		}
+		p.stats.Failed(m.msg, m.attempts, err)
+	}
+	for _, m := range msgs {
+		if m.err != nil {
+			p.stats.Failed(m.msg, m.attempts, m.err)
+		}
+	}
+
+	if err == nil {
+		err = topicErr
+	}
+	return sent, err
+}
+
+// attempt publishes msgs over one connection, returning the
+// number sent and the messages still to be retried. Messages
+// in flight from a broken connection are sent again first.
+func (p *publisher) attempt(msgs []*message) (int, []*message, error) {
+	cn, err := p.connect()
+	if err != nil {
+		return 0, msgs, err
+	}
+
+	qos := p.config.qos
+	if qos > cn.maxQoS {
+		qos = cn.maxQoS
+	}
+	retain := p.config.Retain && cn.retainAvailable
+	window := p.config.MaxInflight
+	if cn.receiveMax > 0 && cn.receiveMax < window {
+		window = cn.receiveMax
+	}
+
+	sent, pending := 0, 0
+	var failErr error
+	finish := func(m *message, err error) {
+		if m.id != 0 {
+			delete(p.inflight, m.id)
+			pending--
+		}
+		m.done = true
+		if err != nil {
+			m.err = err
+			failErr = fmt.Errorf("%s: %s", m.topic, err)
+			return
+		}
+		sent++
+	}
+	// publish buffers m, or drops it if too large for the server.
+	publish := func(m *message, dup bool) {
+		m.attempts++
+		e := &encoder{}
+		e.string(m.topic)
+		if m.qos > 0 {
+			e.uint16(m.id)
+		}
+		if cn.v5 {
+			e.varint(0) // Properties.
+		}
+		e.b = append(e.b, m.payload...)
+		flags := m.qos << 1
+		if dup {
+			flags |= 0x08
+		}
+		if retain {
+			flags |= 0x01
+		}
+		b := packet(packetPublish, flags, e.b)
+		if cn.maxPacket > 0 && len(b) > cn.maxPacket {
+			finish(m, fmt.Errorf("message of %d bytes exceeds server maximum packet size %d", len(b), cn.maxPacket))
+			return
+		}
+		cn.write(b)
+	}
+	pubrel := func(m *message) {
+		e := &encoder{}
+		e.uint16(m.id)
+		cn.write(packet(packetPubrel, 0x02, e.b))
+	}
+
+	// Resend messages left in flight by a broken connection.
+	for _, m := range msgs {
+		if m.id == 0 {
+			continue
+		}
+		pending++
+		if m.released {
+			pubrel(m)
+		} else {
+			publish(m, true)
+		}
+	}
+
+	next := 0
+	for err == nil {
+		// Publish up to the in-flight window.
+		for ; next < len(msgs) && pending < window; next++ {
+			m := msgs[next]
+			if m.id != 0 || m.done {
+				continue
+			}
+			m.qos = qos
+			if qos > 0 {
+				m.id = p.packetID()
+				p.inflight[m.id] = m
+				pending++
+			}
+			publish(m, false)
+		}
+
+		if pending == 0 {
+			// QoS 0 messages count once a ping
+			// after them is answered.
+			if qos == 0 {
+				if err = cn.ping(); err == nil {
+					for _, m := range msgs[:next] {
+						if !m.done {
+							finish(m, nil)
+						}
+					}
+				}
+			}
+			if next == len(msgs) || err != nil {
+				break
+			}
+			continue
+		}
+		if err = cn.flush(); err != nil {
+			break
+		}
+
+		select {
+		case a := <-cn.acks:
+			m, ok := p.inflight[a.id]
+			if !ok {
+				continue
+			}
+			switch {
+			case a.err != nil:
+				finish(m, a.err)
+			case a.typ == packetPubrec:
+				m.released = true
+				pubrel(m)
+			default:
+				finish(m, nil)
+			}
+		case <-cn.done:
+			err = cn.failed()
+		case <-time.After(p.config.timeout):
+			err = errors.New("timed out waiting for acknowledgements")
+			cn.fail(err)
+		}
+	}
+
+	var retry []*message
+	for _, m := range msgs {
+		if !m.done {
+			retry = append(retry, m)
+		}
+	}
+	if err == nil {
+		err = failErr
+	}
+	return sent, retry, err
+}
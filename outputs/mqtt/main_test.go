@@ -0,0 +1,423 @@
+package mqtt
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jamiealquiza/ascender/outputs"
+	"github.com/jamiealquiza/ascender/outputs/outputstest"
+)
+
+// publish is a PUBLISH received by a fake broker.
+type publish struct {
+	topic, payload string
+	qos            byte
+	id             uint16
+	dup, retain    bool
+}
+
+// What a fake broker does with a publish.
+const (
+	ackPublish = iota
+	ignorePublish
+	dropConnection
+)
+
+// broker is a fake MQTT broker. handle says what to do with
+// each publish, and the MQTT 5 reason code to ack it with;
+// release says whether to drop the connection on a PUBREL.
+type broker struct {
+	addr string
+	// CONNACK return code, and MQTT 5 properties.
+	refuse byte
+	props  []byte
+
+	handle  func(p publish) (action int, reason byte)
+	release func(id uint16) bool
+
+	mu       sync.Mutex
+	pubs     []publish
+	releases []uint16
+	clients  []string
+	conns    int
+	// Most QoS 1 and 2 publishes unacknowledged at once.
+	unacked, maxUnacked int
+}
+
+func newBroker(t *testing.T, b *broker) *broker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	b.addr = l.Addr().String()
+	if b.handle == nil {
+		b.handle = func(publish) (int, byte) { return ackPublish, 0 }
+	}
+	if b.release == nil {
+		b.release = func(uint16) bool { return false }
+	}
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			b.mu.Lock()
+			b.conns++
+			b.mu.Unlock()
+			go b.serve(nc)
+		}
+	}()
+	return b
+}
+
+func (b *broker) serve(nc net.Conn) {
+	defer nc.Close()
+	r := bufio.NewReader(nc)
+	var v5 bool
+	// write sends a packet, with a v5 reason code if set.
+	write := func(typ, flags byte, id uint16, reason byte) {
+		e := &encoder{}
+		e.uint16(id)
+		if v5 && reason != 0 {
+			e.byte(reason)
+			e.varint(0)
+		}
+		nc.Write(packet(typ, flags, e.b))
+	}
+	// acked counts a QoS 1 or 2 flow finished.
+	acked := func() {
+		b.mu.Lock()
+		b.unacked--
+		b.mu.Unlock()
+	}
+
+	for {
+		p, err := readPacket(r, 1<<20)
+		if err != nil {
+			return
+		}
+		d := &decoder{b: p.body}
+		switch p.typ {
+		case packetConnect:
+			d.string()
+			v5 = d.byte() == 5
+			flags := d.byte()
+			d.uint16()
+			if v5 {
+				d.properties()
+			}
+			client := d.string()
+			if flags&0x80 != 0 {
+				client += " " + d.string()
+			}
+			b.mu.Lock()
+			b.clients = append(b.clients, client)
+			b.mu.Unlock()
+			e := &encoder{}
+			e.byte(0)
+			e.byte(b.refuse)
+			if v5 {
+				e.varint(len(b.props))
+				e.b = append(e.b, b.props...)
+			}
+			nc.Write(packet(packetConnack, 0, e.b))
+			if b.refuse != 0 {
+				return
+			}
+		case packetPublish:
+			pub := publish{qos: p.flags >> 1 & 3, dup: p.flags&0x08 != 0, retain: p.flags&0x01 != 0}
+			pub.topic = d.string()
+			if pub.qos > 0 {
+				pub.id = d.uint16()
+			}
+			if v5 {
+				d.properties()
+			}
+			pub.payload = string(d.b)
+			action, reason := b.handle(pub)
+			if action == dropConnection {
+				return
+			}
+			b.mu.Lock()
+			b.pubs = append(b.pubs, pub)
+			if pub.qos > 0 && !pub.dup {
+				if b.unacked++; b.unacked > b.maxUnacked {
+					b.maxUnacked = b.unacked
+				}
+			}
+			b.mu.Unlock()
+			if action == ignorePublish {
+				continue
+			}
+			switch pub.qos {
+			case 1:
+				acked()
+				write(packetPuback, 0, pub.id, reason)
+			case 2:
+				write(packetPubrec, 0, pub.id, reason)
+			}
+		case packetPubrel:
+			id := d.uint16()
+			if b.release(id) {
+				return
+			}
+			b.mu.Lock()
+			b.releases = append(b.releases, id)
+			b.mu.Unlock()
+			acked()
+			write(packetPubcomp, 0, id, 0)
+		case packetPingreq:
+			nc.Write(packet(packetPingresp, 0, nil))
+		case packetDisconnect:
+			return
+		}
+	}
+}
+
+// published returns the publishes received, and
+// the packet ids released.
+func (b *broker) published() ([]publish, []uint16) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]publish{}, b.pubs...), append([]uint16{}, b.releases...)
+}
+
+func (b *broker) connections() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.conns
+}
+
+func newPublisher(t *testing.T, c *Config) (*publisher, *outputstest.Stats) {
+	if c.ClientID == "" {
+		c.ClientID = "test"
+	}
+	c.RetryBackoff, c.MaxBackoff = "1ms", "1ms"
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s := &outputstest.Stats{}
+	p := &publisher{config: c, stats: s, clientID: claimClientID(c.ClientID), inflight: map[uint16]*message{}}
+	t.Cleanup(func() {
+		if p.conn != nil {
+			p.conn.close()
+		}
+		releaseClientID(p.clientID)
+	})
+	return p, s
+}
+
+func routed(route string, bodies ...string) []*outputs.Message {
+	ms := outputstest.Messages(bodies...)
+	for _, m := range ms {
+		m.Route = route
+	}
+	return ms
+}
+
+func payloads(pubs []publish) string {
+	var s []string
+	for _, p := range pubs {
+		s = append(s, p.payload)
+	}
+	return strings.Join(s, ",")
+}
+
+func TestPublishQoS(t *testing.T) {
+	for _, version := range []string{"3.1.1", "5"} {
+		for qos := 0; qos <= 2; qos++ {
+			b := newBroker(t, &broker{})
+			q := qos
+			p, s := newPublisher(t, &Config{Servers: []string{"tcp://" + b.addr}, Version: version, Topic: "logs/{:route}", QoS: &q, Retain: true, Username: "u"})
+
+			batch := append(routed("a/b", "1", "2"), routed("c", "3")...)
+			if sent, err := p.send(batch); sent != 3 || err != nil {
+				t.Fatalf("%s qos %d: sent %d: %v", version, qos, sent, err)
+			}
+			pubs, releases := b.published()
+			if payloads(pubs) != "1,2,3" {
+				t.Fatalf("%s qos %d: published %s", version, qos, payloads(pubs))
+			}
+			// Topic levels from messages can't add levels.
+			if pubs[0].topic != "logs/a_b" || pubs[2].topic != "logs/c" || pubs[0].qos != byte(qos) || !pubs[0].retain {
+				t.Errorf("%s qos %d: publish %+v", version, qos, pubs[0])
+			}
+			if qos == 2 && len(releases) != 3 {
+				t.Errorf("%s qos 2: %d released, want 3", version, len(releases))
+			}
+			b.mu.Lock()
+			if len(b.clients) != 1 || !strings.HasPrefix(b.clients[0], "test-") || !strings.HasSuffix(b.clients[0], " u") {
+				t.Errorf("%s: clients %q", version, b.clients)
+			}
+			b.mu.Unlock()
+			if len(s.Dropped()) != 0 {
+				t.Errorf("%s qos %d: failed %v", version, qos, outputs.Bodies(s.Dropped()))
+			}
+		}
+	}
+}
+
+// At most max-inflight messages await acknowledgement.
+func TestInflightWindow(t *testing.T) {
+	b := newBroker(t, &broker{})
+	p, _ := newPublisher(t, &Config{Servers: []string{b.addr}, Topic: "t", MaxInflight: 3})
+	var bodies []string
+	for i := 0; i < 50; i++ {
+		bodies = append(bodies, "m")
+	}
+	if sent, err := p.send(outputstest.Messages(bodies...)); sent != 50 || err != nil {
+		t.Fatalf("sent %d: %v", sent, err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.maxUnacked > 3 {
+		t.Errorf("%d unacknowledged at once, want at most 3", b.maxUnacked)
+	}
+}
+
+// Messages in flight when the connection breaks are sent
+// again with DUP and the same packet id, and QoS 2 messages
+// the broker has received are released again, not resent.
+func TestReconnectResendsInflight(t *testing.T) {
+	var mu sync.Mutex
+	dropped, released := false, false
+	b := newBroker(t, &broker{
+		handle: func(p publish) (int, byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			if p.payload == "2" && !dropped {
+				dropped = true
+				return dropConnection, 0
+			}
+			return ackPublish, 0
+		},
+	})
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down.Close()
+	p, s := newPublisher(t, &Config{Servers: []string{b.addr, down.Addr().String()}, Topic: "t", MaxInflight: 1})
+
+	if sent, err := p.send(outputstest.Messages("1", "2", "3")); sent != 3 || err != nil {
+		t.Fatalf("sent %d: %v", sent, err)
+	}
+	pubs, _ := b.published()
+	if payloads(pubs) != "1,2,3" || !pubs[1].dup || pubs[2].dup || pubs[1].id != 2 {
+		t.Errorf("published %+v", pubs)
+	}
+	if n := b.connections(); n != 2 {
+		t.Errorf("%d connections, want 2", n)
+	}
+	if len(s.Dropped()) != 0 {
+		t.Errorf("failed %v", outputs.Bodies(s.Dropped()))
+	}
+
+	qos2 := newBroker(t, &broker{
+		release: func(id uint16) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			if !released {
+				released = true
+				return true
+			}
+			return false
+		},
+	})
+	q := 2
+	p, s = newPublisher(t, &Config{Servers: []string{qos2.addr}, Topic: "t", QoS: &q})
+	if sent, err := p.send(outputstest.Messages("1")); sent != 1 || err != nil {
+		t.Fatalf("qos 2: sent %d: %v", sent, err)
+	}
+	if pubs, releases := qos2.published(); len(pubs) != 1 || len(releases) != 1 || qos2.connections() != 2 {
+		t.Errorf("qos 2: %d published, %d released over %d connections", len(pubs), len(releases), qos2.connections())
+	}
+}
+
+// Messages an MQTT 5 broker rejects are failed without
+// retrying, and its limits are kept to.
+func TestV5Limits(t *testing.T) {
+	props := &encoder{}
+	props.byte(propMaximumQoS)
+	props.byte(1)
+	props.byte(propRetainAvailable)
+	props.byte(0)
+	props.byte(propMaximumPacketSize)
+	props.uint32(32)
+	b := newBroker(t, &broker{
+		props: props.b,
+		handle: func(p publish) (int, byte) {
+			if p.payload == "rejected" {
+				return ackPublish, 0x97
+			}
+			return ackPublish, 0
+		},
+	})
+	q := 2
+	p, s := newPublisher(t, &Config{Servers: []string{b.addr}, Version: "5", Topic: "t", QoS: &q, Retain: true})
+
+	sent, err := p.send(outputstest.Messages("ok", "rejected", strings.Repeat("x", 32)))
+	if sent != 1 || err == nil {
+		t.Fatalf("sent %d: %v", sent, err)
+	}
+	d := s.Dropped()
+	if len(d) != 2 {
+		t.Fatalf("failed %v", outputs.Bodies(d))
+	}
+	for i, reason := range s.Reasons() {
+		if d[i].Body == "rejected" && !strings.Contains(reason.Error(), "quota exceeded") {
+			t.Errorf("rejected: %s", reason)
+		}
+		if d[i].Body != "rejected" && !strings.Contains(reason.Error(), "maximum packet size") {
+			t.Errorf("oversized: %s", reason)
+		}
+	}
+	pubs, _ := b.published()
+	if payloads(pubs) != "ok,rejected" || pubs[0].qos != 1 || pubs[0].retain {
+		t.Errorf("published %+v", pubs)
+	}
+}
+
+func TestConnectRefused(t *testing.T) {
+	b := newBroker(t, &broker{refuse: 5})
+	retries := 1
+	p, s := newPublisher(t, &Config{Servers: []string{b.addr}, Topic: "t", Retries: &retries})
+	if sent, err := p.send(outputstest.Messages("1", "2")); sent != 0 || err == nil || !strings.Contains(err.Error(), "not authorized") {
+		t.Fatalf("sent %d: %v", sent, err)
+	}
+	if n := len(s.Dropped()); n != 2 {
+		t.Errorf("%d failed, want 2", n)
+	}
+	if n := b.connections(); n != 2 {
+		t.Errorf("%d connections, want 2", n)
+	}
+}
+
+// Messages not acknowledged in time are retried,
+// and failed once retries run out.
+func TestAckTimeout(t *testing.T) {
+	b := newBroker(t, &broker{
+		handle: func(publish) (int, byte) { return ignorePublish, 0 },
+	})
+	retries := 1
+	p, s := newPublisher(t, &Config{Servers: []string{b.addr}, Topic: "t", Timeout: "50ms", Retries: &retries})
+	start := time.Now()
+	if sent, err := p.send(outputstest.Messages("1")); sent != 0 || err == nil {
+		t.Fatalf("sent %d: %v", sent, err)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("gave up after %s, want 2 timeouts", d)
+	}
+	if n := len(s.Dropped()); n != 1 || len(p.inflight) != 0 {
+		t.Errorf("%d failed, %d left in flight", n, len(p.inflight))
+	}
+	if pubs, _ := b.published(); len(pubs) != 2 || !pubs[1].dup {
+		t.Errorf("published %+v", pubs)
+	}
+}
@@ -0,0 +1,265 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Control packet types.
+const (
+	packetConnect    = 1
+	packetConnack    = 2
+	packetPublish    = 3
+	packetPuback     = 4
+	packetPubrec     = 5
+	packetPubrel     = 6
+	packetPubcomp    = 7
+	packetPingreq    = 12
+	packetPingresp   = 13
+	packetDisconnect = 14
+)
+
+// MQTT 5 property ids used.
+const (
+	propSessionExpiry     = 0x11
+	propServerKeepAlive   = 0x13
+	propReasonString      = 0x1f
+	propReceiveMaximum    = 0x21
+	propMaximumQoS        = 0x24
+	propRetainAvailable   = 0x25
+	propMaximumPacketSize = 0x27
+)
+
+// encoder appends MQTT primitives to a buffer.
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) byte(v byte) {
+	e.b = append(e.b, v)
+}
+
+func (e *encoder) uint16(v uint16) {
+	e.b = binary.BigEndian.AppendUint16(e.b, v)
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.b = binary.BigEndian.AppendUint32(e.b, v)
+}
+
+// varint encodes a variable byte integer.
+func (e *encoder) varint(v int) {
+	for {
+		b := byte(v % 128)
+		v /= 128
+		if v > 0 {
+			b |= 0x80
+		}
+		e.b = append(e.b, b)
+		if v == 0 {
+			return
+		}
+	}
+}
+
+// string encodes a length prefixed string or binary value.
+func (e *encoder) string(s string) {
+	e.uint16(uint16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+// packet returns the packet with its fixed header.
+func packet(typ, flags byte, body []byte) []byte {
+	e := &encoder{}
+	e.byte(typ<<4 | flags)
+	e.varint(len(body))
+	e.b = append(e.b, body...)
+	return e.b
+}
+
+var errMalformed = errors.New("malformed packet")
+
+// decoder reads MQTT primitives. The first error
+// is kept and later reads return zero values.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.b) < n {
+		d.err = errMalformed
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) byte() byte {
+	if b := d.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint16() uint16 {
+	if b := d.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) varint() int {
+	v, mult := 0, 1
+	for i := 0; i < 4; i++ {
+		b := d.byte()
+		v += int(b&0x7f) * mult
+		if b&0x80 == 0 {
+			return v
+		}
+		mult *= 128
+	}
+	if d.err == nil {
+		d.err = errMalformed
+	}
+	return 0
+}
+
+func (d *decoder) string() string {
+	return string(d.next(int(d.uint16())))
+}
+
+// properties reads MQTT 5 properties, returning the
+// numeric and string values by id. Others are skipped.
+func (d *decoder) properties() (map[byte]uint32, map[byte]string) {
+	nums, strs := map[byte]uint32{}, map[byte]string{}
+	p := &decoder{b: d.next(d.varint())}
+	for len(p.b) > 0 && p.err == nil {
+		id := p.byte()
+		switch id {
+		case 0x01, 0x17, 0x19, 0x24, 0x25, 0x28, 0x29, 0x2a:
+			nums[id] = uint32(p.byte())
+		case 0x13, 0x21, 0x22, 0x23:
+			nums[id] = uint32(p.uint16())
+		case 0x02, 0x11, 0x18, 0x27:
+			nums[id] = p.uint32()
+		case 0x0b:
+			nums[id] = uint32(p.varint())
+		case 0x03, 0x08, 0x09, 0x12, 0x15, 0x16, 0x1a, 0x1c, 0x1f:
+			strs[id] = p.string()
+		case 0x26:
+			p.string() // User property name and value.
+			p.string()
+		default:
+			p.err = fmt.Errorf("unknown property 0x%02x", id)
+		}
+	}
+	if d.err == nil {
+		d.err = p.err
+	}
+	return nums, strs
+}
+
+// rawPacket is a received packet.
+type rawPacket struct {
+	typ, flags byte
+	body       []byte
+}
+
+// readPacket reads a packet of at most max bytes.
+func readPacket(r *bufio.Reader, max int) (rawPacket, error) {
+	h, err := r.ReadByte()
+	if err != nil {
+		return rawPacket{}, err
+	}
+
+	n, mult := 0, 1
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return rawPacket{}, err
+		}
+		n += int(b&0x7f) * mult
+		if b&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return rawPacket{}, errMalformed
+		}
+		mult *= 128
+	}
+	if n > max {
+		return rawPacket{}, fmt.Errorf("packet of %d bytes exceeds %d", n, max)
+	}
+
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return rawPacket{}, err
+	}
+
+	return rawPacket{typ: h >> 4, flags: h & 0x0f, body: body}, nil
+}
+
+// Reason codes for connection refusal in MQTT 3.1.1.
+var connectReturnCodes = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// Common MQTT 5 reason codes.
+var reasonCodes = map[byte]string{
+	0x80: "unspecified error",
+	0x81: "malformed packet",
+	0x82: "protocol error",
+	0x83: "implementation specific error",
+	0x84: "unsupported protocol version",
+	0x85: "client identifier not valid",
+	0x86: "bad user name or password",
+	0x87: "not authorized",
+	0x88: "server unavailable",
+	0x89: "server busy",
+	0x8a: "banned",
+	0x8b: "server shutting down",
+	0x8d: "keep alive timeout",
+	0x8e: "session taken over",
+	0x90: "topic name invalid",
+	0x92: "packet identifier not found",
+	0x93: "receive maximum exceeded",
+	0x95: "packet too large",
+	0x97: "quota exceeded",
+	0x99: "payload format invalid",
+	0x9a: "retain not supported",
+	0x9b: "qos not supported",
+	0x9c: "use another server",
+	0x9d: "server moved",
+	0x9f: "connection rate exceeded",
+}
+
+// reasonError describes a failing MQTT 5 reason code.
+func reasonError(code byte, reason string) error {
+	s, ok := reasonCodes[code]
+	if !ok {
+		s = "error"
+	}
+	if reason != "" {
+		s += ": " + reason
+	}
+	return fmt.Errorf("reason code 0x%02x (%s)", code, s)
+}
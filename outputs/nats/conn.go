@@ -0,0 +1,291 @@
+package nats
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serverInfo is the subset of the server INFO used.
+type serverInfo struct {
+	TLSRequired bool `json:"tls_required"`
+	Headers     bool `json:"headers"`
+	MaxPayload  int  `json:"max_payload"`
+}
+
+// reply is a message received on the connection's inbox.
+type reply struct {
+	token string
+	// Status from a header message, e.g. "503" for no responders.
+	status string
+	data   []byte
+}
+
+// conn is a NATS client connection. Writes are
+// buffered; a reader goroutine handles server
+// pings and delivers inbox replies and pongs.
+type conn struct {
+	nc      net.Conn
+	w       *bufio.Writer
+	mu      sync.Mutex
+	info    serverInfo
+	inbox   string
+	timeout time.Duration
+
+	replies chan reply
+	pongs   chan struct{}
+	done    chan struct{}
+	errMu   sync.Mutex
+	err     error
+}
+
+// dial connects and authenticates to a NATS server.
+func dial(c *Config, server string) (*conn, error) {
+	addr := strings.TrimPrefix(strings.TrimPrefix(server, "nats://"), "tls://")
+	nc, err := net.DialTimeout("tcp", addr, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	nc.SetDeadline(time.Now().Add(c.timeout))
+
+	// Servers start with INFO.
+	r := bufio.NewReader(nc)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		nc.Close()
+		return nil, fmt.Errorf("unexpected greeting %q", strings.TrimSpace(line))
+	}
+	var info serverInfo
+	if err := json.Unmarshal([]byte(line[5:]), &info); err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("server info: %s", err)
+	}
+	if c.JetStream && !info.Headers {
+		nc.Close()
+		return nil, errors.New("server doesn't support headers, required for jetstream")
+	}
+
+	if c.TLS || info.TLSRequired || strings.HasPrefix(server, "tls://") {
+		host, _, _ := net.SplitHostPort(addr)
+		tc := tls.Client(nc, &tls.Config{ServerName: host})
+		if err := tc.Handshake(); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		nc = tc
+		r = bufio.NewReader(nc)
+	}
+
+	cn := &conn{
+		nc:      nc,
+		w:       bufio.NewWriter(nc),
+		info:    info,
+		inbox:   "_INBOX." + randomID(),
+		timeout: c.timeout,
+		replies: make(chan reply, 1024),
+		pongs:   make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+
+	connect, _ := json.Marshal(map[string]interface{}{
+		"verbose":       false,
+		"pedantic":      false,
+		"name":          c.Name,
+		"lang":          "go",
+		"version":       "ascender",
+		"protocol":      1,
+		"headers":       info.Headers,
+		"no_responders": info.Headers,
+		"user":          c.User,
+		"pass":          c.Password,
+		"auth_token":    c.Token,
+	})
+	fmt.Fprintf(cn.w, "CONNECT %s\r\n", connect)
+	if c.JetStream {
+		fmt.Fprintf(cn.w, "SUB %s.* 1\r\n", cn.inbox)
+	}
+
+	nc.SetDeadline(time.Time{})
+	go cn.read(r)
+	if err := cn.flush(); err != nil {
+		cn.close()
+		return nil, err
+	}
+
+	return cn, nil
+}
+
+func (cn *conn) fail(err error) {
+	cn.errMu.Lock()
+	if cn.err == nil {
+		cn.err = err
+		close(cn.done)
+	}
+	cn.errMu.Unlock()
+	cn.nc.Close()
+}
+
+// failed returns the error that broke the connection, if any.
+func (cn *conn) failed() error {
+	cn.errMu.Lock()
+	defer cn.errMu.Unlock()
+	return cn.err
+}
+
+func (cn *conn) close() {
+	cn.fail(errors.New("connection closed"))
+}
+
+// read handles server messages until the connection fails.
+func (cn *conn) read(r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			cn.fail(err)
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		op, args := line, ""
+		if i := strings.IndexByte(line, ' '); i > 0 {
+			op, args = line[:i], line[i+1:]
+		}
+
+		switch strings.ToUpper(op) {
+		case "PING":
+			cn.mu.Lock()
+			cn.w.WriteString("PONG\r\n")
+			cn.w.Flush()
+			cn.mu.Unlock()
+		case "PONG":
+			select {
+			case cn.pongs <- struct{}{}:
+			default:
+			}
+		case "-ERR":
+			cn.fail(fmt.Errorf("server error: %s", strings.Trim(args, "'")))
+			return
+		case "MSG", "HMSG":
+			rep, err := readMsg(r, strings.ToUpper(op) == "HMSG", strings.Fields(args))
+			if err != nil {
+				cn.fail(err)
+				return
+			}
+			rep.token = strings.TrimPrefix(rep.token, cn.inbox+".")
+			select {
+			case cn.replies <- rep:
+			default:
+				// Nobody waiting for this many replies.
+			}
+		}
+		// +OK and async INFO are ignored.
+	}
+}
+
+// readMsg reads a MSG or HMSG payload following its control line.
+// MSG <subject> <sid> [reply] <size>
+// HMSG <subject> <sid> [reply] <header size> <total size>
+func readMsg(r *bufio.Reader, headers bool, args []string) (reply, error) {
+	rep := reply{}
+	min := 3
+	if headers {
+		min = 4
+	}
+	if len(args) < min {
+		return rep, fmt.Errorf("malformed message %v", args)
+	}
+	rep.token = args[0]
+
+	total, err := strconv.Atoi(args[len(args)-1])
+	if err != nil {
+		return rep, fmt.Errorf("malformed message %v", args)
+	}
+	hdrLen := 0
+	if headers {
+		if hdrLen, err = strconv.Atoi(args[len(args)-2]); err != nil || hdrLen > total {
+			return rep, fmt.Errorf("malformed message %v", args)
+		}
+	}
+
+	buf := make([]byte, total+2)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return rep, err
+	}
+	if headers {
+		// NATS/1.0[ <status>[ <description>]]\r\n...
+		status := strings.SplitN(string(buf[:hdrLen]), "\r\n", 2)[0]
+		if f := strings.Fields(status); len(f) > 1 {
+			rep.status = f[1]
+		}
+	}
+	rep.data = buf[hdrLen:total]
+
+	return rep, nil
+}
+
+// publish writes a message. With reply and msgID set, it is
+// sent with a Nats-Msg-Id header for JetStream deduplication.
+func (cn *conn) publish(subject, reply, msgID string, data []byte) error {
+	if max := cn.info.MaxPayload; max > 0 && len(data) > max {
+		return fmt.Errorf("message of %d bytes exceeds server max payload %d", len(data), max)
+	}
+
+	if reply != "" {
+		subject += " " + reply
+	}
+
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	if msgID == "" {
+		fmt.Fprintf(cn.w, "PUB %s %d\r\n", subject, len(data))
+	} else {
+		hdr := "NATS/1.0\r\nNats-Msg-Id: " + msgID + "\r\n\r\n"
+		fmt.Fprintf(cn.w, "HPUB %s %d %d\r\n%s", subject, len(hdr), len(hdr)+len(data), hdr)
+	}
+	cn.w.Write(data)
+	_, err := cn.w.WriteString("\r\n")
+	return err
+}
+
+// flush sends buffered writes and waits for the server to
+// answer a PING, confirming it processed everything before it.
+func (cn *conn) flush() error {
+	cn.mu.Lock()
+	cn.w.WriteString("PING\r\n")
+	err := cn.w.Flush()
+	cn.mu.Unlock()
+	if err != nil {
+		cn.fail(err)
+		return err
+	}
+
+	select {
+	case <-cn.pongs:
+		return nil
+	case <-cn.done:
+		return cn.failed()
+	case <-time.After(cn.timeout):
+		err := errors.New("timed out waiting for server")
+		cn.fail(err)
+		return err
+	}
+}
+
+func randomID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
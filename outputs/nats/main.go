@@ -0,0 +1,311 @@
+// Package nats publishes messages to NATS subjects, optionally
+// waiting for JetStream acknowledgements.
+package nats
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jamiealquiza/ascender/outputs"
+)
+
+// Config holds NATS output settings.
+type Config struct {
+	// Servers to connect to, host:port (nats:// or tls://
+	// prefixes allowed). Tried in order on reconnect.
+	Servers []string `json:"servers"`
+	// Subject template, e.g. "logs.{@type}". Placeholders are
+	// filled from message fields (see outputs.Template).
+	Subject string `json:"subject"`
+	// Value for placeholders missing from a message.
+	SubjectMissing string `json:"subject-missing"`
+	// Wait for JetStream publish acknowledgements and retry
+	// unacknowledged messages (deduplicated by Nats-Msg-Id).
+	JetStream    bool   `json:"jetstream"`
+	Retries      *int   `json:"retries"`
+	RetryBackoff string `json:"retry-backoff"`
+	MaxBackoff   string `json:"max-backoff"`
+	Timeout      string `json:"timeout"`
+	User         string `json:"user"`
+	Password     string `json:"password"`
+	Token        string `json:"token"`
+	TLS          bool   `json:"tls"`
+	Name         string `json:"name"`
+
+	subject      *outputs.Template
+	retries      int
+	retryBackoff time.Duration
+	maxBackoff   time.Duration
+	timeout      time.Duration
+}
+
+// Validate checks settings and fills in defaults.
+func (c *Config) Validate() error {
+	if len(c.Servers) == 0 {
+		return errors.New("servers is required")
+	}
+	if c.Subject == "" {
+		return errors.New("subject is required")
+	}
+
+	var err error
+	if c.subject, err = outputs.ParseTemplate(c.Subject); err != nil {
+		return err
+	}
+	c.subject.Missing = "unknown"
+	if c.SubjectMissing != "" {
+		c.subject.Missing = c.SubjectMissing
+	}
+
+	c.retries = 3
+	if c.Retries != nil {
+		if *c.Retries < 0 {
+			return errors.New("retries can't be negative")
+		}
+		c.retries = *c.Retries
+	}
+	if c.retryBackoff, err = outputs.Duration(c.RetryBackoff, "100ms"); err != nil {
+		return fmt.Errorf("invalid retry-backoff %q", c.RetryBackoff)
+	}
+	if c.maxBackoff, err = outputs.Duration(c.MaxBackoff, "5s"); err != nil {
+		return fmt.Errorf("invalid max-backoff %q", c.MaxBackoff)
+	}
+	if c.timeout, err = outputs.Duration(c.Timeout, "5s"); err != nil {
+		return fmt.Errorf("invalid timeout %q", c.Timeout)
+	}
+	if c.Name == "" {
+		c.Name = "ascender"
+	}
+
+	return nil
+}
+
+// escapeToken makes a value safe as (part of) a subject token.
+func escapeToken(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// Worker that reads message batches from the messageOutgoingQueue
+// and publishes them to NATS.
+func Handler(c *Config, messageOutgoingQueue <-chan []*outputs.Message, s outputs.Statser) {
+	p := &publisher{config: c, stats: s}
+	defer func() {
+		if p.conn != nil {
+			p.conn.close()
+		}
+	}()
+
+	for m := range messageOutgoingQueue {
+		sent, err := p.send(m)
+		if err != nil {
+			log.Printf("NATS batch error: %d of %d messages not sent: %s\n", len(m)-sent, len(m), err)
+		}
+		s.IncrSent(int64(sent))
+	}
+}
+
+// publisher sends batches over a connection,
+// reconnecting as needed.
+type publisher struct {
+	config *Config
+	stats  outputs.Statser
+	conn   *conn
+	// Next server to try.
+	server int
+	// Last JetStream reply token used.
+	token uint64
+}
+
+// connect returns a working connection, trying each server once.
+func (p *publisher) connect() (*conn, error) {
+	if p.conn != nil && p.conn.failed() == nil {
+		return p.conn, nil
+	}
+
+	var err error
+	for range p.config.Servers {
+		server := p.config.Servers[p.server%len(p.config.Servers)]
+		p.server++
+		if p.conn, err = dial(p.config, server); err == nil {
+			log.Printf("Connected to NATS server: %s\n", server)
+			return p.conn, nil
+		}
+		log.Printf("NATS connection error: %s: %s\n", server, err)
+	}
+	return nil, err
+}
+
+// pending is a message awaiting a JetStream ack.
+type pending struct {
+	subject string
+	msgID   string
+	data    []byte
+
+	msg      *outputs.Message
+	attempts int
+	// Set if the message can't be published.
+	err error
+}
+
+// send publishes a batch and returns the number of messages
+// sent: flushed to the server, or acked by JetStream. Messages
+// not sent are passed to the Statser.
+func (p *publisher) send(batch []*outputs.Message) (int, error) {
+	msgs := make([]*pending, 0, len(batch))
+	for _, m := range batch {
+		msgs = append(msgs, &pending{
+			subject: p.config.subject.Execute(m, escapeToken),
+			data:    []byte(m.Body),
+			msg:     m,
+		})
+		if p.config.JetStream {
+			msgs[len(msgs)-1].msgID = randomID()
+		}
+	}
+
+	sent := 0
+	var err error
+	retry := msgs
+	backoff := p.config.retryBackoff
+	for attempt := 0; ; attempt++ {
+		var n int
+		n, retry, err = p.attempt(retry)
+		sent += n
+		if err == nil || len(retry) == 0 || attempt >= p.config.retries {
+			break
+		}
+		log.Printf("NATS publish failed, retrying %d messages in %s: %s\n", len(retry), backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > p.config.maxBackoff {
+			backoff = p.config.maxBackoff
+		}
+	}
+
+	for _, m := range retry {
+		if m.err == nil {
+			p.stats.Failed(m.msg, m.attempts, err)
+		}
+	}
+	for _, m := range msgs {
+		if m.err != nil {
+			p.stats.Failed(m.msg, m.attempts, m.err)
+		}
+	}
+
+	return sent, err
+}
+
+// attempt publishes msgs once, returning the number
+// sent and the messages still to be retried.
+func (p *publisher) attempt(msgs []*pending) (int, []*pending, error) {
+	cn, err := p.connect()
+	if err != nil {
+		return 0, msgs, err
+	}
+
+	// Reply tokens are unique per publisher so late
+	// acks from an earlier attempt are ignored.
+	waiting := map[string]*pending{}
+	var dropped int
+	var dropErr error
+	for _, m := range msgs {
+		m.attempts, m.err = m.attempts+1, nil
+		var reply string
+		if p.config.JetStream {
+			p.token++
+			token := strconv.FormatUint(p.token, 10)
+			reply = cn.inbox + "." + token
+			waiting[token] = m
+		}
+		if err := cn.publish(m.subject, reply, m.msgID, m.data); err != nil {
+			// Oversized messages can't succeed on retry.
+			delete(waiting, strconv.FormatUint(p.token, 10))
+			dropped++
+			dropErr = err
+			m.err = err
+		}
+	}
+	if err := cn.flush(); err != nil {
+		return 0, msgs, err
+	}
+	if !p.config.JetStream {
+		return len(msgs) - dropped, nil, dropErr
+	}
+
+	// Collect acks until all arrive or the timeout passes.
+	acked, failed := 0, map[*pending]bool{}
+	timeout := time.After(p.config.timeout)
+	for len(waiting) > 0 && err == nil {
+		select {
+		case rep := <-cn.replies:
+			m, ok := waiting[rep.token]
+			if !ok {
+				continue
+			}
+			delete(waiting, rep.token)
+			if ackErr := jetStreamAck(rep); ackErr != nil {
+				failed[m] = true
+				dropErr = fmt.Errorf("%s: %s", m.subject, ackErr)
+				continue
+			}
+			acked++
+		case <-timeout:
+			err = errors.New("timed out waiting for jetstream acks")
+		case <-cn.done:
+			err = cn.failed()
+		}
+	}
+	for _, m := range waiting {
+		failed[m] = true
+	}
+	if err == nil {
+		err = dropErr
+	}
+
+	// Retry in the original order.
+	var retry []*pending
+	for _, m := range msgs {
+		if failed[m] {
+			retry = append(retry, m)
+		}
+	}
+	if len(retry) == 0 {
+		return acked, nil, dropErr
+	}
+	return acked, retry, err
+}
+
+// jetStreamAck checks a publish acknowledgement.
+func jetStreamAck(rep reply) error {
+	if rep.status == "503" {
+		return errors.New("no stream for subject")
+	}
+	var ack struct {
+		Stream string `json:"stream"`
+		Error  *struct {
+			Code        int    `json:"code"`
+			Description string `json:"description"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(rep.data, &ack); err != nil {
+		return fmt.Errorf("invalid ack: %s", err)
+	}
+	if ack.Error != nil {
+		return fmt.Errorf("jetstream error %d: %s", ack.Error.Code, ack.Error.Description)
+	}
+	if ack.Stream == "" {
+		return errors.New("invalid ack: no stream")
+	}
+	return nil
+}
@@ -0,0 +1,322 @@
+package nats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jamiealquiza/ascender/outputs"
+	"github.com/jamiealquiza/ascender/outputs/outputstest"
+)
+
+// published is a message received by a fake server.
+type published struct {
+	subject, reply, msgID, data string
+}
+
+// server is a fake NATS server. handle is called for each
+// message published, returning the JetStream ack to send
+// to its reply subject ("" for none, "503" for no
+// responders), or drop to close the connection instead.
+type server struct {
+	addr   string
+	info   string
+	handle func(p published) (ack string, drop bool)
+
+	mu       sync.Mutex
+	pubs     []published
+	connects []string
+	conns    int
+}
+
+func newServer(t *testing.T, info string, handle func(p published) (string, bool)) *server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &server{addr: l.Addr().String(), info: info, handle: handle}
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns++
+			s.mu.Unlock()
+			go s.serve(nc)
+		}
+	}()
+	return s
+}
+
+func (s *server) serve(nc net.Conn) {
+	defer nc.Close()
+	fmt.Fprintf(nc, "INFO %s\r\n", s.info)
+	r := bufio.NewReader(nc)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		f := strings.Fields(line)
+		switch f[0] {
+		case "CONNECT":
+			s.mu.Lock()
+			s.connects = append(s.connects, strings.TrimSpace(line[len("CONNECT "):]))
+			s.mu.Unlock()
+		case "PING":
+			io.WriteString(nc, "PONG\r\n")
+		case "PUB", "HPUB":
+			// PUB <subject> [reply] <size>
+			// HPUB <subject> [reply] <header size> <total size>
+			p := published{subject: f[1]}
+			args, hdrLen := 3, 0
+			if f[0] == "HPUB" {
+				args = 4
+				hdrLen, _ = strconv.Atoi(f[len(f)-2])
+			}
+			if len(f) > args {
+				p.reply = f[2]
+			}
+			total, _ := strconv.Atoi(f[len(f)-1])
+			b := make([]byte, total+2)
+			if _, err := io.ReadFull(r, b); err != nil {
+				return
+			}
+			for _, h := range strings.Split(string(b[:hdrLen]), "\r\n") {
+				if v := strings.TrimPrefix(h, "Nats-Msg-Id: "); v != h {
+					p.msgID = v
+				}
+			}
+			p.data = string(b[hdrLen:total])
+
+			ack, drop := s.handle(p)
+			if drop {
+				return
+			}
+			s.mu.Lock()
+			s.pubs = append(s.pubs, p)
+			s.mu.Unlock()
+			switch {
+			case p.reply == "" || ack == "":
+			case ack == "503":
+				hdr := "NATS/1.0 503\r\n\r\n"
+				fmt.Fprintf(nc, "HMSG %s 1 %d %d\r\n%s\r\n", p.reply, len(hdr), len(hdr), hdr)
+			default:
+				fmt.Fprintf(nc, "MSG %s 1 %d\r\n%s\r\n", p.reply, len(ack), ack)
+			}
+		}
+	}
+}
+
+// published returns the messages published, the CONNECT
+// options sent and the number of connections made.
+func (s *server) published() ([]published, []string, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]published{}, s.pubs...), append([]string{}, s.connects...), s.conns
+}
+
+const (
+	info          = `{"server_id":"test","headers":true,"max_payload":1048576}`
+	ack           = `{"stream":"LOGS","seq":1}`
+	noStreamError = `{"error":{"code":503,"err_code":10039,"description":"jetstream not enabled"}}`
+)
+
+func accept(p published) (string, bool) {
+	return ack, false
+}
+
+func newPublisher(t *testing.T, c *Config) (*publisher, *outputstest.Stats) {
+	c.RetryBackoff, c.MaxBackoff = "1ms", "1ms"
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s := &outputstest.Stats{}
+	p := &publisher{config: c, stats: s}
+	t.Cleanup(func() {
+		if p.conn != nil {
+			p.conn.close()
+		}
+	})
+	return p, s
+}
+
+func routed(route string, bodies ...string) []*outputs.Message {
+	ms := outputstest.Messages(bodies...)
+	for _, m := range ms {
+		m.Route = route
+	}
+	return ms
+}
+
+func TestPublish(t *testing.T) {
+	srv := newServer(t, info, accept)
+	p, s := newPublisher(t, &Config{Servers: []string{"nats://" + srv.addr}, Subject: "logs.{:route}", User: "u", Password: "p"})
+
+	batch := append(routed("a.b", "1", "2"), routed("c", "3")...)
+	if sent, err := p.send(batch); sent != 3 || err != nil {
+		t.Fatalf("sent %d: %v", sent, err)
+	}
+	pubs, connects, _ := srv.published()
+	var got []string
+	for _, pub := range pubs {
+		if pub.reply != "" || pub.msgID != "" {
+			t.Errorf("core publish with reply %q, id %q", pub.reply, pub.msgID)
+		}
+		got = append(got, pub.subject+" "+pub.data)
+	}
+	// Subject tokens from messages can't add levels.
+	if strings.Join(got, "|") != "logs.a_b 1|logs.a_b 2|logs.c 3" {
+		t.Errorf("published %q", got)
+	}
+	if len(connects) != 1 || !strings.Contains(connects[0], `"user":"u"`) || !strings.Contains(connects[0], `"name":"ascender"`) {
+		t.Errorf("connect %q", connects)
+	}
+	if len(s.Dropped()) != 0 {
+		t.Errorf("failed %v", outputs.Bodies(s.Dropped()))
+	}
+}
+
+// Messages over the server's max payload are failed
+// at once, without holding up the rest.
+func TestMaxPayload(t *testing.T) {
+	srv := newServer(t, `{"headers":true,"max_payload":4}`, accept)
+	p, s := newPublisher(t, &Config{Servers: []string{srv.addr}, Subject: "s"})
+	if sent, err := p.send(outputstest.Messages("ok", "too long", "fine")); sent != 2 || err == nil {
+		t.Fatalf("sent %d: %v", sent, err)
+	}
+	if d := s.Dropped(); len(d) != 1 || d[0].Body != "too long" {
+		t.Errorf("failed %v", outputs.Bodies(d))
+	}
+	if pubs, _, conns := srv.published(); len(pubs) != 2 || conns != 1 {
+		t.Errorf("%d published over %d connections", len(pubs), conns)
+	}
+}
+
+// A connection that breaks before the server confirms a
+// batch is replaced, trying the next server, and the batch
+// published again.
+func TestReconnect(t *testing.T) {
+	var mu sync.Mutex
+	drops := 1
+	srv := newServer(t, info, func(p published) (string, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if p.data == "2" && drops > 0 {
+			drops--
+			return "", true
+		}
+		return "", false
+	})
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down.Close()
+	p, s := newPublisher(t, &Config{Servers: []string{srv.addr, down.Addr().String()}, Subject: "s"})
+
+	if sent, err := p.send(outputstest.Messages("1", "2", "3")); sent != 3 || err != nil {
+		t.Fatalf("sent %d: %v", sent, err)
+	}
+	pubs, _, conns := srv.published()
+	var got []string
+	for _, pub := range pubs {
+		got = append(got, pub.data)
+	}
+	if strings.Join(got, "") != "1123" || conns != 2 {
+		t.Errorf("published %q over %d connections", got, conns)
+	}
+	if len(s.Dropped()) != 0 {
+		t.Errorf("failed %v", outputs.Bodies(s.Dropped()))
+	}
+}
+
+func TestAllServersDown(t *testing.T) {
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down.Close()
+	retries := 2
+	p, s := newPublisher(t, &Config{Servers: []string{down.Addr().String()}, Subject: "s", Retries: &retries})
+	if sent, err := p.send(outputstest.Messages("1", "2")); sent != 0 || err == nil {
+		t.Fatalf("sent %d: %v", sent, err)
+	}
+	if n := len(s.Dropped()); n != 2 {
+		t.Errorf("%d failed, want 2", n)
+	}
+}
+
+// Unacknowledged messages are retried with the same
+// Nats-Msg-Id so JetStream drops duplicates.
+func TestJetStreamRetriesUnacked(t *testing.T) {
+	var mu sync.Mutex
+	replies := map[string][]string{
+		"error":   {noStreamError, ack},
+		"missing": {"", ack},
+		"none":    {"503", "503", "503"},
+	}
+	srv := newServer(t, info, func(p published) (string, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r := replies[p.data]; len(r) > 0 {
+			replies[p.data] = r[1:]
+			return r[0], false
+		}
+		return ack, false
+	})
+	retries := 2
+	p, s := newPublisher(t, &Config{Servers: []string{srv.addr}, Subject: "s", JetStream: true, Timeout: "100ms", Retries: &retries})
+
+	sent, err := p.send(outputstest.Messages("ok", "error", "missing", "none"))
+	if sent != 3 || err == nil {
+		t.Fatalf("sent %d: %v", sent, err)
+	}
+	if d := s.Dropped(); len(d) != 1 || d[0].Body != "none" || !strings.Contains(s.Reasons()[0].Error(), "no stream") {
+		t.Errorf("failed %v: %v", outputs.Bodies(d), s.Reasons())
+	}
+
+	pubs, _, _ := srv.published()
+	ids := map[string]map[string]bool{}
+	for _, pub := range pubs {
+		if pub.reply == "" || pub.msgID == "" {
+			t.Fatalf("jetstream publish without reply or id: %+v", pub)
+		}
+		if ids[pub.data] == nil {
+			ids[pub.data] = map[string]bool{}
+		}
+		ids[pub.data][pub.msgID] = true
+	}
+	counts := map[string]int{}
+	for _, pub := range pubs {
+		counts[pub.data]++
+	}
+	if counts["ok"] != 1 || counts["error"] != 2 || counts["missing"] != 2 || counts["none"] != 3 {
+		t.Errorf("attempts %v", counts)
+	}
+	for data, set := range ids {
+		if len(set) != 1 {
+			t.Errorf("%s published with ids %v", data, set)
+		}
+	}
+}
+
+func TestJetStreamNeedsHeaders(t *testing.T) {
+	srv := newServer(t, `{"headers":false}`, accept)
+	retries := 0
+	p, s := newPublisher(t, &Config{Servers: []string{srv.addr}, Subject: "s", JetStream: true, Retries: &retries})
+	if _, err := p.send(outputstest.Messages("m")); err == nil || !strings.Contains(err.Error(), "headers") {
+		t.Fatalf("err = %v", err)
+	}
+	if n := len(s.Dropped()); n != 1 {
+		t.Errorf("%d failed, want 1", n)
+	}
+}
@@ -0,0 +1,27 @@
+package outputs
+
+import (
+	"errors"
+	"time"
+)
+
+// Statser counts the messages an output sends, and takes
+// those it gives up on after attempts tries (0 if never sent).
+type Statser interface {
+	IncrSent(int64)
+	FetchSent() int64
+	Failed(m *Message, attempts int, reason error)
+}
+
+// Duration parses a positive duration setting,
+// def if unset.
+func Duration(s, def string) (time.Duration, error) {
+	if s == "" {
+		s = def
+	}
+	d, err := time.ParseDuration(s)
+	if err == nil && d <= 0 {
+		err = errors.New("must be positive")
+	}
+	return d, err
+}
@@ -0,0 +1,59 @@
+// Package outputstest provides helpers for testing outputs.
+package outputstest
+
+import (
+	"sync"
+
+	"github.com/jamiealquiza/ascender/outputs"
+)
+
+// Stats is an outputs.Statser recording the messages
+// an output gives up on. It's safe for concurrent use.
+type Stats struct {
+	mu      sync.Mutex
+	sent    int64
+	failed  []*outputs.Message
+	reasons []error
+}
+
+func (s *Stats) IncrSent(n int64) {
+	s.mu.Lock()
+	s.sent += n
+	s.mu.Unlock()
+}
+
+func (s *Stats) FetchSent() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sent
+}
+
+func (s *Stats) Failed(m *outputs.Message, attempts int, reason error) {
+	s.mu.Lock()
+	s.failed = append(s.failed, m)
+	s.reasons = append(s.reasons, reason)
+	s.mu.Unlock()
+}
+
+// Dropped returns the messages passed to Failed, in order.
+func (s *Stats) Dropped() []*outputs.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*outputs.Message{}, s.failed...)
+}
+
+// Reasons returns the errors passed to Failed, in order.
+func (s *Stats) Reasons() []error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]error{}, s.reasons...)
+}
+
+// Messages returns a message for each body.
+func Messages(bodies ...string) []*outputs.Message {
+	ms := make([]*outputs.Message, len(bodies))
+	for i, b := range bodies {
+		ms[i] = &outputs.Message{Body: b}
+	}
+	return ms
+}
@@ -0,0 +1,169 @@
+package redis
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error is an error reply from the server.
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// retriable reports whether a command failing with e
+// may succeed if retried, e.g. once a replica is promoted
+// or the server finishes loading its dataset.
+func (e Error) retriable() bool {
+	switch strings.SplitN(string(e), " ", 2)[0] {
+	case "LOADING", "BUSY", "TRYAGAIN", "READONLY", "MASTERDOWN", "CLUSTERDOWN", "OOM":
+		return true
+	}
+	return false
+}
+
+// conn is a Redis connection speaking RESP2.
+type conn struct {
+	nc      net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	timeout time.Duration
+}
+
+// dial connects to the server, authenticating and
+// selecting the database if configured.
+func dial(c *Config) (*conn, error) {
+	nc, err := net.DialTimeout("tcp", c.Addr, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	if c.TLS {
+		host, _, _ := net.SplitHostPort(c.Addr)
+		tc := tls.Client(nc, &tls.Config{ServerName: host})
+		tc.SetDeadline(time.Now().Add(c.timeout))
+		if err := tc.Handshake(); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		nc = tc
+	}
+	cn := &conn{nc: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc), timeout: c.timeout}
+
+	var setup [][][]byte
+	if c.Password != "" {
+		auth := [][]byte{[]byte("AUTH")}
+		if c.Username != "" {
+			auth = append(auth, []byte(c.Username))
+		}
+		setup = append(setup, append(auth, []byte(c.Password)))
+	}
+	if c.DB != 0 {
+		setup = append(setup, [][]byte{[]byte("SELECT"), []byte(strconv.Itoa(c.DB))})
+	}
+	if len(setup) > 0 {
+		replies, err := cn.pipeline(setup)
+		if err == nil {
+			for _, rerr := range replies {
+				if rerr != nil {
+					err = rerr
+					break
+				}
+			}
+		}
+		if err != nil {
+			cn.close()
+			return nil, err
+		}
+	}
+
+	return cn, nil
+}
+
+func (cn *conn) close() {
+	cn.nc.Close()
+}
+
+// pipeline writes commands and reads their replies. It returns
+// the error reply of each command, nil if it succeeded, and the
+// error that broke the connection, if any. Replies not read
+// before the connection broke are missing from the result.
+func (cn *conn) pipeline(cmds [][][]byte) ([]error, error) {
+	cn.nc.SetDeadline(time.Now().Add(cn.timeout))
+	for _, args := range cmds {
+		fmt.Fprintf(cn.w, "*%d\r\n", len(args))
+		for _, a := range args {
+			fmt.Fprintf(cn.w, "$%d\r\n", len(a))
+			cn.w.Write(a)
+			cn.w.WriteString("\r\n")
+		}
+	}
+	if err := cn.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]error, 0, len(cmds))
+	for range cmds {
+		rerr, err := cn.readReply()
+		if err != nil {
+			return replies, err
+		}
+		replies = append(replies, rerr)
+	}
+
+	return replies, nil
+}
+
+// readReply reads a reply, returning its error if it is an
+// error reply (the first one, for arrays). Values aren't needed.
+func (cn *conn) readReply() (error, error) {
+	line, err := cn.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed reply %q", line)
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+', ':':
+		return nil, nil
+	case '-':
+		return Error(line[1:]), nil
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("malformed reply %q", line)
+		}
+		if n >= 0 {
+			_, err = io.CopyN(io.Discard, cn.r, int64(n)+2)
+		}
+		return nil, err
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("malformed reply %q", line)
+		}
+		var first error
+		for i := 0; i < n; i++ {
+			rerr, err := cn.readReply()
+			if err != nil {
+				return nil, err
+			}
+			if first == nil {
+				first = rerr
+			}
+		}
+		return first, nil
+	}
+
+	return nil, errors.New("unknown reply type " + strconv.Quote(line[:1]))
+}
@@ -0,0 +1,270 @@
+// Package redis pushes messages to Redis lists,
+// pub/sub channels or streams.
+package redis
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/jamiealquiza/ascender/outputs"
+)
+
+// Config holds Redis output settings.
+type Config struct {
+	// host:port, default localhost:6379.
+	Addr     string `json:"addr"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	DB       int    `json:"db"`
+	TLS      bool   `json:"tls"`
+	// "list" (RPUSH, the default), "publish" or "stream" (XADD).
+	Mode string `json:"mode"`
+	// Key template naming the list, channel or stream,
+	// e.g. "logs:{:route}" (see outputs.Template).
+	Key string `json:"key"`
+	// Value for placeholders missing from a message.
+	KeyMissing string `json:"key-missing"`
+	// Stream entry field holding the message, default "message".
+	StreamField string `json:"stream-field"`
+	// Trim streams to about MaxLen entries, or exactly
+	// with MaxLenExact. 0 doesn't trim.
+	MaxLen       int64  `json:"maxlen"`
+	MaxLenExact  bool   `json:"maxlen-exact"`
+	Retries      *int   `json:"retries"`
+	RetryBackoff string `json:"retry-backoff"`
+	MaxBackoff   string `json:"max-backoff"`
+	Timeout      string `json:"timeout"`
+
+	key          *outputs.Template
+	retries      int
+	retryBackoff time.Duration
+	maxBackoff   time.Duration
+	timeout      time.Duration
+}
+
+// Validate checks settings and fills in defaults.
+func (c *Config) Validate() error {
+	if c.Addr == "" {
+		c.Addr = "localhost:6379"
+	}
+	if c.Key == "" {
+		return errors.New("key is required")
+	}
+	if c.DB < 0 {
+		return errors.New("db can't be negative")
+	}
+
+	switch c.Mode {
+	case "":
+		c.Mode = "list"
+	case "list", "publish", "stream":
+	default:
+		return fmt.Errorf("invalid mode %q", c.Mode)
+	}
+	if c.StreamField == "" {
+		c.StreamField = "message"
+	}
+	if c.MaxLen < 0 {
+		return errors.New("maxlen can't be negative")
+	}
+
+	var err error
+	if c.key, err = outputs.ParseTemplate(c.Key); err != nil {
+		return err
+	}
+	c.key.Missing = "unknown"
+	if c.KeyMissing != "" {
+		c.key.Missing = c.KeyMissing
+	}
+
+	c.retries = 5
+	if c.Retries != nil {
+		if *c.Retries < 0 {
+			return errors.New("retries can't be negative")
+		}
+		c.retries = *c.Retries
+	}
+	if c.retryBackoff, err = outputs.Duration(c.RetryBackoff, "100ms"); err != nil {
+		return fmt.Errorf("invalid retry-backoff %q", c.RetryBackoff)
+	}
+	if c.maxBackoff, err = outputs.Duration(c.MaxBackoff, "5s"); err != nil {
+		return fmt.Errorf("invalid max-backoff %q", c.MaxBackoff)
+	}
+	if c.timeout, err = outputs.Duration(c.Timeout, "5s"); err != nil {
+		return fmt.Errorf("invalid timeout %q", c.Timeout)
+	}
+
+	return nil
+}
+
+// Worker that reads message batches from the messageOutgoingQueue
+// and pushes them to Redis, one pipeline per batch.
+func Handler(c *Config, messageOutgoingQueue <-chan []*outputs.Message, s outputs.Statser) {
+	p := &pusher{config: c, stats: s}
+	defer func() {
+		if p.conn != nil {
+			p.conn.close()
+		}
+	}()
+
+	for m := range messageOutgoingQueue {
+		sent, err := p.send(m)
+		if err != nil {
+			log.Printf("Redis batch error: %d of %d messages not sent: %s\n", len(m)-sent, len(m), err)
+		}
+		s.IncrSent(int64(sent))
+	}
+}
+
+// pusher sends batches over a connection,
+// reconnecting as needed.
+type pusher struct {
+	config *Config
+	stats  outputs.Statser
+	conn   *conn
+}
+
+// command is a command and the messages it carries.
+type command struct {
+	args     [][]byte
+	msgs     []*outputs.Message
+	attempts int
+	// Set if the command failed with an error retries won't fix.
+	err error
+}
+
+// commands returns the commands for a batch. In list mode,
+// messages for the same key are pushed with one RPUSH.
+func (p *pusher) commands(batch []*outputs.Message) []*command {
+	c := p.config
+	var cmds []*command
+	lists := map[string]*command{}
+	for _, m := range batch {
+		key := c.key.Execute(m, nil)
+		switch c.Mode {
+		case "list":
+			cmd, ok := lists[key]
+			if !ok {
+				cmd = &command{args: [][]byte{[]byte("RPUSH"), []byte(key)}}
+				lists[key] = cmd
+				cmds = append(cmds, cmd)
+			}
+			cmd.args = append(cmd.args, []byte(m.Body))
+			cmd.msgs = append(cmd.msgs, m)
+		case "publish":
+			cmds = append(cmds, &command{args: [][]byte{[]byte("PUBLISH"), []byte(key), []byte(m.Body)}, msgs: []*outputs.Message{m}})
+		case "stream":
+			args := [][]byte{[]byte("XADD"), []byte(key)}
+			if c.MaxLen > 0 {
+				args = append(args, []byte("MAXLEN"))
+				if !c.MaxLenExact {
+					args = append(args, []byte("~"))
+				}
+				args = append(args, []byte(strconv.FormatInt(c.MaxLen, 10)))
+			}
+			args = append(args, []byte("*"), []byte(c.StreamField), []byte(m.Body))
+			cmds = append(cmds, &command{args: args, msgs: []*outputs.Message{m}})
+		}
+	}
+
+	return cmds
+}
+
+// send pushes a batch and returns the number of messages sent.
+// Failed commands are retried with backoff, reconnecting first
+// if the connection broke. Messages not sent are passed to
+// the Statser.
+func (p *pusher) send(batch []*outputs.Message) (int, error) {
+	cmds := p.commands(batch)
+
+	sent := 0
+	var err error
+	retry := cmds
+	backoff := p.config.retryBackoff
+	for attempt := 0; len(retry) > 0; attempt++ {
+		var n int
+		n, retry, err = p.attempt(retry)
+		sent += n
+		if err == nil || len(retry) == 0 || attempt >= p.config.retries {
+			break
+		}
+		msgs := 0
+		for _, c := range retry {
+			msgs += len(c.msgs)
+		}
+		log.Printf("Redis push failed, retrying %d messages in %s: %s\n", msgs, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > p.config.maxBackoff {
+			backoff = p.config.maxBackoff
+		}
+	}
+
+	for _, c := range retry {
+		for _, m := range c.msgs {
+			p.stats.Failed(m, c.attempts, err)
+		}
+	}
+	for _, c := range cmds {
+		if c.err == nil {
+			continue
+		}
+		for _, m := range c.msgs {
+			p.stats.Failed(m, c.attempts, c.err)
+		}
+	}
+
+	return sent, err
+}
+
+// attempt sends cmds in one pipeline, returning the number
+// of messages sent and the commands to retry.
+func (p *pusher) attempt(cmds []*command) (int, []*command, error) {
+	if p.conn == nil {
+		cn, err := dial(p.config)
+		if err != nil {
+			return 0, cmds, err
+		}
+		log.Printf("Connected to Redis server: %s\n", p.config.Addr)
+		p.conn = cn
+	}
+
+	args := make([][][]byte, len(cmds))
+	for i, c := range cmds {
+		c.attempts++
+		args[i] = c.args
+	}
+	replies, err := p.conn.pipeline(args)
+	if err != nil {
+		p.conn.close()
+		p.conn = nil
+	}
+
+	// Commands without a reply are retried, as are
+	// those failing with a retriable error.
+	sent := 0
+	var retry []*command
+	var cmdErr error
+	for i, c := range cmds {
+		switch {
+		case i >= len(replies):
+			retry = append(retry, c)
+		case replies[i] == nil:
+			sent += len(c.msgs)
+		default:
+			cmdErr = replies[i]
+			if rerr, ok := replies[i].(Error); ok && rerr.retriable() {
+				retry = append(retry, c)
+			} else {
+				c.err = replies[i]
+			}
+		}
+	}
+	if err == nil {
+		err = cmdErr
+	}
+
+	return sent, retry, err
+}
@@ -0,0 +1,269 @@
+package redis
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jamiealquiza/ascender/outputs"
+	"github.com/jamiealquiza/ascender/outputs/outputstest"
+)
+
+// server is a fake Redis server. reply answers each command
+// with a RESP reply; an empty reply closes the connection.
+type server struct {
+	addr  string
+	reply func(cmd []string) string
+
+	mu    sync.Mutex
+	cmds  []string
+	conns int
+}
+
+func newServer(t *testing.T, reply func(cmd []string) string) *server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &server{addr: l.Addr().String(), reply: reply}
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns++
+			s.mu.Unlock()
+			go s.serve(nc)
+		}
+	}()
+	return s
+}
+
+func (s *server) serve(nc net.Conn) {
+	defer nc.Close()
+	r := bufio.NewReader(nc)
+	for {
+		cmd, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.cmds = append(s.cmds, strings.Join(cmd, " "))
+		s.mu.Unlock()
+		reply := s.reply(cmd)
+		if reply == "" {
+			return
+		}
+		io.WriteString(nc, reply)
+	}
+}
+
+// readCommand reads a command sent as an array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	cmd := make([]string, n)
+	for i := range cmd {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		cmd[i] = string(b[:size])
+	}
+	return cmd, nil
+}
+
+// commands returns the commands received, and the
+// number of connections made.
+func (s *server) commands() ([]string, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.cmds...), s.conns
+}
+
+func newPusher(t *testing.T, c *Config) (*pusher, *outputstest.Stats) {
+	c.RetryBackoff, c.MaxBackoff = "1ms", "1ms"
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s := &outputstest.Stats{}
+	p := &pusher{config: c, stats: s}
+	t.Cleanup(func() {
+		if p.conn != nil {
+			p.conn.close()
+		}
+	})
+	return p, s
+}
+
+func routed(route string, bodies ...string) []*outputs.Message {
+	ms := outputstest.Messages(bodies...)
+	for _, m := range ms {
+		m.Route = route
+	}
+	return ms
+}
+
+func TestPushLists(t *testing.T) {
+	srv := newServer(t, func(cmd []string) string {
+		if cmd[0] == "RPUSH" {
+			return ":" + strconv.Itoa(len(cmd)-2) + "\r\n"
+		}
+		return "+OK\r\n"
+	})
+	p, s := newPusher(t, &Config{Addr: srv.addr, Username: "u", Password: "p", DB: 2, Key: "logs:{:route}"})
+
+	batch := append(routed("a", "1", "2"), routed("b", "3")...)
+	batch = append(batch, routed("a", "4")...)
+	if sent, err := p.send(batch); sent != 4 || err != nil {
+		t.Fatalf("sent %d: %v", sent, err)
+	}
+	cmds, _ := srv.commands()
+	want := []string{"AUTH u p", "SELECT 2", "RPUSH logs:a 1 2 4", "RPUSH logs:b 3"}
+	if strings.Join(cmds, "|") != strings.Join(want, "|") {
+		t.Errorf("commands %q, want %q", cmds, want)
+	}
+	if len(s.Dropped()) != 0 {
+		t.Errorf("failed %v", outputs.Bodies(s.Dropped()))
+	}
+}
+
+func TestPublishAndStream(t *testing.T) {
+	srv := newServer(t, func(cmd []string) string {
+		if cmd[0] == "XADD" {
+			return "$15\r\n1526919030474-0\r\n"
+		}
+		return ":1\r\n"
+	})
+	p, _ := newPusher(t, &Config{Addr: srv.addr, Mode: "publish", Key: "ch"})
+	if sent, err := p.send(routed("r", "m")); sent != 1 || err != nil {
+		t.Fatalf("publish: sent %d: %v", sent, err)
+	}
+	p, _ = newPusher(t, &Config{Addr: srv.addr, Mode: "stream", Key: "st", MaxLen: 100})
+	if sent, err := p.send(routed("r", "m")); sent != 1 || err != nil {
+		t.Fatalf("stream: sent %d: %v", sent, err)
+	}
+	cmds, _ := srv.commands()
+	if strings.Join(cmds, "|") != "PUBLISH ch m|XADD st MAXLEN ~ 100 * message m" {
+		t.Errorf("commands %q", cmds)
+	}
+}
+
+// Commands without a reply when the connection breaks are
+// retried over a new one.
+func TestReconnect(t *testing.T) {
+	var mu sync.Mutex
+	drops := 1
+	srv := newServer(t, func(cmd []string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		if cmd[1] == "b" && drops > 0 {
+			drops--
+			return ""
+		}
+		return ":1\r\n"
+	})
+	p, s := newPusher(t, &Config{Addr: srv.addr, Key: "{:route}"})
+
+	batch := append(routed("a", "1"), routed("b", "2")...)
+	if sent, err := p.send(batch); sent != 2 || err != nil {
+		t.Fatalf("sent %d: %v", sent, err)
+	}
+	cmds, conns := srv.commands()
+	if conns != 2 {
+		t.Errorf("%d connections, want 2", conns)
+	}
+	if strings.Join(cmds, "|") != "RPUSH a 1|RPUSH b 2|RPUSH b 2" {
+		t.Errorf("commands %q", cmds)
+	}
+	if len(s.Dropped()) != 0 {
+		t.Errorf("failed %v", outputs.Bodies(s.Dropped()))
+	}
+
+	// Later batches use the new connection.
+	p.send(routed("a", "3"))
+	if _, conns := srv.commands(); conns != 2 {
+		t.Errorf("%d connections, want 2", conns)
+	}
+}
+
+// Retriable errors are retried until retries run out;
+// other errors fail their messages at once.
+func TestCommandErrors(t *testing.T) {
+	var mu sync.Mutex
+	loading := 2
+	srv := newServer(t, func(cmd []string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		switch cmd[1] {
+		case "loading":
+			if loading > 0 {
+				loading--
+				return "-LOADING Redis is loading the dataset in memory\r\n"
+			}
+		case "wrongtype":
+			return "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+		case "readonly":
+			return "-READONLY You can't write against a read only replica.\r\n"
+		}
+		return ":1\r\n"
+	})
+	retries := 3
+	p, s := newPusher(t, &Config{Addr: srv.addr, Key: "{:route}", Retries: &retries})
+
+	batch := append(routed("loading", "1"), routed("wrongtype", "2")...)
+	batch = append(batch, routed("readonly", "3")...)
+	batch = append(batch, routed("ok", "4")...)
+	sent, err := p.send(batch)
+	if sent != 2 || err == nil {
+		t.Fatalf("sent %d: %v", sent, err)
+	}
+	failed := outputs.Bodies(s.Dropped())
+	if len(failed) != 2 || failed[0] != "3" || failed[1] != "2" {
+		t.Fatalf("failed %q, want 3 after retries and 2 at once", failed)
+	}
+	reasons := s.Reasons()
+	if !strings.HasPrefix(reasons[0].Error(), "READONLY") || !strings.HasPrefix(reasons[1].Error(), "WRONGTYPE") {
+		t.Errorf("reasons %v", reasons)
+	}
+
+	cmds, _ := srv.commands()
+	n := map[string]int{}
+	for _, c := range cmds {
+		n[c]++
+	}
+	if n["RPUSH loading 1"] != 3 || n["RPUSH wrongtype 2"] != 1 || n["RPUSH readonly 3"] != 4 || n["RPUSH ok 4"] != 1 {
+		t.Errorf("attempts %v", n)
+	}
+}
+
+func TestDialFailure(t *testing.T) {
+	srv := newServer(t, func(cmd []string) string {
+		return "-WRONGPASS invalid username-password pair\r\n"
+	})
+	retries := 1
+	p, s := newPusher(t, &Config{Addr: srv.addr, Password: "bad", Key: "k", Retries: &retries})
+	if sent, err := p.send(routed("r", "1", "2")); sent != 0 || err == nil || !strings.HasPrefix(err.Error(), "WRONGPASS") {
+		t.Fatalf("sent %d: %v", sent, err)
+	}
+	if n := len(s.Dropped()); n != 2 {
+		t.Errorf("%d failed, want 2", n)
+	}
+	if _, conns := srv.commands(); conns != 2 {
+		t.Errorf("%d connections, want 2", conns)
+	}
+}
@@ -0,0 +1,353 @@
+// Package sns publishes messages to an AWS SNS topic with PublishBatch.
+package sns
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdRoll/goamz/aws"
+	"github.com/jamiealquiza/ascender/outputs"
+)
+
+// PublishBatch limits.
+const (
+	maxEntries = 10
+	maxBytes   = 256 * 1024
+)
+
+// Config holds SNS output settings.
+type Config struct {
+	TopicARN string `json:"topic-arn"`
+	// Default the topic's region.
+	Region string `json:"region"`
+	// If unset, credentials come from the environment, the
+	// instance role or the shared credentials file.
+	AccessKey string `json:"access-key"`
+	SecretKey string `json:"secret-key"`
+	// URL used instead of the region's endpoint.
+	Endpoint string `json:"endpoint"`
+	// Template for the message group ID required by FIFO topics
+	// (see outputs.Template).
+	MessageGroup string `json:"message-group"`
+	Retries      *int   `json:"retries"`
+	RetryBackoff string `json:"retry-backoff"`
+	MaxBackoff   string `json:"max-backoff"`
+	Timeout      string `json:"timeout"`
+
+	region       aws.Region
+	endpoint     string
+	messageGroup *outputs.Template
+	retries      int
+	retryBackoff time.Duration
+	maxBackoff   time.Duration
+	timeout      time.Duration
+}
+
+// Validate checks settings and fills in defaults.
+func (c *Config) Validate() error {
+	arn := strings.Split(c.TopicARN, ":")
+	if len(arn) != 6 || arn[0] != "arn" || arn[2] != "sns" {
+		return errors.New("topic-arn must be an SNS topic ARN")
+	}
+	if c.Region == "" {
+		c.Region = arn[3]
+	}
+	if (c.AccessKey == "") != (c.SecretKey == "") {
+		return errors.New("access-key and secret-key must be set together")
+	}
+
+	var ok bool
+	if c.region, ok = aws.Regions[c.Region]; ok {
+		c.endpoint = c.region.SNSEndpoint
+	} else {
+		c.region = aws.Region{Name: c.Region}
+		c.endpoint = fmt.Sprintf("https://sns.%s.amazonaws.com", c.Region)
+	}
+	if c.Endpoint != "" {
+		u, err := url.Parse(c.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("endpoint must be an absolute http or https URL")
+		}
+		c.endpoint = c.Endpoint
+	}
+
+	var err error
+	if c.MessageGroup != "" {
+		if c.messageGroup, err = outputs.ParseTemplate(c.MessageGroup); err != nil {
+			return err
+		}
+		c.messageGroup.Missing = "unknown"
+	}
+
+	c.retries = 3
+	if c.Retries != nil {
+		if *c.Retries < 0 {
+			return errors.New("retries can't be negative")
+		}
+		c.retries = *c.Retries
+	}
+	if c.retryBackoff, err = outputs.Duration(c.RetryBackoff, "100ms"); err != nil {
+		return fmt.Errorf("invalid retry-backoff %q", c.RetryBackoff)
+	}
+	if c.maxBackoff, err = outputs.Duration(c.MaxBackoff, "5s"); err != nil {
+		return fmt.Errorf("invalid max-backoff %q", c.MaxBackoff)
+	}
+	if c.timeout, err = outputs.Duration(c.Timeout, "10s"); err != nil {
+		return fmt.Errorf("invalid timeout %q", c.Timeout)
+	}
+
+	return nil
+}
+
+// Worker that reads message batches from the messageOutgoingQueue
+// and publishes them, split into requests within the batch limits.
+func Handler(c *Config, messageOutgoingQueue <-chan []*outputs.Message, s outputs.Statser) {
+	auth, err := aws.GetAuth(c.AccessKey, c.SecretKey, "", time.Time{})
+	for err != nil {
+		log.Printf("SNS credentials error: %s, retrying in 5s\n", err)
+		time.Sleep(5 * time.Second)
+		auth, err = aws.GetAuth(c.AccessKey, c.SecretKey, "", time.Time{})
+	}
+	p := &publisher{config: c, auth: auth, client: &http.Client{Timeout: c.timeout}, stats: s}
+
+	for m := range messageOutgoingQueue {
+		sent, err := p.send(m)
+		if err != nil {
+			log.Printf("SNS batch error: %d of %d messages not sent: %s\n", len(m)-sent, len(m), err)
+		}
+		s.IncrSent(int64(sent))
+	}
+}
+
+// publisher sends batches with PublishBatch requests.
+type publisher struct {
+	config *Config
+	auth   aws.Auth
+	client *http.Client
+	stats  outputs.Statser
+}
+
+// entry is a message to publish, with its ID in the request.
+type entry struct {
+	id    string
+	body  string
+	group string
+
+	msg      *outputs.Message
+	attempts int
+	// Set if the entry failed in a way retries won't fix.
+	err error
+}
+
+// send publishes a batch and returns the number of messages sent.
+// Messages not sent are passed to the Statser.
+func (p *publisher) send(batch []*outputs.Message) (int, error) {
+	sent := 0
+	var err error
+	var req []*entry
+	size := 0
+	flush := func() {
+		n, ferr := p.publish(req)
+		sent += n
+		if ferr != nil {
+			err = ferr
+		}
+		req, size = nil, 0
+	}
+	for _, m := range batch {
+		n := len(m.Body) + m.AttributeSize()
+		if n > maxBytes {
+			err = fmt.Errorf("message of %d bytes exceeds %d", n, maxBytes)
+			p.stats.Failed(m, 0, err)
+			continue
+		}
+		if len(req) == maxEntries || size+n > maxBytes {
+			flush()
+		}
+		e := &entry{id: strconv.Itoa(len(req)), body: m.Body, msg: m}
+		if p.config.messageGroup != nil {
+			e.group = p.config.messageGroup.Execute(m, nil)
+		}
+		req = append(req, e)
+		size += n
+	}
+	if len(req) > 0 {
+		flush()
+	}
+
+	return sent, err
+}
+
+// publish sends entries, retrying failed requests and entries
+// the service failed, with backoff. It returns the number sent.
+func (p *publisher) publish(entries []*entry) (int, error) {
+	sent := 0
+	var err error
+	pending := entries
+	backoff := p.config.retryBackoff
+	for attempt := 0; len(pending) > 0; attempt++ {
+		var n int
+		var retry bool
+		n, pending, retry, err = p.attempt(pending)
+		sent += n
+		if err == nil || !retry || attempt >= p.config.retries {
+			break
+		}
+		log.Printf("SNS publish failed, retrying %d messages in %s: %s\n", len(pending), backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > p.config.maxBackoff {
+			backoff = p.config.maxBackoff
+		}
+	}
+
+	// Entries still pending were given up on, as were
+	// those that failed with their own error.
+	for _, e := range pending {
+		if e.err == nil {
+			p.stats.Failed(e.msg, e.attempts, err)
+		}
+	}
+	for _, e := range entries {
+		if e.err != nil {
+			p.stats.Failed(e.msg, e.attempts, e.err)
+		}
+	}
+
+	return sent, err
+}
+
+// publishBatchResponse holds the parts of a response used.
+type publishBatchResponse struct {
+	Successful []struct {
+		Id string
+	} `xml:"PublishBatchResult>Successful>member"`
+	Failed []struct {
+		Id          string
+		Code        string
+		Message     string
+		SenderFault bool
+	} `xml:"PublishBatchResult>Failed>member"`
+}
+
+// errorResponse is an SNS error.
+type errorResponse struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+// attempt sends one PublishBatch request. It returns the number of
+// entries sent, those that failed, and whether to retry them.
+func (p *publisher) attempt(entries []*entry) (int, []*entry, bool, error) {
+	c := p.config
+	form := url.Values{
+		"Action":   {"PublishBatch"},
+		"Version":  {"2010-03-31"},
+		"TopicArn": {c.TopicARN},
+	}
+	for i, e := range entries {
+		e.attempts++
+		prefix := fmt.Sprintf("PublishBatchRequestEntries.member.%d.", i+1)
+		form.Set(prefix+"Id", e.id)
+		form.Set(prefix+"Message", e.body)
+		if e.group != "" {
+			form.Set(prefix+"MessageGroupId", e.group)
+		}
+		for j, a := range e.msg.Attributes {
+			attr := fmt.Sprintf("%sMessageAttributes.entry.%d.", prefix, j+1)
+			form.Set(attr+"Name", a.Name)
+			form.Set(attr+"Value.DataType", "String")
+			form.Set(attr+"Value.StringValue", a.Value)
+		}
+	}
+
+	status, body, err := p.post(form.Encode())
+	if err != nil {
+		return 0, entries, true, err
+	}
+	if status != http.StatusOK {
+		var e errorResponse
+		xml.Unmarshal(body, &e)
+		err = fmt.Errorf("%d %s: %s", status, e.Code, e.Message)
+		retry := status >= 500 || strings.Contains(e.Code, "Throttl")
+		return 0, entries, retry, err
+	}
+
+	// Entries the response doesn't account for are retried,
+	// as are all of them if it can't be read.
+	var r publishBatchResponse
+	if err := xml.Unmarshal(body, &r); err != nil {
+		return 0, entries, true, fmt.Errorf("invalid response: %s", err)
+	}
+	byID := map[string]*entry{}
+	for _, e := range entries {
+		byID[e.id] = e
+	}
+	sent := 0
+	for _, s := range r.Successful {
+		if _, ok := byID[s.Id]; ok {
+			delete(byID, s.Id)
+			sent++
+		}
+	}
+	var failed []*entry
+	for _, f := range r.Failed {
+		// Sender faults would fail again.
+		if e, ok := byID[f.Id]; ok {
+			delete(byID, f.Id)
+			if f.SenderFault {
+				e.err = fmt.Errorf("%s: %s", f.Code, f.Message)
+			} else {
+				failed = append(failed, e)
+			}
+		}
+		if err == nil {
+			err = fmt.Errorf("%d entries failed, first: %s: %s", len(r.Failed), f.Code, f.Message)
+		}
+	}
+	if len(byID) > 0 {
+		for _, e := range entries {
+			if byID[e.id] != nil {
+				failed = append(failed, e)
+			}
+		}
+		if err == nil {
+			err = fmt.Errorf("%d entries missing from the response", len(byID))
+		}
+	}
+
+	return sent, failed, len(failed) > 0, err
+}
+
+// post sends a signed request, returning the response status and body.
+func (p *publisher) post(form string) (int, []byte, error) {
+	c := p.config
+	req, err := http.NewRequest(http.MethodPost, c.endpoint, strings.NewReader(form))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	if token := p.auth.Token(); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	aws.NewV4Signer(p.auth, "sns", c.region).Sign(req)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return resp.StatusCode, b, nil
+}
@@ -0,0 +1,89 @@
+package sns
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/goamz/aws"
+	"github.com/jamiealquiza/ascender/outputs/outputstest"
+)
+
+const success = `<PublishBatchResponse><PublishBatchResult><Successful>
+<member><Id>0</Id></member><member><Id>1</Id></member>
+</Successful></PublishBatchResult></PublishBatchResponse>`
+
+// topic answers requests with bodies in turn, then success
+// for entries 0 and 1, counting requests.
+func topic(t *testing.T, bodies ...string) (*publisher, *outputstest.Stats, *int) {
+	var mu sync.Mutex
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if len(bodies) > 0 {
+			w.Write([]byte(bodies[0]))
+			bodies = bodies[1:]
+			return
+		}
+		w.Write([]byte(success))
+	}))
+	t.Cleanup(srv.Close)
+
+	retries := 2
+	c := &Config{TopicARN: "arn:aws:sns:us-east-1:123456789012:events", Endpoint: srv.URL, Retries: &retries, RetryBackoff: "1ms"}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s := &outputstest.Stats{}
+	p := &publisher{config: c, auth: aws.Auth{AccessKey: "a", SecretKey: "s"}, client: &http.Client{Timeout: time.Second}, stats: s}
+	return p, s, &requests
+}
+
+func TestPublish(t *testing.T) {
+	p, s, requests := topic(t)
+	if n, err := p.send(outputstest.Messages("a", "b")); n != 2 || err != nil || *requests != 1 || len(s.Dropped()) != 0 {
+		t.Fatalf("sent %d in %d requests: %v", n, *requests, err)
+	}
+}
+
+// Entries failing through no fault of the sender are retried.
+func TestPublishFailedEntries(t *testing.T) {
+	p, s, requests := topic(t, `<PublishBatchResponse><PublishBatchResult>
+		<Successful><member><Id>0</Id></member></Successful>
+		<Failed>
+			<member><Id>1</Id><Code>InternalError</Code><SenderFault>false</SenderFault></member>
+			<member><Id>2</Id><Code>InvalidParameter</Code><SenderFault>true</SenderFault></member>
+		</Failed></PublishBatchResult></PublishBatchResponse>`)
+	n, err := p.send(outputstest.Messages("a", "b", "c"))
+	if n != 2 || *requests != 2 {
+		t.Fatalf("sent %d in %d requests: %v", n, *requests, err)
+	}
+	if len(s.Dropped()) != 1 || s.Dropped()[0].Body != "c" {
+		t.Errorf("failed %v", s.Dropped())
+	}
+}
+
+// Responses that don't account for entries have them retried,
+// and failed if they never are.
+func TestPublishUnreadableResponse(t *testing.T) {
+	for name, bad := range map[string]string{
+		"invalid": `<html>gateway error`,
+		"missing": `<PublishBatchResponse><PublishBatchResult><Successful><member><Id>0</Id></member></Successful></PublishBatchResult></PublishBatchResponse>`,
+	} {
+		p, s, requests := topic(t, bad)
+		if n, err := p.send(outputstest.Messages("a", "b")); n != 2 || err != nil || *requests != 2 || len(s.Dropped()) != 0 {
+			t.Errorf("%s: sent %d in %d requests: %v", name, n, *requests, err)
+		}
+
+		p, s, _ = topic(t, bad, bad, bad)
+		n, err := p.send(outputstest.Messages("a", "b"))
+		if n+len(s.Dropped()) != 2 || err == nil || !strings.Contains(err.Error(), map[string]string{"invalid": "invalid response", "missing": "missing"}[name]) {
+			t.Errorf("%s: sent %d, %d failed: %v", name, n, len(s.Dropped()), err)
+		}
+	}
+}
@@ -2,35 +2,83 @@
 package sqs
 
 import (
-	"flag"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"os"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
-	"github.com/jamiealquiza/ascender/outputs/sqs/vendor/github.com/AdRoll/goamz/aws"
-	"github.com/jamiealquiza/ascender/outputs/sqs/vendor/github.com/AdRoll/goamz/sqs"
+	"github.com/AdRoll/goamz/aws"
+	"github.com/AdRoll/goamz/sqs"
+	"github.com/jamiealquiza/ascender/outputs"
 )
 
-var (
-	accessKey = flag.String("aws-access-key",
-		os.Getenv("ASCENDER_ACCESS_KEY"),
-		"AWS access key")
-	secretKey = flag.String("aws-secret-key",
-		os.Getenv("ASCENDER_SECRET_KEY"),
-		"AWS secret key")
-	queueName = flag.String("aws-sqs-queue",
-		os.Getenv("ASCENDER_SQS_QUEUE"),
-		"SQS queue name")
-	regionString = flag.String("aws-sqs-region",
-		os.Getenv("ASCENDER_SQS_REGION"),
-		"SQS queue region")
-	region aws.Region
+// SendMessageBatch limits.
+const (
+	maxEntries = 10
+	maxBytes   = 256 * 1024
 )
 
+// Config holds SQS output settings.
+type Config struct {
+	AccessKey    string `json:"access-key"`
+	SecretKey    string `json:"secret-key"`
+	Queue        string `json:"queue"`
+	Region       string `json:"region"`
+	Retries      *int   `json:"retries"`
+	RetryBackoff string `json:"retry-backoff"`
+	MaxBackoff   string `json:"max-backoff"`
+	Timeout      string `json:"timeout"`
+
+	retries      int
+	retryBackoff time.Duration
+	maxBackoff   time.Duration
+	timeout      time.Duration
+}
+
+// Validate checks settings and fills in defaults.
+func (c *Config) Validate() error {
+	switch {
+	case c.AccessKey == "":
+		return errors.New("access-key is required")
+	case c.SecretKey == "":
+		return errors.New("secret-key is required")
+	case c.Queue == "":
+		return errors.New("queue is required")
+	}
+	_, err := awsFormatRegion(c.Region)
+	if err != nil {
+		return err
+	}
+
+	c.retries = 3
+	if c.Retries != nil {
+		if *c.Retries < 0 {
+			return errors.New("retries can't be negative")
+		}
+		c.retries = *c.Retries
+	}
+	if c.retryBackoff, err = outputs.Duration(c.RetryBackoff, "100ms"); err != nil {
+		return fmt.Errorf("invalid retry-backoff %q", c.RetryBackoff)
+	}
+	if c.maxBackoff, err = outputs.Duration(c.MaxBackoff, "5s"); err != nil {
+		return fmt.Errorf("invalid max-backoff %q", c.MaxBackoff)
+	}
+	if c.timeout, err = outputs.Duration(c.Timeout, "10s"); err != nil {
+		return fmt.Errorf("invalid timeout %q", c.Timeout)
+	}
+
+	return nil
+}
+
 // Convert region human input to type 'aws.Region'.
-func awsFormatRegion(r *string) aws.Region {
+func awsFormatRegion(r string) (aws.Region, error) {
 	var region aws.Region
-	switch *r {
+	switch r {
 	case "us-gov-west-1":
 		region = aws.USGovWest
 	case "us-east-1":
@@ -52,38 +100,263 @@ func awsFormatRegion(r *string) aws.Region {
 	case "":
 		region = aws.USEast
 	default:
-		log.Fatalf("Invalid Region: %s\n", *r)
+		return region, fmt.Errorf("invalid region: %s", r)
 	}
-	return region
-}
-
-type Statser interface {
-	IncrSent(int64)
-	FetchSent() int64
+	return region, nil
 }
 
 // Worker that reads message batches from the messageOutgoingQueue
 // and writes to SQS.
-func Handler(messageOutgoingQueue <-chan []string, s Statser) {
-	region = awsFormatRegion(regionString)
-	sqsConn := newSqsConn(*accessKey, *secretKey, region, *queueName)
+func Handler(c *Config, messageOutgoingQueue <-chan []*outputs.Message, s outputs.Statser) {
+	region, err := awsFormatRegion(c.Region)
+	if err != nil {
+		log.Fatalf("Invalid region: %s\n", err)
+	}
+	sqsConn, err := newSqsConn(c.AccessKey, c.SecretKey, region, c.Queue)
+	for err != nil {
+		log.Printf("SQS connection error: %s, retrying in 5s\n", err)
+		time.Sleep(5 * time.Second)
+		sqsConn, err = newSqsConn(c.AccessKey, c.SecretKey, region, c.Queue)
+	}
+	sn := &sender{config: c, queue: sqsConn, client: &http.Client{Timeout: c.timeout}, stats: s}
+
 	for m := range messageOutgoingQueue {
-		_, err := sqsConn.SendMessageBatchString(m)
+		sent, err := sn.send(m)
 		if err != nil {
-			fmt.Printf("SQS batch error: %s\n", err)
+			log.Printf("SQS batch error: %d of %d messages not sent: %s\n", len(m)-sent, len(m), err)
 		}
-		s.IncrSent(int64(len(m)))
+		s.IncrSent(int64(sent))
 	}
 }
 
 // newSqsConn establishes a connection to SQS.
-func newSqsConn(accessKey string, secretKey string, region aws.Region, queueName string) *sqs.Queue {
+func newSqsConn(accessKey string, secretKey string, region aws.Region, queueName string) (*sqs.Queue, error) {
 	auth := aws.Auth{AccessKey: accessKey, SecretKey: secretKey}
 	client := sqs.New(auth, region)
 	queue, err := client.GetQueue(queueName)
 	if err != nil {
-		log.Fatalf("SQS connection error: %s\n", err)
+		return nil, err
 	}
 	log.Printf("Connected to queue: %s\n", queue.Url)
-	return queue
+	return queue, nil
+}
+
+// sender sends batches with SendMessageBatch requests.
+type sender struct {
+	config *Config
+	queue  *sqs.Queue
+	client *http.Client
+	stats  outputs.Statser
+}
+
+// entry is a message in a request.
+type entry struct {
+	// Id within the request, kept across retries.
+	id       string
+	msg      *outputs.Message
+	attempts int
+	// Set if the entry failed in a way retries won't fix.
+	err error
+}
+
+// send sends a batch and returns the number of messages sent.
+// Messages not sent are passed to the Statser.
+func (sn *sender) send(batch []*outputs.Message) (int, error) {
+	sent := 0
+	var err error
+	var req []*entry
+	size := 0
+	flush := func() {
+		n, ferr := sn.sendEntries(req)
+		sent += n
+		if ferr != nil {
+			err = ferr
+		}
+		req, size = nil, 0
+	}
+	for _, m := range batch {
+		n := len(m.Body) + m.AttributeSize()
+		if n > maxBytes {
+			err = fmt.Errorf("message of %d bytes exceeds %d", n, maxBytes)
+			sn.stats.Failed(m, 0, err)
+			continue
+		}
+		if len(req) == maxEntries || size+n > maxBytes {
+			flush()
+		}
+		req = append(req, &entry{id: fmt.Sprintf("msg-%d", len(req)+1), msg: m})
+		size += n
+	}
+	if len(req) > 0 {
+		flush()
+	}
+
+	return sent, err
+}
+
+// sendEntries sends entries, retrying failed requests and entries
+// failed through no fault of the sender. It returns the number sent.
+func (sn *sender) sendEntries(entries []*entry) (int, error) {
+	sent := 0
+	var err error
+	pending := entries
+	backoff := sn.config.retryBackoff
+	for attempt := 0; len(pending) > 0; attempt++ {
+		var n int
+		var retry bool
+		n, pending, retry, err = sn.attempt(pending)
+		sent += n
+		if err == nil || !retry || attempt >= sn.config.retries {
+			break
+		}
+		log.Printf("SQS send failed, retrying %d messages in %s: %s\n", len(pending), backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > sn.config.maxBackoff {
+			backoff = sn.config.maxBackoff
+		}
+	}
+
+	// Entries still pending were given up on, as were
+	// those that failed with their own error.
+	for _, e := range pending {
+		if e.err == nil {
+			sn.stats.Failed(e.msg, e.attempts, err)
+		}
+	}
+	for _, e := range entries {
+		if e.err != nil {
+			sn.stats.Failed(e.msg, e.attempts, e.err)
+		}
+	}
+
+	return sent, err
+}
+
+// sendMessageBatchResponse holds the parts of a response used.
+type sendMessageBatchResponse struct {
+	Successful []struct {
+		Id string
+	} `xml:"SendMessageBatchResult>SendMessageBatchResultEntry"`
+	Failed []struct {
+		Id          string
+		Code        string
+		Message     string
+		SenderFault bool
+	} `xml:"SendMessageBatchResult>BatchResultErrorEntry"`
+}
+
+// errorResponse is an SQS error.
+type errorResponse struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+// attempt sends one SendMessageBatch request. It returns the number
+// of entries sent, those to retry, and whether to retry them.
+func (sn *sender) attempt(entries []*entry) (int, []*entry, bool, error) {
+	form := url.Values{
+		"Action":  {"SendMessageBatch"},
+		"Version": {"2012-11-05"},
+	}
+	for i, e := range entries {
+		e.attempts++
+		prefix := fmt.Sprintf("SendMessageBatchRequestEntry.%d.", i+1)
+		form.Set(prefix+"Id", e.id)
+		form.Set(prefix+"MessageBody", e.msg.Body)
+		for j, a := range e.msg.Attributes {
+			attr := fmt.Sprintf("%sMessageAttribute.%d.", prefix, j+1)
+			form.Set(attr+"Name", a.Name)
+			form.Set(attr+"Value.DataType", "String")
+			form.Set(attr+"Value.StringValue", a.Value)
+		}
+	}
+
+	status, body, err := sn.post(form.Encode())
+	if err != nil {
+		return 0, entries, true, err
+	}
+	if status != http.StatusOK {
+		var e errorResponse
+		xml.Unmarshal(body, &e)
+		err = fmt.Errorf("%d %s: %s", status, e.Code, e.Message)
+		retry := status >= 500 || strings.Contains(e.Code, "Throttl")
+		return 0, entries, retry, err
+	}
+
+	// Entries the response doesn't account for are retried,
+	// as are all of them if it can't be read.
+	var r sendMessageBatchResponse
+	if err := xml.Unmarshal(body, &r); err != nil {
+		return 0, entries, true, fmt.Errorf("invalid response: %s", err)
+	}
+	byID := map[string]*entry{}
+	for _, e := range entries {
+		byID[e.id] = e
+	}
+	sent := 0
+	for _, s := range r.Successful {
+		if _, ok := byID[s.Id]; ok {
+			delete(byID, s.Id)
+			sent++
+		}
+	}
+	var retry []*entry
+	for _, f := range r.Failed {
+		ferr := fmt.Errorf("%s: %s", f.Code, f.Message)
+		if err == nil {
+			err = fmt.Errorf("%d entries failed, first: %s", len(r.Failed), ferr)
+		}
+		e, ok := byID[f.Id]
+		if !ok {
+			continue
+		}
+		delete(byID, f.Id)
+		// Sender faults, such as InvalidMessageContents,
+		// would fail again.
+		if f.SenderFault {
+			e.err = ferr
+			continue
+		}
+		retry = append(retry, e)
+	}
+	if len(byID) > 0 {
+		for _, e := range entries {
+			if byID[e.id] != nil {
+				retry = append(retry, e)
+			}
+		}
+		if err == nil {
+			err = fmt.Errorf("%d entries missing from the response", len(byID))
+		}
+	}
+
+	return sent, retry, len(retry) > 0, err
+}
+
+// post sends a signed request to the queue, returning
+// the response status and body.
+func (sn *sender) post(form string) (int, []byte, error) {
+	q := sn.queue
+	req, err := http.NewRequest(http.MethodPost, q.Url, strings.NewReader(form))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Amz-Date", time.Now().UTC().Format(aws.ISO8601BasicFormat))
+	if token := q.Auth.Token(); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	aws.NewV4Signer(q.Auth, "sqs", q.Region).Sign(req)
+
+	resp, err := sn.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return resp.StatusCode, b, nil
 }
@@ -0,0 +1,92 @@
+package sqs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdRoll/goamz/aws"
+	"github.com/AdRoll/goamz/sqs"
+	"github.com/jamiealquiza/ascender/outputs/outputstest"
+)
+
+const success = `<SendMessageBatchResponse><SendMessageBatchResult>
+<SendMessageBatchResultEntry><Id>msg-1</Id></SendMessageBatchResultEntry>
+<SendMessageBatchResultEntry><Id>msg-2</Id></SendMessageBatchResultEntry>
+</SendMessageBatchResult></SendMessageBatchResponse>`
+
+// queue answers requests with bodies in turn, then success
+// for entries 1 and 2, counting requests.
+func queue(t *testing.T, bodies ...string) (*sender, *outputstest.Stats, *int) {
+	var mu sync.Mutex
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if len(bodies) > 0 {
+			w.Write([]byte(bodies[0]))
+			bodies = bodies[1:]
+			return
+		}
+		w.Write([]byte(success))
+	}))
+	t.Cleanup(srv.Close)
+
+	retries := 2
+	c := &Config{AccessKey: "a", SecretKey: "s", Queue: "events", Retries: &retries, RetryBackoff: "1ms"}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s := &outputstest.Stats{}
+	q := &sqs.Queue{SQS: &sqs.SQS{Auth: aws.Auth{AccessKey: "a", SecretKey: "s"}, Region: aws.USEast}, Url: srv.URL}
+	sn := &sender{config: c, queue: q, client: &http.Client{Timeout: time.Second}, stats: s}
+	return sn, s, &requests
+}
+
+func TestSend(t *testing.T) {
+	sn, s, requests := queue(t)
+	if n, err := sn.send(outputstest.Messages("a", "b")); n != 2 || err != nil || *requests != 1 || len(s.Dropped()) != 0 {
+		t.Fatalf("sent %d in %d requests: %v", n, *requests, err)
+	}
+}
+
+// Entries failing through no fault of the sender are retried.
+func TestSendFailedEntries(t *testing.T) {
+	sn, s, requests := queue(t, `<SendMessageBatchResponse><SendMessageBatchResult>
+		<SendMessageBatchResultEntry><Id>msg-1</Id></SendMessageBatchResultEntry>
+		<BatchResultErrorEntry><Id>msg-2</Id><Code>InternalError</Code><SenderFault>false</SenderFault></BatchResultErrorEntry>
+		<BatchResultErrorEntry><Id>msg-3</Id><Code>InvalidMessageContents</Code><SenderFault>true</SenderFault></BatchResultErrorEntry>
+		</SendMessageBatchResult></SendMessageBatchResponse>`)
+	n, err := sn.send(outputstest.Messages("a", "b", "c"))
+	if n != 2 || *requests != 2 {
+		t.Fatalf("sent %d in %d requests: %v", n, *requests, err)
+	}
+	if failed := s.Dropped(); len(failed) != 1 || failed[0].Body != "c" {
+		t.Errorf("failed %v", failed)
+	}
+}
+
+// Responses that don't account for entries have them retried,
+// and failed if they never are.
+func TestSendUnreadableResponse(t *testing.T) {
+	for name, bad := range map[string]string{
+		"invalid": `<html>gateway error`,
+		"missing": `<SendMessageBatchResponse><SendMessageBatchResult><SendMessageBatchResultEntry><Id>msg-1</Id></SendMessageBatchResultEntry></SendMessageBatchResult></SendMessageBatchResponse>`,
+		"unknown": `<SendMessageBatchResponse><SendMessageBatchResult><SendMessageBatchResultEntry><Id>msg-1</Id></SendMessageBatchResultEntry><SendMessageBatchResultEntry><Id>msg-9</Id></SendMessageBatchResultEntry></SendMessageBatchResult></SendMessageBatchResponse>`,
+	} {
+		sn, s, requests := queue(t, bad)
+		if n, err := sn.send(outputstest.Messages("a", "b")); n != 2 || err != nil || *requests != 2 || len(s.Dropped()) != 0 {
+			t.Errorf("%s: sent %d in %d requests: %v", name, n, *requests, err)
+		}
+
+		sn, s, _ = queue(t, bad, bad, bad)
+		n, err := sn.send(outputstest.Messages("a", "b"))
+		if n+len(s.Dropped()) != 2 || err == nil || !strings.Contains(err.Error(), map[string]string{"invalid": "invalid response", "missing": "missing", "unknown": "missing"}[name]) {
+			t.Errorf("%s: sent %d, %d failed: %v", name, n, len(s.Dropped()), err)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package outputs
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Template is a string with placeholders filled in per message.
+// {name} is replaced by the top level field name of a JSON
+// message, {:name} by message metadata (see Meta) and {:body}
+// by the whole message, and {+pattern} by the message time (see
+// Message.Time and TimeField) formatted with a date pattern like
+// "yyyy.MM.dd" (see FormatDate). Missing values are replaced by
+// Missing. Dates are never passed through an escape func.
+// Braces that are empty or enclose quotes, spaces or other
+// braces are left as is, so JSON can be templated.
+type Template struct {
+	Missing string
+	// Field holding the time for {+pattern} placeholders.
+	TimeField string
+	parts     []templatePart
+	fields    bool
+}
+
+type templatePart struct {
+	literal string
+	field   string
+	meta    string
+	date    string
+}
+
+// ParseTemplate parses a template string.
+func ParseTemplate(tmpl string) (*Template, error) {
+	t := &Template{}
+	for s := tmpl; s != ""; {
+		open := strings.IndexByte(s, '{')
+		if open < 0 {
+			t.parts = append(t.parts, templatePart{literal: s})
+			break
+		}
+		if open > 0 {
+			t.parts = append(t.parts, templatePart{literal: s[:open]})
+		}
+		end := strings.IndexByte(s[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("template %q: unclosed {", tmpl)
+		}
+		name := s[open+1 : open+end]
+		if name == "" || strings.ContainsAny(name, "{\" \t\r\n") {
+			t.parts = append(t.parts, templatePart{literal: "{"})
+			s = s[open+1:]
+			continue
+		}
+		switch {
+		case name == ":", name == "+":
+			return nil, fmt.Errorf("template %q: empty placeholder", tmpl)
+		case name[0] == '+':
+			t.parts = append(t.parts, templatePart{date: name[1:]})
+		case name[0] == ':':
+			if name != ":body" && !ValidMeta(name[1:]) {
+				return nil, fmt.Errorf("template %q: unknown metadata %q", tmpl, name[1:])
+			}
+			t.parts = append(t.parts, templatePart{meta: name[1:]})
+		default:
+			t.parts = append(t.parts, templatePart{field: name})
+			t.fields = true
+		}
+		s = s[open+end+1:]
+	}
+
+	return t, nil
+}
+
+// Static reports whether the template has no placeholders.
+func (t *Template) Static() bool {
+	for _, p := range t.parts {
+		if p.literal == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Execute fills in the template for m. Substituted values
+// are passed through escape, if not nil.
+func (t *Template) Execute(m *Message, escape func(string) string) string {
+	var fields map[string]json.RawMessage
+	if t.fields {
+		json.Unmarshal([]byte(m.Body), &fields)
+	}
+
+	var b strings.Builder
+	for _, p := range t.parts {
+		var v string
+		switch {
+		case p.literal != "":
+			b.WriteString(p.literal)
+			continue
+		case p.date != "":
+			// Dates come from the config, so aren't escaped.
+			b.WriteString(FormatDate(m.Time(t.TimeField).UTC(), p.date))
+			continue
+		case p.meta == "body":
+			v = m.Body
+		case p.meta != "":
+			v = m.Meta(p.meta)
+		default:
+			v = FieldString(fields[p.field])
+		}
+		if v == "" {
+			v = t.Missing
+		}
+		if escape != nil {
+			v = escape(v)
+		}
+		b.WriteString(v)
+	}
+
+	return b.String()
+}
+
+// Glob returns a filepath.Match pattern matching any string the
+// template produces, if escaped values contain no "/".
+func (t *Template) Glob() string {
+	var b strings.Builder
+	for _, p := range t.parts {
+		switch {
+		case p.literal != "":
+			for _, r := range p.literal {
+				if strings.ContainsRune(`*?[\`, r) {
+					b.WriteByte('\\')
+				}
+				b.WriteRune(r)
+			}
+		case p.date != "":
+			// Dates may hold directory separators.
+			b.WriteString("*" + strings.Repeat("/*", strings.Count(p.date, "/")))
+		default:
+			b.WriteByte('*')
+		}
+	}
+	return b.String()
+}
+
+// FormatDate formats t with a Joda style date pattern: yyyy (year),
+// yy, MM (month), M, dd (day), d, HH (hour), mm (minute), ss
+// (second), xxxx (ISO week year) and ww (ISO week). Other
+// characters, including letters, are copied as is.
+func FormatDate(t time.Time, pattern string) string {
+	year, week := t.ISOWeek()
+	var b strings.Builder
+	for s := pattern; s != ""; {
+		n := 1
+		for n < len(s) && s[n] == s[0] {
+			n++
+		}
+		token := s[:n]
+		s = s[n:]
+		switch token {
+		case "yyyy", "YYYY":
+			fmt.Fprintf(&b, "%04d", t.Year())
+		case "yy", "YY":
+			fmt.Fprintf(&b, "%02d", t.Year()%100)
+		case "xxxx":
+			fmt.Fprintf(&b, "%04d", year)
+		case "MM":
+			fmt.Fprintf(&b, "%02d", int(t.Month()))
+		case "M":
+			fmt.Fprintf(&b, "%d", int(t.Month()))
+		case "dd":
+			fmt.Fprintf(&b, "%02d", t.Day())
+		case "d":
+			fmt.Fprintf(&b, "%d", t.Day())
+		case "HH":
+			fmt.Fprintf(&b, "%02d", t.Hour())
+		case "mm":
+			fmt.Fprintf(&b, "%02d", t.Minute())
+		case "ss":
+			fmt.Fprintf(&b, "%02d", t.Second())
+		case "ww":
+			fmt.Fprintf(&b, "%02d", week)
+		default:
+			b.WriteString(token)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,107 @@
+package outputs
+
+import (
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTemplateExecute(t *testing.T) {
+	received := time.Date(2015, 2, 17, 16, 11, 11, 0, time.UTC)
+	m := &Message{
+		Body:     `{"app":"web/1","level":"info","n":3,"obj":{"a":1},"null":null,"ts":"2020-12-31T23:00:00-02:00"}`,
+		Listener: "main",
+		Route:    "r",
+		Received: received,
+	}
+	tests := []struct {
+		tmpl, timeField, want string
+	}{
+		{"logs-{app}-{level}", "", "logs-web/1-info"},
+		{"{n}/{obj}", "", `3/{"a":1}`},
+		{"{missing}-{null}-{:client}", "", "none-none-none"},
+		{"{:listener}.{:route}", "", "main.r"},
+		{"logs-{+yyyy.MM.dd}", "", "logs-2015.02.17"},
+		// Times are UTC.
+		{"{+yyyy.MM.dd-HH}", "ts", "2021.01.01-01"},
+		// JSON and empty braces are left as is.
+		{`{"app": "{app}"}`, "", `{"app": "web/1"}`},
+		{"{}{ x }", "", "{}{ x }"},
+	}
+	for _, tt := range tests {
+		tmpl, err := ParseTemplate(tt.tmpl)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.tmpl, err)
+		}
+		tmpl.Missing, tmpl.TimeField = "none", tt.timeField
+		if got := tmpl.Execute(m, nil); got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.tmpl, got, tt.want)
+		}
+	}
+}
+
+func TestTemplateEscape(t *testing.T) {
+	tmpl, err := ParseTemplate("/{+yyyy/MM}/{app}?q={:body}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Message{Body: `{"app":"a b/c"}`, Received: time.Date(2015, 2, 17, 0, 0, 0, 0, time.UTC)}
+	want := "/2015/02/a+b%2Fc?q=%7B%22app%22%3A%22a+b%2Fc%22%7D"
+	if got := tmpl.Execute(m, url.QueryEscape); got != want {
+		t.Errorf("%q, want %q", got, want)
+	}
+}
+
+func TestParseTemplateErrors(t *testing.T) {
+	for _, tmpl := range []string{"{app", "{:}", "{+}", "{:nope}"} {
+		if _, err := ParseTemplate(tmpl); err == nil {
+			t.Errorf("%q parsed", tmpl)
+		}
+	}
+}
+
+func TestTemplateStatic(t *testing.T) {
+	for tmpl, want := range map[string]bool{"events": true, `{"a":1}`: true, "{app}": false, "x-{+yyyy}": false} {
+		p, err := ParseTemplate(tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Static() != want {
+			t.Errorf("%q: static %v, want %v", tmpl, !want, want)
+		}
+	}
+}
+
+func TestTemplateGlob(t *testing.T) {
+	tmpl, err := ParseTemplate("logs[1]/{app}/{+yyyy/MM/dd}.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	glob := tmpl.Glob()
+	if want := `logs\[1]/*/*/*/*.log`; glob != want {
+		t.Fatalf("glob %q, want %q", glob, want)
+	}
+	m := &Message{Body: `{"app":"web"}`, Received: time.Now()}
+	if ok, _ := filepath.Match(glob, tmpl.Execute(m, nil)); !ok {
+		t.Errorf("%q doesn't match %q", glob, tmpl.Execute(m, nil))
+	}
+}
+
+func TestFormatDate(t *testing.T) {
+	// ISO week 1 of 2021 starts on January 4th, so this is
+	// week 53 of 2020.
+	d := time.Date(2021, 1, 3, 4, 5, 6, 0, time.UTC)
+	tests := map[string]string{
+		"yyyy.MM.dd":      "2021.01.03",
+		"yy-M-d HH:mm:ss": "21-1-3 04:05:06",
+		"xxxx-'W'ww":      "2020-'W'53",
+		"YYYY/MM/dd/HH":   "2021/01/03/04",
+		"logs yyyyy":      "logs yyyyy",
+	}
+	for pattern, want := range tests {
+		if got := FormatDate(d, pattern); got != want {
+			t.Errorf("%q: %q, want %q", pattern, got, want)
+		}
+	}
+}
@@ -0,0 +1,381 @@
+// Package webhook sends messages to an HTTP endpoint, batched
+// as NDJSON or a JSON array, or one request per message.
+package webhook
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jamiealquiza/ascender/outputs"
+)
+
+// Config holds webhook output settings.
+type Config struct {
+	URL string `json:"url"`
+	// Default POST.
+	Method string `json:"method"`
+	// "ndjson" (default) or "json-array" send a request per
+	// batch; "single" sends one per message.
+	Format string `json:"format"`
+	// Template rendering each message, e.g.
+	// {"text": "{:body}"} (see outputs.Template).
+	BodyTemplate string `json:"body-template"`
+	// Escaping of values substituted into BodyTemplate:
+	// "json" (default) or "none".
+	TemplateEscape string            `json:"template-escape"`
+	ContentType    string            `json:"content-type"`
+	Headers        map[string]string `json:"headers"`
+	Username       string            `json:"username"`
+	Password       string            `json:"password"`
+	BearerToken    string            `json:"bearer-token"`
+	Gzip           bool              `json:"gzip"`
+	// Most requests in flight for the output, shared by its workers.
+	Concurrency  int    `json:"concurrency"`
+	Retries      *int   `json:"retries"`
+	RetryBackoff string `json:"retry-backoff"`
+	// Longest wait between retries, including
+	// waits asked for with Retry-After.
+	MaxBackoff string `json:"max-backoff"`
+	Timeout    string `json:"timeout"`
+
+	template     *outputs.Template
+	escapeJSON   bool
+	retries      int
+	retryBackoff time.Duration
+	maxBackoff   time.Duration
+	timeout      time.Duration
+}
+
+// Validate checks settings and fills in defaults.
+func (c *Config) Validate() error {
+	if c.URL == "" {
+		return errors.New("url is required")
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("url must be an absolute http or https URL")
+	}
+	if c.Method == "" {
+		c.Method = http.MethodPost
+	}
+
+	switch c.Format {
+	case "":
+		c.Format = "ndjson"
+	case "ndjson", "json-array", "single":
+	default:
+		return fmt.Errorf("invalid format %q", c.Format)
+	}
+	if c.ContentType == "" {
+		c.ContentType = "application/json"
+		if c.Format == "ndjson" {
+			c.ContentType = "application/x-ndjson"
+		}
+	}
+
+	if c.BodyTemplate != "" {
+		if c.template, err = outputs.ParseTemplate(c.BodyTemplate); err != nil {
+			return err
+		}
+	}
+	switch c.TemplateEscape {
+	case "", "json":
+		c.escapeJSON = true
+	case "none":
+		c.escapeJSON = false
+	default:
+		return fmt.Errorf("invalid template-escape %q", c.TemplateEscape)
+	}
+
+	if c.BearerToken != "" && (c.Username != "" || c.Password != "") {
+		return errors.New("use one of bearer-token or username/password")
+	}
+	if c.Concurrency == 0 {
+		c.Concurrency = 4
+	}
+	if c.Concurrency < 0 {
+		return errors.New("concurrency can't be negative")
+	}
+
+	c.retries = 3
+	if c.Retries != nil {
+		if *c.Retries < 0 {
+			return errors.New("retries can't be negative")
+		}
+		c.retries = *c.Retries
+	}
+	if c.retryBackoff, err = outputs.Duration(c.RetryBackoff, "500ms"); err != nil {
+		return fmt.Errorf("invalid retry-backoff %q", c.RetryBackoff)
+	}
+	if c.maxBackoff, err = outputs.Duration(c.MaxBackoff, "30s"); err != nil {
+		return fmt.Errorf("invalid max-backoff %q", c.MaxBackoff)
+	}
+	if c.timeout, err = outputs.Duration(c.Timeout, "10s"); err != nil {
+		return fmt.Errorf("invalid timeout %q", c.Timeout)
+	}
+
+	return nil
+}
+
+// render returns the request body for one message.
+func (c *Config) render(m *outputs.Message) []byte {
+	if c.template == nil {
+		return []byte(m.Body)
+	}
+	if c.escapeJSON {
+		return []byte(c.template.Execute(m, outputs.JSONEscape))
+	}
+	return []byte(c.template.Execute(m, nil))
+}
+
+// semaphores limit the requests in flight for each output,
+// shared by its workers and dropped when the last one exits.
+var semaphores = struct {
+	sync.Mutex
+	m map[*Config]*semaphore
+}{m: map[*Config]*semaphore{}}
+
+type semaphore struct {
+	slots   chan struct{}
+	workers int
+}
+
+func acquireSemaphore(c *Config) chan struct{} {
+	semaphores.Lock()
+	defer semaphores.Unlock()
+	s, ok := semaphores.m[c]
+	if !ok {
+		s = &semaphore{slots: make(chan struct{}, c.Concurrency)}
+		semaphores.m[c] = s
+	}
+	s.workers++
+	return s.slots
+}
+
+func releaseSemaphore(c *Config) {
+	semaphores.Lock()
+	defer semaphores.Unlock()
+	if s := semaphores.m[c]; s != nil {
+		if s.workers--; s.workers == 0 {
+			delete(semaphores.m, c)
+		}
+	}
+}
+
+// Worker that reads message batches from the messageOutgoingQueue
+// and sends them to the webhook URL.
+func Handler(c *Config, messageOutgoingQueue <-chan []*outputs.Message, s outputs.Statser) {
+	w := &sender{
+		config: c,
+		client: &http.Client{Timeout: c.timeout},
+		slots:  acquireSemaphore(c),
+		stats:  s,
+	}
+	defer releaseSemaphore(c)
+
+	for m := range messageOutgoingQueue {
+		sent, err := w.send(m)
+		if err != nil {
+			log.Printf("Webhook batch error: %d of %d messages not sent: %s\n", len(m)-sent, len(m), err)
+		}
+		s.IncrSent(int64(sent))
+	}
+}
+
+// sender sends batches as requests.
+type sender struct {
+	config *Config
+	client *http.Client
+	// Request slots shared by the output's workers.
+	slots chan struct{}
+	stats outputs.Statser
+}
+
+// send sends a batch and returns the number of messages sent.
+// Messages not sent are passed to the Statser.
+func (w *sender) send(batch []*outputs.Message) (int, error) {
+	c := w.config
+	switch c.Format {
+	case "ndjson":
+		var b bytes.Buffer
+		for _, m := range batch {
+			// Lines are compacted JSON, with other bodies
+			// wrapped, as newlines would split a message.
+			if c.template != nil {
+				m = &outputs.Message{Body: string(c.render(m))}
+			}
+			b.Write(m.Line())
+		}
+		return w.postBatch(batch, b.Bytes())
+	case "json-array":
+		var b bytes.Buffer
+		b.WriteByte('[')
+		for i, m := range batch {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			body := c.render(m)
+			if !json.Valid(body) {
+				// Plain text becomes a JSON string.
+				body, _ = json.Marshal(string(body))
+			}
+			b.Write(body)
+		}
+		b.WriteByte(']')
+		return w.postBatch(batch, b.Bytes())
+	}
+
+	// One request per message, concurrently
+	// up to the output's limit.
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	sent := 0
+	var lastErr error
+	for _, m := range batch {
+		wg.Add(1)
+		go func(m *outputs.Message) {
+			defer wg.Done()
+			attempts, err := w.post(c.render(m))
+			if err != nil {
+				w.stats.Failed(m, attempts, err)
+			}
+			mu.Lock()
+			if err != nil {
+				lastErr = err
+			} else {
+				sent++
+			}
+			mu.Unlock()
+		}(m)
+	}
+	wg.Wait()
+
+	return sent, lastErr
+}
+
+// postBatch sends the body for a batch, which
+// succeeds or fails as a whole.
+func (w *sender) postBatch(batch []*outputs.Message, body []byte) (int, error) {
+	attempts, err := w.post(body)
+	if err != nil {
+		for _, m := range batch {
+			w.stats.Failed(m, attempts, err)
+		}
+		return 0, err
+	}
+	return len(batch), nil
+}
+
+// post sends a request body, retrying transient failures
+// with backoff, and returns the number of attempts made.
+func (w *sender) post(body []byte) (int, error) {
+	c := w.config
+	if c.Gzip {
+		var b bytes.Buffer
+		gz := gzip.NewWriter(&b)
+		gz.Write(body)
+		gz.Close()
+		body = b.Bytes()
+	}
+
+	backoff := c.retryBackoff
+	for attempt := 0; ; attempt++ {
+		wait, err := w.attempt(body)
+		if err == nil {
+			return attempt + 1, nil
+		}
+		if wait < 0 || attempt >= c.retries {
+			return attempt + 1, err
+		}
+		if wait == 0 {
+			wait = backoff
+			backoff *= 2
+		}
+		if wait > c.maxBackoff {
+			wait = c.maxBackoff
+		}
+		log.Printf("Webhook request failed, retrying in %s: %s\n", wait, err)
+		time.Sleep(wait)
+	}
+}
+
+// attempt sends one request while holding a slot. On failure it
+// returns how long the server asked to wait (0 for the default
+// backoff), or -1 if the request shouldn't be retried.
+func (w *sender) attempt(body []byte) (time.Duration, error) {
+	c := w.config
+	w.slots <- struct{}{}
+	defer func() { <-w.slots }()
+
+	req, err := http.NewRequest(c.Method, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+	req.Header.Set("Content-Type", c.ContentType)
+	req.Header.Set("User-Agent", "ascender")
+	if c.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	for k, v := range c.Headers {
+		req.Header.Set(k, v)
+	}
+	switch {
+	case c.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+c.BearerToken)
+	case c.Username != "" || c.Password != "":
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	// Read some of the body so the connection can be reused,
+	// and to show in errors.
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return 0, nil
+	}
+	err = fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode == http.StatusRequestTimeout,
+		resp.StatusCode >= 500:
+		return retryAfter(resp.Header.Get("Retry-After")), err
+	}
+	return -1, err
+}
+
+// retryAfter parses a Retry-After header, in seconds
+// or as an HTTP date. It returns 0 if unset or invalid.
+func retryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(v); err == nil {
+		if s <= 0 {
+			return 0
+		}
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
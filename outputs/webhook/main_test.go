@@ -0,0 +1,123 @@
+package webhook
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jamiealquiza/ascender/outputs/outputstest"
+)
+
+// server answers requests with statuses in turn, then
+// 200, recording the bodies.
+func server(t *testing.T, statuses ...int) (*httptest.Server, *[]string) {
+	var mu sync.Mutex
+	var bodies []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		bodies = append(bodies, string(b))
+		if len(statuses) > 0 {
+			if statuses[0] == http.StatusTooManyRequests {
+				w.Header().Set("Retry-After", "0")
+			}
+			w.WriteHeader(statuses[0])
+			statuses = statuses[1:]
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s, &bodies
+}
+
+func newSender(t *testing.T, c *Config) (*sender, *outputstest.Stats) {
+	if c.RetryBackoff == "" {
+		c.RetryBackoff = "1ms"
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s := &outputstest.Stats{}
+	return &sender{config: c, client: &http.Client{Timeout: time.Second}, slots: make(chan struct{}, 1), stats: s}, s
+}
+
+func TestNDJSONLines(t *testing.T) {
+	srv, bodies := server(t)
+	w, _ := newSender(t, &Config{URL: srv.URL})
+	if n, err := w.send(outputstest.Messages("{\n  \"a\": 1\n}", "two\nlines")); n != 2 || err != nil {
+		t.Fatalf("sent %d: %v", n, err)
+	}
+	if want := "{\"a\":1}\n{\"message\":\"two\\nlines\"}\n"; (*bodies)[0] != want {
+		t.Errorf("body %q, want %q", (*bodies)[0], want)
+	}
+
+	// Templated lines too.
+	srv, bodies = server(t)
+	w, _ = newSender(t, &Config{URL: srv.URL, BodyTemplate: "{\n  \"text\": \"{:body}\"\n}"})
+	w.send(outputstest.Messages("a\nb"))
+	if want := "{\"text\":\"a\\nb\"}\n"; (*bodies)[0] != want {
+		t.Errorf("templated body %q, want %q", (*bodies)[0], want)
+	}
+	srv, bodies = server(t)
+	w, _ = newSender(t, &Config{URL: srv.URL, BodyTemplate: "{:route}: {:body}", TemplateEscape: "none"})
+	ms := outputstest.Messages("a\nb")
+	ms[0].Route = "r"
+	w.send(ms)
+	if want := "{\"message\":\"r: a\\nb\"}\n"; (*bodies)[0] != want {
+		t.Errorf("templated text %q, want %q", (*bodies)[0], want)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	srv, bodies := server(t, 503, 429, 500)
+	w, s := newSender(t, &Config{URL: srv.URL})
+	if n, err := w.send(outputstest.Messages("a", "b")); n != 2 || err != nil {
+		t.Fatalf("sent %d: %v", n, err)
+	}
+	if len(*bodies) != 4 || len(s.Dropped()) != 0 {
+		t.Errorf("%d requests, %d failed", len(*bodies), len(s.Dropped()))
+	}
+}
+
+func TestRetriesExhausted(t *testing.T) {
+	srv, bodies := server(t, 500, 500, 500)
+	retries := 2
+	w, s := newSender(t, &Config{URL: srv.URL, Retries: &retries})
+	if n, err := w.send(outputstest.Messages("a", "b")); n != 0 || err == nil {
+		t.Fatalf("sent %d: %v", n, err)
+	}
+	if len(*bodies) != 3 || len(s.Dropped()) != 2 {
+		t.Errorf("%d requests, %d failed", len(*bodies), len(s.Dropped()))
+	}
+}
+
+// Client errors aren't retried.
+func TestNoRetryOnClientError(t *testing.T) {
+	srv, bodies := server(t, 400)
+	w, s := newSender(t, &Config{URL: srv.URL, Format: "single"})
+	n, err := w.send(outputstest.Messages("a"))
+	if n != 0 || err == nil || !strings.Contains(err.Error(), "400") {
+		t.Fatalf("sent %d: %v", n, err)
+	}
+	if len(*bodies) != 1 || len(s.Dropped()) != 1 {
+		t.Errorf("%d requests, %d failed", len(*bodies), len(s.Dropped()))
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	if d := retryAfter("3"); d != 3*time.Second {
+		t.Errorf("seconds: %s", d)
+	}
+	if d := retryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)); d < 58*time.Second || d > time.Minute {
+		t.Errorf("date: %s", d)
+	}
+	for _, v := range []string{"", "-1", "soon"} {
+		if d := retryAfter(v); d != 0 {
+			t.Errorf("%q: %s", v, d)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jamiealquiza/ascender/outputs"
+)
+
+// startBatcher runs a batcher for c without workers.
+func startBatcher(c *OutputConfig) *output {
+	o := &output{
+		config:   c,
+		incoming: make(chan *outputs.Message, 100),
+		outgoing: make(chan []*outputs.Message, 100),
+	}
+	go o.batcher()
+	return o
+}
+
+func TestBatcherFlushesFullBatch(t *testing.T) {
+	c := &OutputConfig{BatchSize: 3, maxLinger: time.Hour, minLinger: time.Hour}
+	o := startBatcher(c)
+	defer o.stop()
+	for i := 0; i < 3; i++ {
+		o.incoming <- &outputs.Message{Body: "m"}
+	}
+	select {
+	case b := <-o.outgoing:
+		if len(b) != 3 {
+			t.Fatalf("batch of %d, want 3", len(b))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("full batch not flushed")
+	}
+}
+
+// The linger must come from the flush interval even for
+// configs built from flags and never validated.
+func TestBatcherLingerFromFlags(t *testing.T) {
+	withFlags(t, func() {
+		options.console = true
+		options.flushInterval = 200 * time.Millisecond
+	})
+	c := configFromFlags()
+	o := startBatcher(c.Outputs[0])
+	o.config.BatchSize = 10
+	defer o.stop()
+
+	start := time.Now()
+	o.incoming <- &outputs.Message{Body: "m"}
+	select {
+	case b := <-o.outgoing:
+		if d := time.Since(start); d < 150*time.Millisecond {
+			t.Fatalf("partial batch of %d flushed after %s, want 200ms", len(b), d)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("partial batch not flushed")
+	}
+}
+
+func TestBatcherFlushesOnStop(t *testing.T) {
+	c := &OutputConfig{BatchSize: 10, maxLinger: time.Hour, minLinger: time.Hour}
+	o := startBatcher(c)
+	o.incoming <- &outputs.Message{Body: "m"}
+	o.stop()
+	if b := <-o.outgoing; len(b) != 1 {
+		t.Fatalf("batch of %d, want 1", len(b))
+	}
+	if _, ok := <-o.outgoing; ok {
+		t.Fatal("outgoing not closed")
+	}
+}
+
+func TestAdaptLinger(t *testing.T) {
+	o := &output{
+		config:   &OutputConfig{minLinger: 10 * time.Millisecond, maxLinger: 80 * time.Millisecond},
+		incoming: make(chan *outputs.Message, 1),
+	}
+	if l := o.adaptLinger(40 * time.Millisecond); l != 20*time.Millisecond {
+		t.Errorf("idle: %s, want 20ms", l)
+	}
+	if l := o.adaptLinger(10 * time.Millisecond); l != 10*time.Millisecond {
+		t.Errorf("idle at min: %s, want 10ms", l)
+	}
+	o.incoming <- &outputs.Message{}
+	if l := o.adaptLinger(40 * time.Millisecond); l != 80*time.Millisecond {
+		t.Errorf("busy: %s, want 80ms", l)
+	}
+	if l := o.adaptLinger(80 * time.Millisecond); l != 80*time.Millisecond {
+		t.Errorf("busy at max: %s, want 80ms", l)
+	}
+}
+
+// newTestRouter returns a router with no routes over outputs.
+func newTestRouter(outputs map[string]*output) *router {
+	return newRouter(&Config{}, outputs)
+}
+
+func TestDeliverTakesUpdatesWhileFull(t *testing.T) {
+	full := &output{config: &OutputConfig{Name: "o"}, incoming: make(chan *outputs.Message)}
+	h := &handler{r: newTestRouter(map[string]*output{"o": full})}
+	done := make(chan struct{})
+	m := &outputs.Message{Body: "m"}
+	go func() {
+		h.deliver(full, m)
+		close(done)
+	}()
+
+	// A reload replacing the full output isn't held up,
+	// and the message goes to the replacement.
+	replacement := &output{config: &OutputConfig{Name: "o"}, incoming: make(chan *outputs.Message, 1)}
+	select {
+	case routerUpdates <- newTestRouter(map[string]*output{"o": replacement}):
+	case <-time.After(time.Second):
+		t.Fatal("router update blocked by a full output")
+	}
+	<-done
+	if got := <-replacement.incoming; got != m {
+		t.Fatalf("replacement got %v", got)
+	}
+}
+
+func TestDeliverDropsForRemovedOutput(t *testing.T) {
+	full := &output{config: &OutputConfig{Name: "o"}, incoming: make(chan *outputs.Message)}
+	h := &handler{r: newTestRouter(map[string]*output{"o": full})}
+	done := make(chan struct{})
+	go func() {
+		h.deliver(full, &outputs.Message{Body: "m"})
+		close(done)
+	}()
+	routerUpdates <- newTestRouter(map[string]*output{})
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("delivery to a removed output still blocked")
+	}
+}
+
+func TestRouteReplayedToOneOutput(t *testing.T) {
+	a := &output{config: &OutputConfig{Name: "a"}, incoming: make(chan *outputs.Message, 1)}
+	b := &output{config: &OutputConfig{Name: "b"}, incoming: make(chan *outputs.Message, 1)}
+	c := &Config{Routes: []*RouteConfig{{Name: "r", Outputs: []string{"a", "b"}}}}
+	h := &handler{r: newRouter(c, map[string]*output{"a": a, "b": b})}
+
+	h.route(&Message{Body: "m", Route: "r", Output: "b"})
+	if len(a.incoming) != 0 {
+		t.Error("replayed message delivered to the route's other output")
+	}
+	if m := <-b.incoming; m.Body != "m" || m.Route != "r" {
+		t.Errorf("delivered %+v", m)
+	}
+
+	// Outputs removed since are skipped.
+	h.route(&Message{Body: "m", Route: "r", Output: "gone"})
+	if len(a.incoming)+len(b.incoming) != 0 {
+		t.Error("message for a removed output delivered")
+	}
+}
+
+// Linger lengthens while messages queue behind the batcher
+// and shortens again once it keeps up.
+func TestBatcherAdaptsLingerUnderLoad(t *testing.T) {
+	c := &OutputConfig{BatchSize: 2, AdaptiveLinger: true, minLinger: 20 * time.Millisecond, maxLinger: 320 * time.Millisecond}
+	o := &output{
+		config:   c,
+		incoming: make(chan *outputs.Message, 100),
+		// Unbuffered, so messages queue while a batch waits.
+		outgoing: make(chan []*outputs.Message),
+	}
+	go o.batcher()
+	defer o.stop()
+	send := func(n int) {
+		for i := 0; i < n; i++ {
+			o.incoming <- &outputs.Message{Body: "m"}
+		}
+	}
+	// partial times a lone message's flush.
+	partial := func() time.Duration {
+		start := time.Now()
+		send(1)
+		select {
+		case <-o.outgoing:
+			return time.Since(start)
+		case <-time.After(2 * time.Second):
+			t.Fatal("partial batch not flushed")
+		}
+		return 0
+	}
+
+	// Under load, full batches are flushed with more
+	// behind them: 20ms doubles to the 320ms max.
+	send(2)
+	for i := 0; i < 4; i++ {
+		send(2)
+		<-o.outgoing
+	}
+	// The last batch leaves the queue empty: 160ms.
+	<-o.outgoing
+	if d := partial(); d < 120*time.Millisecond {
+		t.Errorf("linger after load %s, want 160ms", d)
+	}
+
+	// Keeping up, it halves back to the min: 80ms, 40ms, 20ms.
+	for i := 0; i < 3; i++ {
+		partial()
+	}
+	if d := partial(); d > 100*time.Millisecond {
+		t.Errorf("linger once idle %s, want 20ms", d)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/jamiealquiza/ascender/outputs"
+)
+
+// PackConfig packs many messages into each message an
+// output sends, up to MaxBytes (default the output's limit,
+// or 256KB) and MaxMessages (default 1000). A partial pack
+// is sent with the output's batch when it lingers out.
+//
+// Packed messages are NDJSON lines, or a JSON array with
+// Format "array": JSON messages are compacted and others
+// wrapped as {"message": "..."}, as the file output writes
+// them. Packs take the metadata of their first message.
+//
+// Flag says how consumers tell packs from other messages:
+// "envelope" (default) wraps them as {"pack": {"count": 2,
+// "format": "ndjson"}, "data": ...}, with NDJSON as a string
+// and arrays as they are, "attribute" sets message attributes
+// (sqs, sns) and "none" leaves it to them.
+type PackConfig struct {
+	Format      string `json:"format"`
+	Flag        string `json:"flag"`
+	MaxBytes    int    `json:"max-bytes"`
+	MaxMessages int    `json:"max-messages"`
+
+	// Bytes the flag adds to a pack, at most.
+	overhead int
+}
+
+func (c *PackConfig) validate(t *outputType) error {
+	switch c.Format {
+	case "":
+		c.Format = "ndjson"
+	case "ndjson", "array":
+	default:
+		return fmt.Errorf("invalid format %q", c.Format)
+	}
+	switch c.Flag {
+	case "":
+		c.Flag = "envelope"
+	case "envelope", "none":
+	case "attribute":
+		if !t.attributes {
+			return errors.New("output doesn't support the attribute flag")
+		}
+	default:
+		return fmt.Errorf("invalid flag %q", c.Flag)
+	}
+
+	switch {
+	case c.MaxBytes < 0:
+		return errors.New("max-bytes can't be negative")
+	case c.MaxBytes == 0:
+		c.MaxBytes = t.maxSize
+		if c.MaxBytes == 0 {
+			c.MaxBytes = 256 * 1024
+		}
+	case t.maxSize > 0 && c.MaxBytes > t.maxSize:
+		return fmt.Errorf("max-bytes exceeds the output's limit of %d", t.maxSize)
+	}
+	switch {
+	case c.MaxMessages < 0:
+		return errors.New("max-messages can't be negative")
+	case c.MaxMessages == 0:
+		c.MaxMessages = 1000
+	}
+
+	switch c.Flag {
+	case "envelope":
+		c.overhead = len(envelopeStart(c.MaxMessages, c.Format)) + len(`""}`)
+	case "attribute":
+		for _, a := range packAttributes(c.MaxMessages, c.Format) {
+			c.overhead += len(a.Name) + len("String") + len(a.Value)
+		}
+	}
+	if c.overhead >= c.MaxBytes {
+		return errors.New("max-bytes is too small")
+	}
+
+	return nil
+}
+
+// envelopeStart returns the start of a pack envelope,
+// up to its data.
+func envelopeStart(count int, format string) string {
+	return fmt.Sprintf(`{"pack":{"count":%d,"format":"%s"},"data":`, count, format)
+}
+
+func packAttributes(count int, format string) []outputs.Attribute {
+	return []outputs.Attribute{
+		{Name: outputs.PackFormatAttribute, Value: format},
+		{Name: outputs.PackCountAttribute, Value: strconv.Itoa(count)},
+	}
+}
+
+// packer builds packs for an output's batcher.
+type packer struct {
+	config   *PackConfig
+	body     bytes.Buffer
+	messages []*outputs.Message
+}
+
+// add packs m. If m doesn't fit, the pack is closed and
+// returned, and m starts the next one.
+func (p *packer) add(m *outputs.Message) *outputs.Message {
+	line := m.Line()
+	switch {
+	case p.config.Format == "array":
+		line = line[:len(line)-1]
+	case p.config.Flag == "envelope":
+		// NDJSON is sent as a JSON string.
+		line = quote(line)
+	}
+
+	var full *outputs.Message
+	// The pack's closing bytes and a separator.
+	if len(p.messages) > 0 && (len(p.messages) == p.config.MaxMessages || p.body.Len()+len(line)+2+p.config.overhead > p.config.MaxBytes) {
+		full = p.close()
+	}
+
+	switch {
+	case p.config.Format == "ndjson":
+	case len(p.messages) == 0:
+		p.body.WriteByte('[')
+	default:
+		p.body.WriteByte(',')
+	}
+	p.body.Write(line)
+	p.messages = append(p.messages, m)
+
+	return full
+}
+
+// close returns the pack, or nil if it's empty, and
+// starts a new one.
+func (p *packer) close() *outputs.Message {
+	if len(p.messages) == 0 {
+		return nil
+	}
+	c := p.config
+	if c.Format == "array" {
+		p.body.WriteByte(']')
+	}
+
+	pack := *p.messages[0]
+	pack.Packed = p.messages
+	switch c.Flag {
+	case "envelope":
+		q := ""
+		if c.Format == "ndjson" {
+			q = `"`
+		}
+		pack.Body = envelopeStart(len(p.messages), c.Format) + q + p.body.String() + q + "}"
+	case "attribute":
+		pack.Body = p.body.String()
+		pack.Attributes = packAttributes(len(p.messages), c.Format)
+	default:
+		pack.Body = p.body.String()
+	}
+	p.body.Reset()
+	p.messages = nil
+
+	return &pack
+}
+
+// pending reports whether the pack has messages.
+func (p *packer) pending() bool {
+	return p != nil && len(p.messages) > 0
+}
+
+// quote returns b as the inside of a JSON string.
+func quote(b []byte) []byte {
+	var q bytes.Buffer
+	enc := json.NewEncoder(&q)
+	enc.SetEscapeHTML(false)
+	enc.Encode(string(b))
+	// Drop the quotes and line feed.
+	return q.Bytes()[1 : q.Len()-2]
+}
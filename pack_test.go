@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jamiealquiza/ascender/outputs"
+)
+
+// pack packs bodies with c, returning the packs.
+func pack(t *testing.T, c *PackConfig, bodies ...string) []*outputs.Message {
+	if err := c.validate(&outputType{attributes: true}); err != nil {
+		t.Fatal(err)
+	}
+	p := &packer{config: c}
+	var packs []*outputs.Message
+	for _, b := range bodies {
+		if full := p.add(&outputs.Message{Body: b, Route: "r"}); full != nil {
+			packs = append(packs, full)
+		}
+	}
+	if last := p.close(); last != nil {
+		packs = append(packs, last)
+	}
+	return packs
+}
+
+func TestPackEnvelope(t *testing.T) {
+	for _, format := range []string{"ndjson", "array"} {
+		packs := pack(t, &PackConfig{Format: format}, `{"a": 1}`, "plain \"text\"")
+		if len(packs) != 1 {
+			t.Fatalf("%s: %d packs", format, len(packs))
+		}
+		var env struct {
+			Pack struct {
+				Count  int
+				Format string
+			}
+			Data json.RawMessage
+		}
+		if err := json.Unmarshal([]byte(packs[0].Body), &env); err != nil {
+			t.Fatalf("%s: %s: %q", format, err, packs[0].Body)
+		}
+		if env.Pack.Count != 2 || env.Pack.Format != format {
+			t.Errorf("%s: pack %+v", format, env.Pack)
+		}
+
+		var lines []json.RawMessage
+		if format == "array" {
+			json.Unmarshal(env.Data, &lines)
+		} else {
+			var ndjson string
+			json.Unmarshal(env.Data, &ndjson)
+			for _, l := range strings.Split(strings.TrimSuffix(ndjson, "\n"), "\n") {
+				lines = append(lines, json.RawMessage(l))
+			}
+		}
+		if len(lines) != 2 || string(lines[0]) != `{"a":1}` || string(lines[1]) != `{"message":"plain \"text\""}` {
+			t.Errorf("%s: packed %q", format, lines)
+		}
+	}
+}
+
+func TestPackAttributes(t *testing.T) {
+	packs := pack(t, &PackConfig{Flag: "attribute"}, "a", "b", "c")
+	want := []outputs.Attribute{{Name: "Pack-Format", Value: "ndjson"}, {Name: "Pack-Count", Value: "3"}}
+	if len(packs) != 1 || len(packs[0].Attributes) != 2 || packs[0].Attributes[0] != want[0] || packs[0].Attributes[1] != want[1] {
+		t.Fatalf("packs %+v", packs)
+	}
+	if packs[0].Body != "{\"message\":\"a\"}\n{\"message\":\"b\"}\n{\"message\":\"c\"}\n" {
+		t.Errorf("body %q", packs[0].Body)
+	}
+
+	if err := (&PackConfig{Flag: "attribute"}).validate(&outputType{}); err == nil {
+		t.Error("attribute flag accepted for an output without attributes")
+	}
+}
+
+// Packs fit max-bytes with their envelope, and
+// max-messages.
+func TestPackLimits(t *testing.T) {
+	bodies := make([]string, 100)
+	for i := range bodies {
+		bodies[i] = `{"msg": "a \"quoted\" message"}`
+	}
+	n := 0
+	for _, p := range pack(t, &PackConfig{MaxBytes: 300}, bodies...) {
+		if len(p.Body) > 300 {
+			t.Errorf("pack of %d bytes", len(p.Body))
+		}
+		n += len(p.Packed)
+	}
+	if n != 100 {
+		t.Errorf("%d messages packed, want 100", n)
+	}
+
+	if packs := pack(t, &PackConfig{MaxMessages: 2}, "a", "b", "c"); len(packs) != 2 || len(packs[0].Packed) != 2 {
+		t.Errorf("%d packs", len(packs))
+	}
+}
+
+func TestFailedPackDeadLettersEach(t *testing.T) {
+	withQueues(t, &Config{})
+	c := &OutputConfig{Name: "o", DeadLetter: "dead", Encoding: &EncodingConfig{Base64: true}}
+	c.Encoding.validate(&outputType{})
+	packs := pack(t, &PackConfig{}, "one", "two")
+
+	// As the pack would be sent.
+	sent := newEncoder(c.Encoding).encode(packs[0])
+	(&outputStats{config: c}).Failed(sent, 2, errors.New("down"))
+	if n := len(deadLetterQueue); n != 2 {
+		t.Fatalf("%d dead letters, want 2", n)
+	}
+	for _, want := range []string{"one", "two"} {
+		var d DeadLetter
+		json.Unmarshal([]byte((<-deadLetterQueue).message.Body), &d)
+		if d.Message != want || d.Output != "o" || d.Route != "r" {
+			t.Errorf("dead letter %+v, want %q", d, want)
+		}
+	}
+}
+
+// Packs are split at max-bytes, counting the envelope or
+// attributes, and max-messages, and each pack takes as
+// many messages as fit, in order.
+func TestPackSplitsAtLimits(t *testing.T) {
+	var bodies []string
+	for i := 0; i < 40; i++ {
+		bodies = append(bodies, `{"n": `+strings.Repeat("1", 1+i%7)+`, "msg": "\"quoted\""}`)
+	}
+	for _, format := range []string{"ndjson", "array"} {
+		for _, flag := range []string{"envelope", "attribute", "none"} {
+			config := func() *PackConfig { return &PackConfig{Format: format, Flag: flag, MaxBytes: 200} }
+			packs := pack(t, config(), bodies...)
+			i := 0
+			for j, p := range packs {
+				if n := len(p.Body) + p.AttributeSize(); n > 200 {
+					t.Errorf("%s/%s: pack of %d bytes", format, flag, n)
+				}
+				for _, m := range p.Packed {
+					if m.Body != bodies[i] {
+						t.Fatalf("%s/%s: message %d out of order", format, flag, i)
+					}
+					i++
+				}
+				// The next message wouldn't have fit.
+				if j < len(packs)-1 {
+					more := append(outputs.Bodies(p.Packed), bodies[i])
+					if n := len(pack(t, config(), more...)); n != 2 {
+						t.Errorf("%s/%s: pack %d closed with room left", format, flag, j)
+					}
+				}
+			}
+			if i != len(bodies) {
+				t.Errorf("%s/%s: %d messages packed, want %d", format, flag, i, len(bodies))
+			}
+		}
+	}
+
+	var counts []int
+	for _, p := range pack(t, &PackConfig{MaxMessages: 3}, "a", "b", "c", "d", "e", "f", "g") {
+		counts = append(counts, len(p.Packed))
+	}
+	if len(counts) != 3 || counts[0] != 3 || counts[1] != 3 || counts[2] != 1 {
+		t.Errorf("packs of %v, want [3 3 1]", counts)
+	}
+}
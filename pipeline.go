@@ -0,0 +1,743 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jamiealquiza/ascender/outputs"
+)
+
+// Condition matches messages by a top level field of JSON
+// messages, by metadata ("listener", "source" or "client"),
+// or by the whole body if neither is set. Exactly one of
+// Equals, Matches and Exists is set; Not inverts the result.
+type Condition struct {
+	Field   string  `json:"field"`
+	Meta    string  `json:"meta"`
+	Equals  *string `json:"equals"`
+	Matches string  `json:"matches"`
+	Exists  *bool   `json:"exists"`
+	Not     bool    `json:"not"`
+
+	re *regexp.Regexp
+}
+
+// compile checks the condition and compiles Matches.
+func (c *Condition) compile() error {
+	switch {
+	case c.Field != "" && c.Meta != "":
+		return errors.New("field and meta can't both be set")
+	case c.Meta != "" && c.Meta != "listener" && c.Meta != "source" && c.Meta != "client":
+		return fmt.Errorf("invalid meta %q", c.Meta)
+	}
+	n := 0
+	if c.Equals != nil {
+		n++
+	}
+	if c.Matches != "" {
+		n++
+		var err error
+		if c.re, err = regexp.Compile(c.Matches); err != nil {
+			return fmt.Errorf("invalid matches: %s", err)
+		}
+	}
+	if c.Exists != nil {
+		n++
+	}
+	if n != 1 {
+		return errors.New("exactly one of equals, matches and exists is required")
+	}
+	return nil
+}
+
+// match reports whether e matches the condition.
+func (c *Condition) match(e *event) bool {
+	var v string
+	var ok bool
+	switch {
+	case c.Field != "":
+		if obj := e.object(); obj != nil {
+			var raw json.RawMessage
+			raw, ok = obj.values[c.Field]
+			v = outputs.FieldString(raw)
+		}
+	case c.Meta != "":
+		v = e.meta(c.Meta)
+		ok = v != ""
+	default:
+		v, ok = e.body(), true
+	}
+
+	var m bool
+	switch {
+	case c.Exists != nil:
+		m = ok == *c.Exists
+	case c.Equals != nil:
+		m = ok && v == *c.Equals
+	default:
+		m = ok && c.re.MatchString(v)
+	}
+	return m != c.Not
+}
+
+// object is a JSON object that keeps its key order.
+type object struct {
+	keys   []string
+	values map[string]json.RawMessage
+}
+
+// parseObject parses b as a JSON object, or returns nil.
+func parseObject(b string) *object {
+	dec := json.NewDecoder(bytes.NewReader([]byte(b)))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil
+	}
+	o := &object{values: map[string]json.RawMessage{}}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			return nil
+		}
+		o.set(t.(string), v)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil
+	}
+	// Nothing may follow the object.
+	if _, err := dec.Token(); err != io.EOF {
+		return nil
+	}
+	return o
+}
+
+// set sets a field, keeping its position if present.
+func (o *object) set(k string, v json.RawMessage) {
+	if _, ok := o.values[k]; !ok {
+		o.keys = append(o.keys, k)
+	}
+	o.values[k] = v
+}
+
+func (o *object) delete(k string) {
+	if _, ok := o.values[k]; !ok {
+		return
+	}
+	delete(o.values, k)
+	for i, key := range o.keys {
+		if key == k {
+			o.keys = append(o.keys[:i], o.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// rename renames a field in place, replacing any field named to.
+func (o *object) rename(from, to string) bool {
+	v, ok := o.values[from]
+	if !ok || from == to {
+		return ok
+	}
+	o.delete(to)
+	for i, key := range o.keys {
+		if key == from {
+			o.keys[i] = to
+			break
+		}
+	}
+	delete(o.values, from)
+	o.values[to] = v
+	return true
+}
+
+// encode returns the object as compact JSON.
+func (o *object) encode() string {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range o.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.Write(outputs.JSONString(k))
+		b.WriteByte(':')
+		if json.Compact(&b, o.values[k]) != nil {
+			b.Write(o.values[k])
+		}
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// event is a message passing through the pipeline. Its body
+// is parsed once for processors working on fields, and only
+// encoded again if they change it.
+type event struct {
+	*Message
+	obj    *object
+	parsed bool
+	dirty  bool
+}
+
+// object returns the parsed body, nil if it isn't a JSON object.
+func (e *event) object() *object {
+	if !e.parsed {
+		e.obj = parseObject(e.Body)
+		e.parsed = true
+	}
+	return e.obj
+}
+
+// changed marks the parsed body as modified.
+func (e *event) changed() {
+	e.dirty = true
+}
+
+// body returns the current body.
+func (e *event) body() string {
+	if e.dirty {
+		e.Body = e.obj.encode()
+		e.dirty = false
+	}
+	return e.Body
+}
+
+// setBody replaces the body.
+func (e *event) setBody(b string) {
+	e.Body = b
+	e.obj, e.parsed, e.dirty = nil, false, false
+}
+
+func (e *event) meta(name string) string {
+	switch name {
+	case "listener":
+		return e.Listener
+	case "source":
+		return e.Source
+	case "client":
+		if e.Client != nil {
+			return e.Client.Name
+		}
+	}
+	return ""
+}
+
+// errNotObject is returned by processors needing a JSON object.
+var errNotObject = errors.New("message is not a JSON object")
+
+// processor is a pipeline stage. It returns false to drop
+// the message, and an error if it couldn't be processed
+// (the message continues unchanged).
+type processor interface {
+	process(e *event) (bool, error)
+}
+
+// splitter is a processor that may turn a message into
+// several, used instead of process. None drops it.
+type splitter interface {
+	split(e *event) ([]*event, error)
+}
+
+// flusher is a processor holding messages back, which
+// releases those due at now when flushed, or all of them
+// if now is zero. They continue from the next stage.
+type flusher interface {
+	flush(now time.Time) []*event
+}
+
+// processorTypes build processors from their config.
+var processorTypes = map[string]func(p *ProcessorConfig) (processor, error){
+	"json":          newJSONProcessor,
+	"add-fields":    newAddFields,
+	"rename-fields": newRenameFields,
+	"delete-fields": newDeleteFields,
+	"stamp":         newStamp,
+	"envelope":      newEnvelope,
+	"template":      newTemplateProcessor,
+	"drop":          newDrop,
+	"script":        newScript,
+	"dedup":         newDedup,
+	"sample":        newSampleProcessor,
+}
+
+// jsonProcessor makes sure messages are JSON objects.
+type jsonProcessor struct {
+	field     string
+	onInvalid string
+}
+
+func newJSONProcessor(p *ProcessorConfig) (processor, error) {
+	j := &jsonProcessor{field: "message", onInvalid: "wrap"}
+	if p.Field != "" {
+		j.field = p.Field
+	}
+	switch p.OnInvalid {
+	case "":
+	case "wrap", "drop", "keep":
+		j.onInvalid = p.OnInvalid
+	default:
+		return nil, fmt.Errorf("invalid on-invalid %q", p.OnInvalid)
+	}
+	return j, nil
+}
+
+func (j *jsonProcessor) process(e *event) (bool, error) {
+	if e.object() != nil {
+		// Compacted when encoded.
+		e.changed()
+		return true, nil
+	}
+	switch j.onInvalid {
+	case "drop":
+		return false, nil
+	case "keep":
+		return true, errNotObject
+	}
+	e.setBody(fmt.Sprintf("{%s:%s}", outputs.JSONString(j.field), outputs.JSONString(e.Body)))
+	return true, nil
+}
+
+// addFields sets fields. String values are templates.
+type addFields struct {
+	keys      []string
+	literals  map[string]json.RawMessage
+	templates map[string]*outputs.Template
+	overwrite bool
+}
+
+func newAddFields(p *ProcessorConfig) (processor, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(p.Fields, &fields); err != nil || len(fields) == 0 {
+		return nil, errors.New("fields must be an object of field values")
+	}
+	a := &addFields{
+		literals:  map[string]json.RawMessage{},
+		templates: map[string]*outputs.Template{},
+		overwrite: p.Overwrite,
+	}
+	for k, v := range fields {
+		a.keys = append(a.keys, k)
+		var s string
+		if json.Unmarshal(v, &s) != nil {
+			a.literals[k] = v
+			continue
+		}
+		t, err := outputs.ParseTemplate(s)
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %s", k, err)
+		}
+		a.templates[k] = t
+	}
+	sort.Strings(a.keys)
+	return a, nil
+}
+
+func (a *addFields) process(e *event) (bool, error) {
+	obj := e.object()
+	if obj == nil {
+		return true, errNotObject
+	}
+	var m *outputs.Message
+	for _, k := range a.keys {
+		if _, ok := obj.values[k]; ok && !a.overwrite {
+			continue
+		}
+		v, ok := a.literals[k]
+		if !ok {
+			if m == nil {
+				// Templates see earlier changes.
+				e.body()
+				m = e.output("")
+			}
+			v = outputs.JSONString(a.templates[k].Execute(m, nil))
+		}
+		obj.set(k, v)
+		e.changed()
+	}
+	return true, nil
+}
+
+// renameFields renames fields, replacing any with the new name.
+type renameFields struct {
+	from []string
+	to   map[string]string
+}
+
+func newRenameFields(p *ProcessorConfig) (processor, error) {
+	r := &renameFields{}
+	if err := json.Unmarshal(p.Fields, &r.to); err != nil || len(r.to) == 0 {
+		return nil, errors.New("fields must be an object of old to new names")
+	}
+	for from, to := range r.to {
+		if to == "" {
+			return nil, fmt.Errorf("field %q: new name is empty", from)
+		}
+		r.from = append(r.from, from)
+	}
+	sort.Strings(r.from)
+	return r, nil
+}
+
+func (r *renameFields) process(e *event) (bool, error) {
+	obj := e.object()
+	if obj == nil {
+		return true, errNotObject
+	}
+	for _, from := range r.from {
+		if obj.rename(from, r.to[from]) {
+			e.changed()
+		}
+	}
+	return true, nil
+}
+
+// deleteFields removes fields.
+type deleteFields struct {
+	fields []string
+}
+
+func newDeleteFields(p *ProcessorConfig) (processor, error) {
+	d := &deleteFields{}
+	if err := json.Unmarshal(p.Fields, &d.fields); err != nil || len(d.fields) == 0 {
+		return nil, errors.New("fields must be a list of field names")
+	}
+	return d, nil
+}
+
+func (d *deleteFields) process(e *event) (bool, error) {
+	obj := e.object()
+	if obj == nil {
+		return true, errNotObject
+	}
+	for _, k := range d.fields {
+		if _, ok := obj.values[k]; ok {
+			obj.delete(k)
+			e.changed()
+		}
+	}
+	return true, nil
+}
+
+// timestampLayout is RFC 3339 with nanoseconds, kept to
+// a fixed width so timestamps sort as strings.
+const timestampLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+// stamp adds the time received and the hostname if missing.
+type stamp struct {
+	timestampField string
+	hostnameField  string
+	hostname       json.RawMessage
+}
+
+func newStamp(p *ProcessorConfig) (processor, error) {
+	s := &stamp{timestampField: "@timestamp", hostnameField: "@hostname"}
+	if p.TimestampField != "" {
+		s.timestampField = p.TimestampField
+	}
+	if p.HostnameField != "" {
+		s.hostnameField = p.HostnameField
+	}
+	h, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	s.hostname = outputs.JSONString(h)
+	return s, nil
+}
+
+func (s *stamp) process(e *event) (bool, error) {
+	obj := e.object()
+	if obj == nil {
+		return true, errNotObject
+	}
+	if _, ok := obj.values[s.timestampField]; !ok {
+		obj.set(s.timestampField, outputs.JSONString(e.Received.UTC().Format(timestampLayout)))
+		e.changed()
+	}
+	if _, ok := obj.values[s.hostnameField]; !ok {
+		obj.set(s.hostnameField, s.hostname)
+		e.changed()
+	}
+	return true, nil
+}
+
+// envelope wraps plain text messages and adds receive
+// metadata, keeping fields JSON objects already have
+// unless overwriting.
+type envelope struct {
+	field          string
+	timestampField string
+	hostnameField  string
+	hostname       json.RawMessage
+	overwrite      bool
+}
+
+func newEnvelope(p *ProcessorConfig) (processor, error) {
+	s, err := newStamp(p)
+	if err != nil {
+		return nil, err
+	}
+	st := s.(*stamp)
+	e := &envelope{
+		field:          "message",
+		timestampField: st.timestampField,
+		hostnameField:  st.hostnameField,
+		hostname:       st.hostname,
+		overwrite:      p.Overwrite,
+	}
+	if p.Field != "" {
+		e.field = p.Field
+	}
+	return e, nil
+}
+
+func (en *envelope) process(e *event) (bool, error) {
+	obj := e.object()
+	if obj == nil {
+		e.setBody(fmt.Sprintf("{%s:%s}", outputs.JSONString(en.field), outputs.JSONString(e.Body)))
+		obj = e.object()
+	}
+	set := func(k string, v json.RawMessage) {
+		if _, ok := obj.values[k]; ok && !en.overwrite {
+			return
+		}
+		obj.set(k, v)
+	}
+	set(en.hostnameField, en.hostname)
+	set("@source", outputs.JSONString(e.RemoteAddr))
+	set("@listener", outputs.JSONString(e.Listener))
+	if e.Client != nil {
+		set("@client", outputs.JSONString(e.Client.Name))
+	}
+	set(en.timestampField, outputs.JSONString(e.Received.UTC().Format(timestampLayout)))
+	set("@id", outputs.JSONString(messageID(e.Received)))
+	e.changed()
+	return true, nil
+}
+
+// messageID returns a unique ID that sorts by time t:
+// its Unix nanoseconds then 8 random bytes, in hex.
+func messageID(t time.Time) string {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
+	rand.Read(b[8:])
+	return hex.EncodeToString(b)
+}
+
+// templateProcessor replaces the body with a template.
+type templateProcessor struct {
+	template *outputs.Template
+	escape   func(string) string
+}
+
+func newTemplateProcessor(p *ProcessorConfig) (processor, error) {
+	if p.Template == "" {
+		return nil, errors.New("template is required")
+	}
+	t := &templateProcessor{}
+	var err error
+	if t.template, err = outputs.ParseTemplate(p.Template); err != nil {
+		return nil, err
+	}
+	switch p.Escape {
+	case "", "json":
+		t.escape = outputs.JSONEscape
+	case "none":
+	default:
+		return nil, fmt.Errorf("invalid escape %q", p.Escape)
+	}
+	return t, nil
+}
+
+func (t *templateProcessor) process(e *event) (bool, error) {
+	e.body()
+	e.setBody(t.template.Execute(e.output(""), t.escape))
+	return true, nil
+}
+
+// drop drops every message it's applied to; its
+// When condition picks which.
+type drop struct{}
+
+func newDrop(p *ProcessorConfig) (processor, error) {
+	if p.When == nil {
+		return nil, errors.New("when is required")
+	}
+	return drop{}, nil
+}
+
+func (drop) process(e *event) (bool, error) {
+	return false, nil
+}
+
+// processorCounters count messages seen by a processor
+// between statsTracker intervals.
+type processorCounters struct {
+	processed, dropped, errors int64
+}
+
+// processorUsage holds counters by processor name. They
+// outlive reloads, so a processor keeps its counts.
+type processorUsage struct {
+	mu       sync.Mutex
+	counters map[string]*processorCounters
+}
+
+var processorStats = &processorUsage{counters: map[string]*processorCounters{}}
+
+func (p *processorUsage) get(name string) *processorCounters {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := p.counters[name]
+	if !ok {
+		c = &processorCounters{}
+		p.counters[name] = c
+	}
+	return c
+}
+
+// logAndReset logs the counts of each processor that saw
+// messages since the last call and starts a new interval.
+func (p *processorUsage) logAndReset(interval time.Duration) {
+	p.mu.Lock()
+	names := make([]string, 0, len(p.counters))
+	for name := range p.counters {
+		names = append(names, name)
+	}
+	counters := p.counters
+	p.mu.Unlock()
+
+	sort.Strings(names)
+	for _, name := range names {
+		c := counters[name]
+		processed := atomic.SwapInt64(&c.processed, 0)
+		dropped := atomic.SwapInt64(&c.dropped, 0)
+		errs := atomic.SwapInt64(&c.errors, 0)
+		if processed == 0 {
+			continue
+		}
+		log.Printf("Last %s: processor %s | processed %d messages | dropped %d | errors %d\n",
+			interval,
+			name,
+			processed,
+			dropped,
+			errs)
+	}
+}
+
+// stage is a processor in a pipeline.
+type stage struct {
+	config    *ProcessorConfig
+	processor processor
+	counters  *processorCounters
+}
+
+// pipeline applies processors to messages in order.
+type pipeline struct {
+	stages []*stage
+}
+
+// newPipeline builds the pipeline for c, whose
+// processors were checked by validate.
+func newPipeline(c *Config) *pipeline {
+	p := &pipeline{}
+	for _, pc := range c.Pipeline {
+		p.stages = append(p.stages, &stage{
+			config:    pc,
+			processor: pc.processor,
+			counters:  processorStats.get(pc.Name),
+		})
+	}
+	return p
+}
+
+// run applies the pipeline to m, returning the messages
+// it results in: none if dropped, several if split.
+func (p *pipeline) run(m *Message) []*Message {
+	if len(p.stages) == 0 {
+		return []*Message{m}
+	}
+	return messages(runStages(p.stages, []*event{{Message: m}}))
+}
+
+// flush returns the messages released by flushers, as
+// flusher.flush.
+func (p *pipeline) flush(now time.Time) []*Message {
+	var events []*event
+	for i, s := range p.stages {
+		if f, ok := s.processor.(flusher); ok {
+			if released := f.flush(now); len(released) > 0 {
+				events = append(events, runStages(p.stages[i+1:], released)...)
+			}
+		}
+	}
+	return messages(events)
+}
+
+// runStages applies stages to events in order.
+func runStages(stages []*stage, events []*event) []*event {
+	for _, s := range stages {
+		var next []*event
+		for _, e := range events {
+			next = append(next, s.apply(e)...)
+		}
+		if events = next; len(events) == 0 {
+			return nil
+		}
+	}
+	return events
+}
+
+// messages returns the messages of events.
+func messages(events []*event) []*Message {
+	if len(events) == 0 {
+		return nil
+	}
+	messages := make([]*Message, len(events))
+	for i, e := range events {
+		e.body()
+		messages[i] = e.Message
+	}
+	return messages
+}
+
+// apply runs the stage on e if it matches.
+func (s *stage) apply(e *event) []*event {
+	if w := s.config.When; w != nil && !w.match(e) {
+		return []*event{e}
+	}
+	atomic.AddInt64(&s.counters.processed, 1)
+
+	var events []*event
+	var err error
+	if sp, ok := s.processor.(splitter); ok {
+		events, err = sp.split(e)
+	} else {
+		var keep bool
+		if keep, err = s.processor.process(e); keep {
+			events = []*event{e}
+		}
+	}
+	if err != nil {
+		atomic.AddInt64(&s.counters.errors, 1)
+	}
+	if len(events) == 0 {
+		atomic.AddInt64(&s.counters.dropped, 1)
+	}
+	return events
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestPipeline builds a pipeline from a JSON list of
+// processor configs, as validate would.
+func newTestPipeline(t *testing.T, stages string) *pipeline {
+	t.Helper()
+	c := &Config{}
+	if err := json.Unmarshal([]byte(stages), &c.Pipeline); err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range c.Pipeline {
+		p.Name = fmt.Sprintf("%s-%s-%d", t.Name(), p.Type, i)
+		if p.When != nil {
+			if err := p.When.compile(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var err error
+		if p.processor, err = processorTypes[p.Type](p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := newPipeline(c)
+	// Counters are kept by name across reloads; the
+	// test's own start at zero.
+	for _, s := range p.stages {
+		s.counters = &processorCounters{}
+	}
+	return p
+}
+
+// bodies runs body through p, returning the resulting bodies.
+func (p *pipeline) bodies(body string) []string {
+	var bodies []string
+	for _, m := range p.run(&Message{Body: body, Listener: "main", Received: time.Now()}) {
+		bodies = append(bodies, m.Body)
+	}
+	return bodies
+}
+
+func expectBodies(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestPipelineFields(t *testing.T) {
+	p := newTestPipeline(t, `[
+		{"type": "json"},
+		{"type": "rename-fields", "fields": {"msg": "message", "lvl": "level"}},
+		{"type": "delete-fields", "fields": ["secret"]},
+		{"type": "add-fields", "fields": {"env": "prod", "n": 1, "level": "info", "from": "{:listener}/{message}"}}
+	]`)
+	expectBodies(t, p.bodies(`{ "lvl": "warn", "secret": 1, "msg": "hi", "level": "x" }`),
+		`{"level":"warn","message":"hi","env":"prod","from":"main/hi","n":1}`)
+	// Plain text is wrapped first.
+	expectBodies(t, p.bodies(`plain <text>`),
+		`{"message":"plain <text>","env":"prod","from":"main/plain <text>","level":"info","n":1}`)
+}
+
+func TestPipelineOverwrite(t *testing.T) {
+	p := newTestPipeline(t, `[{"type": "add-fields", "fields": {"a": 2}, "overwrite": true}]`)
+	expectBodies(t, p.bodies(`{"a":1,"b":1}`), `{"a":2,"b":1}`)
+	// Other processors than json leave plain text as is.
+	expectBodies(t, p.bodies(`text`), `text`)
+}
+
+func TestPipelineJSONOnInvalid(t *testing.T) {
+	tests := []struct {
+		config, body string
+		want         []string
+	}{
+		{`{"type": "json", "field": "log"}`, `a "b"`, []string{`{"log":"a \"b\""}`}},
+		{`{"type": "json", "on-invalid": "drop"}`, `text`, nil},
+		{`{"type": "json", "on-invalid": "keep"}`, `text`, []string{`text`}},
+		// JSON is compacted.
+		{`{"type": "json", "on-invalid": "drop"}`, `{ "a" : [1, 2] }`, []string{`{"a":[1,2]}`}},
+		{`{"type": "json", "on-invalid": "drop"}`, `{"a":1} {"b":2}`, nil},
+	}
+	for _, tt := range tests {
+		expectBodies(t, newTestPipeline(t, "["+tt.config+"]").bodies(tt.body), tt.want...)
+	}
+}
+
+func TestPipelineWhen(t *testing.T) {
+	p := newTestPipeline(t, `[
+		{"type": "drop", "when": {"field": "level", "equals": "debug"}},
+		{"type": "add-fields", "fields": {"alert": true}, "when": {"field": "level", "matches": "^(error|fatal)$"}},
+		{"type": "add-fields", "fields": {"tagged": true}, "when": {"field": "tags", "exists": false, "not": true}},
+		{"type": "drop", "when": {"meta": "listener", "equals": "other"}}
+	]`)
+	expectBodies(t, p.bodies(`{"level":"debug"}`))
+	expectBodies(t, p.bodies(`{"level":"error"}`), `{"level":"error","alert":true}`)
+	expectBodies(t, p.bodies(`{"level":"info","tags":[]}`), `{"level":"info","tags":[],"tagged":true}`)
+	expectBodies(t, p.bodies(`text`), `text`)
+}
+
+func TestPipelineTemplate(t *testing.T) {
+	p := newTestPipeline(t, `[{"type": "template", "template": "{\"line\": \"{:listener}: {:body}\"}"}]`)
+	expectBodies(t, p.bodies(`say "hi"`), `{"line": "main: say \"hi\""}`)
+}
+
+func TestPipelineStampAndEnvelope(t *testing.T) {
+	host, _ := os.Hostname()
+	received := time.Date(2015, 2, 17, 16, 11, 11, 0, time.UTC)
+	m := &Message{Body: `{"@hostname":"app1"}`, Listener: "main", RemoteAddr: "10.0.0.1:5000", Client: &ClientToken{Name: "web"}, Received: received}
+
+	p := newTestPipeline(t, `[{"type": "stamp", "timestamp-field": "ts"}]`)
+	expectBodies(t, []string{p.run(m)[0].Body}, `{"@hostname":"app1","ts":"2015-02-17T16:11:11.000000000Z"}`)
+
+	m.Body = "text"
+	p = newTestPipeline(t, `[{"type": "envelope"}]`)
+	var got map[string]string
+	if err := json.Unmarshal([]byte(p.run(m)[0].Body), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"message":    "text",
+		"@hostname":  host,
+		"@source":    "10.0.0.1:5000",
+		"@listener":  "main",
+		"@client":    "web",
+		"@timestamp": "2015-02-17T16:11:11.000000000Z",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: %q, want %q", k, got[k], v)
+		}
+	}
+	if len(got["@id"]) != 32 || !strings.HasPrefix(got["@id"], fmt.Sprintf("%016x", received.UnixNano())) {
+		t.Errorf("@id %q", got["@id"])
+	}
+}
+
+func TestPipelineCounters(t *testing.T) {
+	p := newTestPipeline(t, `[{"type": "add-fields", "fields": {"a": 1}}, {"type": "drop", "when": {"field": "drop", "exists": true}}]`)
+	p.bodies(`{}`)
+	p.bodies(`text`)
+	p.bodies(`{"drop":1}`)
+	add, drop := p.stages[0].counters, p.stages[1].counters
+	if add.processed != 3 || add.errors != 1 || add.dropped != 0 {
+		t.Errorf("add-fields counters %+v", *add)
+	}
+	if drop.processed != 1 || drop.dropped != 1 {
+		t.Errorf("drop counters %+v", *drop)
+	}
+}
+
+func TestProcessorConfigErrors(t *testing.T) {
+	for _, config := range []string{
+		`{"type": "json", "on-invalid": "ignore"}`,
+		`{"type": "add-fields"}`,
+		`{"type": "add-fields", "fields": {"a": "{b"}}`,
+		`{"type": "rename-fields", "fields": {"a": ""}}`,
+		`{"type": "delete-fields", "fields": "a"}`,
+		`{"type": "template"}`,
+		`{"type": "template", "template": "x", "escape": "html"}`,
+		`{"type": "drop"}`,
+	} {
+		p := &ProcessorConfig{}
+		if err := json.Unmarshal([]byte(config), p); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := processorTypes[p.Type](p); err == nil {
+			t.Errorf("%s accepted", config)
+		}
+	}
+	for _, when := range []Condition{{}, {Field: "a", Meta: "source", Exists: new(bool)}, {Meta: "route", Exists: new(bool)}, {Matches: "("}} {
+		if err := when.compile(); err == nil {
+			t.Errorf("condition %+v accepted", when)
+		}
+	}
+}
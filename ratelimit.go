@@ -0,0 +1,254 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RateLimits are token bucket limits applied to each
+// connection, each remote IP and each authenticated
+// client on a listener.
+type RateLimits struct {
+	Connection RateLimit `json:"per-connection"`
+	IP         RateLimit `json:"per-ip"`
+	Client     RateLimit `json:"per-client"`
+}
+
+// RateLimit sets sustained per-second rates, allowing bursts
+// of up to one second's worth. Zero is unlimited.
+type RateLimit struct {
+	Messages float64 `json:"messages-per-sec"`
+	Bytes    float64 `json:"bytes-per-sec"`
+}
+
+func (r RateLimit) unlimited() bool {
+	return r.Messages == 0 && r.Bytes == 0
+}
+
+// tokenBucket refills at rate tokens/sec up to burst.
+type tokenBucket struct {
+	rate, burst, tokens float64
+	last                time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: rate, tokens: rate, last: time.Now()}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// ready reports whether n tokens can be taken. Requests
+// larger than the burst are let through on a full bucket
+// and paid back before the next is allowed.
+func (b *tokenBucket) ready(n float64) bool {
+	if n > b.burst {
+		n = b.burst
+	}
+	return b.tokens >= n
+}
+
+// limiter enforces a RateLimit. A nil limiter allows everything.
+type limiter struct {
+	mu       sync.Mutex
+	limit    RateLimit
+	messages *tokenBucket
+	bytes    *tokenBucket
+	// Connections holding a shared limiter, guarded
+	// by its limiterSet's mu.
+	refs int
+}
+
+func newLimiter(r RateLimit) *limiter {
+	if r.unlimited() {
+		return nil
+	}
+	l := &limiter{limit: r}
+	if r.Messages > 0 {
+		l.messages = newTokenBucket(r.Messages)
+	}
+	if r.Bytes > 0 {
+		l.bytes = newTokenBucket(r.Bytes)
+	}
+	return l
+}
+
+// allow reports whether a message of n bytes is within
+// the limit, and takes its tokens if so.
+func (l *limiter) allow(n int) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for _, b := range []*tokenBucket{l.messages, l.bytes} {
+		if b != nil {
+			b.refill(now)
+		}
+	}
+	if l.messages != nil && !l.messages.ready(1) {
+		return false
+	}
+	if l.bytes != nil && !l.bytes.ready(float64(n)) {
+		return false
+	}
+	if l.messages != nil {
+		l.messages.tokens--
+	}
+	if l.bytes != nil {
+		l.bytes.tokens -= float64(n)
+	}
+
+	return true
+}
+
+// idle reports whether l has fully refilled, in
+// which case dropping it loses no state.
+func (l *limiter) idle() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for _, b := range []*tokenBucket{l.messages, l.bytes} {
+		if b != nil {
+			b.refill(now)
+			if b.tokens < b.burst {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// limiterSet holds limiters shared by all
+// connections with the same key.
+type limiterSet struct {
+	mu       sync.Mutex
+	limiters map[string]*limiter
+}
+
+var (
+	// Per remote IP limiters, keyed by listener name and IP.
+	ipLimiters = &limiterSet{limiters: map[string]*limiter{}}
+	// Per client limiters, keyed by listener and client name.
+	clientLimiters = &limiterSet{limiters: map[string]*limiter{}}
+)
+
+// get returns the limiter for key, replacing it if the
+// limit has changed since it was created. Connections
+// release it once closed.
+func (s *limiterSet) get(key string, r RateLimit) *limiter {
+	if r.unlimited() {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok := s.limiters[key]
+	if !ok || l.limit != r {
+		l = newLimiter(r)
+		s.limiters[key] = l
+	}
+	l.refs++
+	return l
+}
+
+// release gives back a limiter from get.
+func (s *limiterSet) release(l *limiter) {
+	if l == nil {
+		return
+	}
+	s.mu.Lock()
+	l.refs--
+	s.mu.Unlock()
+}
+
+// expire drops limiters that have fully refilled and
+// aren't held by a connection, which would otherwise get
+// a fresh bucket by reconnecting.
+func (s *limiterSet) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, l := range s.limiters {
+		if l.refs == 0 && l.idle() {
+			delete(s.limiters, key)
+		}
+	}
+}
+
+// usage is traffic counted for a source.
+type usage struct {
+	messages, bytes, limited int64
+}
+
+// sourceUsage counts traffic per source
+// between statsTracker intervals.
+type sourceUsage struct {
+	mu      sync.Mutex
+	sources map[string]*usage
+}
+
+var sourceStats = &sourceUsage{sources: map[string]*usage{}}
+
+// count records a message of n bytes from source,
+// or a rejected one if limited.
+func (s *sourceUsage) count(source string, n int, limited bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.sources[source]
+	if !ok {
+		u = &usage{}
+		s.sources[source] = u
+	}
+	if limited {
+		u.limited++
+	} else {
+		u.messages++
+		u.bytes += int64(n)
+	}
+}
+
+// logAndReset logs usage for each source seen
+// since the last call and starts a new interval.
+func (s *sourceUsage) logAndReset(interval time.Duration) {
+	s.mu.Lock()
+	current := s.sources
+	s.sources = map[string]*usage{}
+	s.mu.Unlock()
+
+	names := make([]string, 0, len(current))
+	for name := range current {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		u := current[name]
+		log.Printf("Last %s: source %s | received %d messages, %d bytes | rate limited %d messages\n",
+			interval,
+			name,
+			u.messages,
+			u.bytes,
+			u.limited)
+	}
+}
+
+// remoteIP returns the IP of the client on conn.
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketRefill(t *testing.T) {
+	b := newTokenBucket(10)
+	start := b.last
+	b.tokens = 0
+	b.refill(start.Add(500 * time.Millisecond))
+	if b.tokens != 5 {
+		t.Fatalf("tokens %v after 0.5s at 10/s, want 5", b.tokens)
+	}
+	b.refill(start.Add(10 * time.Second))
+	if b.tokens != 10 {
+		t.Fatalf("tokens %v, want capped at burst 10", b.tokens)
+	}
+}
+
+func TestLimiterMessages(t *testing.T) {
+	l := newLimiter(RateLimit{Messages: 3})
+	for i := 0; i < 3; i++ {
+		if !l.allow(1) {
+			t.Fatalf("message %d limited within burst", i)
+		}
+	}
+	if l.allow(1) {
+		t.Fatal("message over burst allowed")
+	}
+}
+
+func TestLimiterBytes(t *testing.T) {
+	l := newLimiter(RateLimit{Bytes: 100})
+	if !l.allow(60) || l.allow(60) {
+		t.Fatal("second 60 bytes should be limited at 100/s")
+	}
+
+	// Messages larger than the burst pass on a full
+	// bucket and are paid back after.
+	l = newLimiter(RateLimit{Bytes: 100})
+	if !l.allow(250) {
+		t.Fatal("oversized message limited on a full bucket")
+	}
+	if l.allow(1) {
+		t.Fatal("allowed before the oversized message was paid back")
+	}
+}
+
+func TestLimiterUnlimited(t *testing.T) {
+	l := newLimiter(RateLimit{})
+	if l != nil || !l.allow(1<<20) {
+		t.Fatal("zero limits should be unlimited")
+	}
+}
+
+func TestLimiterSetShares(t *testing.T) {
+	s := &limiterSet{limiters: map[string]*limiter{}}
+	r := RateLimit{Messages: 1}
+	a, b := s.get("k", r), s.get("k", r)
+	if a != b {
+		t.Fatal("same key should share a limiter")
+	}
+	if c := s.get("k", RateLimit{Messages: 2}); c == a {
+		t.Fatal("changed limit should replace the limiter")
+	}
+}
+
+// Limiters held by open connections must survive expiry,
+// or reconnecting would hand out a fresh bucket.
+func TestLimiterSetExpire(t *testing.T) {
+	s := &limiterSet{limiters: map[string]*limiter{}}
+	r := RateLimit{Messages: 1}
+	held := s.get("k", r)
+	s.expire()
+	if s.get("k", r) != held {
+		t.Fatal("held limiter expired")
+	}
+	s.release(held)
+	s.release(held)
+	s.expire()
+	if s.get("k", r) == held {
+		t.Fatal("released idle limiter not expired")
+	}
+
+	// Limiters still refilling are kept.
+	busy := s.get("b", r)
+	busy.allow(1)
+	s.release(busy)
+	s.expire()
+	if s.get("b", r) != busy {
+		t.Fatal("refilling limiter expired")
+	}
+}
+
+// A client's limit is per listener: its connections to
+// another listener don't share it.
+func TestClientLimitPerListener(t *testing.T) {
+	withQueues(t, &Config{})
+	tokens := []*ClientToken{{Name: "web", Token: "s3cret"}}
+	limits := RateLimits{Client: RateLimit{Messages: 1}}
+	for _, name := range []string{"a", "b"} {
+		l := &ListenerConfig{Name: name, MaxMessageSize: 1024, RateLimits: limits, tokens: tokens, authTimeout: time.Second}
+		conn, err := net.Dial("tcp", listenTest(t, l))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Left open, so the limiter is held.
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		conn.Write([]byte("AUTH s3cret\na\nb\n"))
+		expectResponses(t, bufio.NewScanner(conn), "200|0|authenticated", "200|", "429|")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/jamiealquiza/ascender/outputs"
+)
+
+// replayPrefix starts dead letter lines sent by -replay
+// to listeners accepting replays.
+const replayPrefix = "REPLAY "
+
+// replayer takes dead letters replayed to a listener. Letters
+// from an output go through the pipeline again and on to that
+// output alone, or straight to it as they were when it failed
+// them if direct; quarantined letters are received again on
+// their route, once they pass its schema.
+type replayer struct {
+	outputs map[string]bool
+	routes  map[string]*RouteConfig
+}
+
+func newReplayer(c *Config) *replayer {
+	rp := &replayer{outputs: map[string]bool{}, routes: map[string]*RouteConfig{}}
+	for _, o := range c.Outputs {
+		rp.outputs[o.Name] = true
+	}
+	for _, r := range c.Routes {
+		rp.routes[r.Name] = r
+	}
+	return rp
+}
+
+// replay queues the dead letter in line, returning the
+// response code and info.
+func (rp *replayer) replay(line string, client *ClientToken, direct bool) (int, string) {
+	var d DeadLetter
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, replayPrefix)), &d); err != nil {
+		return 400, "invalid dead letter"
+	}
+
+	if d.Output != "" {
+		switch {
+		case !rp.outputs[d.Output]:
+			return 404, "no output " + d.Output
+		case !client.allowsOutput(d.Output):
+			return 403, "output not allowed"
+		}
+		if direct {
+			m := &outputs.Message{Body: d.Message, Listener: d.Listener, Source: d.Source, Client: d.Client, Route: d.Route, Received: d.Received}
+			select {
+			case deadLetterQueue <- &deadLetter{output: d.Output, message: m}:
+				return 200, "replayed"
+			default:
+				return 503, "message queue full"
+			}
+		}
+		m := &Message{Body: d.Message, Listener: d.Listener, Source: d.Source, Client: client, Received: d.Received, Route: d.Route, Output: d.Output}
+		return rp.receive(m)
+	}
+
+	r := rp.routes[d.Route]
+	switch {
+	case r == nil:
+		return 404, "no route " + d.Route
+	case !client.allowsRoute(d.Route):
+		return 403, "route not allowed"
+	}
+	if r.schema != nil {
+		if err := r.schema.check(d.Message); err != nil {
+			return 422, "schema violation: " + err.Error()
+		}
+	}
+	m := &Message{Body: d.Message, Listener: d.Listener, Source: d.Source, Client: client, Received: d.Received, Route: d.Route}
+	return rp.receive(m)
+}
+
+// receive queues a replayed message for the pipeline.
+func (rp *replayer) receive(m *Message) (int, string) {
+	if !currentShedder().accept(m, len(messageIncomingQueue)) {
+		return 503, "message queue full"
+	}
+	messageIncomingQueue <- m
+	return 200, "replayed"
+}
+
+// The running replayer, replaced on reload.
+var replaying = struct {
+	sync.RWMutex
+	r *replayer
+}{}
+
+func setReplayer(r *replayer) {
+	replaying.Lock()
+	replaying.r = r
+	replaying.Unlock()
+}
+
+func currentReplayer() *replayer {
+	replaying.RLock()
+	defer replaying.RUnlock()
+	return replaying.r
+}
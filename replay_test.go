@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listenTest serves reqHandler for l on a local port,
+// returning its address.
+func listenTest(t *testing.T, l *ListenerConfig) string {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go reqHandler(conn, l)
+		}
+	}()
+	return server.Addr().String()
+}
+
+// withQueues gives a test its own incoming and dead-letter
+// queues, and the shedder and validator for c.
+func withQueues(t *testing.T, c *Config) {
+	in, dead := messageIncomingQueue, deadLetterQueue
+	t.Cleanup(func() { messageIncomingQueue, deadLetterQueue = in, dead })
+	c.setDefaults()
+	messageIncomingQueue = make(chan *Message, c.QueueCap)
+	deadLetterQueue = make(chan *deadLetter, c.QueueCap)
+	setShedder(newShedder(c))
+	setValidator(newValidator(c))
+	setReplayer(newReplayer(c))
+}
+
+func TestReplayDeadLetters(t *testing.T) {
+	dir := t.TempDir()
+	schemaPath := filepath.Join(dir, "schema.json")
+	os.WriteFile(schemaPath, []byte(`{"type": "object", "required": ["msg"]}`), 0644)
+	sc, err := loadSchema(schemaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{
+		Routes: []*RouteConfig{{Name: "checked", Outputs: []string{"events", "archive"}, schema: sc}},
+		Outputs: []*OutputConfig{
+			{Name: "events", Type: "console"},
+			{Name: "archive", Type: "console"},
+		},
+	}
+	withQueues(t, c)
+	addr := listenTest(t, &ListenerConfig{Name: "replay", MaxMessageSize: 1024, Replay: true})
+
+	letters := strings.Join([]string{
+		// Failed by one output of a route.
+		`{"message":"multi\nline","reason":"x","output":"events","attempts":3,"listener":"main","source":"10.0.0.1","client":"app","route":"checked","received":"2015-02-17T16:11:11Z"}`,
+		// Quarantined, since fixed.
+		`{"message":"{\"msg\":1}","reason":"schema violation","output":"","listener":"main","source":"10.0.0.2","route":"checked"}`,
+		// Quarantined, still violating.
+		`{"message":"{}","reason":"schema violation","output":"","listener":"main","route":"checked"}`,
+		// Unknown output.
+		`{"message":"m","output":"gone","route":"checked"}`,
+		`not a letter`,
+	}, "\n")
+	path := filepath.Join(dir, "dead.ndjson")
+	os.WriteFile(path, []byte(letters+"\n"), 0644)
+
+	if err := replayDeadLetters(path, addr, "", "", false); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(deadLetterQueue); n != 0 {
+		t.Fatalf("%d messages replayed straight to outputs", n)
+	}
+	if n := len(messageIncomingQueue); n != 2 {
+		t.Fatalf("%d messages received, want 2", n)
+	}
+	m := <-messageIncomingQueue
+	if m.Output != "events" {
+		t.Errorf("replayed to %q, want only the failed output events", m.Output)
+	}
+	if m.Body != "multi\nline" || m.Listener != "main" || m.Source != "10.0.0.1" || m.Route != "checked" {
+		t.Errorf("replayed message %+v", m)
+	}
+	if q := <-messageIncomingQueue; q.Body != `{"msg":1}` || q.Route != "checked" || q.Listener != "main" || q.Output != "" {
+		t.Errorf("quarantined message %+v", q)
+	}
+}
+
+func TestReplayDirect(t *testing.T) {
+	c := &Config{
+		Routes:  []*RouteConfig{{Name: "r", Outputs: []string{"events"}}},
+		Outputs: []*OutputConfig{{Name: "events", Type: "console"}},
+	}
+	withQueues(t, c)
+	addr := listenTest(t, &ListenerConfig{Name: "replay", MaxMessageSize: 1024, Replay: true, ReplayDirect: true})
+	path := filepath.Join(t.TempDir(), "dead.ndjson")
+	os.WriteFile(path, []byte(`{"message":"m","output":"events","listener":"main","source":"10.0.0.1","client":"app","route":"r"}`+"\n"), 0644)
+
+	if err := replayDeadLetters(path, addr, "", "", false); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(messageIncomingQueue); n != 0 {
+		t.Fatalf("%d messages sent through the pipeline", n)
+	}
+	if n := len(deadLetterQueue); n != 1 {
+		t.Fatalf("%d messages replayed to outputs, want 1", n)
+	}
+	d := <-deadLetterQueue
+	m := d.message
+	if d.output != "events" || m.Body != "m" || m.Listener != "main" || m.Source != "10.0.0.1" || m.Client != "app" || m.Route != "r" {
+		t.Errorf("replayed %+v to %s", m, d.output)
+	}
+}
+
+func TestReplayOutputFilter(t *testing.T) {
+	c := &Config{
+		Routes:  []*RouteConfig{{Name: "r", Outputs: []string{"a", "b"}}},
+		Outputs: []*OutputConfig{{Name: "a", Type: "console"}, {Name: "b", Type: "console"}},
+	}
+	withQueues(t, c)
+	addr := listenTest(t, &ListenerConfig{Name: "replay", MaxMessageSize: 1024, Replay: true})
+	path := filepath.Join(t.TempDir(), "dead.ndjson")
+	os.WriteFile(path, []byte(`{"message":"1","output":"a","route":"r"}`+"\n"+`{"message":"2","output":"b","route":"r"}`+"\n"), 0644)
+
+	if err := replayDeadLetters(path, addr, "", "b", false); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-messageIncomingQueue:
+		if m.Output != "b" || m.Body != "2" {
+			t.Errorf("replayed %q to %s", m.Body, m.Output)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("nothing replayed")
+	}
+	if n := len(messageIncomingQueue); n != 0 {
+		t.Errorf("%d more replayed", n)
+	}
+}
+
+// Listeners without replay take REPLAY lines as messages.
+func TestReplayNeedsReplayListener(t *testing.T) {
+	withQueues(t, &Config{})
+	rp := &replayer{outputs: map[string]bool{"a": true}}
+	if code, _ := rp.replay(`REPLAY {"message":"1","output":"a"}`, &ClientToken{Name: "c", Outputs: []string{"b"}}, false); code != 403 {
+		t.Errorf("replay to a disallowed output: %d, want 403", code)
+	}
+
+	addr := listenTest(t, &ListenerConfig{Name: "main", MaxMessageSize: 1024})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(`REPLAY {"message":"1","output":"a"}` + "\n"))
+	b := make([]byte, 64)
+	n, _ := conn.Read(b)
+	if !strings.HasPrefix(string(b[:n]), "200|") {
+		t.Fatalf("response %q", b[:n])
+	}
+	if m := <-messageIncomingQueue; !strings.HasPrefix(m.Body, "REPLAY ") {
+		t.Errorf("queued %q", m.Body)
+	}
+	if len(deadLetterQueue) != 0 {
+		t.Error("replayed on a listener without replay")
+	}
+}
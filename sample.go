@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+
+	"github.com/jamiealquiza/ascender/outputs"
+)
+
+// Sampling keeps 1 in KeepOneIn messages, or Percent of
+// them. Kept messages get RateField (default
+// "@sample_rate") set to the rate, e.g. 10 for 1 in 10,
+// so consumers can reweight counts. Messages other than
+// JSON objects are first wrapped as {"message": "..."}.
+type Sampling struct {
+	KeepOneIn int     `json:"keep-one-in"`
+	Percent   float64 `json:"percent"`
+	RateField string  `json:"rate-field"`
+}
+
+// Most field values counted separately by a sampler
+// before its counts are reset.
+const maxSampleKeys = 10000
+
+// sampler applies a Sampling. With field set, 1 in N
+// messages of each value of the field is kept, so rare
+// values aren't sampled away.
+type sampler struct {
+	oneIn     int
+	percent   float64
+	rate      float64
+	field     string
+	rateField string
+	counts    map[string]int
+}
+
+func newSampler(s *Sampling, field string) (*sampler, error) {
+	sp := &sampler{
+		oneIn:     s.KeepOneIn,
+		percent:   s.Percent,
+		field:     field,
+		rateField: s.RateField,
+		counts:    map[string]int{},
+	}
+	switch {
+	case s.KeepOneIn != 0 && s.Percent != 0:
+		return nil, errors.New("keep-one-in and percent can't both be set")
+	case s.KeepOneIn > 0:
+		sp.rate = float64(s.KeepOneIn)
+	case s.Percent > 0 && s.Percent <= 100:
+		sp.rate = 100 / s.Percent
+	default:
+		return nil, errors.New("keep-one-in (at least 1) or percent (0 to 100) is required")
+	}
+	if sp.rateField == "" {
+		sp.rateField = "@sample_rate"
+	}
+	return sp, nil
+}
+
+func newSampleProcessor(p *ProcessorConfig) (processor, error) {
+	s, err := newSampler(&p.Sampling, p.Field)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// process keeps e if it's sampled, recording the rate.
+func (s *sampler) process(e *event) (bool, error) {
+	if !s.keep(e) {
+		return false, nil
+	}
+	if s.rate == 1 {
+		return true, nil
+	}
+
+	obj := e.object()
+	if obj == nil {
+		// Wrapped, as the json processor does, so the
+		// rate isn't lost.
+		e.setBody(fmt.Sprintf(`{"message":%s}`, outputs.JSONString(e.Body)))
+		obj = e.object()
+	}
+	// Sampled again, e.g. by a route: rates multiply.
+	rate := s.rate
+	if v, ok := obj.values[s.rateField]; ok {
+		if r, err := strconv.ParseFloat(string(v), 64); err == nil && r > 0 {
+			rate *= r
+		}
+	}
+	obj.set(s.rateField, json.RawMessage(strconv.FormatFloat(rate, 'g', -1, 64)))
+	e.changed()
+	return true, nil
+}
+
+func (s *sampler) keep(e *event) bool {
+	if s.oneIn == 0 {
+		return rand.Float64()*100 < s.percent
+	}
+
+	key := ""
+	if s.field != "" {
+		if obj := e.object(); obj != nil {
+			key = outputs.FieldString(obj.values[s.field])
+		}
+	}
+	if len(s.counts) >= maxSampleKeys {
+		if _, ok := s.counts[key]; !ok {
+			s.counts = map[string]int{}
+		}
+	}
+	n := s.counts[key]
+	s.counts[key] = (n + 1) % s.oneIn
+	return n == 0
+}
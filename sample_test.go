@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func newTestSampler(t *testing.T, s Sampling, field string) *sampler {
+	t.Helper()
+	sp, err := newSampler(&s, field)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sp
+}
+
+// sample runs body through s, returning the kept body, if any.
+func sample(s *sampler, body string) (string, bool) {
+	e := &event{Message: &Message{Body: body}}
+	if keep, _ := s.process(e); !keep {
+		return "", false
+	}
+	return e.body(), true
+}
+
+func TestSamplerKeepOneIn(t *testing.T) {
+	s := newTestSampler(t, Sampling{KeepOneIn: 3}, "")
+	kept := 0
+	for i := 0; i < 9; i++ {
+		if _, ok := sample(s, `{"n":1}`); ok {
+			kept++
+		}
+	}
+	if kept != 3 {
+		t.Fatalf("kept %d of 9, want 3", kept)
+	}
+}
+
+func TestSamplerPerField(t *testing.T) {
+	s := newTestSampler(t, Sampling{KeepOneIn: 10}, "level")
+	for _, level := range []string{"info", "error", "debug"} {
+		if _, ok := sample(s, `{"level":"`+level+`"}`); !ok {
+			t.Fatalf("first %s message dropped", level)
+		}
+	}
+	if _, ok := sample(s, `{"level":"info"}`); ok {
+		t.Fatal("second info message kept")
+	}
+}
+
+func TestSamplerRate(t *testing.T) {
+	s := newTestSampler(t, Sampling{Percent: 100}, "")
+	s.rate = 4
+	tests := []struct {
+		body string
+		want map[string]interface{}
+	}{
+		{`{"a":1}`, map[string]interface{}{"a": 1.0, "@sample_rate": 4.0}},
+		// Sampled before: rates multiply.
+		{`{"a":1,"@sample_rate":10}`, map[string]interface{}{"a": 1.0, "@sample_rate": 40.0}},
+		// Plain text is wrapped to hold the rate.
+		{`plain "text"`, map[string]interface{}{"message": `plain "text"`, "@sample_rate": 4.0}},
+		{`[1,2]`, map[string]interface{}{"message": `[1,2]`, "@sample_rate": 4.0}},
+	}
+	for _, tt := range tests {
+		body, ok := sample(s, tt.body)
+		if !ok {
+			t.Fatalf("%s dropped", tt.body)
+		}
+		var got map[string]interface{}
+		if err := json.Unmarshal([]byte(body), &got); err != nil {
+			t.Fatalf("%s: %s: %s", tt.body, body, err)
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("%s: got %s", tt.body, body)
+		}
+		for k, v := range tt.want {
+			if got[k] != v {
+				t.Fatalf("%s: got %s", tt.body, body)
+			}
+		}
+	}
+}
+
+func TestSamplerInvalid(t *testing.T) {
+	for _, s := range []Sampling{{}, {KeepOneIn: 2, Percent: 50}, {Percent: 101}, {KeepOneIn: -1}} {
+		if _, err := newSampler(&s, ""); err == nil {
+			t.Fatalf("%+v accepted", s)
+		}
+	}
+}
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// schema is a compiled JSON Schema. The validation keywords
+// of draft 7 are supported except multipleOf, uniqueItems,
+// dependencies, contains, propertyNames, if/then/else, tuple
+// items and format, which reject the schema rather than
+// pass messages unchecked; $ref may point to "#" or a
+// definition ("#/definitions/<name>" or "#/$defs/<name>").
+// Other keywords, such as annotations, are ignored.
+type schema struct {
+	// Set for the true and false schemas.
+	always *bool
+
+	types []string
+	enum  []interface{}
+	cnst  *interface{}
+
+	properties           map[string]*schema
+	patternProperties    map[*regexp.Regexp]*schema
+	additionalProperties *schema
+	required             []string
+	minProperties        *float64
+	maxProperties        *float64
+
+	items    *schema
+	minItems *float64
+	maxItems *float64
+
+	minLength *float64
+	maxLength *float64
+	pattern   *regexp.Regexp
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+
+	allOf []*schema
+	anyOf []*schema
+	oneOf []*schema
+	not   *schema
+	ref   *schema
+}
+
+// loadSchema reads and compiles the schema in file path.
+func loadSchema(path string) (*schema, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	c := &schemaCompiler{root: &schema{}, defs: map[string]*schema{}}
+	if obj, ok := raw.(map[string]interface{}); ok {
+		// Definitions are allocated first so references to
+		// them, including recursive ones, can be resolved.
+		for _, key := range []string{"definitions", "$defs"} {
+			defs, _ := obj[key].(map[string]interface{})
+			for name := range defs {
+				c.defs["#/"+key+"/"+name] = &schema{}
+			}
+		}
+		for _, key := range []string{"definitions", "$defs"} {
+			defs, _ := obj[key].(map[string]interface{})
+			for name, def := range defs {
+				if err := c.compileInto(c.defs["#/"+key+"/"+name], def, "/"+key+"/"+name); err != nil {
+					return nil, fmt.Errorf("%s: %s", path, err)
+				}
+			}
+		}
+	}
+	if err := c.compileInto(c.root, raw, ""); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return c.root, nil
+}
+
+// unsupportedKeywords are validation keywords schema
+// doesn't check.
+var unsupportedKeywords = []string{
+	"format", "uniqueItems", "multipleOf", "if", "then", "else",
+	"contains", "dependencies", "propertyNames",
+}
+
+type schemaCompiler struct {
+	root *schema
+	defs map[string]*schema
+}
+
+func (c *schemaCompiler) compile(raw interface{}, at string) (*schema, error) {
+	s := &schema{}
+	return s, c.compileInto(s, raw, at)
+}
+
+// compileInto compiles raw, found at JSON pointer at, into s.
+func (c *schemaCompiler) compileInto(s *schema, raw interface{}, at string) error {
+	if b, ok := raw.(bool); ok {
+		s.always = &b
+		return nil
+	}
+	obj, ok := raw.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s: schema must be an object or boolean", pointer(at))
+	}
+
+	fail := func(key, want string) error {
+		return fmt.Errorf("%s/%s: must be %s", at, key, want)
+	}
+	number := func(key string) (*float64, error) {
+		v, ok := obj[key]
+		if !ok {
+			return nil, nil
+		}
+		f, ok := v.(float64)
+		if !ok {
+			return nil, fail(key, "a number")
+		}
+		return &f, nil
+	}
+	sub := func(key string) (*schema, error) {
+		v, ok := obj[key]
+		if !ok {
+			return nil, nil
+		}
+		return c.compile(v, at+"/"+key)
+	}
+	list := func(key string) ([]*schema, error) {
+		v, ok := obj[key]
+		if !ok {
+			return nil, nil
+		}
+		items, ok := v.([]interface{})
+		if !ok || len(items) == 0 {
+			return nil, fail(key, "a non-empty array")
+		}
+		var schemas []*schema
+		for i, item := range items {
+			sub, err := c.compile(item, fmt.Sprintf("%s/%s/%d", at, key, i))
+			if err != nil {
+				return nil, err
+			}
+			schemas = append(schemas, sub)
+		}
+		return schemas, nil
+	}
+	var err error
+
+	for _, key := range unsupportedKeywords {
+		if _, ok := obj[key]; ok {
+			return fmt.Errorf("%s/%s: unsupported keyword", at, key)
+		}
+	}
+
+	if v, ok := obj["$ref"]; ok {
+		ref, _ := v.(string)
+		switch {
+		case ref == "#":
+			s.ref = c.root
+		case c.defs[ref] != nil:
+			s.ref = c.defs[ref]
+		default:
+			return fail("$ref", `"#" or a definition`)
+		}
+	}
+
+	switch t := obj["type"].(type) {
+	case nil:
+	case string:
+		s.types = []string{t}
+	case []interface{}:
+		for _, v := range t {
+			name, ok := v.(string)
+			if !ok {
+				return fail("type", "a type name or array of them")
+			}
+			s.types = append(s.types, name)
+		}
+	default:
+		return fail("type", "a type name or array of them")
+	}
+	for _, t := range s.types {
+		switch t {
+		case "null", "boolean", "object", "array", "number", "integer", "string":
+		default:
+			return fmt.Errorf("%s/type: unknown type %q", at, t)
+		}
+	}
+	if v, ok := obj["enum"]; ok {
+		if s.enum, ok = v.([]interface{}); !ok {
+			return fail("enum", "an array")
+		}
+	}
+	if v, ok := obj["const"]; ok {
+		s.cnst = &v
+	}
+
+	if v, ok := obj["properties"]; ok {
+		props, ok := v.(map[string]interface{})
+		if !ok {
+			return fail("properties", "an object")
+		}
+		s.properties = map[string]*schema{}
+		for name, p := range props {
+			if s.properties[name], err = c.compile(p, at+"/properties/"+name); err != nil {
+				return err
+			}
+		}
+	}
+	if v, ok := obj["patternProperties"]; ok {
+		props, ok := v.(map[string]interface{})
+		if !ok {
+			return fail("patternProperties", "an object")
+		}
+		s.patternProperties = map[*regexp.Regexp]*schema{}
+		for pattern, p := range props {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("%s/patternProperties: %s", at, err)
+			}
+			if s.patternProperties[re], err = c.compile(p, at+"/patternProperties/"+pattern); err != nil {
+				return err
+			}
+		}
+	}
+	if s.additionalProperties, err = sub("additionalProperties"); err != nil {
+		return err
+	}
+	if v, ok := obj["required"]; ok {
+		names, ok := v.([]interface{})
+		if !ok {
+			return fail("required", "an array of names")
+		}
+		for _, n := range names {
+			name, ok := n.(string)
+			if !ok {
+				return fail("required", "an array of names")
+			}
+			s.required = append(s.required, name)
+		}
+	}
+	if s.minProperties, err = number("minProperties"); err != nil {
+		return err
+	}
+	if s.maxProperties, err = number("maxProperties"); err != nil {
+		return err
+	}
+
+	if _, ok := obj["items"].([]interface{}); ok {
+		return fail("items", "a schema (tuple items aren't supported)")
+	}
+	if s.items, err = sub("items"); err != nil {
+		return err
+	}
+	if s.minItems, err = number("minItems"); err != nil {
+		return err
+	}
+	if s.maxItems, err = number("maxItems"); err != nil {
+		return err
+	}
+
+	if s.minLength, err = number("minLength"); err != nil {
+		return err
+	}
+	if s.maxLength, err = number("maxLength"); err != nil {
+		return err
+	}
+	if v, ok := obj["pattern"]; ok {
+		pattern, ok := v.(string)
+		if !ok {
+			return fail("pattern", "a string")
+		}
+		if s.pattern, err = regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("%s/pattern: %s", at, err)
+		}
+	}
+
+	if s.minimum, err = number("minimum"); err != nil {
+		return err
+	}
+	if s.maximum, err = number("maximum"); err != nil {
+		return err
+	}
+	if s.exclusiveMinimum, err = number("exclusiveMinimum"); err != nil {
+		return err
+	}
+	if s.exclusiveMaximum, err = number("exclusiveMaximum"); err != nil {
+		return err
+	}
+
+	if s.allOf, err = list("allOf"); err != nil {
+		return err
+	}
+	if s.anyOf, err = list("anyOf"); err != nil {
+		return err
+	}
+	if s.oneOf, err = list("oneOf"); err != nil {
+		return err
+	}
+	if s.not, err = sub("not"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// check parses a message and validates it, returning
+// the first violation found.
+func (s *schema) check(body string) error {
+	var v interface{}
+	if err := json.Unmarshal([]byte(body), &v); err != nil {
+		return fmt.Errorf("invalid JSON: %s", err)
+	}
+	return s.validate(v, "")
+}
+
+// validate checks value v, found at JSON pointer at.
+func (s *schema) validate(v interface{}, at string) error {
+	if s.always != nil {
+		if !*s.always {
+			return fmt.Errorf("%s: not allowed", pointer(at))
+		}
+		return nil
+	}
+	fail := func(format string, a ...interface{}) error {
+		return fmt.Errorf("%s: %s", pointer(at), fmt.Sprintf(format, a...))
+	}
+
+	if s.ref != nil {
+		if err := s.ref.validate(v, at); err != nil {
+			return err
+		}
+	}
+
+	if len(s.types) > 0 {
+		ok := false
+		for _, t := range s.types {
+			if isType(v, t) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fail("want %s, got %s", strings.Join(s.types, " or "), typeName(v))
+		}
+	}
+	if s.enum != nil {
+		ok := false
+		for _, e := range s.enum {
+			if reflect.DeepEqual(v, e) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fail("not one of the allowed values")
+		}
+	}
+	if s.cnst != nil && !reflect.DeepEqual(v, *s.cnst) {
+		return fail("not the allowed value")
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.required {
+			if _, ok := v[name]; !ok {
+				return fail("missing required property %q", name)
+			}
+		}
+		n := float64(len(v))
+		if s.minProperties != nil && n < *s.minProperties {
+			return fail("fewer than %g properties", *s.minProperties)
+		}
+		if s.maxProperties != nil && n > *s.maxProperties {
+			return fail("more than %g properties", *s.maxProperties)
+		}
+		// Sorted, so the violation reported is stable.
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			pat := at + "/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+			matched := false
+			if p, ok := s.properties[name]; ok {
+				matched = true
+				if err := p.validate(v[name], pat); err != nil {
+					return err
+				}
+			}
+			for re, p := range s.patternProperties {
+				if re.MatchString(name) {
+					matched = true
+					if err := p.validate(v[name], pat); err != nil {
+						return err
+					}
+				}
+			}
+			if !matched && s.additionalProperties != nil {
+				if err := s.additionalProperties.validate(v[name], pat); err != nil {
+					if a := s.additionalProperties.always; a != nil && !*a {
+						return fail("unexpected property %q", name)
+					}
+					return err
+				}
+			}
+		}
+	case []interface{}:
+		n := float64(len(v))
+		if s.minItems != nil && n < *s.minItems {
+			return fail("fewer than %g items", *s.minItems)
+		}
+		if s.maxItems != nil && n > *s.maxItems {
+			return fail("more than %g items", *s.maxItems)
+		}
+		if s.items != nil {
+			for i, item := range v {
+				if err := s.items.validate(item, fmt.Sprintf("%s/%d", at, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		n := float64(utf8.RuneCountInString(v))
+		if s.minLength != nil && n < *s.minLength {
+			return fail("shorter than %g characters", *s.minLength)
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			return fail("longer than %g characters", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return fail("doesn't match pattern %q", s.pattern)
+		}
+	case float64:
+		switch {
+		case s.minimum != nil && v < *s.minimum:
+			return fail("less than %g", *s.minimum)
+		case s.maximum != nil && v > *s.maximum:
+			return fail("greater than %g", *s.maximum)
+		case s.exclusiveMinimum != nil && v <= *s.exclusiveMinimum:
+			return fail("not greater than %g", *s.exclusiveMinimum)
+		case s.exclusiveMaximum != nil && v >= *s.exclusiveMaximum:
+			return fail("not less than %g", *s.exclusiveMaximum)
+		}
+	}
+
+	for _, sub := range s.allOf {
+		if err := sub.validate(v, at); err != nil {
+			return err
+		}
+	}
+	if s.anyOf != nil {
+		ok := false
+		for _, sub := range s.anyOf {
+			if sub.validate(v, at) == nil {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fail("doesn't match any of anyOf")
+		}
+	}
+	if s.oneOf != nil {
+		n := 0
+		for _, sub := range s.oneOf {
+			if sub.validate(v, at) == nil {
+				n++
+			}
+		}
+		if n != 1 {
+			return fail("matches %d of oneOf, want 1", n)
+		}
+	}
+	if s.not != nil && s.not.validate(v, at) == nil {
+		return fail("matches not")
+	}
+
+	return nil
+}
+
+// pointer formats a JSON pointer for messages.
+func pointer(at string) string {
+	if at == "" {
+		return "/"
+	}
+	return at
+}
+
+func isType(v interface{}, t string) bool {
+	switch v := v.(type) {
+	case nil:
+		return t == "null"
+	case bool:
+		return t == "boolean"
+	case map[string]interface{}:
+		return t == "object"
+	case []interface{}:
+		return t == "array"
+	case string:
+		return t == "string"
+	case float64:
+		return t == "number" || t == "integer" && v == math.Trunc(v)
+	}
+	return false
+}
+
+func typeName(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	}
+	return "unknown"
+}
+
+// validator checks messages as they're received against the
+// schema of the route their listener and client would take.
+type validator struct {
+	routes []*RouteConfig
+}
+
+func newValidator(c *Config) *validator {
+	for _, r := range c.Routes {
+		if r.schema != nil {
+			return &validator{routes: c.Routes}
+		}
+	}
+	return &validator{}
+}
+
+// check returns the route m would take and how m violates
+// its schema, or a nil error if it has none or m is valid.
+func (v *validator) check(m *Message) (*RouteConfig, error) {
+	for _, r := range v.routes {
+		if !allowed(r.Listeners, m.Listener) || !m.Client.allowsRoute(r.Name) {
+			continue
+		}
+		if r.schema == nil {
+			return r, nil
+		}
+		return r, r.schema.check(m.Body)
+	}
+	return nil, nil
+}
+
+// The running validator, replaced on reload.
+var validation = struct {
+	sync.RWMutex
+	v *validator
+}{}
+
+func setValidator(v *validator) {
+	validation.Lock()
+	validation.v = v
+	validation.Unlock()
+}
+
+func currentValidator() *validator {
+	validation.RLock()
+	defer validation.RUnlock()
+	return validation.v
+}
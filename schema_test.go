@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// compileSchema loads schema text from a file.
+func compileSchema(t *testing.T, text string) (*schema, error) {
+	path := filepath.Join(t.TempDir(), "schema.json")
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return loadSchema(path)
+}
+
+func TestSchemaCheck(t *testing.T) {
+	sc, err := compileSchema(t, `{
+		"title": "event",
+		"type": "object",
+		"required": ["msg", "level"],
+		"properties": {
+			"msg": {"type": "string", "minLength": 1, "maxLength": 5},
+			"level": {"enum": ["info", "error"]},
+			"count": {"type": "integer", "minimum": 0, "exclusiveMaximum": 10},
+			"tags": {"type": "array", "items": {"$ref": "#/definitions/tag"}, "maxItems": 2},
+			"nested": {"$ref": "#"},
+			"id": {"anyOf": [{"type": "string", "pattern": "^[a-z]+$"}, {"type": "null"}]}
+		},
+		"patternProperties": {"^x-": {"type": "boolean"}},
+		"additionalProperties": false,
+		"definitions": {"tag": {"type": "string", "not": {"const": "bad"}}}
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for body, want := range map[string]string{
+		`{"msg": "hi", "level": "info"}`:                                          "",
+		`{"msg": "hi", "level": "info", "count": 9, "tags": ["a"], "x-ok": true}`: "",
+		`{"msg": "hi", "level": "info", "id": null}`:                              "",
+		`not json`:                           "invalid JSON",
+		`[]`:                                 "/: want object, got array",
+		`{"level": "info"}`:                  `/: missing required property "msg"`,
+		`{"msg": "", "level": "info"}`:       "/msg: shorter than 1 characters",
+		`{"msg": "hello!", "level": "info"}`: "/msg: longer than 5 characters",
+		`{"msg": "hi", "level": "debug"}`:    "/level: not one of the allowed values",
+		`{"msg": "hi", "level": "info", "count": 1.5}`:            "/count: want integer, got number",
+		`{"msg": "hi", "level": "info", "count": 10}`:             "/count: not less than 10",
+		`{"msg": "hi", "level": "info", "tags": ["a", "bad"]}`:    "/tags/1: matches not",
+		`{"msg": "hi", "level": "info", "tags": ["a", "b", "c"]}`: "/tags: more than 2 items",
+		`{"msg": "hi", "level": "info", "x-ok": 1}`:               "/x-ok: want boolean, got integer",
+		`{"msg": "hi", "level": "info", "other": 1}`:              `/: unexpected property "other"`,
+		`{"msg": "hi", "level": "info", "nested": {"msg": "hi"}}`: `/nested: missing required property "level"`,
+		`{"msg": "hi", "level": "info", "id": "A1"}`:              "/id",
+	} {
+		err := sc.check(body)
+		switch {
+		case want == "" && err != nil:
+			t.Errorf("%s: %s", body, err)
+		case want != "" && (err == nil || !strings.HasPrefix(err.Error(), want)):
+			t.Errorf("%s: got %v, want %s", body, err, want)
+		}
+	}
+}
+
+func TestSchemaUnsupported(t *testing.T) {
+	for _, text := range []string{
+		`{"type": "string", "format": "email"}`,
+		`{"type": "array", "uniqueItems": true}`,
+		`{"multipleOf": 2}`,
+		`{"if": {"type": "string"}, "then": {"minLength": 1}}`,
+		`{"else": true}`,
+		`{"contains": {"type": "string"}}`,
+		`{"dependencies": {"a": ["b"]}}`,
+		`{"propertyNames": {"pattern": "^a"}}`,
+		`{"items": [{"type": "string"}]}`,
+		// Nested schemas too.
+		`{"properties": {"email": {"type": "string", "format": "email"}}}`,
+		`{"definitions": {"n": {"multipleOf": 3}}}`,
+	} {
+		if _, err := compileSchema(t, text); err == nil {
+			t.Errorf("%s accepted", text)
+		}
+	}
+
+	// Properties named like keywords are fine.
+	if _, err := compileSchema(t, `{"properties": {"format": {"type": "string"}}, "required": ["format"]}`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSchemaInvalid(t *testing.T) {
+	for _, text := range []string{
+		`{"type": "text"}`,
+		`{"minLength": "1"}`,
+		`{"$ref": "#/definitions/missing"}`,
+		`{"pattern": "("}`,
+		`{"anyOf": []}`,
+		`"object"`,
+	} {
+		if _, err := compileSchema(t, text); err == nil {
+			t.Errorf("%s accepted", text)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// script runs messages through a Starlark function:
+//
+//	def process(msg):
+//	    return msg
+//
+// msg is a dict of the message "body", the "listener",
+// "source", "remote_addr", "client", "received" time and
+// "route" (empty unless picked earlier).
+// process returns the message (only "body" and an optional
+// "route" are read back), a list of messages to split it,
+// or None to drop it. Scripts can't do I/O; each call has
+// step and time limits.
+type script struct {
+	path     string
+	fn       starlark.Callable
+	maxSteps uint64
+	timeout  time.Duration
+	onError  string
+}
+
+// Predeclared names available to scripts.
+var scriptModules = starlark.StringDict{"json": json.Module}
+
+func newScript(p *ProcessorConfig) (processor, error) {
+	if p.Script == "" {
+		return nil, errors.New("script is required")
+	}
+	s := &script{path: p.Script, maxSteps: 1000000, timeout: 100 * time.Millisecond, onError: "keep"}
+	if p.MaxSteps > 0 {
+		s.maxSteps = p.MaxSteps
+	}
+	if p.Timeout != "" {
+		d, err := time.ParseDuration(p.Timeout)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid timeout %q", p.Timeout)
+		}
+		s.timeout = d
+	}
+	switch p.OnError {
+	case "":
+	case "keep", "drop":
+		s.onError = p.OnError
+	default:
+		return nil, fmt.Errorf("invalid on-error %q", p.OnError)
+	}
+
+	// Read on every load, so a reload picks up changes.
+	src, err := ioutil.ReadFile(p.Script)
+	if err != nil {
+		return nil, err
+	}
+	thread := s.thread()
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, p.Script, src, scriptModules)
+	if err != nil {
+		return nil, scriptError(err)
+	}
+	fn, ok := globals["process"].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("%s: no process function", p.Script)
+	}
+	s.fn = fn
+
+	return s, nil
+}
+
+// thread returns a thread for one call, with
+// the step limit set. Loading modules fails.
+func (s *script) thread() *starlark.Thread {
+	t := &starlark.Thread{
+		Name: s.path,
+		Print: func(_ *starlark.Thread, msg string) {
+			log.Printf("Script %s: %s\n", s.path, msg)
+		},
+	}
+	t.SetMaxExecutionSteps(s.maxSteps)
+	return t
+}
+
+// scriptError includes the Starlark backtrace, if any.
+func scriptError(err error) error {
+	if e, ok := err.(*starlark.EvalError); ok {
+		return errors.New(e.Backtrace())
+	}
+	return err
+}
+
+func (s *script) process(e *event) (bool, error) {
+	events, err := s.split(e)
+	return len(events) > 0, err
+}
+
+func (s *script) split(e *event) ([]*event, error) {
+	msg := starlark.NewDict(7)
+	msg.SetKey(starlark.String("body"), starlark.String(e.body()))
+	msg.SetKey(starlark.String("listener"), starlark.String(e.Listener))
+	msg.SetKey(starlark.String("source"), starlark.String(e.Source))
+	msg.SetKey(starlark.String("remote_addr"), starlark.String(e.RemoteAddr))
+	msg.SetKey(starlark.String("client"), starlark.String(e.meta("client")))
+	msg.SetKey(starlark.String("received"), starlark.String(e.Received.UTC().Format(time.RFC3339Nano)))
+	msg.SetKey(starlark.String("route"), starlark.String(e.Route))
+
+	thread := s.thread()
+	timer := time.AfterFunc(s.timeout, func() {
+		thread.Cancel(fmt.Sprintf("timed out after %s", s.timeout))
+	})
+	v, err := starlark.Call(thread, s.fn, starlark.Tuple{msg}, nil)
+	timer.Stop()
+	if err != nil {
+		return s.failed(e, scriptError(err))
+	}
+
+	var results []starlark.Value
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case *starlark.List:
+		for i := 0; i < v.Len(); i++ {
+			results = append(results, v.Index(i))
+		}
+	default:
+		results = []starlark.Value{v}
+	}
+
+	events := make([]*event, 0, len(results))
+	for _, r := range results {
+		d, ok := r.(*starlark.Dict)
+		if !ok {
+			return s.failed(e, fmt.Errorf("process returned %s, not a message", r.Type()))
+		}
+		m := *e.Message
+		body, err := dictString(d, "body", true)
+		if err != nil {
+			return s.failed(e, err)
+		}
+		m.Body = body
+		if m.Route, err = dictString(d, "route", false); err != nil {
+			return s.failed(e, err)
+		}
+		events = append(events, &event{Message: &m})
+	}
+
+	return events, nil
+}
+
+// failed handles a script error according to onError.
+func (s *script) failed(e *event, err error) ([]*event, error) {
+	log.Printf("Script %s error: %s\n", s.path, err)
+	if s.onError == "drop" {
+		return nil, err
+	}
+	return []*event{e}, err
+}
+
+// dictString returns the string at key in d.
+func dictString(d *starlark.Dict, key string, required bool) (string, error) {
+	v, found, _ := d.Get(starlark.String(key))
+	if !found || v == starlark.None {
+		if required {
+			return "", fmt.Errorf("message has no %s", key)
+		}
+		return "", nil
+	}
+	s, ok := starlark.AsString(v)
+	if !ok {
+		return "", fmt.Errorf("message %s is %s, not a string", key, v.Type())
+	}
+	return s, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestScript builds a script processor running src.
+func newTestScript(t *testing.T, src string, p *ProcessorConfig) (*script, error) {
+	t.Helper()
+	p.Script = filepath.Join(t.TempDir(), "process.star")
+	if err := os.WriteFile(p.Script, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newScript(p)
+	if err != nil {
+		return nil, err
+	}
+	return s.(*script), nil
+}
+
+// runScript runs body through s, returning the events made.
+func runScript(t *testing.T, s *script, m *Message) ([]*event, error) {
+	t.Helper()
+	return s.split(&event{Message: m})
+}
+
+func TestScript(t *testing.T) {
+	s, err := newTestScript(t, `
+def process(msg):
+    obj = json.decode(msg["body"])
+    obj["listener"] = msg["listener"]
+    obj["client"] = msg["client"]
+    msg["body"] = json.encode(obj)
+    if obj.get("alert"):
+        msg["route"] = "alerts"
+    return msg
+`, &ProcessorConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := runScript(t, s, &Message{Body: `{"alert":true}`, Listener: "main", Client: &ClientToken{Name: "web"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("%d messages, want 1", len(events))
+	}
+	m := events[0].Message
+	if m.Body != `{"alert":true,"client":"web","listener":"main"}` || m.Route != "alerts" || m.Listener != "main" {
+		t.Errorf("message %+v", m)
+	}
+}
+
+func TestScriptSplitAndDrop(t *testing.T) {
+	s, err := newTestScript(t, `
+def process(msg):
+    if msg["body"] == "":
+        return None
+    return [{"body": line} for line in msg["body"].split(",")]
+`, &ProcessorConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := runScript(t, s, &Message{Body: "a,b,c", Source: "10.0.0.1"})
+	if err != nil || len(events) != 3 {
+		t.Fatalf("%d messages, %v", len(events), err)
+	}
+	for i, want := range []string{"a", "b", "c"} {
+		if events[i].Body != want || events[i].Source != "10.0.0.1" {
+			t.Errorf("message %d: %+v", i, events[i].Message)
+		}
+	}
+	if events, err := runScript(t, s, &Message{}); err != nil || len(events) != 0 {
+		t.Errorf("empty message: %d messages, %v", len(events), err)
+	}
+}
+
+func TestScriptErrors(t *testing.T) {
+	tests := []struct {
+		src, err string
+		p        ProcessorConfig
+	}{
+		{`def process(msg): fail("no")`, "no", ProcessorConfig{}},
+		{`def process(msg): return 1`, "not a message", ProcessorConfig{}},
+		{`def process(msg): return {"route": "r"}`, "no body", ProcessorConfig{}},
+		{`def process(msg): return {"body": 1}`, "not a string", ProcessorConfig{}},
+		{"def process(msg):\n    for i in range(1000000):\n        pass\n", "too many steps", ProcessorConfig{MaxSteps: 1000}},
+		{"def process(msg):\n    for i in range(100000000):\n        pass\n", "timed out", ProcessorConfig{Timeout: "10ms", MaxSteps: 1 << 40}},
+	}
+	for _, tt := range tests {
+		for _, onError := range []string{"keep", "drop"} {
+			p := tt.p
+			p.OnError = onError
+			s, err := newTestScript(t, tt.src, &p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := &Message{Body: "m"}
+			events, err := runScript(t, s, m)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: error %v, want %q", tt.src, err, tt.err)
+			}
+			switch {
+			case onError == "keep" && (len(events) != 1 || events[0].Message != m):
+				t.Errorf("%q: message not kept on error", tt.src)
+			case onError == "drop" && len(events) != 0:
+				t.Errorf("%q: message not dropped on error", tt.src)
+			}
+		}
+	}
+}
+
+func TestScriptLoadErrors(t *testing.T) {
+	tests := []struct {
+		src, err string
+		p        ProcessorConfig
+	}{
+		{`x = `, "got end of file", ProcessorConfig{}},
+		{`def other(msg): return msg`, "no process function", ProcessorConfig{}},
+		{`load("os.star", "os")`, "load", ProcessorConfig{}},
+		{`def process(msg): return msg`, "invalid on-error", ProcessorConfig{OnError: "retry"}},
+		{`def process(msg): return msg`, "invalid timeout", ProcessorConfig{Timeout: "0s"}},
+	}
+	for _, tt := range tests {
+		p := tt.p
+		if _, err := newTestScript(t, tt.src, &p); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: error %v, want %q", tt.src, err, tt.err)
+		}
+	}
+	if _, err := newScript(&ProcessorConfig{}); err == nil {
+		t.Error("processor without a script accepted")
+	}
+}
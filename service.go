@@ -0,0 +1,131 @@
+package main
+
+import (
+	"log"
+	"reflect"
+	"sync"
+)
+
+// service holds the running listeners and outputs
+// built from the current config.
+type service struct {
+	// Held while applying a config.
+	mu        sync.Mutex
+	config    *Config
+	stats     *Statser
+	listeners map[string]*listener // Keyed by address.
+	outputs   map[string]*output   // Keyed by name.
+}
+
+// reload re-reads the config file and applies it. An invalid
+// config is rejected and the running config kept. Reloads
+// run one at a time.
+func (s *service) reload() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if options.configFile == "" {
+		log.Printf("Reload: no config file in use, nothing to reload\n")
+		return
+	}
+
+	c, errs := loadConfig()
+	if errs != nil {
+		for _, err := range errs {
+			log.Printf("Reload: config error: %s\n", err)
+		}
+		log.Printf("Reload: rejected, keeping running config\n")
+		return
+	}
+
+	if err := s.apply(c); err != nil {
+		log.Printf("Reload: rejected, keeping running config: %s\n", err)
+		return
+	}
+	log.Printf("Reload: config %s applied\n", options.configFile)
+}
+
+// apply moves the service to config c. Listeners and outputs
+// are reused where unchanged; replaced outputs drain their
+// queued messages before stopping and open client connections
+// are never closed. If any new listener address fails to bind,
+// nothing is changed.
+func (s *service) apply(c *Config) error {
+	// The incoming queue is shared by all connections
+	// and can't be resized while running.
+	if s.config != nil && c.QueueCap != s.config.QueueCap {
+		log.Printf("Reload: queue-cap change requires a restart, keeping %d\n", s.config.QueueCap)
+		c.QueueCap = s.config.QueueCap
+	}
+
+	// Bind new listener addresses first so a failure
+	// leaves the running config untouched.
+	listeners := map[string]*listener{}
+	var bound []*listener
+	for _, lc := range c.Listeners {
+		if l, ok := s.listeners[lc.address()]; ok {
+			listeners[lc.address()] = l
+			continue
+		}
+		l, err := newListener(lc)
+		if err != nil {
+			for _, b := range bound {
+				b.server.Close()
+			}
+			return err
+		}
+		listeners[lc.address()] = l
+		bound = append(bound, l)
+	}
+
+	// Start new and changed outputs.
+	outputs := map[string]*output{}
+	for _, oc := range c.Outputs {
+		if o, ok := s.outputs[oc.Name]; ok && o.unchanged(oc, c) {
+			outputs[oc.Name] = o
+			continue
+		}
+		outputs[oc.Name] = startOutput(oc, c, s.stats)
+	}
+
+	// Swap routes, then stop outputs no longer in use.
+	r := newRouter(c, outputs)
+	if s.config == nil {
+		go messageHandler(r)
+	} else {
+		routerUpdates <- r
+	}
+	for name, o := range s.outputs {
+		if outputs[name] != o {
+			o.stop()
+		}
+	}
+
+	// Update running listeners (picking up rotated TLS
+	// certificates), priorities, schemas and replay
+	// targets, start new ones and close removed ones.
+	setShedder(newShedder(c))
+	setValidator(newValidator(c))
+	setReplayer(newReplayer(c))
+	for _, lc := range c.Listeners {
+		listeners[lc.address()].setConfig(lc)
+	}
+	for _, l := range bound {
+		go l.listenTcp()
+	}
+	for addr, l := range s.listeners {
+		if listeners[addr] != l {
+			l.server.Close()
+		}
+	}
+
+	s.config, s.listeners, s.outputs = c, listeners, outputs
+
+	return nil
+}
+
+// unchanged reports whether the running output already
+// matches output config oc from config c.
+func (o *output) unchanged(oc *OutputConfig, c *Config) bool {
+	return cap(o.incoming) == c.QueueCap && reflect.DeepEqual(o.config, oc)
+}
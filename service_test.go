@@ -0,0 +1,201 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jamiealquiza/ascender/outputs"
+)
+
+// freePort returns a local port nothing is listening on.
+func freePort(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
+
+// withTestOutput adds output type "test", whose workers
+// pass "<output>:<body>" for each message to the channel
+// returned.
+func withTestOutput(t *testing.T) <-chan string {
+	delivered := make(chan string, 100)
+	outputTypes["test"] = &outputType{
+		defaultBatch: 1,
+		start: func(o *OutputConfig, q <-chan []*outputs.Message, s *outputStats) {
+			for b := range q {
+				for _, m := range b {
+					delivered <- o.Name + ":" + m.Body
+				}
+			}
+		},
+	}
+	t.Cleanup(func() { delete(outputTypes, "test") })
+	return delivered
+}
+
+// takeRouters stands in for messageHandler, passing on
+// the routers a service sends until the test ends.
+func takeRouters(t *testing.T) <-chan *router {
+	routers := make(chan *router, 10)
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		for {
+			select {
+			case r := <-routerUpdates:
+				routers <- r
+			case <-done:
+				return
+			}
+		}
+	}()
+	return routers
+}
+
+func testServiceConfig(t *testing.T, port string, outputNames ...string) *Config {
+	c := &Config{
+		QueueCap:  10,
+		Listeners: []*ListenerConfig{{Name: "l" + port, Addr: "127.0.0.1", Port: port}},
+		Routes:    []*RouteConfig{{Name: "r", Outputs: outputNames}},
+	}
+	for _, name := range outputNames {
+		c.Outputs = append(c.Outputs, &OutputConfig{Name: name, Type: "test"})
+	}
+	c.setDefaults()
+	if errs := c.validate(); errs != nil {
+		t.Fatal(errs)
+	}
+	return c
+}
+
+func dials(addr string) bool {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// A reload changing listeners and outputs binds and closes
+// listeners, keeps unchanged outputs running, stops removed
+// ones and routes to the new set.
+func TestServiceApplyReload(t *testing.T) {
+	delivered := withTestOutput(t)
+	portA, portB := freePort(t), freePort(t)
+	c1 := testServiceConfig(t, portA, "kept", "removed")
+	withQueues(t, c1)
+	routers := takeRouters(t)
+
+	// As if already running, so the test takes the routers.
+	s := &service{config: &Config{QueueCap: c1.QueueCap}}
+	if err := s.apply(c1); err != nil {
+		t.Fatal(err)
+	}
+	<-routers
+	t.Cleanup(func() {
+		for _, l := range s.listeners {
+			l.server.Close()
+		}
+		for _, o := range s.outputs {
+			o.stop()
+		}
+	})
+	if !dials("127.0.0.1:" + portA) {
+		t.Fatal("listener not started")
+	}
+	kept, removed := s.outputs["kept"], s.outputs["removed"]
+
+	c2 := testServiceConfig(t, portB, "kept", "added")
+	if err := s.apply(c2); err != nil {
+		t.Fatal(err)
+	}
+	r := <-routers
+
+	if s.outputs["kept"] != kept {
+		t.Error("unchanged output restarted")
+	}
+	if _, open := <-removed.incoming; open {
+		t.Error("removed output still running")
+	}
+	if s.outputs["added"] == nil || s.outputs["removed"] != nil {
+		t.Errorf("outputs %v", s.outputs)
+	}
+	if dials("127.0.0.1:" + portA) {
+		t.Error("removed listener still accepting")
+	}
+	if !dials("127.0.0.1:" + portB) {
+		t.Error("added listener not accepting")
+	}
+	if s.config != c2 {
+		t.Error("config not replaced")
+	}
+
+	(&handler{r: r}).route(&Message{Body: "m", Listener: "l" + portB})
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case d := <-delivered:
+			got[d] = true
+		case <-time.After(time.Second):
+			t.Fatalf("delivered %v, want kept:m and added:m", got)
+		}
+	}
+	if !got["kept:m"] || !got["added:m"] {
+		t.Errorf("delivered %v", got)
+	}
+}
+
+// A reload that can't bind a listener changes nothing.
+func TestServiceApplyBindFailure(t *testing.T) {
+	withTestOutput(t)
+	port := freePort(t)
+	c1 := testServiceConfig(t, port, "out")
+	withQueues(t, c1)
+	routers := takeRouters(t)
+
+	s := &service{config: &Config{QueueCap: c1.QueueCap}}
+	if err := s.apply(c1); err != nil {
+		t.Fatal(err)
+	}
+	<-routers
+	t.Cleanup(func() {
+		for _, l := range s.listeners {
+			l.server.Close()
+		}
+		for _, o := range s.outputs {
+			o.stop()
+		}
+	})
+	out := s.outputs["out"]
+
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	_, takenPort, _ := net.SplitHostPort(taken.Addr().String())
+	c2 := testServiceConfig(t, port, "out", "new")
+	c2.Listeners = append(c2.Listeners, &ListenerConfig{Name: "taken", Addr: "127.0.0.1", Port: takenPort})
+	if err := s.apply(c2); err == nil || !strings.Contains(err.Error(), "address already in use") {
+		t.Fatalf("apply: %v", err)
+	}
+
+	select {
+	case <-routers:
+		t.Error("routes replaced")
+	default:
+	}
+	if s.config != c1 || s.outputs["out"] != out || s.outputs["new"] != nil || len(s.listeners) != 1 {
+		t.Errorf("service changed: %+v", s)
+	}
+	if !dials("127.0.0.1:" + port) {
+		t.Error("running listener closed")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PriorityRule gives messages matching When a class:
+// "high", "normal" or "low". Messages take the class of
+// the first rule they match, or normal.
+type PriorityRule struct {
+	Class string     `json:"class"`
+	When  *Condition `json:"when"`
+}
+
+// Shedding sets how full, as a percentage of queue-cap,
+// the incoming queue may be before low and normal
+// priority messages are rejected. High priority messages
+// are only rejected when it's full.
+type Shedding struct {
+	Low    float64 `json:"low"`
+	Normal float64 `json:"normal"`
+}
+
+const (
+	priorityLow = iota
+	priorityNormal
+	priorityHigh
+)
+
+var priorityClasses = map[string]int{
+	"low":    priorityLow,
+	"normal": priorityNormal,
+	"high":   priorityHigh,
+}
+
+// shedder decides which messages to reject as the
+// incoming queue fills.
+type shedder struct {
+	rules []*PriorityRule
+	// Queue length at which each class is rejected.
+	limits [3]int
+}
+
+func newShedder(c *Config) *shedder {
+	return &shedder{
+		rules: c.Priorities,
+		limits: [3]int{
+			int(float64(c.QueueCap) * c.Shedding.Low / 100),
+			int(float64(c.QueueCap) * c.Shedding.Normal / 100),
+			c.QueueCap,
+		},
+	}
+}
+
+// accept reports whether m may be queued behind queued
+// messages. Messages are only classified once the queue
+// is past the low priority limit.
+func (s *shedder) accept(m *Message, queued int) bool {
+	if queued < s.limits[priorityLow] {
+		return true
+	}
+	class := s.classify(m)
+	if queued < s.limits[class] {
+		return true
+	}
+	atomic.AddInt64(&shedCounts[class], 1)
+	return false
+}
+
+func (s *shedder) classify(m *Message) int {
+	e := &event{Message: m}
+	for _, r := range s.rules {
+		if r.When.match(e) {
+			return priorityClasses[r.Class]
+		}
+	}
+	return priorityNormal
+}
+
+// The running shedder, replaced on reload.
+var shedding = struct {
+	sync.RWMutex
+	s *shedder
+}{}
+
+func setShedder(s *shedder) {
+	shedding.Lock()
+	shedding.s = s
+	shedding.Unlock()
+}
+
+func currentShedder() *shedder {
+	shedding.RLock()
+	defer shedding.RUnlock()
+	return shedding.s
+}
+
+// Messages rejected by class since last logged.
+var shedCounts [3]int64
+
+// logShedding logs the messages rejected by
+// class in the last interval, if any.
+func logShedding(interval time.Duration) {
+	var counts [3]int64
+	var total int64
+	for i := range shedCounts {
+		counts[i] = atomic.SwapInt64(&shedCounts[i], 0)
+		total += counts[i]
+	}
+	if total == 0 {
+		return
+	}
+	log.Printf("Last %s: queue filling, shed %d high | %d normal | %d low priority messages\n",
+		interval,
+		counts[priorityHigh],
+		counts[priorityNormal],
+		counts[priorityLow])
+}
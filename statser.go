@@ -47,5 +47,10 @@ func statsTracker(s *Statser) {
 				float64(deltaCnt)/5,
 				len(messageIncomingQueue))
 		}
+		sourceStats.logAndReset(5 * time.Second)
+		processorStats.logAndReset(5 * time.Second)
+		logShedding(5 * time.Second)
+		ipLimiters.expire()
+		clientLimiters.expire()
 	}
 }